@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// cborMap is a map encodeCBOR writes in the order of its pairs.
+type cborMap [][2]interface{}
+
+// encodeCBOR encodes the values authenticators do, as decodeCBOR decodes
+// them.
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return []byte{0xf6}
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		encoded := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			encoded = append(encoded, encodeCBOR(item)...)
+		}
+		return encoded
+	case cborMap:
+		encoded := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			encoded = append(encoded, encodeCBOR(pair[0])...)
+			encoded = append(encoded, encodeCBOR(pair[1])...)
+		}
+		return encoded
+	}
+	panic("cbor: can't encode a value of this type")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	case n <= 0xffffffff:
+		return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return []byte{major<<5 | 27, byte(n >> 56), byte(n >> 48), byte(n >> 40), byte(n >> 32), byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+var testCBOR = encodeCBOR(cborMap{
+	{"fmt", "packed"},
+	{"attStmt", cborMap{{"alg", -7}, {"x5c", []interface{}{[]byte{1, 2, 3}}}}},
+	{-2, []interface{}{0, 23, 24, 255, 256, 65536, 1 << 40, -1, -25, -257, true, false, nil}},
+	{"authData", bytes.Repeat([]byte{0xaa}, 300)},
+})
+
+func TestDecodeCBOR(t *testing.T) {
+	want := map[interface{}]interface{}{
+		"fmt": "packed",
+		"attStmt": map[interface{}]interface{}{
+			"alg": int64(-7),
+			"x5c": []interface{}{[]byte{1, 2, 3}},
+		},
+		int64(-2): []interface{}{int64(0), int64(23), int64(24), int64(255), int64(256), int64(65536), int64(1 << 40),
+			int64(-1), int64(-25), int64(-257), true, false, nil},
+		"authData": bytes.Repeat([]byte{0xaa}, 300),
+	}
+
+	decoded, rest, err := decodeCBOR(append(testCBOR, 0x01, 0x02))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("got %#v, want %#v", decoded, want)
+	}
+	if !bytes.Equal(rest, []byte{0x01, 0x02}) {
+		t.Errorf("got %x left, want 0102", rest)
+	}
+}
+
+func TestDecodeCBORTruncated(t *testing.T) {
+	for i := 0; i < len(testCBOR); i++ {
+		if _, _, err := decodeCBOR(testCBOR[:i]); err == nil {
+			t.Errorf("decoded the first %d of %d bytes", i, len(testCBOR))
+		}
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"indefinite byte string", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"indefinite map", []byte{0xbf, 0x01, 0x02, 0xff}},
+		{"reserved length", []byte{0x1c}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"tag", []byte{0xc2, 0x41, 0x01}},
+		{"unsigned overflowing int64", cborHead(0, 1<<63)},
+		{"negative overflowing int64", cborHead(1, 1<<63)},
+		{"byte string longer than the data", append(cborHead(2, 1<<62), 0x00)},
+		{"array longer than the data", append(cborHead(4, 1<<62), 0x00)},
+		{"map longer than the data", append(cborHead(5, 1<<62), 0x00, 0x00)},
+		{"byte string map key", encodeCBOR(cborMap{{[]byte{1}, 1}})},
+		{"array map key", encodeCBOR(cborMap{{[]interface{}{}, 1}})},
+		{"duplicate map key", encodeCBOR(cborMap{{1, 1}, {1, 2}})},
+		{"nested too deep", append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x00)},
+	}
+	for _, tt := range tests {
+		if decoded, _, err := decodeCBOR(tt.data); err == nil {
+			t.Errorf("%s: decoded %#v", tt.name, decoded)
+		}
+	}
+
+	if _, _, err := decodeCBOR(append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x00)); err != nil {
+		t.Errorf("nested as deep as allowed: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: %[1]s [command]
+
+Without a command the HTTP server is started.
+
+commands:
+  migrate up [n]        apply all (or the next n) pending migrations
+  migrate down [n]      revert the last (or the last n) applied migrations
+  migrate status        list migrations and whether they are applied
+  migrate force VERSION record a dirty migration as applied, once the schema was repaired by hand;
+                        MySQL can't roll back schema changes, so migrations failing partway there
+                        are left dirty
+  migrate create NAME   write an empty migration pair for every dialect into ./migrations (-dir to change)
+  import [-tenant SLUG] [-format csv|jsonl] [-on-conflict skip|upsert|fail] FILE
+                        create users from a CSV or JSON Lines file ("-" reads stdin), the format
+                        defaulting to the file extension
+  tenants create SLUG NAME
+                        create a tenant
+  tenants list          list the tenants
+  grant [-tenant SLUG] EMAIL ROLES
+                        set the comma separated roles of a user, admin or superadmin, empty to
+                        revoke them all
+`
+
+func runCommand(config *Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(config, args[1:])
+	case "import":
+		return runImport(config, args[1:])
+	case "tenants":
+		return runTenants(config, args[1:])
+	case "grant":
+		return runGrant(config, args[1:])
+	case "help", "-h", "--help":
+		fmt.Printf(usage, os.Args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, run \"%s help\"", args[0], os.Args[0])
+	}
+}
+
+func runMigrate(config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing migrate subcommand: up, down, status, force or create")
+	}
+
+	if args[0] == "create" {
+		flags := flag.NewFlagSet("migrate create", flag.ContinueOnError)
+		dir := flags.String("dir", migrationsDir, "directory holding the migration files")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New("usage: migrate create [-dir DIR] NAME")
+		}
+		created, err := CreateMigrationFiles(*dir, flags.Arg(0))
+		for _, file := range created {
+			fmt.Println(file)
+		}
+		return err
+	}
+
+	n := 0
+	if len(args) > 1 && args[0] != "force" {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid migration count %q", args[1])
+		}
+		n = v
+	}
+
+	db := initDatabase(config)
+	defer db.Close()
+
+	migrator, err := NewMigrator(db, config)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrator.Up(n)
+		for _, m := range done {
+			fmt.Printf("applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to apply")
+		}
+		return err
+	case "down":
+		done, err := migrator.Down(n)
+		for _, m := range done {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Println("nothing to revert")
+		}
+		return err
+	case "force":
+		if len(args) != 2 {
+			return errors.New("usage: migrate force VERSION")
+		}
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		return migrator.Force(version)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Dirty {
+				state += " (dirty, failed partway)"
+			}
+			if s.Modified {
+				state += " (checksum mismatch)"
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate subcommand %q", args[0])
+	}
+}
+
+func runImport(config *Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	tenant := flags.String("tenant", config.Tenants.Default, "slug of the tenant the users are created in")
+	format := flags.String("format", "", "csv or jsonl")
+	onConflict := flags.String("on-conflict", ImportFail, "what to do with rows of existing emails: skip, upsert or fail")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-tenant SLUG] [-format csv|jsonl] [-on-conflict skip|upsert|fail] FILE")
+	}
+
+	file := os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file = f
+
+		if *format == "" {
+			switch strings.ToLower(filepath.Ext(name)) {
+			case ".csv":
+				*format = ImportCSV
+			case ".jsonl", ".ndjson":
+				*format = ImportJSONL
+			}
+		}
+	}
+	if *format == "" {
+		return errors.New("can't tell the format of the file, use -format")
+	}
+
+	usecaseHandler, err := tenantUsecases(config, *tenant)
+	if err != nil {
+		return err
+	}
+
+	report, err := usecaseHandler.Import(file, ImportOptions{Format: *format, OnConflict: *onConflict})
+	if err != nil {
+		return err
+	}
+
+	for _, row := range report.Rows {
+		if row.Status == ImportCreated {
+			continue
+		}
+		line := fmt.Sprintf("line %-6d %-8s %s", row.Line, row.Status, row.Email)
+		if row.Error != "" {
+			line += ": " + row.Error
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("created %d, updated %d, skipped %d, failed %d\n", report.Created, report.Updated, report.Skipped, report.Failed)
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d rows failed", report.Failed)
+	}
+	return nil
+}
+
+// tenantUsecases are the usecases of the users of the tenant named slug.
+func tenantUsecases(config *Config, slug string) (*UsecaseHandler, error) {
+	store := initPersistence(config)
+	tenant, err := store.FindTenantBySlug(slug)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: %v", slug, err)
+	}
+	return &UsecaseHandler{ScopeToTenant(store, tenant.ID), store, nil, nil, config}, nil
+}
+
+func runTenants(config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing tenants subcommand: create or list")
+	}
+
+	tenantUsecaseHandler := TenantUsecaseHandler{initPersistence(config)}
+
+	switch args[0] {
+	case "create":
+		if len(args) != 3 {
+			return errors.New("usage: tenants create SLUG NAME")
+		}
+		tenant, err := tenantUsecaseHandler.Create(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created tenant %d %s\n", tenant.ID, tenant.Slug)
+		return nil
+	case "list":
+		tenants, err := tenantUsecaseHandler.List()
+		if err != nil {
+			return err
+		}
+		for _, t := range tenants {
+			fmt.Printf("%-6d %-20s %s\n", t.ID, t.Slug, t.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown tenants subcommand %q", args[0])
+	}
+}
+
+// runGrant sets roles without a token, to bootstrap the first superadmin.
+func runGrant(config *Config, args []string) error {
+	flags := flag.NewFlagSet("grant", flag.ContinueOnError)
+	tenant := flags.String("tenant", config.Tenants.Default, "slug of the tenant of the user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: grant [-tenant SLUG] EMAIL ROLES")
+	}
+
+	roles, err := ParseRoles(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	usecases, err := tenantUsecases(config, *tenant)
+	if err != nil {
+		return err
+	}
+	user, err := usecases.FindByEmail(NormalizeString("email", flags.Arg(0)))
+	if err != nil {
+		return fmt.Errorf("user %q: %v", flags.Arg(0), err)
+	}
+	if _, err := usecases.UpdateOne(user, map[string]interface{}{"Roles": roles}); err != nil {
+		return err
+	}
+
+	fmt.Printf("user %d now has roles %v\n", user.ID, []string(roles))
+	return nil
+}
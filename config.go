@@ -7,13 +7,18 @@ type Config struct {
 	Env       string `default:"develop" env:"ENV"`
 	Port      string `default:"5001" env:"PORT"`
 	JwtSecret string `required:"true" env:"JWT_SECRET"`
+	Issuer    string `env:"ISSUER"` // URL of the service, like https://auth.example.com, issuer of its tokens. AppName when empty
 
 	DB struct {
-		Host     string `required:"true" env:"DB_HOST"`
-		Port     string `required:"true" env:"DB_PORT"`
-		Name     string `required:"true" env:"DB_NAME"`
-		Username string `required:"true" env:"DB_USERNAME"`
-		Password string `required:"true" env:"DB_PASSWORD"`
+		Driver   string `default:"mysql" env:"DB_DRIVER"` // mysql, postgres, sqlite or memory
+		Host     string `env:"DB_HOST"`
+		Port     string `env:"DB_PORT"`
+		Name     string `env:"DB_NAME"` // file path for sqlite
+		Username string `env:"DB_USERNAME"`
+		Password string `env:"DB_PASSWORD"`
+		SSLMode  string `default:"disable" env:"DB_SSL_MODE"` // postgres only
+
+		MigrationLockTimeoutInSeconds uint `default:"60"`
 	}
 
 	AWS struct {
@@ -25,6 +30,17 @@ type Config struct {
 
 	//SendgridApiKey string `required:"true" env:"SENDGRID_API_KEY"`
 
+	Mail struct {
+		Driver string `default:"log" env:"MAIL_DRIVER"` // log or smtp
+		From   string `env:"MAIL_FROM"`
+		SMTP   struct {
+			Host     string `env:"SMTP_HOST"`
+			Port     string `default:"587" env:"SMTP_PORT"`
+			Username string `env:"SMTP_USERNAME"`
+			Password string `env:"SMTP_PASSWORD"`
+		}
+	}
+
 	// Not env vars
 
 	AppName string
@@ -36,12 +52,110 @@ type Config struct {
 		AllowedHeaders string
 	}
 
+	Pagination struct {
+		DefaultLimit int `default:"20"`
+		MaxLimit     int `default:"100"`
+	}
+
+	Bulk struct {
+		MaxAffected int `default:"100"` // bulk writes over this many users need confirm=<count>
+		SampleSize  int `default:"10"`
+	}
+
+	Jobs struct {
+		Workers               int    `default:"2"`
+		BatchSize             int    `default:"500"`
+		PollIntervalInSeconds uint   `default:"5"`
+		StaleAfterInSeconds   uint   `default:"60"` // running jobs without a heartbeat for this long are resumed by another worker
+		ExportDir             string `default:"exports" env:"JOBS_EXPORT_DIR"`
+	}
+
+	Import struct {
+		BatchSize   int `default:"100"` // rows written per transaction
+		MaxSizeInMB int `default:"32"`
+	}
+
+	Concurrency struct {
+		IfMatchOptional bool // accept single user writes without an If-Match header
+	}
+
 	Login struct {
 		TokenDurationInDays uint
+		Verifiers           []string // of passwords, local and ldap, in the order they're tried, local alone when empty
 	}
 
+	LDAP LDAPConfig
+
 	Password struct {
 		Min uint
 		Max uint
 	}
+
+	Validation struct {
+		Language string `default:"en"` // of error messages, unless the request accepts another one we have
+		Email    ValidationRule
+		Name     ValidationRule
+		Age      ValidationRule
+		Number   ValidationRule
+	}
+
+	Profile struct {
+		Fields []ProfileField // custom user attributes, see profile.go
+	}
+
+	Groups struct {
+		InToken bool // claim the groups of users in their tokens, nested ones included
+	}
+
+	MagicLinks struct {
+		ExpiryInMinutes uint `default:"15"`
+		MaxPerHour      uint `default:"5"` // sent to each email, the others are dropped silently
+		Passwordless    bool // lets users be created without a password, to log in with links and identity providers only
+	}
+
+	WebAuthn struct {
+		RPID             string   // the domain passkeys are registered for, the host of Issuer when empty
+		RPName           string   // shown by authenticators, AppName when empty
+		Origins          []string // of the pages running the ceremonies, the one of Issuer when empty
+		UserVerification string   `default:"preferred"` // required, preferred or discouraged, logins with a passkey alone always require it
+		Attestation      string   `default:"none"`      // none, or direct to verify the packed attestations of authenticators
+		TimeoutInSeconds uint     `default:"300"`       // of the ceremonies
+		SecondFactor     bool     // users with passkeys confirm their password and magic link logins with one, the ones with identity providers rely on the factors of the provider
+	}
+
+	Invitations struct {
+		LinkURL       string // page accepting invitations, which gets the invitation and token params
+		ExpiryInHours uint   `default:"72"`
+	}
+
+	OAuth struct {
+		Scopes                     []string // the ones clients can be allowed, besides openid, profile, email, roles and groups
+		LoginURL                   string   // page signing users in and asking their consent, which gets the params of /oauth/authorize
+		LogoutURL                  string   // page forgetting the login of users, which gets the redirect param to continue to
+		CodeExpiryInSeconds        uint     `default:"60"`
+		AccessTokenExpiryInMinutes uint     `default:"60"`
+		RefreshTokenExpiryInDays   uint     `default:"30"`
+
+		DeviceURL                   string // page where users enter the codes of devices, which gets the user_code param
+		DeviceCodeExpiryInSeconds   uint   `default:"600"`
+		DevicePollIntervalInSeconds uint   `default:"5"`
+	}
+
+	OIDC struct {
+		KeyFile                string `env:"OIDC_KEY_FILE"` // PEM RSA private key signing ID tokens, a new one on each start when empty
+		IDTokenExpiryInMinutes uint   `default:"60"`
+	}
+
+	Federation struct {
+		ReturnURL            string // page getting the token of users who logged in with a provider or a magic link in its fragment, JSON replies when empty
+		LoginExpiryInSeconds uint   `default:"600"`
+		Providers            []ProviderConfig
+		SAMLProviders        []SAMLProviderConfig
+	}
+
+	Tenants struct {
+		Default string `default:"default"` // slug of the tenant of requests naming none, empty to require one
+		Header  string `default:"X-Tenant"`
+		Domain  string // subdomains of it name tenants, like acme.example.com
+	}
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -10,9 +16,9 @@ type EndpointHandler struct {
 	usecaseHandler Usecase
 }
 
-func (h *EndpointHandler) Signup() gin.HandlerFunc {
+func (h *EndpointHandler) Signup(config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		h.defaultSignup(c)
+		h.defaultSignup(c, config)
 	}
 }
 
@@ -22,9 +28,9 @@ func (h *EndpointHandler) Login() gin.HandlerFunc {
 	}
 }
 
-func (h *EndpointHandler) Post() gin.HandlerFunc {
+func (h *EndpointHandler) Post(config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		h.defaultPost(c)
+		h.defaultPost(c, config)
 	}
 }
 
@@ -64,83 +70,124 @@ func (h *EndpointHandler) DeleteOne() gin.HandlerFunc {
 	}
 }
 
-func (h *EndpointHandler) defaultSignup(c *gin.Context) {
+func (h *EndpointHandler) Import(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultImport(c, config)
+	}
+}
 
-	var err error
+func (h *EndpointHandler) Export() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultExport(c)
+	}
+}
 
-	var email string
-	var password string
-	var name string
-	var age uint
-	var number int
-	var date time.Time
+// usecases are the ones of the tenant set by ResolveTenant.
+func (h *EndpointHandler) usecases(c *gin.Context) Usecase {
+	return h.usecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
 
-	if _, ok := c.GetPostForm("email"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter email missing")
+func (h *EndpointHandler) defaultSignup(c *gin.Context, config *Config) {
+
+	params, ok := newUserParams(c, true, config.MagicLinks.Passwordless)
+	if !ok {
 		return
 	}
-	if _, ok := c.GetPostForm("password"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter password missing")
+
+	attributes := profileSchema.Params(c.GetPostForm, false)
+
+	model, err := h.usecases(c).Create(params.email, params.password, params.name, params.age, params.number, params.date, attributes)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
 		return
 	}
+
+	c.JSON(http.StatusCreated, gin.H{"model": model})
+}
+
+// newUser holds the params every way of creating a user requires.
+type newUser struct {
+	email    string
+	password string
+	name     string
+	age      uint
+	number   int
+	date     time.Time
+}
+
+// newUserParams reads the params of a new user, its email only withEmail and
+// its password optionally when passwordless, replying when any is missing or
+// invalid.
+func newUserParams(c *gin.Context, withEmail bool, passwordless bool) (*newUser, bool) {
+
+	var err error
+	var params newUser
+
+	if _, ok := c.GetPostForm("email"); withEmail && !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter email missing")
+		return nil, false
+	}
+	if _, ok := c.GetPostForm("password"); !passwordless && !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter password missing")
+		return nil, false
+	}
 	if _, ok := c.GetPostForm("name"); !ok {
 		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
-		return
+		return nil, false
 	}
 	if _, ok := c.GetPostForm("age"); !ok {
 		ErrorReply(c, http.StatusBadRequest, "Parameter age missing")
-		return
+		return nil, false
 	}
 	if _, ok := c.GetPostForm("number"); !ok {
 		ErrorReply(c, http.StatusBadRequest, "Parameter number missing")
-		return
+		return nil, false
 	}
 	if _, ok := c.GetPostForm("date"); !ok {
 		ErrorReply(c, http.StatusBadRequest, "Parameter date missing")
-		return
+		return nil, false
 	}
 
-	if param, ok := c.GetPostForm("email"); ok {
-		email = param
+	if param, ok := c.GetPostForm("email"); ok && withEmail {
+		params.email = param
 	}
 	if param, ok := c.GetPostForm("password"); ok {
-		password = param
+		params.password = param
+		if params.password == "" && !passwordless {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for password")
+			return nil, false
+		}
 	}
 	if param, ok := c.GetPostForm("name"); ok {
-		name = param
+		params.name = param
 	}
 	if param, ok := c.GetPostForm("age"); ok {
-		age, err = ParseAgeFromString(param)
+		params.age, err = ParseAgeFromString(param)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for age")
-			return
+			return nil, false
 		}
 	}
 	if param, ok := c.GetPostForm("number"); ok {
-		number, err = ParseNumberFromString(param)
+		params.number, err = ParseNumberFromString(param)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for number")
-			return
+			return nil, false
 		}
 	}
 	if param, ok := c.GetPostForm("date"); ok {
-		date, err = ParseDateFromString(param)
+		params.date, err = ParseDateFromString(param)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for date")
-			return
-		}
-	}
-
-	model, err := h.usecaseHandler.Create(email, password, name, age, number, date)
-	if err != nil {
-		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
-		} else {
-			panic(err)
+			return nil, false
 		}
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"model": model})
+	return &params, true
 }
 
 func (h *EndpointHandler) defaultLogin(c *gin.Context) {
@@ -166,92 +213,39 @@ func (h *EndpointHandler) defaultLogin(c *gin.Context) {
 		password = param
 	}
 
-	token, user, err := h.usecaseHandler.Login(email, password)
+	token, user, err := h.usecases(c).Login(email, password)
 	if err != nil {
-		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+		if v, ok := err.(SecondFactorRequired); ok {
+			// Finished by /webauthn/login/finish with an assertion for the options
+			c.JSON(http.StatusUnauthorized, gin.H{"msg": RequestMessage(c, errSecondFactorRequired), "webauthn": gin.H{"publicKey": v.Options}})
+		} else if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"token": token, "user": user})
 }
 
-func (h *EndpointHandler) defaultPost(c *gin.Context) {
-
-	var err error
-
-	var email string
-	var password string
-	var name string
-	var age uint
-	var number int
-	var date time.Time
+func (h *EndpointHandler) defaultPost(c *gin.Context, config *Config) {
 
-	if _, ok := c.GetPostForm("email"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter email missing")
-		return
-	}
-	if _, ok := c.GetPostForm("password"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter password missing")
-		return
-	}
-	if _, ok := c.GetPostForm("name"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
-		return
-	}
-	if _, ok := c.GetPostForm("age"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter age missing")
-		return
-	}
-	if _, ok := c.GetPostForm("number"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter number missing")
-		return
-	}
-	if _, ok := c.GetPostForm("date"); !ok {
-		ErrorReply(c, http.StatusBadRequest, "Parameter date missing")
+	params, ok := newUserParams(c, true, config.MagicLinks.Passwordless)
+	if !ok {
 		return
 	}
 
-	if param, ok := c.GetPostForm("email"); ok {
-		email = param
-	}
-	if param, ok := c.GetPostForm("password"); ok {
-		password = param
-	}
-	if param, ok := c.GetPostForm("name"); ok {
-		name = param
-	}
-	if param, ok := c.GetPostForm("age"); ok {
-		age, err = ParseAgeFromString(param)
-		if err != nil {
-			ErrorReply(c, http.StatusBadRequest, "Invalid value for age")
-			return
-		}
-	}
-	if param, ok := c.GetPostForm("number"); ok {
-		number, err = ParseNumberFromString(param)
-		if err != nil {
-			ErrorReply(c, http.StatusBadRequest, "Invalid value for number")
-			return
-		}
-	}
-	if param, ok := c.GetPostForm("date"); ok {
-		date, err = ParseDateFromString(param)
-		if err != nil {
-			ErrorReply(c, http.StatusBadRequest, "Invalid value for date")
-			return
-		}
-	}
+	attributes := profileSchema.Params(c.GetPostForm, true)
 
-	model, err := h.usecaseHandler.Create(email, password, name, age, number, date)
+	model, err := h.usecases(c).Create(params.email, params.password, params.name, params.age, params.number, params.date, attributes)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"model": model})
@@ -259,21 +253,70 @@ func (h *EndpointHandler) defaultPost(c *gin.Context) {
 
 func (h *EndpointHandler) defaultGet(c *gin.Context) {
 
-	filter := c.MustGet("filter").([]map[string]string)
-	order := c.MustGet("order").(map[string]string)
-	offset := c.MustGet("offset").(int)
-	limit := c.MustGet("limit").(int)
+	filter, _ := c.MustGet("filter").(FilterExpr)
+	order := c.MustGet("order").(Ordering)
+	page := c.MustGet("page").(Page)
+	withTotal := c.MustGet("total").(bool)
+	fields := c.MustGet("fields").([]string)
+	expand := c.MustGet("expand").([]string)
+
+	result, err := h.usecases(c).Find(filter, order, page, withTotal, fields)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
 
-	models, err := h.usecaseHandler.Find(filter, order, offset, limit)
+	expanded, err := h.usecases(c).Expand(result.Models, expand)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
+	}
+
+	users := make([]interface{}, len(result.Models))
+	for i := range result.Models {
+		users[i] = RenderUser(&result.Models[i], fields, expanded)
+	}
+
+	var links []string
+	if result.Next != "" {
+		links = append(links, "<"+pageURL(c, result.Next)+">; rel=\"next\"")
+	}
+	if result.Prev != "" {
+		links = append(links, "<"+pageURL(c, result.Prev)+">; rel=\"prev\"")
 	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+
+	response := gin.H{"models": users}
+	if result.Next != "" {
+		response["next"] = result.Next
+	}
+	if result.Prev != "" {
+		response["prev"] = result.Prev
+	}
+	if result.Total != nil {
+		response["total"] = *result.Total
+	}
+
+	c.JSON(http.StatusOK, response)
+}
 
-	c.JSON(http.StatusOK, gin.H{"models": models})
+// pageURL is the request URL pointing at another page.
+func pageURL(c *gin.Context, cursor string) string {
+	query := c.Request.URL.Query()
+	query.Set("Cursor", cursor)
+	u := *c.Request.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
 }
 
 func (h *EndpointHandler) defaultPut(c *gin.Context) {
@@ -299,7 +342,7 @@ func (h *EndpointHandler) defaultPut(c *gin.Context) {
 		}
 		updates["Number"] = number
 	}
-	if param, ok := c.GetPostForm("param"); ok {
+	if param, ok := c.GetPostForm("date"); ok {
 		date, err := ParseDateFromString(param)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for date")
@@ -307,40 +350,146 @@ func (h *EndpointHandler) defaultPut(c *gin.Context) {
 		}
 		updates["Date"] = date
 	}
+	if !attributeUpdates(c, updates, true) {
+		return
+	}
 
-	filter := c.MustGet("filter").([]map[string]string)
+	filter, _ := c.MustGet("filter").(FilterExpr)
 
-	err := h.usecaseHandler.Update(updates, filter)
+	options, ok := bulkOptions(c)
+	if !ok {
+		return
+	}
+
+	result, err := h.usecases(c).Update(updates, filter, options)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{})
+	c.JSON(http.StatusOK, bulkResponse(result, options))
 }
 
 func (h *EndpointHandler) defaultDelete(c *gin.Context) {
 
-	filter := c.MustGet("filter").([]map[string]string)
+	filter, _ := c.MustGet("filter").(FilterExpr)
+
+	options, ok := bulkOptions(c)
+	if !ok {
+		return
+	}
 
-	err := h.usecaseHandler.Delete(filter)
+	result, err := h.usecases(c).Delete(filter, options)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{})
+	c.JSON(http.StatusOK, bulkResponse(result, options))
+}
+
+// attributeUpdates adds the attributes of the profile schema sent in the
+// request to updates, internal ones only when withInternal.
+func attributeUpdates(c *gin.Context, updates map[string]interface{}, withInternal bool) bool {
+	params := profileSchema.Params(c.GetPostForm, withInternal)
+	if len(params) == 0 {
+		return true
+	}
+
+	attributes, err := profileSchema.Parse(params)
+	if err != nil {
+		v := err.(Error)
+		ErrorReply(c, v.Code, RequestMessage(c, v))
+		return false
+	}
+	updates["Attributes"] = AttributeUpdates(attributes)
+	return true
+}
+
+func bulkOptions(c *gin.Context) (BulkOptions, bool) {
+	var options BulkOptions
+
+	if param := c.Query("dryRun"); param != "" {
+		if param != "true" && param != "false" {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for dryRun")
+			return options, false
+		}
+		options.DryRun = param == "true"
+	}
+	if param := c.Query("confirm"); param != "" {
+		confirm, err := strconv.Atoi(param)
+		if err != nil || confirm < 0 {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for confirm")
+			return options, false
+		}
+		options.Confirm = confirm
+	}
+
+	return options, true
+}
+
+// isSelf reports whether model is the authenticated user.
+func isSelf(c *gin.Context, model *Model) bool {
+	id, ok := c.Get("authenticatedID")
+	return ok && id.(uint) == model.ID
 }
 
+// canGrant reports whether the authenticated user can change the roles of a
+// user from current to roles: admins grant roles, but only superadmins grant
+// or revoke superadmin.
+func canGrant(c *gin.Context, current, roles Roles) bool {
+	if hasRole(c, RoleSuperadmin) {
+		return true
+	}
+	return hasRole(c, RoleAdmin) && !current.Has(RoleSuperadmin) && !roles.Has(RoleSuperadmin)
+}
+
+func bulkResponse(result *BulkResult, options BulkOptions) gin.H {
+	if options.DryRun {
+		return gin.H{"dryRun": true, "matched": result.Matched, "sample": result.Sample}
+	}
+	return gin.H{"matched": result.Matched, "affected": result.Affected}
+}
+
+// defaultGetOne only sends an ETag without expand, as the version of the user
+// doesn't change with its related resources.
 func (h *EndpointHandler) defaultGetOne(c *gin.Context) {
-	model := c.MustGet("one")
-	c.JSON(http.StatusOK, gin.H{"model": model})
+	model := c.MustGet("one").(*Model)
+	fields := c.MustGet("fields").([]string)
+	expand := c.MustGet("expand").([]string)
+	self := isSelf(c, model)
+
+	if len(expand) == 0 {
+		etag := ModelETag(model, fields, self)
+		c.Header("ETag", etag)
+		if header := c.GetHeader("If-None-Match"); header != "" && ETagMatches(header, etag, true) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	expanded, err := h.usecases(c).Expand([]Model{*model}, expand)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	user := *model
+	user.Attributes = profileSchema.Visible(model.Attributes, self)
+
+	c.JSON(http.StatusOK, gin.H{"model": RenderUser(&user, fields, expanded)})
 }
 
 func (h *EndpointHandler) defaultPutOne(c *gin.Context) {
@@ -387,30 +536,150 @@ func (h *EndpointHandler) defaultPutOne(c *gin.Context) {
 		}
 		updates["Date"] = date
 	}
+	if !attributeUpdates(c, updates, false) {
+		return
+	}
+	if param, ok := c.GetPostForm("roles"); ok {
+		roles, err := ParseRoles(param)
+		if err != nil {
+			v := err.(Error)
+			ErrorReply(c, v.Code, RequestMessage(c, v))
+			return
+		}
+		if !canGrant(c, model.Roles, roles) {
+			ErrorReply(c, http.StatusForbidden, "Forbidden")
+			return
+		}
+		updates["Roles"] = roles
+	}
 
-	model, err := h.usecaseHandler.UpdateOne(model, updates)
+	model, err := h.usecases(c).UpdateOne(model, updates)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"model": model})
+	self := isSelf(c, model)
+	user := *model
+	user.Attributes = profileSchema.Visible(model.Attributes, self)
+
+	c.Header("ETag", ModelETag(model, nil, self))
+	c.JSON(http.StatusOK, gin.H{"model": &user})
 }
 
 func (h *EndpointHandler) defaultDeleteOne(c *gin.Context) {
 	model := c.MustGet("one").(*Model)
 
-	err := h.usecaseHandler.DeleteOne(model)
+	err := h.usecases(c).DeleteOne(model)
 	if err != nil {
 		if v, ok := err.(Error); ok {
-			c.JSON(v.Code, gin.H{"msg": v.Message})
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
 		} else {
 			panic(err)
 		}
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{})
 }
+
+// defaultImport reads the file to import from the request body. The format
+// comes from the format param or else from the Content-Type.
+func (h *EndpointHandler) defaultImport(c *gin.Context, config *Config) {
+
+	options := ImportOptions{Format: c.Query("format"), OnConflict: c.DefaultQuery("onConflict", ImportFail)}
+
+	if options.Format == "" {
+		contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		switch contentType {
+		case "text/csv":
+			options.Format = ImportCSV
+		case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+			options.Format = ImportJSONL
+		default:
+			ErrorReply(c, http.StatusBadRequest, "Parameter format missing")
+			return
+		}
+	}
+
+	maxSizeInMB := config.Import.MaxSizeInMB
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(maxSizeInMB)<<20))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		ErrorReply(c, http.StatusRequestEntityTooLarge, "The file can't be larger than "+strconv.Itoa(maxSizeInMB)+"MB")
+		return
+	}
+	if err != nil {
+		ErrorReply(c, http.StatusBadRequest, "Invalid body")
+		return
+	}
+
+	report, err := h.usecases(c).Import(bytes.NewReader(body), options)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+// exportFlushRows is how many rows are buffered before they're sent.
+const exportFlushRows = 100
+
+// defaultExport streams the users as they're read from the database. Once the
+// response started an error can't change its status, so the connection is cut
+// before the end of the chunked body for the client to notice.
+func (h *EndpointHandler) defaultExport(c *gin.Context) {
+
+	filter, _ := c.MustGet("filter").(FilterExpr)
+	order := c.MustGet("order").(Ordering)
+
+	columns, err := ParseExportColumns(c.Query("columns"))
+	if err != nil {
+		ErrorReply(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := c.DefaultQuery("format", ExportCSV)
+	writer, contentType, err := NewExportWriter(c.Writer, format, columns)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+			return
+		}
+		panic(err)
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=\"users."+format+"\"")
+	c.Status(http.StatusOK)
+
+	rows := 0
+	err = h.usecases(c).Export(filter, order, columns, func(m *Model) error {
+		if err := writer.Write(m); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("export cut short after %d rows: %v", rows, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	ExportCSV   = "csv"
+	ExportJSONL = "jsonl"
+)
+
+// exportColumns are the columns an export can select, in their default order.
+// Passwords are never exported. In CSV, attributes are a JSON object.
+var exportColumns = []string{"id", "email", "name", "age", "number", "date", "compromised", "created_at", "updated_at", "version", "attributes"}
+
+// ExportWriter writes users one at a time, in a given format, keeping only
+// what's buffered until the next Flush.
+type ExportWriter interface {
+	Write(m *Model) error
+	Flush() error
+}
+
+// NewExportWriter returns a writer for format, "ndjson" being the same as
+// "jsonl", and its content type.
+func NewExportWriter(w io.Writer, format string, columns []string) (ExportWriter, string, error) {
+	switch format {
+	case ExportCSV:
+		writer := &csvExportWriter{w: csv.NewWriter(w), columns: columns}
+		return writer, "text/csv; charset=utf-8", writer.w.Write(columns)
+	case ExportJSONL, "ndjson":
+		return &jsonlExportWriter{w: w, columns: columns}, "application/x-ndjson", nil
+	}
+	return nil, "", Error{Code: http.StatusBadRequest, Message: "Invalid value for format, use csv or jsonl"}
+}
+
+type csvExportWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+func (e *csvExportWriter) Write(m *Model) error {
+	record := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		value := exportValue(m, column)
+		if attributes, ok := value.(Attributes); ok {
+			encoded, err := json.Marshal(attributes)
+			if err != nil {
+				return err
+			}
+			value = string(encoded)
+		}
+		record[i] = fmt.Sprint(value)
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExportWriter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExportWriter writes an object per line with the keys in column order.
+type jsonlExportWriter struct {
+	w       io.Writer
+	columns []string
+	buf     bytes.Buffer
+}
+
+func (e *jsonlExportWriter) Write(m *Model) error {
+	e.buf.WriteByte('{')
+	for i, column := range e.columns {
+		value, err := json.Marshal(exportValue(m, column))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		e.buf.WriteString(`"` + column + `":`)
+		e.buf.Write(value)
+	}
+	e.buf.WriteString("}\n")
+	return nil
+}
+
+func (e *jsonlExportWriter) Flush() error {
+	_, err := e.w.Write(e.buf.Bytes())
+	e.buf.Reset()
+	return err
+}
+
+func exportValue(m *Model, column string) interface{} {
+	field, _ := modelField(m, column)
+	v := field.Interface()
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// ParseExportColumns validates a comma separated list of columns, returning
+// every exportable column for an empty one.
+func ParseExportColumns(param string) ([]string, error) {
+	if param == "" {
+		return exportColumns, nil
+	}
+
+	columns, invalid, ok := ParseFieldList(param, func(name string) bool {
+		for _, c := range exportColumns {
+			if c == name {
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid column " + invalid}
+	}
+	return columns, nil
+}
+
+func (h *UsecaseHandler) Export(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error {
+	return h.persistenceHandler.Iterate(filter, order, columns, fn)
+}
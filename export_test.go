@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportColumns(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    []string
+		wantErr bool
+	}{
+		{"", exportColumns, false},
+		{"email,name", []string{"email", "name"}, false},
+		{"name, email", []string{"name", "email"}, false},
+		{"password", nil, true},
+		{"email,protection_scheme", nil, true},
+		{"email,", nil, true},
+	}
+	for _, tt := range tests {
+		columns, err := ParseExportColumns(tt.param)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v", tt.param, columns)
+			}
+			continue
+		}
+		if err != nil || !equalStrings(columns, tt.want) {
+			t.Errorf("%q: got %v, %v, want %v", tt.param, columns, err, tt.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	store := NewMemoryPersistence()
+	config := &Config{JwtSecret: "secret", AppName: "test"}
+	users := (&UsecaseHandler{store, store, nil, nil, config}).ForTenant(defaultTenantID).(*UsecaseHandler)
+
+	models := createTestModels(t, store, "a", "b", "c")
+	updates := map[string]interface{}{"Name": `Smith, "Bob"`, "Attributes": Attributes{"team": "x"}}
+	if err := store.UpdateFields(models[1], updates); err != nil {
+		t.Fatal(err)
+	}
+	other := &Model{TenantID: defaultTenantID + 1, Email: "eve@example.com", Name: "eve"}
+	if err := store.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	date := models[0].Date.Format(time.RFC3339Nano)
+
+	tests := []struct {
+		format  string
+		columns []string
+		want    string
+	}{
+		{ExportCSV, []string{"email", "name", "age"},
+			"email,name,age\na@example.com,a,20\nb@example.com,\"Smith, \"\"Bob\"\"\",21\nc@example.com,c,22\n"},
+		{ExportCSV, []string{"name", "attributes"},
+			"name,attributes\na,{}\n\"Smith, \"\"Bob\"\"\",\"{\"\"team\"\":\"\"x\"\"}\"\nc,{}\n"},
+		{ExportJSONL, []string{"name", "email", "date"},
+			`{"name":"a","email":"a@example.com","date":"` + date + `"}` + "\n" +
+				`{"name":"Smith, \"Bob\"","email":"b@example.com","date":"` + date + `"}` + "\n" +
+				`{"name":"c","email":"c@example.com","date":"` + date + `"}` + "\n"},
+		{"ndjson", []string{"id", "attributes"},
+			`{"id":1,"attributes":{}}` + "\n" + `{"id":2,"attributes":{"team":"x"}}` + "\n" + `{"id":3,"attributes":{}}` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writer, _, err := NewExportWriter(&buf, tt.format, tt.columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = users.Export(nil, Ordering{Column: "id"}, tt.columns, writer.Write)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.format, tt.columns, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s %v: got\n%s\nwant\n%s", tt.format, tt.columns, got, tt.want)
+		}
+	}
+
+	if _, _, err := NewExportWriter(&bytes.Buffer{}, "xml", exportColumns); err == nil {
+		t.Error("created a writer of an unknown format")
+	}
+
+	var buf bytes.Buffer
+	writer, _, _ := NewExportWriter(&buf, ExportCSV, exportColumns)
+	if err := users.Export(nil, Ordering{Column: "id"}, exportColumns, writer.Write); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if strings.Contains(buf.String(), "eve") || strings.Count(buf.String(), "\n") != 4 {
+		t.Errorf("exported\n%s", buf.String())
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderConfig is an upstream identity provider users can log in with,
+// like Google, Azure AD or Okta. OpenID Connect providers only need their
+// issuer, their endpoints being discovered, while OAuth 2.0 ones need all
+// three endpoints. Either registers Issuer+"/providers/"+Name+"/callback"
+// as redirect URI.
+//
+// Claims maps the fields of users, and their profile attributes, to the
+// claims of the provider that fill them:
+//
+//	subject         sub by default, the id of users at the provider
+//	email           email by default
+//	email_verified  email_verified by default, or every email with TrustEmail
+//	name            name by default
+//	age, number, date and profile attributes, none by default
+type ProviderConfig struct {
+	Name             string // in the paths of its login, like google
+	Issuer           string
+	AuthorizationURL string // overriding the discovered endpoints, if any
+	TokenURL         string
+	UserInfoURL      string
+	ClientID         string
+	ClientSecret     string
+	Scopes           []string // openid, email and profile when empty and Issuer is set
+	Claims           map[string]string
+	TrustEmail       bool // for providers that verify every email but don't claim email_verified
+}
+
+var defaultProviderClaims = map[string]string{
+	"subject":        "sub",
+	"email":          "email",
+	"email_verified": "email_verified",
+	"name":           "name",
+}
+
+// Provider logs users in with an upstream identity provider, discovering its
+// endpoints on first use.
+type Provider struct {
+	ProviderConfig
+	redirectURI string
+	client      *http.Client
+
+	mu         sync.Mutex
+	discovered bool
+}
+
+// ExternalUser is a user as an identity provider knows it.
+type ExternalUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Fields        map[string]string // age, number, date and profile attributes, by name
+}
+
+var errProviderFailed = Error{Code: http.StatusBadGateway, Message: "The identity provider failed, try again later"}
+
+// NewProviders returns the providers of config by name, checking they can be
+// logged in with.
+func NewProviders(config *Config) (map[string]*Provider, error) {
+	providers := map[string]*Provider{}
+	for _, c := range config.Federation.Providers {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/?#") {
+			return nil, fmt.Errorf("federation: invalid provider name %q", c.Name)
+		}
+		if _, ok := providers[c.Name]; ok {
+			return nil, fmt.Errorf("federation: provider %s is configured twice", c.Name)
+		}
+		if c.ClientID == "" {
+			return nil, fmt.Errorf("federation: provider %s has no client id", c.Name)
+		}
+		if c.Issuer == "" && (c.AuthorizationURL == "" || c.TokenURL == "" || c.UserInfoURL == "") {
+			return nil, fmt.Errorf("federation: provider %s needs an issuer, or authorization, token and userinfo URLs", c.Name)
+		}
+		if config.Issuer == "" {
+			return nil, errors.New("federation: providers need the issuer of the service configured, for their redirect URIs")
+		}
+
+		if len(c.Scopes) == 0 && c.Issuer != "" {
+			c.Scopes = []string{ScopeOpenID, ScopeEmail, ScopeProfile}
+		}
+		claims := map[string]string{}
+		for field, claim := range defaultProviderClaims {
+			claims[field] = claim
+		}
+		for field, claim := range c.Claims {
+			claims[field] = claim
+		}
+		c.Claims = claims
+
+		providers[c.Name] = &Provider{
+			ProviderConfig: c,
+			redirectURI:    config.Issuer + "/providers/" + c.Name + "/callback",
+			client:         &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return providers, nil
+}
+
+// AuthCodeURL is where users log in at the provider, which redirects them
+// back with a code for state. The verifier of PKCE is sent hashed.
+func (p *Provider) AuthCodeURL(state string, nonce string, codeVerifier string) (string, error) {
+
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(codeVerifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURI},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if len(p.Scopes) > 0 {
+		params.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	if p.Issuer != "" {
+		params.Set("nonce", nonce)
+	}
+
+	return addQuery(p.AuthorizationURL, params.Encode()), nil
+}
+
+// Exchange trades code for the user who logged in. The signature of the ID
+// token isn't checked, as it comes straight from the token endpoint over
+// TLS, as OpenID Connect allows, but its issuer, audience, expiry and nonce
+// are.
+func (p *Provider) Exchange(code string, codeVerifier string, nonce string) (*ExternalUser, error) {
+
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	request, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, p.failed("token request", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := p.do(request, &tokens); err != nil {
+		// Codes that expired or were used are the usual reason
+		p.failed("token", err)
+		return nil, Error{Code: http.StatusBadRequest, Message: "The identity provider refused the login, start over"}
+	}
+
+	claims := map[string]interface{}{}
+	if p.Issuer != "" {
+		if claims, err = p.idTokenClaims(tokens.IDToken, nonce); err != nil {
+			return nil, p.failed("ID token", err)
+		}
+	}
+
+	if p.UserInfoURL != "" && tokens.AccessToken != "" {
+		request, err := http.NewRequest(http.MethodGet, p.UserInfoURL, nil)
+		if err != nil {
+			return nil, p.failed("userinfo request", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		userInfo := map[string]interface{}{}
+		if err := p.do(request, &userInfo); err != nil {
+			return nil, p.failed("userinfo", err)
+		}
+		if subject, ok := claims["sub"]; ok && claimString(userInfo["sub"]) != claimString(subject) {
+			return nil, p.failed("userinfo", errors.New("its subject isn't the one of the ID token"))
+		}
+		for name, value := range userInfo {
+			claims[name] = value
+		}
+	}
+
+	return p.externalUser(claims)
+}
+
+// discover fetches the endpoints of OpenID Connect providers once they
+// answer, leaving the configured ones as they are.
+func (p *Provider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered || p.Issuer == "" {
+		return nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return p.failed("discovery", err)
+	}
+	var metadata struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := p.do(request, &metadata); err != nil {
+		return p.failed("discovery", err)
+	}
+	if metadata.Issuer != p.Issuer {
+		return p.failed("discovery", fmt.Errorf("the issuer is %q", metadata.Issuer))
+	}
+
+	if p.AuthorizationURL == "" {
+		p.AuthorizationURL = metadata.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = metadata.TokenEndpoint
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = metadata.UserInfoEndpoint
+	}
+	if p.AuthorizationURL == "" || p.TokenURL == "" {
+		return p.failed("discovery", errors.New("the authorization or token endpoint is missing"))
+	}
+	p.discovered = true
+	return nil
+}
+
+// do sends request, decoding the JSON of its successful reply into v, with
+// numbers as json.Number so ids aren't rounded.
+func (p *Provider) do(request *http.Request, v interface{}) error {
+
+	request.Header.Set("Accept", "application/json")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s replied %d: %s", request.Method, request.URL, response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func (p *Provider) idTokenClaims(idToken string, nonce string) (map[string]interface{}, error) {
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token endpoint replied no ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	if claims["iss"] != p.Issuer {
+		return nil, fmt.Errorf("its issuer is %v", claims["iss"])
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == p.ClientID
+		}
+	}
+	if !audience {
+		return nil, fmt.Errorf("its audience is %v", claims["aud"])
+	}
+	exp, err := strconv.ParseInt(claimString(claims["exp"]), 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil, errors.New("it expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("its nonce isn't the one of the login")
+	}
+
+	return claims, nil
+}
+
+// externalUser maps claims to a user with the Claims of the provider.
+func (p *Provider) externalUser(claims map[string]interface{}) (*ExternalUser, error) {
+
+	user := ExternalUser{Fields: map[string]string{}}
+	for field, claim := range p.Claims {
+		value := claimString(claims[claim])
+		switch field {
+		case "subject":
+			user.Subject = value
+		case "email":
+			user.Email = value
+		case "email_verified":
+			user.EmailVerified, _ = strconv.ParseBool(value)
+		case "name":
+			user.Name = value
+		default:
+			if value != "" {
+				user.Fields[field] = value
+			}
+		}
+	}
+	if p.TrustEmail {
+		user.EmailVerified = true
+	}
+
+	if user.Subject == "" {
+		return nil, p.failed("claims", fmt.Errorf("the %s claim of the subject is missing", p.Claims["subject"]))
+	}
+	return &user, nil
+}
+
+func (p *Provider) failed(what string, err error) error {
+	return logFailure("provider "+p.Name, what, err, errProviderFailed)
+}
+
+// claimString is the text of strings, numbers and booleans, and empty for
+// the others.
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
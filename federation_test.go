@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider serves the discovery, token and userinfo endpoints of an
+// OpenID Connect provider, replying the claims of its fields.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	idToken  map[string]interface{}
+	userInfo map[string]interface{}
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	p := &fakeOIDCProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" || r.PostFormValue("code") != "code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		payload, _ := json.Marshal(p.idToken)
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"id_token":     "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(p.userInfo)
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// startLogin starts a login of h with the provider, resetting its claims to
+// the ones of alice with the nonce of the login.
+func (p *fakeOIDCProvider) startLogin(t *testing.T, h *IdentityUsecaseHandler) string {
+	redirect, state, err := h.StartLogin("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.idToken = map[string]interface{}{
+		"iss":   p.URL,
+		"aud":   "client",
+		"sub":   "subject",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": location.Query().Get("nonce"),
+	}
+	p.userInfo = map[string]interface{}{
+		"sub":            "subject",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+	return state
+}
+
+func newTestIdentityUsecases(t *testing.T, store *MemoryPersistence, provider ProviderConfig) *IdentityUsecaseHandler {
+	config := &Config{JwtSecret: "secret", AppName: "test", Issuer: "http://localhost"}
+	config.Federation.LoginExpiryInSeconds = 600
+	config.Federation.Providers = []ProviderConfig{provider}
+	providers, err := NewProviders(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &UsecaseHandler{store, store, nil, nil, config}
+	return &IdentityUsecaseHandler{store, store, store, users, &TokenIssuer{store, config, nil}, providers, nil, config, defaultTenantID}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+
+	tests := []struct {
+		name    string
+		change  func(idToken, userInfo map[string]interface{})
+		wantErr bool
+	}{
+		{"valid", func(idToken, userInfo map[string]interface{}) {}, false},
+		{"wrong issuer", func(idToken, userInfo map[string]interface{}) { idToken["iss"] = "https://evil.example.com" }, true},
+		{"wrong audience", func(idToken, userInfo map[string]interface{}) { idToken["aud"] = "other" }, true},
+		{"audience list", func(idToken, userInfo map[string]interface{}) { idToken["aud"] = []string{"other", "client"} }, false},
+		{"wrong nonce", func(idToken, userInfo map[string]interface{}) { idToken["nonce"] = "other" }, true},
+		{"no nonce", func(idToken, userInfo map[string]interface{}) { delete(idToken, "nonce") }, true},
+		{"expired", func(idToken, userInfo map[string]interface{}) { idToken["exp"] = time.Now().Add(-time.Minute).Unix() }, true},
+		{"userinfo of another subject", func(idToken, userInfo map[string]interface{}) { userInfo["sub"] = "other" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryPersistence()
+			h := newTestIdentityUsecases(t, store, ProviderConfig{Name: "test", Issuer: provider.URL, ClientID: "client", ClientSecret: "secret"})
+
+			state := provider.startLogin(t, h)
+			tt.change(provider.idToken, provider.userInfo)
+
+			token, user, err := h.FinishLogin("test", state, "code")
+			if tt.wantErr {
+				if err != errProviderFailed {
+					t.Errorf("got %v, want %v", err, errProviderFailed)
+				}
+				if count, _ := store.Count(nil); count != 0 {
+					t.Errorf("created %d users", count)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == "" || user.Email != "alice@example.com" || user.Name != "Alice" || !user.EmailVerified || user.Password != "" {
+				t.Errorf("logged in %+v with token %q", user, token)
+			}
+		})
+	}
+}
+
+func TestOIDCLinking(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+
+	tests := []struct {
+		name          string
+		local         bool // a user has the email already
+		localVerified bool // and verified it
+		emailVerified bool // the provider verified the email
+		wantErr       bool
+		wantLinked    bool
+	}{
+		{name: "creates the user just in time", emailVerified: true},
+		{name: "creates the user with an unverified email", emailVerified: false},
+		{name: "links by verified email", local: true, localVerified: true, emailVerified: true, wantLinked: true},
+		{name: "refuses an email the provider didn't verify", local: true, localVerified: true, emailVerified: false, wantErr: true},
+		{name: "refuses a user that didn't verify the email", local: true, localVerified: false, emailVerified: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryPersistence()
+			h := newTestIdentityUsecases(t, store, ProviderConfig{Name: "test", Issuer: provider.URL, ClientID: "client", ClientSecret: "secret"})
+
+			var local *Model
+			if tt.local {
+				local = newTestModel("alice@example.com", "local", 30)
+				local.Password = "protected"
+				local.EmailVerified = tt.localVerified
+				if err := store.Create(local); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			login := func() (*Model, error) {
+				state := provider.startLogin(t, h)
+				provider.userInfo["email_verified"] = tt.emailVerified
+				_, user, err := h.FinishLogin("test", state, "code")
+				return user, err
+			}
+
+			user, err := login()
+			if tt.wantErr {
+				if v, ok := err.(Error); !ok || v.Code != http.StatusConflict {
+					t.Fatalf("got %v, want a conflict", err)
+				}
+				if identities, _ := store.ListIdentities(local.ID); len(identities) != 0 {
+					t.Errorf("linked %d identities", len(identities))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantLinked != (local != nil && user.ID == local.ID) {
+				t.Errorf("logged in user %d, local user is %v", user.ID, local)
+			}
+			if user.EmailVerified != (tt.emailVerified || tt.localVerified) {
+				t.Errorf("email verified is %v", user.EmailVerified)
+			}
+
+			// The identity is linked, so the next login finds the same user
+			again, err := login()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.ID != user.ID {
+				t.Errorf("logged in user %d the second time, %d the first", again.ID, user.ID)
+			}
+			if count, _ := store.Count(nil); count != 1 {
+				t.Errorf("counted %d users, want 1", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// publicFields are the fields of a user a client can select with fields=,
+// mapped to their key in the response.
+var publicFields = map[string]string{
+	"id":             "ID",
+	"email":          "Email",
+	"email_verified": "EmailVerified",
+	"name":           "Name",
+	"age":            "Age",
+	"number":         "Number",
+	"date":           "Date",
+	"compromised":    "Compromised",
+	"created_at":     "CreatedAt",
+	"updated_at":     "UpdatedAt",
+	"version":        "Version",
+	"attributes":     "Attributes",
+	"tenant_id":      "TenantID",
+	"roles":          "Roles",
+}
+
+// UserExpansion embeds a resource related to users, loaded for a whole page
+// of them at once and keyed by user id.
+type UserExpansion struct {
+	Key  string // key of the resource in the response
+	Load func(h *UsecaseHandler, ids []uint) (map[uint]interface{}, error)
+}
+
+// userExpansions are the resources expand= can embed in a user.
+var userExpansions = map[string]UserExpansion{}
+
+// ParseFieldList splits a comma separated list of names, keeping the ones in
+// valid and rejecting the others. Repeated names are dropped.
+func ParseFieldList(param string, valid func(name string) bool) ([]string, string, bool) {
+	if param == "" {
+		return nil, "", true
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if !valid(name) {
+			return nil, name, false
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, "", true
+}
+
+// selectColumns adds to fields the columns pagination needs, the order
+// column and id. It returns nil, every column, for no fields.
+func selectColumns(fields []string, order Ordering) []string {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	orderColumn := order.Column
+	if _, ok := profileSchema.Field(orderColumn); ok {
+		orderColumn = "attributes"
+	}
+
+	columns := append([]string{}, fields...)
+	for _, required := range []string{orderColumn, "id"} {
+		found := false
+		for _, c := range columns {
+			found = found || c == required
+		}
+		if !found {
+			columns = append(columns, required)
+		}
+	}
+	return columns
+}
+
+func (h *UsecaseHandler) Expand(models []Model, expand []string) (map[string]map[uint]interface{}, error) {
+
+	if len(expand) == 0 || len(models) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint, len(models))
+	for i, m := range models {
+		ids[i] = m.ID
+	}
+
+	expanded := map[string]map[uint]interface{}{}
+	for _, name := range expand {
+		expansion, ok := userExpansions[name]
+		if !ok {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Invalid expand " + name}
+		}
+		loaded, err := expansion.Load(h, ids)
+		if err != nil {
+			if _, ok := err.(Error); ok {
+				return nil, err
+			}
+			panic(err)
+		}
+		expanded[expansion.Key] = loaded
+	}
+
+	return expanded, nil
+}
+
+// RenderUser keeps the requested fields of m, or all the public ones, and
+// embeds its expansions. With neither, m is rendered as is.
+func RenderUser(m *Model, fields []string, expanded map[string]map[uint]interface{}) interface{} {
+	if len(fields) == 0 && len(expanded) == 0 {
+		return m
+	}
+
+	if len(fields) == 0 {
+		for name := range publicFields {
+			fields = append(fields, name)
+		}
+	}
+
+	user := map[string]interface{}{}
+	for _, name := range fields {
+		field, _ := modelField(m, name)
+		user[publicFields[name]] = field.Interface()
+	}
+	for key, byID := range expanded {
+		user[key] = byID[m.ID]
+	}
+	return user
+}
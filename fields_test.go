@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRenderUserHidesPasswords(t *testing.T) {
+	m := newTestModel("alice@example.com", "alice", 20)
+	m.ID = 1
+	m.Password = strings.Repeat("ab", 96)
+	m.ProtectionScheme = defaultProtectionScheme
+
+	expanded := map[string]map[uint]interface{}{"groups": {1: []string{"staff"}}}
+	for _, rendered := range []interface{}{
+		RenderUser(m, nil, nil),
+		RenderUser(m, nil, expanded),
+		RenderUser(m, []string{"email"}, expanded),
+	} {
+		encoded, err := json.Marshal(rendered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(encoded), m.Password) || strings.Contains(string(encoded), "ProtectionScheme") {
+			t.Errorf("rendered the password: %s", encoded)
+		}
+		if !strings.Contains(string(encoded), m.Email) {
+			t.Errorf("didn't render the email: %s", encoded)
+		}
+	}
+
+	user := RenderUser(m, nil, expanded).(map[string]interface{})
+	if len(user) != len(publicFields)+1 || user["groups"] == nil {
+		t.Errorf("rendered %v, want the public fields and the expansion", user)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter expressions look like
+//
+//	age>=18 and (name~"ann*" or email in ["a@x.com","b@y.com"])
+//
+// expr       := or
+// or         := and ("or" and)*
+// and        := not ("and" not)*
+// not        := "not" not | primary
+// primary    := "(" expr ")" | comparison | membership
+// comparison := field ("=" | "!=" | "<>" | ">" | ">=" | "<" | "<=" | "~") value
+// membership := field ["not"] "in" "[" value ("," value)* "]"
+// value      := string | integer
+//
+// "~" matches strings case-insensitively, "*" standing for any run of characters.
+// Dates are written as RFC3339 strings.
+
+const (
+	maxFilterLength   = 2048
+	maxFilterDepth    = 16
+	maxFilterInValues = 100
+)
+
+type FilterFieldType int
+
+const (
+	FilterString FilterFieldType = iota
+	FilterInt
+	FilterUint
+	FilterTime
+)
+
+func (t FilterFieldType) String() string {
+	switch t {
+	case FilterString:
+		return "string"
+	case FilterInt, FilterUint:
+		return "integer"
+	case FilterTime:
+		return "date"
+	}
+	return "unknown"
+}
+
+type filterableField struct {
+	Column string
+	Type   FilterFieldType
+}
+
+// filterableFields is the whitelist of fields a filter can reference, with the
+// column each one maps to. The profile schema adds its filterable fields.
+var filterableFields = map[string]filterableField{
+	"id":         {"id", FilterUint},
+	"email":      {"email", FilterString},
+	"name":       {"name", FilterString},
+	"age":        {"age", FilterUint},
+	"number":     {"number", FilterInt},
+	"date":       {"date", FilterTime},
+	"created_at": {"created_at", FilterTime},
+	"updated_at": {"updated_at", FilterTime},
+}
+
+// FilterExpr is a node of a parsed filter. Values held by the leaves are
+// already typed: string, int64, uint64 or time.Time.
+type FilterExpr interface {
+	filterExpr()
+}
+
+type FilterAnd []FilterExpr
+
+type FilterOr []FilterExpr
+
+type FilterNot struct {
+	Expr FilterExpr
+}
+
+type FilterComparison struct {
+	Column string
+	Op     string // =, <>, >, >=, <, <=, ~
+	Value  interface{}
+}
+
+type FilterIn struct {
+	Column string
+	Values []interface{}
+}
+
+// FilterMember matches the users belonging directly to any of GroupIDs. It
+// isn't part of the filter language: group= resolves to it.
+type FilterMember struct {
+	GroupIDs []uint
+}
+
+func (FilterAnd) filterExpr()        {}
+func (FilterOr) filterExpr()         {}
+func (FilterNot) filterExpr()        {}
+func (FilterComparison) filterExpr() {}
+func (FilterIn) filterExpr()         {}
+func (FilterMember) filterExpr()     {}
+
+// FilterError points at the character, counting from 1, where parsing failed.
+type FilterError struct {
+	Position int
+	Message  string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+// AndFilters joins the non nil expressions, returning nil when there's none.
+func AndFilters(exprs ...FilterExpr) FilterExpr {
+	var terms FilterAnd
+	for _, e := range exprs {
+		if e != nil {
+			terms = append(terms, e)
+		}
+	}
+	switch len(terms) {
+	case 0:
+		return nil
+	case 1:
+		return terms[0]
+	}
+	return terms
+}
+
+// FormatFilter writes expr back in the filter language, so that ParseFilter
+// restores an equivalent expression. It returns "" for a nil expression.
+func FormatFilter(expr FilterExpr) string {
+	switch e := expr.(type) {
+	case nil:
+		return ""
+	case FilterAnd:
+		terms := make([]string, len(e))
+		for i, term := range e {
+			terms[i] = formatFilterTerm(term, true)
+		}
+		return strings.Join(terms, " and ")
+	case FilterOr:
+		terms := make([]string, len(e))
+		for i, term := range e {
+			terms[i] = formatFilterTerm(term, false)
+		}
+		return strings.Join(terms, " or ")
+	case FilterNot:
+		return "not " + formatFilterTerm(e.Expr, true)
+	case FilterComparison:
+		return filterFieldName(e.Column) + e.Op + formatFilterValue(e.Value)
+	case FilterIn:
+		values := make([]string, len(e.Values))
+		for i, v := range e.Values {
+			values[i] = formatFilterValue(v)
+		}
+		return filterFieldName(e.Column) + " in [" + strings.Join(values, ",") + "]"
+	}
+	panic(fmt.Sprintf("unknown filter node %T", expr))
+}
+
+// filterFieldName is the field a filter references column by, which is the
+// column itself except for attributes of the profile schema.
+func filterFieldName(column string) string {
+	return strings.TrimPrefix(column, attributePrefix)
+}
+
+// formatFilterTerm parenthesizes the terms that would otherwise bind differently.
+func formatFilterTerm(expr FilterExpr, parenthesizeAnd bool) string {
+	switch expr.(type) {
+	case FilterOr:
+		return "(" + FormatFilter(expr) + ")"
+	case FilterAnd:
+		if parenthesizeAnd {
+			return "(" + FormatFilter(expr) + ")"
+		}
+	}
+	return FormatFilter(expr)
+}
+
+func formatFilterValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(v) + "\""
+	case time.Time:
+		return "\"" + v.Format(time.RFC3339Nano) + "\""
+	}
+	return fmt.Sprint(v)
+}
+
+func ParseFilter(s string) (FilterExpr, error) {
+	if len([]rune(s)) > maxFilterLength {
+		return nil, &FilterError{Position: maxFilterLength + 1, Message: fmt.Sprintf("filter longer than %d characters", maxFilterLength)}
+	}
+
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	return expr, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenEOF filterTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return "\"" + t.text + "\""
+}
+
+func (t filterToken) isKeyword(keyword string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func lexFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{tokenLParen, "(", pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{tokenRParen, ")", pos})
+			i++
+		case r == '[':
+			tokens = append(tokens, filterToken{tokenLBracket, "[", pos})
+			i++
+		case r == ']':
+			tokens = append(tokens, filterToken{tokenRBracket, "]", pos})
+			i++
+		case r == ',':
+			tokens = append(tokens, filterToken{tokenComma, ",", pos})
+			i++
+		case strings.ContainsRune("=!<>~", r):
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := op + string(runes[i+1]); two == "!=" || two == "<>" || two == ">=" || two == "<=" {
+					op = two
+				}
+			}
+			if op == "!" {
+				return nil, &FilterError{Position: pos, Message: "unexpected \"!\""}
+			}
+			tokens = append(tokens, filterToken{tokenOperator, op, pos})
+			i += len(op)
+		case r == '"':
+			var b strings.Builder
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &FilterError{Position: pos, Message: "unterminated string"}
+			}
+			tokens = append(tokens, filterToken{tokenString, b.String(), pos})
+		case r == '-' || unicode.IsDigit(r):
+			start := i
+			i++
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			if text == "-" {
+				return nil, &FilterError{Position: pos, Message: "expected a number after \"-\""}
+			}
+			tokens = append(tokens, filterToken{tokenNumber, text, pos})
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, string(runes[start:i]), pos})
+		default:
+			return nil, &FilterError{Position: pos, Message: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+
+	return append(tokens, filterToken{kind: tokenEOF, pos: len(runes) + 1}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	depth  int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) advance() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return &FilterError{Position: t.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	terms := FilterOr{first}
+	for p.peek().isKeyword("or") {
+		p.advance()
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, next)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	terms := FilterAnd{first}
+	for p.peek().isKeyword("and") {
+		p.advance()
+		next, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, next)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return terms, nil
+}
+
+func (p *filterParser) parseNot() (FilterExpr, error) {
+	if !p.peek().isKeyword("not") {
+		return p.parsePrimary()
+	}
+	t := p.advance()
+	if err := p.enter(t); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	expr, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return FilterNot{expr}, nil
+}
+
+func (p *filterParser) parsePrimary() (FilterExpr, error) {
+	t := p.advance()
+
+	if t.kind == tokenLParen {
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.advance(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected \")\" but found %s", closing)
+		}
+		return expr, nil
+	}
+
+	if t.kind != tokenIdent || t.isKeyword("and") || t.isKeyword("or") || t.isKeyword("in") {
+		return nil, p.errorf(t, "expected a field but found %s", t)
+	}
+	field, ok := filterableFields[strings.ToLower(t.text)]
+	if !ok {
+		return nil, p.errorf(t, "unknown field %s", t)
+	}
+
+	negated := false
+	if p.peek().isKeyword("not") {
+		p.advance()
+		negated = true
+		if !p.peek().isKeyword("in") {
+			return nil, p.errorf(p.peek(), "expected \"in\" but found %s", p.peek())
+		}
+	}
+
+	if p.peek().isKeyword("in") {
+		p.advance()
+		if open := p.advance(); open.kind != tokenLBracket {
+			return nil, p.errorf(open, "expected \"[\" but found %s", open)
+		}
+		var values []interface{}
+		for {
+			v, err := p.parseValue(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if len(values) > maxFilterInValues {
+				return nil, p.errorf(t, "more than %d values in list", maxFilterInValues)
+			}
+			sep := p.advance()
+			if sep.kind == tokenRBracket {
+				break
+			}
+			if sep.kind != tokenComma {
+				return nil, p.errorf(sep, "expected \",\" or \"]\" but found %s", sep)
+			}
+		}
+		var expr FilterExpr = FilterIn{Column: field.Column, Values: values}
+		if negated {
+			expr = FilterNot{expr}
+		}
+		return expr, nil
+	}
+
+	op := p.advance()
+	if op.kind != tokenOperator {
+		return nil, p.errorf(op, "expected an operator but found %s", op)
+	}
+	operator := op.text
+	if operator == "!=" {
+		operator = "<>"
+	}
+	if operator == "~" && field.Type != FilterString {
+		return nil, p.errorf(op, "\"~\" only applies to text fields")
+	}
+
+	v, err := p.parseValue(field.Type)
+	if err != nil {
+		return nil, err
+	}
+	return FilterComparison{Column: field.Column, Op: operator, Value: v}, nil
+}
+
+func (p *filterParser) parseValue(fieldType FilterFieldType) (interface{}, error) {
+	t := p.advance()
+
+	switch fieldType {
+	case FilterString:
+		if t.kind == tokenString {
+			return t.text, nil
+		}
+	case FilterInt:
+		if t.kind == tokenNumber {
+			v, err := strconv.ParseInt(t.text, 10, 32)
+			if err != nil {
+				return nil, p.errorf(t, "integer %s out of range", t)
+			}
+			return v, nil
+		}
+	case FilterUint:
+		if t.kind == tokenNumber {
+			v, err := strconv.ParseUint(t.text, 10, 32)
+			if err != nil {
+				return nil, p.errorf(t, "invalid unsigned integer %s", t)
+			}
+			return v, nil
+		}
+	case FilterTime:
+		if t.kind == tokenString {
+			v, err := time.Parse(time.RFC3339, t.text)
+			if err != nil {
+				return nil, p.errorf(t, "invalid date %s, expected RFC3339", t)
+			}
+			return v, nil
+		}
+	}
+
+	return nil, p.errorf(t, "expected %s value but found %s", withArticle(fieldType.String()), t)
+}
+
+// withArticle prefixes word with its indefinite article, as in "an integer".
+func withArticle(word string) string {
+	if word != "" && strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an " + word
+	}
+	return "a " + word
+}
+
+func (p *filterParser) enter(t filterToken) error {
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return p.errorf(t, "filter nested deeper than %d levels", maxFilterDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) leave() {
+	p.depth--
+}
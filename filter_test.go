@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestParseFilterValueErrors(t *testing.T) {
+	tests := []struct {
+		filter  string
+		message string
+	}{
+		{`age="x"`, `expected an integer value but found "x"`},
+		{`name=1`, `expected a string value but found "1"`},
+		{`date=1`, `expected a date value but found "1"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.filter)
+		filterErr, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("%s: got %v, want a filter error", tt.filter, err)
+			continue
+		}
+		if filterErr.Message != tt.message {
+			t.Errorf("%s: got %q, want %q", tt.filter, filterErr.Message, tt.message)
+		}
+	}
+}
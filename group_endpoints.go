@@ -0,0 +1,316 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GroupEndpointHandler struct {
+	groupUsecaseHandler GroupUsecase
+}
+
+func (h *GroupEndpointHandler) Post() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPost(c)
+	}
+}
+
+func (h *GroupEndpointHandler) Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGet(c)
+	}
+}
+
+func (h *GroupEndpointHandler) GetOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetOne(c)
+	}
+}
+
+func (h *GroupEndpointHandler) PutOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPutOne(c)
+	}
+}
+
+func (h *GroupEndpointHandler) DeleteOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDeleteOne(c)
+	}
+}
+
+func (h *GroupEndpointHandler) AddMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultAddMember(c)
+	}
+}
+
+func (h *GroupEndpointHandler) RemoveMember() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultRemoveMember(c)
+	}
+}
+
+func (h *GroupEndpointHandler) Subgroups() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultSubgroups(c)
+	}
+}
+
+func (h *GroupEndpointHandler) AddSubgroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultAddSubgroup(c)
+	}
+}
+
+func (h *GroupEndpointHandler) RemoveSubgroup() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultRemoveSubgroup(c)
+	}
+}
+
+// usecases are the ones of the tenant set by ResolveTenant.
+func (h *GroupEndpointHandler) usecases(c *gin.Context) GroupUsecase {
+	return h.groupUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+// group loads the group given by GetID, replying when it can't.
+func (h *GroupEndpointHandler) group(c *gin.Context) (*Group, bool) {
+	group, err := h.usecases(c).Get(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return nil, false
+	}
+	return group, true
+}
+
+// idParam reads the id of a member from the name param of the path or form.
+func idParam(c *gin.Context, name string) (uint, bool) {
+	param := c.Param(name)
+	if param == "" {
+		var ok bool
+		if param, ok = c.GetPostForm(name); !ok {
+			ErrorReply(c, http.StatusBadRequest, "Parameter "+name+" missing")
+			return 0, false
+		}
+	}
+
+	id, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		ErrorReply(c, http.StatusBadRequest, "Invalid value for "+name)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func (h *GroupEndpointHandler) defaultPost(c *gin.Context) {
+
+	name, ok := c.GetPostForm("name")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
+		return
+	}
+
+	group, err := h.usecases(c).Create(name, c.PostForm("description"))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Header("Location", "/groups/"+strconv.FormatUint(uint64(group.ID), 10))
+	c.JSON(http.StatusCreated, gin.H{"group": group})
+}
+
+func (h *GroupEndpointHandler) defaultGet(c *gin.Context) {
+
+	groups, err := h.usecases(c).List()
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+func (h *GroupEndpointHandler) defaultGetOne(c *gin.Context) {
+
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+func (h *GroupEndpointHandler) defaultPutOne(c *gin.Context) {
+
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if param, ok := c.GetPostForm("name"); ok {
+		updates["Name"] = param
+	}
+	if param, ok := c.GetPostForm("description"); ok {
+		updates["Description"] = param
+	}
+
+	group, err := h.usecases(c).Update(group, updates)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+func (h *GroupEndpointHandler) defaultDeleteOne(c *gin.Context) {
+
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	if err := h.usecases(c).Delete(group); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func (h *GroupEndpointHandler) defaultAddMember(c *gin.Context) {
+
+	userID, ok := idParam(c, "user")
+	if !ok {
+		return
+	}
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	if err := h.usecases(c).AddMember(group, userID); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{})
+}
+
+func (h *GroupEndpointHandler) defaultRemoveMember(c *gin.Context) {
+
+	userID, ok := idParam(c, "user")
+	if !ok {
+		return
+	}
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	if err := h.usecases(c).RemoveMember(group, userID); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+func (h *GroupEndpointHandler) defaultSubgroups(c *gin.Context) {
+
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	subgroups, err := h.usecases(c).Subgroups(group)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": subgroups})
+}
+
+func (h *GroupEndpointHandler) defaultAddSubgroup(c *gin.Context) {
+
+	childID, ok := idParam(c, "group")
+	if !ok {
+		return
+	}
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	if err := h.usecases(c).AddSubgroup(group, childID); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{})
+}
+
+func (h *GroupEndpointHandler) defaultRemoveSubgroup(c *gin.Context) {
+
+	childID, ok := idParam(c, "group")
+	if !ok {
+		return
+	}
+	group, ok := h.group(c)
+	if !ok {
+		return
+	}
+
+	if err := h.usecases(c).RemoveSubgroup(group, childID); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
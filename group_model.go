@@ -0,0 +1,74 @@
+package main
+
+import "time"
+
+// Group is a team of users of a tenant. Groups nest: the members of a
+// subgroup are members of its parents too.
+type Group struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	TenantID    uint   `gorm:"not null;unique_index:uix_groups_tenant_id_name" json:"-"`
+	Name        string `gorm:"type:varchar(63);unique_index:uix_groups_tenant_id_name"` // used by group= and token claims
+	Description string
+}
+
+// GroupMember is a user belonging directly to a group.
+type GroupMember struct {
+	GroupID   uint `gorm:"primary_key;auto_increment:false"`
+	UserID    uint `gorm:"primary_key;auto_increment:false"`
+	CreatedAt time.Time
+}
+
+// GroupSubgroup nests the child group into the parent one.
+type GroupSubgroup struct {
+	ParentID  uint `gorm:"primary_key;auto_increment:false"`
+	ChildID   uint `gorm:"primary_key;auto_increment:false"`
+	CreatedAt time.Time
+}
+
+// GroupTree is the nesting of the groups of a tenant, by parent group.
+type GroupTree map[uint][]uint
+
+// Descendants are the groups nested in id at any depth, id included.
+func (t GroupTree) Descendants(id uint) []uint {
+	seen := map[uint]bool{id: true}
+	result := []uint{id}
+	for i := 0; i < len(result); i++ {
+		for _, child := range t[result[i]] {
+			if !seen[child] {
+				seen[child] = true
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+// Ancestors are the groups ids is nested in at any depth, ids included.
+func (t GroupTree) Ancestors(ids []uint) []uint {
+	parents := map[uint][]uint{}
+	for parent, children := range t {
+		for _, child := range children {
+			parents[child] = append(parents[child], parent)
+		}
+	}
+
+	seen := map[uint]bool{}
+	var result []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	for i := 0; i < len(result); i++ {
+		for _, parent := range parents[result[i]] {
+			if !seen[parent] {
+				seen[parent] = true
+				result = append(result, parent)
+			}
+		}
+	}
+	return result
+}
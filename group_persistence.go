@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+)
+
+type GroupPersistence interface {
+	CreateGroup(group *Group) error
+	FindGroup(id uint) (*Group, error)
+	FindGroupByName(tenantID uint, name string) (*Group, error)
+	ListGroups(tenantID uint) ([]Group, error)
+	UpdateGroup(group *Group, updates map[string]interface{}) error
+	// DeleteGroup also deletes its memberships and nesting
+	DeleteGroup(group *Group) error
+	AddMember(groupID uint, userID uint) error
+	RemoveMember(groupID uint, userID uint) error
+	// UserGroups are the groups userID belongs to directly
+	UserGroups(userID uint) ([]uint, error)
+	AddSubgroup(parentID uint, childID uint) error
+	RemoveSubgroup(parentID uint, childID uint) error
+	GroupTree(tenantID uint) (GroupTree, error)
+}
+
+var errGroupNotFound = Error{Code: http.StatusNotFound, Message: "Group not found"}
+
+var errGroupNameInUse = Error{Code: http.StatusConflict, Message: "Name is already in use"}
+
+var errAlreadyMember = Error{Code: http.StatusConflict, Message: "Already a member of the group"}
+
+var errNotMember = Error{Code: http.StatusNotFound, Message: "Not a member of the group"}
+
+func (h *PersistenceHandler) CreateGroup(group *Group) error {
+	if err := h.DB.Create(group).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errGroupNameInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) FindGroup(id uint) (*Group, error) {
+	var group Group
+
+	r := h.DB.First(&group, id)
+	if r.RecordNotFound() {
+		return nil, errGroupNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &group, nil
+}
+
+func (h *PersistenceHandler) FindGroupByName(tenantID uint, name string) (*Group, error) {
+	var group Group
+
+	r := h.DB.Where("tenant_id = ? AND name = ?", tenantID, name).First(&group)
+	if r.RecordNotFound() {
+		return nil, errGroupNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &group, nil
+}
+
+func (h *PersistenceHandler) ListGroups(tenantID uint) ([]Group, error) {
+	var groups []Group
+
+	if err := h.DB.Where("tenant_id = ?", tenantID).Order("name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func (h *PersistenceHandler) UpdateGroup(group *Group, updates map[string]interface{}) error {
+	if err := h.DB.Model(group).Updates(updates).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errGroupNameInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) DeleteGroup(group *Group) error {
+	return h.Transaction(func(tx Persistence) error {
+		db := tx.(*PersistenceHandler).DB
+		if err := db.Where("group_id = ?", group.ID).Delete(GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("parent_id = ? OR child_id = ?", group.ID, group.ID).Delete(GroupSubgroup{}).Error; err != nil {
+			return err
+		}
+		return db.Delete(group).Error
+	})
+}
+
+func (h *PersistenceHandler) AddMember(groupID uint, userID uint) error {
+	if err := h.DB.Create(&GroupMember{GroupID: groupID, UserID: userID}).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errAlreadyMember
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) RemoveMember(groupID uint, userID uint) error {
+	r := h.DB.Where("group_id = ? AND user_id = ?", groupID, userID).Delete(GroupMember{})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errNotMember
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) UserGroups(userID uint) ([]uint, error) {
+	var ids []uint
+	if err := h.DB.Model(&GroupMember{}).Where("user_id = ?", userID).Pluck("group_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (h *PersistenceHandler) AddSubgroup(parentID uint, childID uint) error {
+	if err := h.DB.Create(&GroupSubgroup{ParentID: parentID, ChildID: childID}).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errAlreadyMember
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) RemoveSubgroup(parentID uint, childID uint) error {
+	r := h.DB.Where("parent_id = ? AND child_id = ?", parentID, childID).Delete(GroupSubgroup{})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errNotMember
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) GroupTree(tenantID uint) (GroupTree, error) {
+	var ids []uint
+	if err := h.DB.Model(&Group{}).Where("tenant_id = ?", tenantID).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	tree := GroupTree{}
+	if len(ids) == 0 {
+		return tree, nil
+	}
+
+	var subgroups []GroupSubgroup
+	if err := h.DB.Where("parent_id IN (?)", ids).Find(&subgroups).Error; err != nil {
+		return nil, err
+	}
+	for _, s := range subgroups {
+		tree[s.ParentID] = append(tree[s.ParentID], s.ChildID)
+	}
+
+	return tree, nil
+}
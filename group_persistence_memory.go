@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateGroup(group *Group) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isGroupNameInUse(group.TenantID, group.Name, 0) {
+		return errGroupNameInUse
+	}
+
+	h.nextGroupID++
+	group.ID = h.nextGroupID
+	now := time.Now()
+	group.CreatedAt, group.UpdatedAt = now, now
+
+	stored := *group
+	h.groups[group.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindGroup(id uint) (*Group, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.groups[id]
+	if !ok {
+		return nil, errGroupNotFound
+	}
+
+	group := *stored
+	return &group, nil
+}
+
+func (h *MemoryPersistence) FindGroupByName(tenantID uint, name string) (*Group, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.groups {
+		if stored.TenantID == tenantID && stored.Name == name {
+			group := *stored
+			return &group, nil
+		}
+	}
+	return nil, errGroupNotFound
+}
+
+func (h *MemoryPersistence) ListGroups(tenantID uint) ([]Group, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var groups []Group
+	for _, stored := range h.groups {
+		if stored.TenantID == tenantID {
+			groups = append(groups, *stored)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (h *MemoryPersistence) UpdateGroup(group *Group, updates map[string]interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.groups[group.ID]
+	if !ok {
+		return errGroupNotFound
+	}
+
+	updated := *stored
+	for key, value := range updates {
+		switch key {
+		case "Name":
+			updated.Name = value.(string)
+		case "Description":
+			updated.Description = value.(string)
+		}
+	}
+	if h.isGroupNameInUse(updated.TenantID, updated.Name, updated.ID) {
+		return errGroupNameInUse
+	}
+	updated.UpdatedAt = time.Now()
+
+	*stored = updated
+	*group = updated
+	return nil
+}
+
+func (h *MemoryPersistence) DeleteGroup(group *Group) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.groups, group.ID)
+	delete(h.groupMembers, group.ID)
+	delete(h.subgroups, group.ID)
+	for _, children := range h.subgroups {
+		delete(children, group.ID)
+	}
+	return nil
+}
+
+func (h *MemoryPersistence) AddMember(groupID uint, userID uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return addEdge(h.groupMembers, groupID, userID)
+}
+
+func (h *MemoryPersistence) RemoveMember(groupID uint, userID uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return removeEdge(h.groupMembers, groupID, userID)
+}
+
+func (h *MemoryPersistence) UserGroups(userID uint) ([]uint, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var ids []uint
+	for groupID, members := range h.groupMembers {
+		if members[userID] {
+			ids = append(ids, groupID)
+		}
+	}
+	return ids, nil
+}
+
+func (h *MemoryPersistence) AddSubgroup(parentID uint, childID uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return addEdge(h.subgroups, parentID, childID)
+}
+
+func (h *MemoryPersistence) RemoveSubgroup(parentID uint, childID uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return removeEdge(h.subgroups, parentID, childID)
+}
+
+func (h *MemoryPersistence) GroupTree(tenantID uint) (GroupTree, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tree := GroupTree{}
+	for parentID, children := range h.subgroups {
+		if group, ok := h.groups[parentID]; !ok || group.TenantID != tenantID {
+			continue
+		}
+		for childID := range children {
+			tree[parentID] = append(tree[parentID], childID)
+		}
+	}
+	return tree, nil
+}
+
+func (h *MemoryPersistence) isGroupNameInUse(tenantID uint, name string, exceptID uint) bool {
+	for id, g := range h.groups {
+		if id != exceptID && g.TenantID == tenantID && g.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// memberIDs are the users belonging directly to any of groupIDs.
+func (h *MemoryPersistence) memberIDs(groupIDs []uint) map[uint]bool {
+	ids := map[uint]bool{}
+	for _, groupID := range groupIDs {
+		for userID := range h.groupMembers[groupID] {
+			ids[userID] = true
+		}
+	}
+	return ids
+}
+
+func addEdge(edges map[uint]map[uint]bool, from uint, to uint) error {
+	if edges[from] == nil {
+		edges[from] = map[uint]bool{}
+	}
+	if edges[from][to] {
+		return errAlreadyMember
+	}
+	edges[from][to] = true
+	return nil
+}
+
+func removeEdge(edges map[uint]map[uint]bool, from uint, to uint) error {
+	if !edges[from][to] {
+		return errNotMember
+	}
+	delete(edges[from], to)
+	return nil
+}
+
+// resolveMembers replaces the FilterMember nodes of filter with the ids of the
+// members, which evaluateFilter can check on each model.
+func (h *MemoryPersistence) resolveMembers(filter FilterExpr) FilterExpr {
+	switch e := filter.(type) {
+	case FilterAnd:
+		terms := make(FilterAnd, len(e))
+		for i, term := range e {
+			terms[i] = h.resolveMembers(term)
+		}
+		return terms
+	case FilterOr:
+		terms := make(FilterOr, len(e))
+		for i, term := range e {
+			terms[i] = h.resolveMembers(term)
+		}
+		return terms
+	case FilterNot:
+		return FilterNot{Expr: h.resolveMembers(e.Expr)}
+	case FilterMember:
+		var values []interface{}
+		for id := range h.memberIDs(e.GroupIDs) {
+			values = append(values, uint64(id))
+		}
+		return FilterIn{Column: "id", Values: values}
+	}
+	return filter
+}
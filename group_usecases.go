@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+type GroupUsecase interface {
+	// ForTenant returns the usecases confined to the groups and users of a tenant
+	ForTenant(tenantID uint) GroupUsecase
+	Create(name string, description string) (*Group, error)
+	Get(id uint) (*Group, error)
+	List() ([]Group, error)
+	Update(group *Group, updates map[string]interface{}) (*Group, error)
+	Delete(group *Group) error
+	AddMember(group *Group, userID uint) error
+	RemoveMember(group *Group, userID uint) error
+	Subgroups(group *Group) ([]Group, error)
+	AddSubgroup(group *Group, childID uint) error
+	RemoveSubgroup(group *Group, childID uint) error
+}
+
+type GroupUsecaseHandler struct {
+	groupPersistence   GroupPersistence
+	persistenceHandler Persistence
+	tenantID           uint
+}
+
+func (h *GroupUsecaseHandler) ForTenant(tenantID uint) GroupUsecase {
+	return &GroupUsecaseHandler{h.groupPersistence, ScopeToTenant(h.persistenceHandler, tenantID), tenantID}
+}
+
+// groupNamePattern keeps names usable in group= and token claims as they are.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+var errInvalidGroupName = Error{Code: http.StatusBadRequest, Message: "Invalid value for name, use up to 63 lower case letters, digits, dots, dashes and underscores"}
+
+func (h *GroupUsecaseHandler) Create(name string, description string) (*Group, error) {
+
+	if !groupNamePattern.MatchString(name) {
+		return nil, errInvalidGroupName
+	}
+
+	group := Group{TenantID: h.tenantID, Name: name, Description: description}
+	if err := h.groupPersistence.CreateGroup(&group); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return &group, nil
+}
+
+func (h *GroupUsecaseHandler) Get(id uint) (*Group, error) {
+
+	group, err := h.groupPersistence.FindGroup(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if group.TenantID != h.tenantID {
+		return nil, errGroupNotFound
+	}
+
+	return group, nil
+}
+
+func (h *GroupUsecaseHandler) List() ([]Group, error) {
+
+	groups, err := h.groupPersistence.ListGroups(h.tenantID)
+	if err != nil {
+		panic(err)
+	}
+
+	return groups, nil
+}
+
+func (h *GroupUsecaseHandler) Update(group *Group, updates map[string]interface{}) (*Group, error) {
+
+	if len(updates) == 0 {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Nothing to update"}
+	}
+	if name, ok := updates["Name"]; ok && !groupNamePattern.MatchString(name.(string)) {
+		return nil, errInvalidGroupName
+	}
+
+	if err := h.groupPersistence.UpdateGroup(group, updates); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return group, nil
+}
+
+func (h *GroupUsecaseHandler) Delete(group *Group) error {
+
+	if err := h.groupPersistence.DeleteGroup(group); err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+func (h *GroupUsecaseHandler) AddMember(group *Group, userID uint) error {
+
+	if _, err := h.persistenceHandler.FindOne(userID); err != nil {
+		if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+			return Error{Code: http.StatusNotFound, Message: "User not found"}
+		}
+		panic(err)
+	}
+
+	if err := h.groupPersistence.AddMember(group.ID, userID); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		panic(err)
+	}
+
+	return nil
+}
+
+func (h *GroupUsecaseHandler) RemoveMember(group *Group, userID uint) error {
+
+	if err := h.groupPersistence.RemoveMember(group.ID, userID); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		panic(err)
+	}
+
+	return nil
+}
+
+// Subgroups are the groups nested directly in group.
+func (h *GroupUsecaseHandler) Subgroups(group *Group) ([]Group, error) {
+
+	tree, err := h.groupPersistence.GroupTree(h.tenantID)
+	if err != nil {
+		panic(err)
+	}
+
+	children := map[uint]bool{}
+	for _, id := range tree[group.ID] {
+		children[id] = true
+	}
+
+	groups, err := h.List()
+	if err != nil {
+		return nil, err
+	}
+	subgroups := []Group{}
+	for _, g := range groups {
+		if children[g.ID] {
+			subgroups = append(subgroups, g)
+		}
+	}
+
+	return subgroups, nil
+}
+
+// AddSubgroup nests a group of the tenant into group, unless group already is
+// nested in it at any depth, which would make a cycle.
+func (h *GroupUsecaseHandler) AddSubgroup(group *Group, childID uint) error {
+
+	child, err := h.Get(childID)
+	if err != nil {
+		return err
+	}
+
+	tree, err := h.groupPersistence.GroupTree(h.tenantID)
+	if err != nil {
+		panic(err)
+	}
+	for _, id := range tree.Descendants(child.ID) {
+		if id == group.ID {
+			return Error{Code: http.StatusConflict, Message: "The group would end up nested in itself"}
+		}
+	}
+
+	if err := h.groupPersistence.AddSubgroup(group.ID, child.ID); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		panic(err)
+	}
+
+	return nil
+}
+
+func (h *GroupUsecaseHandler) RemoveSubgroup(group *Group, childID uint) error {
+
+	if err := h.groupPersistence.RemoveSubgroup(group.ID, childID); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		panic(err)
+	}
+
+	return nil
+}
+
+// memberFilter matches the members of group, with nested those of the groups
+// nested in it too.
+func memberFilter(groups GroupPersistence, group *Group, nested bool) (FilterExpr, error) {
+	ids := []uint{group.ID}
+	if nested {
+		tree, err := groups.GroupTree(group.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		ids = tree.Descendants(group.ID)
+	}
+	return FilterMember{GroupIDs: ids}, nil
+}
+
+// groupNames are the names of the groups user belongs to, directly or through
+// the groups nested in them.
+func groupNames(groups GroupPersistence, user *Model) ([]string, error) {
+	direct, err := groups.UserGroups(user.ID)
+	if err != nil || len(direct) == 0 {
+		return nil, err
+	}
+
+	tree, err := groups.GroupTree(user.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	member := map[uint]bool{}
+	for _, id := range tree.Ancestors(direct) {
+		member[id] = true
+	}
+
+	all, err := groups.ListGroups(user.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, g := range all {
+		if member[g.ID] {
+			names = append(names, g.Name)
+		}
+	}
+	return names, nil
+}
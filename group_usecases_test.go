@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+)
+
+// createTestGroups creates a group of each name in the default tenant.
+func createTestGroups(t *testing.T, groups GroupUsecase, names ...string) []*Group {
+	var created []*Group
+	for _, name := range names {
+		group, err := groups.Create(name, "")
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		created = append(created, group)
+	}
+	return created
+}
+
+func newTestGroups(store *MemoryPersistence) GroupUsecase {
+	return (&GroupUsecaseHandler{store, store, 0}).ForTenant(defaultTenantID)
+}
+
+func TestGroupSubgroupCycles(t *testing.T) {
+	store := NewMemoryPersistence()
+	groups := newTestGroups(store)
+	created := createTestGroups(t, groups, "a", "b", "c", "d")
+	a, b, c, d := created[0], created[1], created[2], created[3]
+
+	// a > b > c
+	if err := groups.AddSubgroup(a, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.AddSubgroup(b, c.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := groups.ForTenant(defaultTenantID+1).Create("other", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		parent   *Group
+		child    uint
+		wantCode int
+	}{
+		{"itself", a, a.ID, http.StatusConflict},
+		{"its parent", b, a.ID, http.StatusConflict},
+		{"an ancestor deeper up", c, a.ID, http.StatusConflict},
+		{"a group nested in a child", c, b.ID, http.StatusConflict},
+		{"a group of another tenant", a, other.ID, http.StatusNotFound},
+		{"a group that doesn't exist", a, other.ID + 1, http.StatusNotFound},
+		{"a group nested deeper already", a, c.ID, 0},
+		{"a group in two parents", d, c.ID, 0},
+		{"its other parent", c, d.ID, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		err := groups.AddSubgroup(tt.parent, tt.child)
+		if tt.wantCode == 0 && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if v, ok := err.(Error); tt.wantCode != 0 && (!ok || v.Code != tt.wantCode) {
+			t.Errorf("%s: got %v, want %d", tt.name, err, tt.wantCode)
+		}
+	}
+
+	subgroups, err := groups.Subgroups(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range subgroups {
+		names = append(names, g.Name)
+	}
+	sort.Strings(names)
+	if !equalStrings(names, []string{"b", "c"}) {
+		t.Errorf("subgroups of a are %v", names)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	store := NewMemoryPersistence()
+	groups := newTestGroups(store)
+	created := createTestGroups(t, groups, "a", "b", "c", "d")
+	a, b, c, d := created[0], created[1], created[2], created[3]
+	for _, edge := range [][2]*Group{{a, b}, {b, c}, {d, c}} {
+		if err := groups.AddSubgroup(edge[0], edge[1].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := createTestModels(t, store, "alice", "bob", "carol", "dave", "nobody")
+	for i, group := range created {
+		if err := groups.AddMember(group, users[i].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := groups.AddMember(a, users[2].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &Model{TenantID: defaultTenantID + 1, Email: "eve@example.com", Name: "eve"}
+	if err := store.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.AddMember(a, other.ID); err == nil {
+		t.Error("added a user of another tenant")
+	}
+
+	tests := []struct {
+		group  *Group
+		nested bool
+		want   []string
+	}{
+		{a, false, []string{"alice", "carol"}},
+		{a, true, []string{"alice", "bob", "carol"}},
+		{b, true, []string{"bob", "carol"}},
+		{c, true, []string{"carol"}},
+		{d, false, []string{"dave"}},
+		{d, true, []string{"carol", "dave"}},
+	}
+	for _, tt := range tests {
+		filter, err := memberFilter(store, tt.group, tt.nested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		models, err := store.Find(filter, Ordering{Column: "id"}, Page{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := modelNames(models); !equalStrings(names, tt.want) {
+			t.Errorf("members of %s (nested %t) are %v, want %v", tt.group.Name, tt.nested, names, tt.want)
+		}
+	}
+
+	names, err := groupNames(store, users[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !equalStrings(names, []string{"a", "b", "c", "d"}) {
+		t.Errorf("carol is in %v", names)
+	}
+	if names, _ := groupNames(store, users[4]); len(names) != 0 {
+		t.Errorf("nobody is in %v", names)
+	}
+
+	if err := groups.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	filter, _ := memberFilter(store, a, true)
+	if models, _ := store.Find(filter, Ordering{Column: "id"}, Page{}, nil); !equalStrings(modelNames(models), []string{"alice", "carol"}) {
+		t.Errorf("members of a after deleting b are %v", modelNames(models))
+	}
+}
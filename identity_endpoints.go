@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type IdentityEndpointHandler struct {
+	identityUsecaseHandler IdentityUsecase
+}
+
+// providerLoginCookie carries the state of a login with a provider, so the
+// callback only finishes logins started by the same browser.
+const providerLoginCookie = "provider_login"
+
+func (h *IdentityEndpointHandler) GetProviders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetProviders(c)
+	}
+}
+
+func (h *IdentityEndpointHandler) Login(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultLogin(c, config)
+	}
+}
+
+func (h *IdentityEndpointHandler) Callback(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultCallback(c, config)
+	}
+}
+
+func (h *IdentityEndpointHandler) SAMLMetadata() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultSAMLMetadata(c)
+	}
+}
+
+func (h *IdentityEndpointHandler) SAMLLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultSAMLLogin(c)
+	}
+}
+
+func (h *IdentityEndpointHandler) AssertionConsumer(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultAssertionConsumer(c, config)
+	}
+}
+
+func (h *IdentityEndpointHandler) Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGet(c)
+	}
+}
+
+func (h *IdentityEndpointHandler) DeleteOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDeleteOne(c)
+	}
+}
+
+func (h *IdentityEndpointHandler) usecases(c *gin.Context) IdentityUsecase {
+	return h.identityUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+func (h *IdentityEndpointHandler) defaultGetProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": h.identityUsecaseHandler.Providers()})
+}
+
+// defaultLogin sends the user to log in at the provider, in the tenant of the
+// request.
+func (h *IdentityEndpointHandler) defaultLogin(c *gin.Context, config *Config) {
+
+	redirect, state, err := h.usecases(c).StartLogin(c.Param("provider"))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     providerLoginCookie,
+		Value:    state,
+		Path:     "/providers",
+		MaxAge:   int(config.Federation.LoginExpiryInSeconds),
+		Secure:   strings.HasPrefix(config.Issuer, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// loggedIn hands the token of a user who logged in with a provider, or a
+// link, to the return page in the fragment, which isn't sent to servers, or
+// as JSON without one.
+func loggedIn(c *gin.Context, config *Config, token string, user *Model) {
+	if config.Federation.ReturnURL != "" {
+		c.Redirect(http.StatusFound, config.Federation.ReturnURL+"#"+url.Values{"token": {token}}.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": token, "user": user})
+}
+
+// loginFailed tells the return page why a login with a provider failed, the
+// way loggedIn hands it tokens.
+func loginFailed(c *gin.Context, config *Config, code int, err string, description string) {
+	if config.Federation.ReturnURL != "" {
+		fragment := url.Values{"error": {err}, "error_description": {description}}
+		c.Redirect(http.StatusFound, config.Federation.ReturnURL+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(code, gin.H{"msg": description})
+}
+
+// secondFactorRequired hands the return page the options of the assertion
+// /webauthn/login/finish takes to finish a login, the way loginFailed does.
+func secondFactorRequired(c *gin.Context, config *Config, required SecondFactorRequired) {
+	webAuthn := gin.H{"publicKey": required.Options}
+	if config.Federation.ReturnURL != "" {
+		options, err := json.Marshal(webAuthn)
+		if err != nil {
+			panic(err)
+		}
+		fragment := url.Values{"error": {"second_factor_required"}, "error_description": {RequestMessage(c, errSecondFactorRequired)}, "webauthn": {string(options)}}
+		c.Redirect(http.StatusFound, config.Federation.ReturnURL+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"msg": RequestMessage(c, errSecondFactorRequired), "webauthn": webAuthn})
+}
+
+// defaultCallback logs in the user the provider sent back.
+func (h *IdentityEndpointHandler) defaultCallback(c *gin.Context, config *Config) {
+
+	state := c.Query("state")
+	cookie, _ := c.Cookie(providerLoginCookie)
+	http.SetCookie(c.Writer, &http.Cookie{Name: providerLoginCookie, Path: "/providers", MaxAge: -1})
+
+	if upstream := c.Query("error"); upstream != "" {
+		loginFailed(c, config, http.StatusBadRequest, upstream, "The identity provider didn't log the user in")
+		return
+	}
+	if state == "" || state != cookie {
+		loginFailed(c, config, http.StatusBadRequest, "invalid_request", RequestMessage(c, errProviderLoginNotFound))
+		return
+	}
+	code, ok := c.GetQuery("code")
+	if !ok {
+		loginFailed(c, config, http.StatusBadRequest, "invalid_request", "Parameter code missing")
+		return
+	}
+
+	token, user, err := h.identityUsecaseHandler.FinishLogin(c.Param("provider"), state, code)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			loginFailed(c, config, v.Code, "access_denied", RequestMessage(c, v))
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	loggedIn(c, config, token, user)
+}
+
+func (h *IdentityEndpointHandler) defaultSAMLMetadata(c *gin.Context) {
+
+	metadata, err := h.identityUsecaseHandler.SAMLMetadata(c.Param("provider"))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// samlPostForm posts a SAML request from the browser, which is how the
+// HTTP-POST binding sends it.
+var samlPostForm = template.Must(template.New("saml").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.URL}}">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// defaultSAMLLogin sends the user to log in at the SAML provider, in the
+// tenant of the provider.
+func (h *IdentityEndpointHandler) defaultSAMLLogin(c *gin.Context) {
+
+	request, err := h.identityUsecaseHandler.StartSAMLLogin(c.Param("provider"))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	if !request.Post {
+		c.Redirect(http.StatusFound, request.URL)
+		return
+	}
+	var page bytes.Buffer
+	if err := samlPostForm.Execute(&page, request); err != nil {
+		panic(err)
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// defaultAssertionConsumer logs in the user of the SAML response the
+// provider posted, or redirected with, replying like defaultCallback.
+func (h *IdentityEndpointHandler) defaultAssertionConsumer(c *gin.Context, config *Config) {
+
+	response, ok := c.GetPostForm("SAMLResponse")
+	deflated := false
+	if c.Request.Method == http.MethodGet {
+		response, ok = c.GetQuery("SAMLResponse")
+		deflated = true
+	}
+	if !ok {
+		loginFailed(c, config, http.StatusBadRequest, "invalid_request", "Parameter SAMLResponse missing")
+		return
+	}
+
+	token, user, err := h.identityUsecaseHandler.FinishSAMLLogin(c.Param("provider"), response, deflated)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			loginFailed(c, config, v.Code, "access_denied", RequestMessage(c, v))
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	loggedIn(c, config, token, user)
+}
+
+// defaultGet lists the identities linked to the authenticated user.
+func (h *IdentityEndpointHandler) defaultGet(c *gin.Context) {
+
+	identities, err := h.usecases(c).ListIdentities(c.MustGet("authenticatedID").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+func (h *IdentityEndpointHandler) defaultDeleteOne(c *gin.Context) {
+
+	if err := h.usecases(c).Unlink(c.MustGet("authenticatedID").(uint), c.MustGet("id").(uint)); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+)
+
+// Identity links a user to its account at an identity provider, by the
+// subject the provider knows it by.
+type Identity struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	TenantID  uint   `gorm:"not null;unique_index:uix_identities_tenant_id_provider_subject" json:"-"`
+	UserID    uint   `gorm:"not null;index"`
+	Provider  string `gorm:"type:varchar(64);unique_index:uix_identities_tenant_id_provider_subject"`
+	Subject   string `gorm:"type:varchar(255);unique_index:uix_identities_tenant_id_provider_subject"`
+	Email     string `gorm:"type:varchar(254)"` // the one the provider claimed when linking
+}
+
+// ProviderLogin is a login with an identity provider, from the redirect of
+// the user to it until it comes back, used once. Only the hash of its state,
+// or of the ID of the request of SAML logins, is stored.
+type ProviderLogin struct {
+	ID           uint `gorm:"primary_key"`
+	CreatedAt    time.Time
+	StateHash    string `gorm:"type:varchar(64);unique_index"`
+	Provider     string `gorm:"type:varchar(64)"`
+	TenantID     uint
+	Nonce        string `gorm:"type:varchar(64)"`
+	CodeVerifier string `gorm:"type:varchar(64)"`
+	ExpiresAt    time.Time
+}
+
+// SAMLAssertion is an assertion a SAML identity provider logged a user in
+// with, kept until it expires so it's used once.
+type SAMLAssertion struct {
+	ID        string `gorm:"primary_key;type:varchar(128)"`
+	CreatedAt time.Time
+	Provider  string `gorm:"type:varchar(64)"`
+	ExpiresAt time.Time
+}
+
+func (SAMLAssertion) TableName() string {
+	return "saml_assertions"
+}
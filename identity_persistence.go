@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type IdentityPersistence interface {
+	// CreateIdentity fails with errIdentityInUse when the subject is linked
+	// to a user of the tenant already
+	CreateIdentity(identity *Identity) error
+	FindIdentity(tenantID uint, provider string, subject string) (*Identity, error)
+	ListIdentities(userID uint) ([]Identity, error)
+	DeleteIdentity(identity *Identity) error
+
+	// CreateProviderLogin forgets the expired logins first
+	CreateProviderLogin(login *ProviderLogin) error
+	// UseProviderLogin deletes the login with stateHash and returns it,
+	// failing with errProviderLoginNotFound if it was used already.
+	UseProviderLogin(stateHash string) (*ProviderLogin, error)
+
+	// UseSAMLAssertion keeps assertion until it expires, forgetting the ones
+	// that did, and fails with errSAMLAssertionUsed if it was used already.
+	UseSAMLAssertion(assertion *SAMLAssertion) error
+}
+
+var errIdentityNotFound = Error{Code: http.StatusNotFound, Message: "Identity not found"}
+
+var errIdentityInUse = Error{Code: http.StatusConflict, Message: "The identity is linked to another user"}
+
+var errProviderLoginNotFound = Error{Code: http.StatusBadRequest, Message: "Invalid, expired or used login, start over"}
+
+var errSAMLAssertionUsed = Error{Code: http.StatusBadRequest, Message: "The SAML response was used already, start over"}
+
+func (h *PersistenceHandler) CreateIdentity(identity *Identity) error {
+	if err := h.DB.Create(identity).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errIdentityInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) FindIdentity(tenantID uint, provider string, subject string) (*Identity, error) {
+	var identity Identity
+
+	r := h.DB.Where("tenant_id = ? AND provider = ? AND subject = ?", tenantID, provider, subject).First(&identity)
+	if r.RecordNotFound() {
+		return nil, errIdentityNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &identity, nil
+}
+
+func (h *PersistenceHandler) ListIdentities(userID uint) ([]Identity, error) {
+	var identities []Identity
+
+	if err := h.DB.Where("user_id = ?", userID).Order("id").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (h *PersistenceHandler) DeleteIdentity(identity *Identity) error {
+	return h.DB.Delete(identity).Error
+}
+
+func (h *PersistenceHandler) CreateProviderLogin(login *ProviderLogin) error {
+	if err := h.DB.Where("expires_at < ?", time.Now()).Delete(ProviderLogin{}).Error; err != nil {
+		return err
+	}
+	return h.DB.Create(login).Error
+}
+
+func (h *PersistenceHandler) UseProviderLogin(stateHash string) (*ProviderLogin, error) {
+	var login ProviderLogin
+
+	r := h.DB.Where("state_hash = ?", stateHash).First(&login)
+	if r.RecordNotFound() {
+		return nil, errProviderLoginNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	// Of concurrent uses, only the one deleting it gets it
+	r = h.DB.Where("id = ?", login.ID).Delete(ProviderLogin{})
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	if r.RowsAffected == 0 {
+		return nil, errProviderLoginNotFound
+	}
+
+	return &login, nil
+}
+
+func (h *PersistenceHandler) UseSAMLAssertion(assertion *SAMLAssertion) error {
+	if err := h.DB.Where("expires_at < ?", time.Now()).Delete(SAMLAssertion{}).Error; err != nil {
+		return err
+	}
+	if err := h.DB.Create(assertion).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errSAMLAssertionUsed
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateIdentity(identity *Identity) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, stored := range h.identities {
+		if stored.TenantID == identity.TenantID && stored.Provider == identity.Provider && stored.Subject == identity.Subject {
+			return errIdentityInUse
+		}
+	}
+
+	h.nextIdentityID++
+	identity.ID = h.nextIdentityID
+	identity.CreatedAt = time.Now()
+
+	stored := *identity
+	h.identities[identity.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindIdentity(tenantID uint, provider string, subject string) (*Identity, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.identities {
+		if stored.TenantID == tenantID && stored.Provider == provider && stored.Subject == subject {
+			identity := *stored
+			return &identity, nil
+		}
+	}
+	return nil, errIdentityNotFound
+}
+
+func (h *MemoryPersistence) ListIdentities(userID uint) ([]Identity, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var identities []Identity
+	for _, stored := range h.identities {
+		if stored.UserID == userID {
+			identities = append(identities, *stored)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+	return identities, nil
+}
+
+func (h *MemoryPersistence) DeleteIdentity(identity *Identity) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.identities, identity.ID)
+	return nil
+}
+
+func (h *MemoryPersistence) CreateProviderLogin(login *ProviderLogin) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for hash, stored := range h.providerLogins {
+		if stored.ExpiresAt.Before(now) {
+			delete(h.providerLogins, hash)
+		}
+	}
+
+	h.nextProviderLoginID++
+	login.ID = h.nextProviderLoginID
+	login.CreatedAt = now
+
+	stored := *login
+	h.providerLogins[login.StateHash] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) UseProviderLogin(stateHash string) (*ProviderLogin, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.providerLogins[stateHash]
+	if !ok {
+		return nil, errProviderLoginNotFound
+	}
+	delete(h.providerLogins, stateHash)
+
+	login := *stored
+	return &login, nil
+}
+
+func (h *MemoryPersistence) UseSAMLAssertion(assertion *SAMLAssertion) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for id, stored := range h.samlAssertions {
+		if stored.ExpiresAt.Before(now) {
+			delete(h.samlAssertions, id)
+		}
+	}
+
+	if _, ok := h.samlAssertions[assertion.ID]; ok {
+		return errSAMLAssertionUsed
+	}
+	assertion.CreatedAt = now
+
+	stored := *assertion
+	h.samlAssertions[assertion.ID] = &stored
+	return nil
+}
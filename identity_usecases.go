@@ -0,0 +1,394 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+type IdentityUsecase interface {
+	// ForTenant returns the usecases confined to the users of a tenant
+	ForTenant(tenantID uint) IdentityUsecase
+	// Providers are the names of the identity providers users can log in with
+	Providers() []string
+	// StartLogin returns where to send the user to log in with provider,
+	// and the state it comes back with
+	StartLogin(provider string) (string, string, error)
+	// FinishLogin logs in the user who came back from provider with state
+	// and code, in the tenant the login started at, linking or creating it
+	// first if needed
+	FinishLogin(provider string, state string, code string) (string, *Model, error)
+	SAMLMetadata(provider string) ([]byte, error)
+	// StartSAMLLogin returns the request sending the user to log in with the
+	// SAML provider, in its tenant
+	StartSAMLLogin(provider string) (*SAMLRequest, error)
+	// FinishSAMLLogin logs in the user of the SAML response the provider
+	// sent back, the way FinishLogin does
+	FinishSAMLLogin(provider string, response string, deflated bool) (string, *Model, error)
+	ListIdentities(userID uint) ([]Identity, error)
+	Unlink(userID uint, id uint) error
+}
+
+type IdentityUsecaseHandler struct {
+	identityPersistence IdentityPersistence
+	persistenceHandler  Persistence
+	tenantPersistence   TenantPersistence
+	usecaseHandler      Usecase
+	issuer              *TokenIssuer
+	providers           map[string]*Provider
+	samlProviders       map[string]*SAMLProvider
+	config              *Config
+	tenantID            uint
+}
+
+func (h *IdentityUsecaseHandler) ForTenant(tenantID uint) IdentityUsecase {
+	return &IdentityUsecaseHandler{h.identityPersistence, h.persistenceHandler, h.tenantPersistence, h.usecaseHandler, h.issuer, h.providers, h.samlProviders, h.config, tenantID}
+}
+
+var errProviderNotFound = Error{Code: http.StatusNotFound, Message: "Identity provider not found"}
+
+func (h *IdentityUsecaseHandler) Providers() []string {
+
+	names := []string{}
+	for name := range h.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (h *IdentityUsecaseHandler) StartLogin(provider string) (string, string, error) {
+
+	p, ok := h.providers[provider]
+	if !ok {
+		return "", "", errProviderNotFound
+	}
+
+	state, stateHash := newOpaqueToken()
+	nonce, _ := newOpaqueToken()
+	codeVerifier, _ := newOpaqueToken()
+	redirect, err := p.AuthCodeURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	login := ProviderLogin{
+		StateHash:    stateHash,
+		Provider:     provider,
+		TenantID:     h.tenantID,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(time.Duration(h.config.Federation.LoginExpiryInSeconds) * time.Second),
+	}
+	if err := h.identityPersistence.CreateProviderLogin(&login); err != nil {
+		panic(err)
+	}
+
+	return redirect, state, nil
+}
+
+// FinishLogin trusts the emails the provider verified, so its users log in
+// to the users with their email, linking them. Otherwise they'd have to log
+// in as them first, which the users it creates can't, having no password.
+func (h *IdentityUsecaseHandler) FinishLogin(provider string, state string, code string) (string, *Model, error) {
+
+	p, ok := h.providers[provider]
+	if !ok {
+		return "", nil, errProviderNotFound
+	}
+
+	login, err := h.identityPersistence.UseProviderLogin(hashOpaqueToken(state))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, err
+		}
+		panic(err)
+	}
+	if login.Provider != provider || !time.Now().Before(login.ExpiresAt) {
+		return "", nil, errProviderLoginNotFound
+	}
+
+	external, err := p.Exchange(code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	user, err := h.ForTenant(login.TenantID).(*IdentityUsecaseHandler).linkedUser(provider, external)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := h.issuer.LoginToken(user)
+	if err != nil {
+		panic(err)
+	}
+
+	return token, user, nil
+}
+
+func (h *IdentityUsecaseHandler) SAMLMetadata(provider string) ([]byte, error) {
+
+	p, ok := h.samlProviders[provider]
+	if !ok {
+		return nil, errProviderNotFound
+	}
+
+	return p.Metadata(), nil
+}
+
+func (h *IdentityUsecaseHandler) StartSAMLLogin(provider string) (*SAMLRequest, error) {
+
+	p, ok := h.samlProviders[provider]
+	if !ok {
+		return nil, errProviderNotFound
+	}
+	tenantID, err := h.samlTenant(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs can't start with a digit
+	token, _ := newOpaqueToken()
+	id := "_" + token
+	request, err := p.AuthnRequest(id)
+	if err != nil {
+		panic(err)
+	}
+
+	login := ProviderLogin{
+		StateHash: hashOpaqueToken(id),
+		Provider:  provider,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(time.Duration(h.config.Federation.LoginExpiryInSeconds) * time.Second),
+	}
+	if err := h.identityPersistence.CreateProviderLogin(&login); err != nil {
+		panic(err)
+	}
+
+	return request, nil
+}
+
+// FinishSAMLLogin takes the responses to the requests of StartSAMLLogin,
+// once, and the ones of logins the provider initiated if it's allowed to.
+func (h *IdentityUsecaseHandler) FinishSAMLLogin(provider string, response string, deflated bool) (string, *Model, error) {
+
+	p, ok := h.samlProviders[provider]
+	if !ok {
+		return "", nil, errProviderNotFound
+	}
+
+	login, err := p.ParseResponse(response, deflated)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var tenantID uint
+	if login.InResponseTo != "" {
+		started, err := h.identityPersistence.UseProviderLogin(hashOpaqueToken(login.InResponseTo))
+		if err != nil {
+			if _, ok := err.(Error); ok {
+				return "", nil, err
+			}
+			panic(err)
+		}
+		if started.Provider != provider || !time.Now().Before(started.ExpiresAt) {
+			return "", nil, errProviderLoginNotFound
+		}
+		tenantID = started.TenantID
+	} else {
+		if !p.AllowIdPInitiated {
+			return "", nil, Error{Code: http.StatusBadRequest, Message: "Logins must start at the service, not at the identity provider"}
+		}
+		if tenantID, err = h.samlTenant(p); err != nil {
+			return "", nil, err
+		}
+	}
+
+	assertion := SAMLAssertion{ID: login.AssertionID, Provider: provider, ExpiresAt: login.ExpiresAt}
+	if err := h.identityPersistence.UseSAMLAssertion(&assertion); err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, err
+		}
+		panic(err)
+	}
+
+	user, err := h.ForTenant(tenantID).(*IdentityUsecaseHandler).linkedUser(provider, login.User)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := h.issuer.LoginToken(user)
+	if err != nil {
+		panic(err)
+	}
+
+	return token, user, nil
+}
+
+// samlTenant is the tenant the users of p log in to.
+func (h *IdentityUsecaseHandler) samlTenant(p *SAMLProvider) (uint, error) {
+
+	slug := p.Tenant
+	if slug == "" {
+		slug = h.config.Tenants.Default
+	}
+	tenant, err := h.tenantPersistence.FindTenantBySlug(slug)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return 0, err
+		}
+		panic(err)
+	}
+
+	return tenant.ID, nil
+}
+
+// linkedUser is the user the identity of external is linked to, linking it
+// to the user with its email when both verified it, or to a new user, when
+// there's none.
+func (h *IdentityUsecaseHandler) linkedUser(provider string, external *ExternalUser) (*Model, error) {
+
+	identity, err := h.identityPersistence.FindIdentity(h.tenantID, provider, external.Subject)
+	switch err.(type) {
+	case nil:
+		user, err := ScopeToTenant(h.persistenceHandler, h.tenantID).FindOne(identity.UserID)
+		if err == nil {
+			return user, nil
+		}
+		if _, ok := err.(Error); !ok {
+			panic(err)
+		}
+		// The user was deleted since, so the identity is linked again
+		if err := h.identityPersistence.DeleteIdentity(identity); err != nil {
+			panic(err)
+		}
+	case Error:
+	default:
+		panic(err)
+	}
+
+	if external.Email == "" {
+		return nil, Error{Code: http.StatusBadRequest, Message: "The identity provider didn't share the email of the user"}
+	}
+	users := h.usecaseHandler.ForTenant(h.tenantID)
+	email, err := ValidateString("email", external.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := FilterComparison{Column: "email", Op: "=", Value: email}
+	existing, err := users.Find(filter, Ordering{Column: "id"}, Page{Limit: 1}, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *Model
+	if len(existing.Models) > 0 {
+		if !external.EmailVerified {
+			return nil, Error{Code: http.StatusConflict, Message: "A user has the email of this identity, which the identity provider didn't verify"}
+		}
+		// Whoever signed up with an email first could otherwise take over
+		// the account of its owner
+		if !existing.Models[0].EmailVerified {
+			return nil, Error{Code: http.StatusConflict, Message: "A user has the email of this identity, which the user didn't verify"}
+		}
+		user = &existing.Models[0]
+	} else {
+		if user, err = createExternalUser(users, external); err != nil {
+			return nil, err
+		}
+	}
+
+	if external.EmailVerified && !user.EmailVerified {
+		if user, err = users.UpdateOne(user, map[string]interface{}{"EmailVerified": true}); err != nil {
+			return nil, err
+		}
+	}
+
+	identity = &Identity{TenantID: h.tenantID, UserID: user.ID, Provider: provider, Subject: external.Subject, Email: external.Email}
+	if err := h.identityPersistence.CreateIdentity(identity); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return user, nil
+}
+
+// createExternalUser provisions the user of external without a password, so
+// it only logs in with its identity providers, or the directory it's from.
+func createExternalUser(users Usecase, external *ExternalUser) (*Model, error) {
+
+	var age uint
+	var number int
+	var date time.Time
+	attributes := map[string]string{}
+	for field, value := range external.Fields {
+		var err error
+		switch field {
+		case "age":
+			age, err = ParseAgeFromString(value)
+		case "number":
+			number, err = ParseNumberFromString(value)
+		case "date":
+			date, err = ParseDateFromString(value)
+		default:
+			attributes[field] = value
+		}
+		if err != nil {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for " + field + " from the identity provider"}
+		}
+	}
+
+	return users.Create(external.Email, "", external.Name, age, number, date, attributes)
+}
+
+func (h *IdentityUsecaseHandler) ListIdentities(userID uint) ([]Identity, error) {
+
+	identities, err := h.identityPersistence.ListIdentities(userID)
+	if err != nil {
+		panic(err)
+	}
+
+	return identities, nil
+}
+
+// Unlink keeps the last identity of users without a password, so they can
+// still log in.
+func (h *IdentityUsecaseHandler) Unlink(userID uint, id uint) error {
+
+	identities, err := h.identityPersistence.ListIdentities(userID)
+	if err != nil {
+		panic(err)
+	}
+	var identity *Identity
+	for i := range identities {
+		if identities[i].ID == id {
+			identity = &identities[i]
+		}
+	}
+	if identity == nil {
+		return errIdentityNotFound
+	}
+
+	if len(identities) == 1 {
+		user, err := ScopeToTenant(h.persistenceHandler, h.tenantID).FindOne(userID)
+		if err != nil {
+			if _, ok := err.(Error); ok {
+				return err
+			}
+			panic(err)
+		}
+		if user.Password == "" {
+			return Error{Code: http.StatusConflict, Message: "The only identity of a user without a password can't be unlinked"}
+		}
+	}
+
+	if err := h.identityPersistence.DeleteIdentity(identity); err != nil {
+		panic(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Imports read users from CSV, with a header row naming the columns, or from
+// JSON Lines, one object per line with the same keys:
+//
+//	email,password,name,age,number,date
+//	ann@x.com,secret123,Annabel,30,3,2000-01-01T00:00:00Z
+//
+// Instead of password a row can carry password_hash and protection_scheme, a
+// password protected by another system with one of the supported schemes. The
+// attributes of the profile schema are columns named after their field.
+//
+// Rows are validated like a signup and written in batches, one transaction
+// each. A batch that fails is retried row by row so every row gets a result.
+
+const (
+	ImportCSV   = "csv"
+	ImportJSONL = "jsonl"
+)
+
+// What to do with a row whose email belongs to an existing user.
+const (
+	ImportSkip   = "skip"
+	ImportUpsert = "upsert"
+	ImportFail   = "fail"
+)
+
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+	ImportFailed  = "failed"
+)
+
+var importColumns = map[string]bool{
+	"email":             true,
+	"password":          true,
+	"password_hash":     true,
+	"protection_scheme": true,
+	"name":              true,
+	"age":               true,
+	"number":            true,
+	"date":              true,
+}
+
+func isImportColumn(name string) bool {
+	_, isAttribute := profileSchema.byName[name]
+	return importColumns[name] || isAttribute
+}
+
+type ImportOptions struct {
+	Format     string
+	OnConflict string
+}
+
+type ImportRowResult struct {
+	Line   int
+	Email  string
+	Status string
+	ID     uint   `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+type ImportReport struct {
+	Created int
+	Updated int
+	Skipped int
+	Failed  int
+	Rows    []ImportRowResult
+}
+
+type importRow struct {
+	line   int
+	fields map[string]string
+}
+
+// importUser is a validated row ready to be written.
+type importUser struct {
+	model    *Model
+	password string // plain text password, protected right before writing
+}
+
+func (h *UsecaseHandler) Import(r io.Reader, options ImportOptions) (*ImportReport, error) {
+
+	switch options.OnConflict {
+	case ImportSkip, ImportUpsert, ImportFail:
+	default:
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for onConflict, use skip, upsert or fail"}
+	}
+
+	rows, err := parseImport(r, options.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := ImportReport{Rows: make([]ImportRowResult, len(rows))}
+
+	batchSize := h.config.Import.BatchSize
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		users := h.prepareImport(rows[start:end], report.Rows[start:end])
+		h.writeImport(users, report.Rows[start:end], options.OnConflict)
+	}
+
+	for _, row := range report.Rows {
+		switch row.Status {
+		case ImportCreated:
+			report.Created++
+		case ImportUpdated:
+			report.Updated++
+		case ImportSkipped:
+			report.Skipped++
+		case ImportFailed:
+			report.Failed++
+		}
+	}
+
+	return &report, nil
+}
+
+// prepareImport validates rows, marking the invalid ones as failed, and
+// protects the plain text passwords of the others in parallel.
+func (h *UsecaseHandler) prepareImport(rows []importRow, results []ImportRowResult) []*importUser {
+
+	users := make([]*importUser, len(rows))
+	for i, row := range rows {
+		results[i] = ImportRowResult{Line: row.line, Email: row.fields["email"]}
+		user, err := h.importUserFromRow(row)
+		if err != nil {
+			results[i].Status = ImportFailed
+			results[i].Error = err.Error()
+			continue
+		}
+		users[i] = user
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, runtime.NumCPU())
+	for _, user := range users {
+		if user == nil || user.password == "" {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(user *importUser) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			protectedForm, err := h.ProtectedFormFromPassword(user.password)
+			if err != nil {
+				panic(err)
+			}
+			user.model.Password = protectedForm
+			user.model.ProtectionScheme = defaultProtectionScheme
+		}(user)
+	}
+	wg.Wait()
+
+	return users
+}
+
+func (h *UsecaseHandler) importUserFromRow(row importRow) (*importUser, error) {
+
+	var err error
+	fields := row.fields
+
+	for _, column := range []string{"email", "name", "age", "number", "date"} {
+		if fields[column] == "" {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Parameter " + column + " missing"}
+		}
+	}
+
+	model := Model{Email: fields["email"], Name: fields["name"]}
+	attributes := profileSchema.Params(func(key string) (string, bool) {
+		value, ok := fields[key]
+		return value, ok && value != ""
+	}, true)
+	if model.Attributes, err = profileSchema.Parse(attributes); err != nil {
+		return nil, err
+	}
+	if model.Age, err = ParseAgeFromString(fields["age"]); err != nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for age"}
+	}
+	if model.Number, err = ParseNumberFromString(fields["number"]); err != nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for number"}
+	}
+	if model.Date, err = ParseDateFromString(fields["date"]); err != nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for date"}
+	}
+
+	if err := h.validateModel(&model); err != nil {
+		return nil, err
+	}
+
+	user := importUser{model: &model}
+	switch {
+	case fields["password"] != "" && fields["password_hash"] != "":
+		return nil, Error{Code: http.StatusBadRequest, Message: "Use either password or password_hash"}
+	case fields["password"] != "":
+		user.password = fields["password"]
+	case fields["password_hash"] != "":
+		scheme := fields["protection_scheme"]
+		if scheme == "" {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Parameter protection_scheme missing"}
+		}
+		if err := ValidateProtectedForm(scheme, fields["password_hash"]); err != nil {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for password_hash: " + err.Error()}
+		}
+		model.Password = fields["password_hash"]
+		model.ProtectionScheme = scheme
+	default:
+		return nil, Error{Code: http.StatusBadRequest, Message: "Parameter password missing"}
+	}
+
+	return &user, nil
+}
+
+// writeImport writes a batch in a single transaction. If it fails, every row
+// is written again in a transaction of its own to find out which ones fail.
+func (h *UsecaseHandler) writeImport(users []*importUser, results []ImportRowResult, onConflict string) {
+
+	attempt := make([]ImportRowResult, len(results))
+	copy(attempt, results)
+
+	err := h.persistenceHandler.Transaction(func(tx Persistence) error {
+		for i, user := range users {
+			if user == nil {
+				continue
+			}
+			if err := h.writeImportUser(tx, user, &attempt[i], onConflict); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		copy(results, attempt)
+		return
+	}
+
+	for i, user := range users {
+		if user == nil {
+			continue
+		}
+		result := results[i]
+		err := h.persistenceHandler.Transaction(func(tx Persistence) error {
+			return h.writeImportUser(tx, user, &result, onConflict)
+		})
+		if err != nil {
+			result.Status = ImportFailed
+			result.Error = err.Error()
+			result.ID = 0
+		}
+		results[i] = result
+	}
+}
+
+func (h *UsecaseHandler) writeImportUser(tx Persistence, user *importUser, result *ImportRowResult, onConflict string) error {
+
+	model := *user.model
+
+	filter := FilterComparison{Column: "email", Op: "=", Value: model.Email}
+	existing, err := tx.Find(filter, Ordering{Column: "id"}, Page{Limit: 1}, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		if err := tx.Create(&model); err != nil {
+			return err
+		}
+		result.Status = ImportCreated
+		result.ID = model.ID
+		return nil
+	}
+
+	result.ID = existing[0].ID
+	switch onConflict {
+	case ImportSkip:
+		result.Status = ImportSkipped
+	case ImportFail:
+		result.Status = ImportFailed
+		result.Error = errEmailInUse.Message
+	case ImportUpsert:
+		updates := map[string]interface{}{
+			"Name":             model.Name,
+			"Age":              model.Age,
+			"Number":           model.Number,
+			"Date":             model.Date,
+			"Password":         model.Password,
+			"ProtectionScheme": model.ProtectionScheme,
+			"Attributes":       AttributeUpdates(model.Attributes),
+		}
+		if err := tx.UpdateFields(&existing[0], updates); err != nil {
+			return err
+		}
+		result.Status = ImportUpdated
+	}
+	return nil
+}
+
+// parseImport reads every row up front, so that a malformed input is rejected
+// before anything is written.
+func parseImport(r io.Reader, format string) ([]importRow, error) {
+	switch format {
+	case ImportCSV:
+		return parseImportCSV(r)
+	case ImportJSONL:
+		return parseImportJSONL(r)
+	}
+	return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for format, use csv or jsonl"}
+}
+
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid CSV: missing header row"}
+	}
+	if err != nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid CSV: " + err.Error()}
+	}
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if !isImportColumn(header[i]) {
+			return nil, Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid CSV: unknown column %q", column)}
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Invalid CSV: " + err.Error()}
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := importRow{line: line, fields: map[string]string{}}
+		for i, value := range record {
+			row.fields[header[i]] = strings.TrimSpace(value)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func parseImportJSONL(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var object map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&object); err != nil {
+			return nil, Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON on line %d: %v", line, err)}
+		}
+
+		row := importRow{line: line, fields: map[string]string{}}
+		for key, value := range object {
+			if !isImportColumn(key) {
+				return nil, Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON on line %d: unknown key %q", line, key)}
+			}
+			switch v := value.(type) {
+			case nil:
+			case string:
+				row.fields[key] = strings.TrimSpace(v)
+			case json.Number:
+				row.fields[key] = v.String()
+			case bool:
+				row.fields[key] = strconv.FormatBool(v)
+			default:
+				return nil, Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid JSON on line %d: %q must be a string, a number or a boolean", line, key)}
+			}
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid JSON Lines: " + err.Error()}
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type InvitationEndpointHandler struct {
+	invitationUsecaseHandler InvitationUsecase
+}
+
+func (h *InvitationEndpointHandler) Post() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPost(c)
+	}
+}
+
+func (h *InvitationEndpointHandler) Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGet(c)
+	}
+}
+
+func (h *InvitationEndpointHandler) Resend() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultResend(c)
+	}
+}
+
+func (h *InvitationEndpointHandler) Revoke() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultRevoke(c)
+	}
+}
+
+func (h *InvitationEndpointHandler) Accept(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultAccept(c, config)
+	}
+}
+
+// usecases are the ones of the tenant set by ResolveTenant.
+func (h *InvitationEndpointHandler) usecases(c *gin.Context) InvitationUsecase {
+	return h.invitationUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+func (h *InvitationEndpointHandler) defaultPost(c *gin.Context) {
+
+	email, ok := c.GetPostForm("email")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter email missing")
+		return
+	}
+
+	roles, err := ParseRoles(c.PostForm("roles"))
+	if err != nil {
+		v := err.(Error)
+		ErrorReply(c, v.Code, RequestMessage(c, v))
+		return
+	}
+	if len(roles) > 0 && !canGrant(c, nil, roles) {
+		ErrorReply(c, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	groups := GroupIDs{}
+	for _, param := range strings.Split(c.PostForm("groups"), ",") {
+		if param = strings.TrimSpace(param); param == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for groups")
+			return
+		}
+		groups = append(groups, uint(id))
+	}
+
+	invitation, err := h.usecases(c).Create(email, roles, groups, c.MustGet("authenticatedID").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invitation": invitation})
+}
+
+func (h *InvitationEndpointHandler) defaultGet(c *gin.Context) {
+
+	invitations, err := h.usecases(c).List()
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+func (h *InvitationEndpointHandler) defaultResend(c *gin.Context) {
+
+	invitation, err := h.usecases(c).Resend(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitation": invitation})
+}
+
+func (h *InvitationEndpointHandler) defaultRevoke(c *gin.Context) {
+
+	invitation, err := h.usecases(c).Revoke(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitation": invitation})
+}
+
+// defaultAccept takes the params of a signup, but the email of the invitation.
+func (h *InvitationEndpointHandler) defaultAccept(c *gin.Context, config *Config) {
+
+	token, ok := c.GetPostForm("token")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter token missing")
+		return
+	}
+	params, ok := newUserParams(c, false, config.MagicLinks.Passwordless)
+	if !ok {
+		return
+	}
+
+	attributes := profileSchema.Params(c.GetPostForm, false)
+
+	model, err := h.invitationUsecaseHandler.Accept(c.MustGet("id").(uint), token, params.password, params.name, params.age, params.number, params.date, attributes)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"model": model})
+}
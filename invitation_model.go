@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+)
+
+// Invitation lets someone create its own user, with the email, roles and
+// groups an admin chose, through a single use link. Only the hash of the
+// token in the link is stored.
+type Invitation struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	TenantID   uint     `gorm:"not null;index" json:"-"`
+	Email      string   `gorm:"type:varchar(255)"`
+	Roles      Roles    `gorm:"type:text"`
+	Groups     GroupIDs `gorm:"type:text"`
+	InvitedBy  uint
+	TokenHash  string `gorm:"type:varchar(64)" json:"-"`
+	ExpiresAt  time.Time
+	SentAt     *time.Time
+	AcceptedAt *time.Time
+	RevokedAt  *time.Time
+	UserID     *uint // the user created on acceptance
+}
+
+func (i *Invitation) State(now time.Time) string {
+	switch {
+	case i.AcceptedAt != nil:
+		return InvitationAccepted
+	case i.RevokedAt != nil:
+		return InvitationRevoked
+	case !now.Before(i.ExpiresAt):
+		return InvitationExpired
+	}
+	return InvitationPending
+}
+
+// MarshalJSON adds the state of the invitation.
+func (i Invitation) MarshalJSON() ([]byte, error) {
+	type invitation Invitation
+	return json.Marshal(struct {
+		invitation
+		State string
+	}{invitation(i), i.State(time.Now())})
+}
+
+// GroupIDs are the ids of groups, stored as a JSON array.
+type GroupIDs []uint
+
+func (g GroupIDs) Value() (driver.Value, error) {
+	if g == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal([]uint(g))
+	return string(encoded), err
+}
+
+func (g *GroupIDs) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*g = GroupIDs{}
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return errors.New("group ids: can't scan " + reflect.TypeOf(src).String())
+	}
+	if len(raw) == 0 {
+		*g = GroupIDs{}
+		return nil
+	}
+	return json.Unmarshal(raw, (*[]uint)(g))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+)
+
+type InvitationPersistence interface {
+	CreateInvitation(invitation *Invitation) error
+	FindInvitation(id uint) (*Invitation, error)
+	ListInvitations(tenantID uint) ([]Invitation, error)
+	// SavePendingInvitation stores invitation only if it still is pending
+	// with tokenHash, failing with errInvitationNotPending otherwise, so a
+	// link can't be used twice nor after it was resent or revoked.
+	SavePendingInvitation(invitation *Invitation, tokenHash string) error
+	SaveInvitation(invitation *Invitation) error
+}
+
+var errInvitationNotFound = Error{Code: http.StatusNotFound, Message: "Invitation not found"}
+
+var errInvitationNotPending = Error{Code: http.StatusConflict, Message: "The invitation isn't pending anymore"}
+
+func (h *PersistenceHandler) CreateInvitation(invitation *Invitation) error {
+	return h.DB.Create(invitation).Error
+}
+
+func (h *PersistenceHandler) FindInvitation(id uint) (*Invitation, error) {
+	var invitation Invitation
+
+	r := h.DB.First(&invitation, id)
+	if r.RecordNotFound() {
+		return nil, errInvitationNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &invitation, nil
+}
+
+func (h *PersistenceHandler) ListInvitations(tenantID uint) ([]Invitation, error) {
+	var invitations []Invitation
+
+	if err := h.DB.Where("tenant_id = ?", tenantID).Order("id DESC").Find(&invitations).Error; err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func (h *PersistenceHandler) SavePendingInvitation(invitation *Invitation, tokenHash string) error {
+	r := h.DB.Model(&Invitation{}).
+		Where("id = ? AND token_hash = ? AND accepted_at IS NULL AND revoked_at IS NULL", invitation.ID, tokenHash).
+		Updates(invitationColumns(invitation))
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errInvitationNotPending
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) SaveInvitation(invitation *Invitation) error {
+	return h.DB.Model(&Invitation{}).Where("id = ?", invitation.ID).Updates(invitationColumns(invitation)).Error
+}
+
+// invitationColumns are the columns that change after an invitation is
+// created, nil ones included.
+func invitationColumns(invitation *Invitation) map[string]interface{} {
+	return map[string]interface{}{
+		"token_hash":  invitation.TokenHash,
+		"expires_at":  invitation.ExpiresAt,
+		"sent_at":     invitation.SentAt,
+		"accepted_at": invitation.AcceptedAt,
+		"revoked_at":  invitation.RevokedAt,
+		"user_id":     invitation.UserID,
+	}
+}
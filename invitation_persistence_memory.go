@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateInvitation(invitation *Invitation) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextInvitationID++
+	invitation.ID = h.nextInvitationID
+	now := time.Now()
+	invitation.CreatedAt, invitation.UpdatedAt = now, now
+
+	stored := *invitation
+	h.invitations[invitation.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindInvitation(id uint) (*Invitation, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.invitations[id]
+	if !ok {
+		return nil, errInvitationNotFound
+	}
+
+	invitation := *stored
+	return &invitation, nil
+}
+
+func (h *MemoryPersistence) ListInvitations(tenantID uint) ([]Invitation, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var invitations []Invitation
+	for _, stored := range h.invitations {
+		if stored.TenantID == tenantID {
+			invitations = append(invitations, *stored)
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].ID > invitations[j].ID })
+	return invitations, nil
+}
+
+func (h *MemoryPersistence) SavePendingInvitation(invitation *Invitation, tokenHash string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.invitations[invitation.ID]
+	if !ok || stored.TokenHash != tokenHash || stored.AcceptedAt != nil || stored.RevokedAt != nil {
+		return errInvitationNotPending
+	}
+	saveInvitation(stored, invitation)
+	return nil
+}
+
+func (h *MemoryPersistence) SaveInvitation(invitation *Invitation) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stored, ok := h.invitations[invitation.ID]; ok {
+		saveInvitation(stored, invitation)
+	}
+	return nil
+}
+
+// saveInvitation copies the columns PersistenceHandler saves.
+func saveInvitation(stored *Invitation, invitation *Invitation) {
+	stored.TokenHash = invitation.TokenHash
+	stored.ExpiresAt = invitation.ExpiresAt
+	stored.SentAt = invitation.SentAt
+	stored.AcceptedAt = invitation.AcceptedAt
+	stored.RevokedAt = invitation.RevokedAt
+	stored.UserID = invitation.UserID
+	stored.UpdatedAt = time.Now()
+}
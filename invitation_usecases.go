@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InvitationUsecase interface {
+	// ForTenant returns the usecases confined to the invitations of a tenant
+	ForTenant(tenantID uint) InvitationUsecase
+	Create(email string, roles Roles, groups GroupIDs, invitedBy uint) (*Invitation, error)
+	List() ([]Invitation, error)
+	Resend(id uint) (*Invitation, error)
+	Revoke(id uint) (*Invitation, error)
+	// Accept creates the invited user, in the tenant of the invitation
+	Accept(id uint, token string, password string, name string, age uint, number int, date time.Time, attributes map[string]string) (*Model, error)
+}
+
+type InvitationUsecaseHandler struct {
+	invitationPersistence InvitationPersistence
+	groupPersistence      GroupPersistence
+	usecaseHandler        Usecase
+	mailer                Mailer
+	config                *Config
+	tenantID              uint
+}
+
+func (h *InvitationUsecaseHandler) ForTenant(tenantID uint) InvitationUsecase {
+	return &InvitationUsecaseHandler{h.invitationPersistence, h.groupPersistence, h.usecaseHandler, h.mailer, h.config, tenantID}
+}
+
+var errInvitationNotSent = Error{Code: http.StatusBadGateway, Message: "The invitation was saved but couldn't be sent, try resending it"}
+
+func (h *InvitationUsecaseHandler) Create(email string, roles Roles, groups GroupIDs, invitedBy uint) (*Invitation, error) {
+
+	email, err := ValidateString("email", email)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := FilterComparison{Column: "email", Op: "=", Value: email}
+	existing, err := h.usecaseHandler.ForTenant(h.tenantID).Find(filter, Ordering{Column: "id"}, Page{Limit: 1}, false, []string{"id"})
+	if err != nil {
+		return nil, err
+	}
+	if len(existing.Models) > 0 {
+		return nil, errEmailInUse
+	}
+
+	for _, id := range groups {
+		invalid := Error{Code: http.StatusBadRequest, Message: "Invalid group " + strconv.FormatUint(uint64(id), 10)}
+		group, err := h.groupPersistence.FindGroup(id)
+		if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+			return nil, invalid
+		}
+		if err != nil {
+			panic(err)
+		}
+		if group.TenantID != h.tenantID {
+			return nil, invalid
+		}
+	}
+
+	token, hash := newOpaqueToken()
+	invitation := Invitation{
+		TenantID:  h.tenantID,
+		Email:     email,
+		Roles:     roles,
+		Groups:    groups,
+		InvitedBy: invitedBy,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(time.Duration(h.config.Invitations.ExpiryInHours) * time.Hour),
+	}
+	if err := h.invitationPersistence.CreateInvitation(&invitation); err != nil {
+		panic(err)
+	}
+
+	if err := h.send(&invitation, token); err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
+
+func (h *InvitationUsecaseHandler) List() ([]Invitation, error) {
+
+	invitations, err := h.invitationPersistence.ListInvitations(h.tenantID)
+	if err != nil {
+		panic(err)
+	}
+
+	return invitations, nil
+}
+
+func (h *InvitationUsecaseHandler) get(id uint) (*Invitation, error) {
+
+	invitation, err := h.invitationPersistence.FindInvitation(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if invitation.TenantID != h.tenantID {
+		return nil, errInvitationNotFound
+	}
+
+	return invitation, nil
+}
+
+// Resend sends a new link, valid for the whole expiry again, and the previous
+// one stops working.
+func (h *InvitationUsecaseHandler) Resend(id uint) (*Invitation, error) {
+
+	invitation, err := h.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := invitation.TokenHash
+	token, hash := newOpaqueToken()
+	invitation.TokenHash = hash
+	invitation.ExpiresAt = time.Now().Add(time.Duration(h.config.Invitations.ExpiryInHours) * time.Hour)
+	if err := h.invitationPersistence.SavePendingInvitation(invitation, previous); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	if err := h.send(invitation, token); err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+func (h *InvitationUsecaseHandler) Revoke(id uint) (*Invitation, error) {
+
+	invitation, err := h.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invitation.RevokedAt = &now
+	if err := h.invitationPersistence.SavePendingInvitation(invitation, invitation.TokenHash); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return invitation, nil
+}
+
+// Accept claims the invitation before creating the user, so the link can
+// only be used once, and gives it back if the user can't be created.
+func (h *InvitationUsecaseHandler) Accept(id uint, token string, password string, name string, age uint, number int, date time.Time, attributes map[string]string) (*Model, error) {
+
+	invitation, err := h.invitationPersistence.FindInvitation(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashOpaqueToken(token)), []byte(invitation.TokenHash)) != 1 {
+		return nil, errInvitationNotFound
+	}
+
+	now := time.Now()
+	switch invitation.State(now) {
+	case InvitationExpired:
+		return nil, Error{Code: http.StatusGone, Message: "The invitation expired"}
+	case InvitationPending:
+	default:
+		return nil, errInvitationNotPending
+	}
+
+	invitation.AcceptedAt = &now
+	if err := h.invitationPersistence.SavePendingInvitation(invitation, invitation.TokenHash); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	users := h.usecaseHandler.ForTenant(invitation.TenantID)
+	model, err := users.Create(invitation.Email, password, name, age, number, date, attributes)
+	if err != nil {
+		invitation.AcceptedAt = nil
+		if err := h.invitationPersistence.SaveInvitation(invitation); err != nil {
+			panic(err)
+		}
+		return nil, err
+	}
+
+	// The link was sent to the email, so the user owns it
+	updates := map[string]interface{}{"EmailVerified": true}
+	if len(invitation.Roles) > 0 {
+		updates["Roles"] = invitation.Roles
+	}
+	if model, err = users.UpdateOne(model, updates); err != nil {
+		return nil, err
+	}
+	for _, groupID := range invitation.Groups {
+		// Groups deleted since the invitation was sent are left out
+		if _, err := h.groupPersistence.FindGroup(groupID); err != nil {
+			continue
+		}
+		if err := h.groupPersistence.AddMember(groupID, model.ID); err != nil {
+			panic(err)
+		}
+	}
+
+	invitation.UserID = &model.ID
+	if err := h.invitationPersistence.SaveInvitation(invitation); err != nil {
+		panic(err)
+	}
+
+	return model, nil
+}
+
+// send emails the link of invitation, recording when it was sent.
+func (h *InvitationUsecaseHandler) send(invitation *Invitation, token string) error {
+
+	params := url.Values{}
+	params.Set("invitation", strconv.FormatUint(uint64(invitation.ID), 10))
+	params.Set("token", token)
+	link := h.config.Invitations.LinkURL
+	if strings.Contains(link, "?") {
+		link += "&" + params.Encode()
+	} else {
+		link += "?" + params.Encode()
+	}
+
+	body := fmt.Sprintf("You were invited to create your user.\n\nSet your password with this link before %s:\n\n%s\n",
+		invitation.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), link)
+	if err := h.mailer.Send(invitation.Email, "You're invited", body); err != nil {
+		log.Printf("sending invitation %d: %v", invitation.ID, err)
+		return errInvitationNotSent
+	}
+
+	now := time.Now()
+	invitation.SentAt = &now
+	if err := h.invitationPersistence.SaveInvitation(invitation); err != nil {
+		panic(err)
+	}
+	return nil
+}
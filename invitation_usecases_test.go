@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newTestInvitations returns the invitation usecases of the default tenant,
+// which send their links to mailer.
+func newTestInvitations(store *MemoryPersistence, mailer testMailer) (InvitationUsecase, Usecase) {
+	config := &Config{JwtSecret: "secret", AppName: "test"}
+	config.Invitations.LinkURL = "https://app.example.com/invitation"
+	config.Invitations.ExpiryInHours = 72
+	users := (&UsecaseHandler{store, store, nil, nil, config}).ForTenant(defaultTenantID)
+	invitations := (&InvitationUsecaseHandler{store, store, users, mailer, config, 0}).ForTenant(defaultTenantID)
+	return invitations, users
+}
+
+// sentToken is the token of the invitation link mailer got.
+func sentToken(t *testing.T, mailer testMailer) string {
+	select {
+	case body := <-mailer:
+		link, err := url.Parse(regexp.MustCompile(`https://\S+`).FindString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link.Query().Get("token")
+	case <-time.After(time.Second):
+		t.Fatal("no invitation sent")
+	}
+	return ""
+}
+
+func TestInvitationAccept(t *testing.T) {
+	store := NewMemoryPersistence()
+	mailer := make(testMailer, 1)
+	invitations, _ := newTestInvitations(store, mailer)
+	group, err := newTestGroups(store).Create("staff", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invitation, err := invitations.Create("alice@example.com", Roles{RoleAdmin}, GroupIDs{group.ID}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sentToken(t, mailer)
+
+	if _, err := invitations.Accept(invitation.ID, token+"x", "password", "Alice", 30, 0, time.Time{}, nil); err != errInvitationNotFound {
+		t.Errorf("accepted with another token: %v", err)
+	}
+
+	user, err := invitations.Accept(invitation.ID, token, "password", "Alice", 30, 0, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" || !user.EmailVerified || !user.Roles.Has(RoleAdmin) || user.TenantID != defaultTenantID {
+		t.Errorf("created %+v", user)
+	}
+	if names, _ := groupNames(store, user); !equalStrings(names, []string{"staff"}) {
+		t.Errorf("the user is in %v", names)
+	}
+
+	if _, err := invitations.Accept(invitation.ID, token, "password", "Mallory", 30, 0, time.Time{}, nil); err != errInvitationNotPending {
+		t.Errorf("accepted twice: %v", err)
+	}
+	if _, err := invitations.Create("alice@example.com", nil, nil, 0); err != errEmailInUse {
+		t.Errorf("invited a user again: %v", err)
+	}
+}
+
+func TestInvitationAcceptRollsBack(t *testing.T) {
+	store := NewMemoryPersistence()
+	mailer := make(testMailer, 1)
+	invitations, users := newTestInvitations(store, mailer)
+
+	invitation, err := invitations.Create("alice@example.com", nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sentToken(t, mailer)
+
+	// Someone signed up with the email in the meantime
+	squatter, err := users.Create("alice@example.com", "password", "Squatter", 30, 0, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invitations.Accept(invitation.ID, token, "password", "Alice", 30, 0, time.Time{}, nil); err != errEmailInUse {
+		t.Fatalf("accepted with the email in use: %v", err)
+	}
+	if stored, _ := store.FindInvitation(invitation.ID); stored.State(time.Now()) != InvitationPending {
+		t.Fatalf("the failed accept left the invitation %s", stored.State(time.Now()))
+	}
+
+	if err := store.UpdateFields(squatter, map[string]interface{}{"Email": "squatter@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := invitations.Accept(invitation.ID, token, "password", "Alice", 30, 0, time.Time{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := store.FindInvitation(invitation.ID); stored.State(time.Now()) != InvitationAccepted || stored.UserID == nil || *stored.UserID != user.ID {
+		t.Errorf("accepted as %+v", stored)
+	}
+}
+
+func TestInvitationStates(t *testing.T) {
+	store := NewMemoryPersistence()
+	mailer := make(testMailer, 2)
+	invitations, _ := newTestInvitations(store, mailer)
+
+	tests := []struct {
+		name     string
+		change   func(invitation *Invitation, token string) string
+		wantCode int
+	}{
+		{"pending", func(invitation *Invitation, token string) string { return token }, 0},
+		{"revoked", func(invitation *Invitation, token string) string {
+			if _, err := invitations.Revoke(invitation.ID); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, http.StatusConflict},
+		{"expired", func(invitation *Invitation, token string) string {
+			invitation.ExpiresAt = time.Now().Add(-time.Second)
+			if err := store.SaveInvitation(invitation); err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}, http.StatusGone},
+		{"resent", func(invitation *Invitation, token string) string {
+			if _, err := invitations.Resend(invitation.ID); err != nil {
+				t.Fatal(err)
+			}
+			return sentToken(t, mailer)
+		}, 0},
+		{"resent, with the previous link", func(invitation *Invitation, token string) string {
+			if _, err := invitations.Resend(invitation.ID); err != nil {
+				t.Fatal(err)
+			}
+			sentToken(t, mailer)
+			return token
+		}, http.StatusNotFound},
+		{"of another tenant", func(invitation *Invitation, token string) string {
+			if _, err := invitations.ForTenant(defaultTenantID + 1).Revoke(invitation.ID); err != errInvitationNotFound {
+				t.Errorf("another tenant revoked the invitation: %v", err)
+			}
+			return token
+		}, 0},
+	}
+	for i, tt := range tests {
+		email := "user" + string(rune('a'+i)) + "@example.com"
+		invitation, err := invitations.Create(email, nil, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := tt.change(invitation, sentToken(t, mailer))
+
+		_, err = invitations.Accept(invitation.ID, token, "password", "User", 30, 0, time.Time{}, nil)
+		if tt.wantCode == 0 && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if v, ok := err.(Error); tt.wantCode != 0 && (!ok || v.Code != tt.wantCode) {
+			t.Errorf("%s: got %v, want %d", tt.name, err, tt.wantCode)
+		}
+	}
+
+	if _, err := invitations.Revoke(1); err != errInvitationNotPending {
+		t.Errorf("revoked an accepted invitation: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobEndpointHandler struct {
+	jobUsecaseHandler JobUsecase
+}
+
+func (h *JobEndpointHandler) Post() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPost(c)
+	}
+}
+
+func (h *JobEndpointHandler) GetOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetOne(c)
+	}
+}
+
+func (h *JobEndpointHandler) Cancel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultCancel(c)
+	}
+}
+
+func (h *JobEndpointHandler) Export() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultExport(c)
+	}
+}
+
+// usecases are the ones of the tenant set by ResolveTenant.
+func (h *JobEndpointHandler) usecases(c *gin.Context) JobUsecase {
+	return h.jobUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+func (h *JobEndpointHandler) defaultPost(c *gin.Context) {
+
+	action, ok := c.GetPostForm("action")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter action missing")
+		return
+	}
+
+	params := map[string]string{}
+	for _, key := range updateParams {
+		if param, ok := c.GetPostForm(key); ok {
+			params[key] = param
+		}
+	}
+	for key, param := range profileSchema.Params(c.GetPostForm, true) {
+		params[key] = param
+	}
+
+	confirm := 0
+	if param := c.Query("confirm"); param != "" {
+		var err error
+		confirm, err = strconv.Atoi(param)
+		if err != nil || confirm < 0 {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for confirm")
+			return
+		}
+	}
+
+	filter, _ := c.MustGet("filter").(FilterExpr)
+
+	job, err := h.usecases(c).Create(action, filter, params, confirm)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Header("Location", "/jobs/"+strconv.FormatUint(uint64(job.ID), 10))
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+func (h *JobEndpointHandler) defaultGetOne(c *gin.Context) {
+
+	job, err := h.usecases(c).Get(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+func (h *JobEndpointHandler) defaultCancel(c *gin.Context) {
+
+	job, err := h.usecases(c).Cancel(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+func (h *JobEndpointHandler) defaultExport(c *gin.Context) {
+
+	id := c.MustGet("id").(uint)
+
+	path, err := h.usecases(c).ExportFile(id)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", "attachment; filename=\"users-"+strconv.FormatUint(uint64(id), 10)+".jsonl\"")
+	c.File(path)
+}
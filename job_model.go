@@ -0,0 +1,48 @@
+package main
+
+import "time"
+
+const (
+	JobUpdate = "update"
+	JobDelete = "delete"
+	JobExport = "export"
+)
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a bulk update, delete or export run in the background. Users are
+// handled in batches by ascending id and LastID is the checkpoint: every user
+// matching Filter up to it was already handled.
+type Job struct {
+	ID              uint `gorm:"primary_key"`
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	TenantID        uint   `json:"-"` // whose users the job handles
+	Action          string `gorm:"type:varchar(16)"`
+	Filter          string `gorm:"type:text"`
+	Updates         string `gorm:"type:text"` // JSON object with the update params of update jobs
+	State           string `gorm:"type:varchar(16);index"`
+	Total           int
+	Processed       int
+	Affected        int
+	Failed          int
+	LastID          uint
+	LastError       string `gorm:"type:text"`
+	ResultSize      int64  `json:"-"` // bytes of the export file covered by the checkpoint
+	CancelRequested bool
+	Worker          string     `gorm:"type:varchar(128)" json:"-"`
+	Attempts        int        `json:"-"`
+	HeartbeatAt     *time.Time `json:"-"`
+	StartedAt       *time.Time
+	FinishedAt      *time.Time
+}
+
+func (j *Job) Finished() bool {
+	return j.State == JobSucceeded || j.State == JobFailed || j.State == JobCancelled
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type JobPersistence interface {
+	CreateJob(job *Job) error
+	FindJob(id uint) (*Job, error)
+	// ClaimJob hands worker the oldest pending job, or a running one whose
+	// heartbeat is older than staleBefore. It returns nil when there's none.
+	ClaimJob(worker string, staleBefore time.Time) (*Job, error)
+	// SaveJob stores the progress of a claimed job, failing with errJobLost
+	// when another worker claimed it in the meantime.
+	SaveJob(job *Job) error
+	// CancelJob cancels a pending job right away and asks the worker of a
+	// running one to stop.
+	CancelJob(id uint) (*Job, error)
+}
+
+var errJobNotFound = Error{Code: http.StatusNotFound, Message: "Job not found"}
+
+var errJobLost = Error{Code: http.StatusConflict, Message: "The job was claimed by another worker"}
+
+// jobClaimCandidates bounds the jobs a worker tries to claim per poll; the
+// ones it loses go to the workers that won them.
+const jobClaimCandidates = 10
+
+func (h *PersistenceHandler) CreateJob(job *Job) error {
+	return h.DB.Create(job).Error
+}
+
+func (h *PersistenceHandler) FindJob(id uint) (*Job, error) {
+	var job Job
+
+	r := h.DB.First(&job, id)
+	if r.RecordNotFound() {
+		return nil, errJobNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &job, nil
+}
+
+// ClaimJob takes a job by bumping its attempts only if nobody did it first,
+// so two workers, even in different processes, can't run the same job.
+func (h *PersistenceHandler) ClaimJob(worker string, staleBefore time.Time) (*Job, error) {
+	var candidates []Job
+
+	err := h.DB.Where("state = ? OR (state = ? AND heartbeat_at < ?)", JobPending, JobRunning, staleBefore).
+		Order("id").Limit(jobClaimCandidates).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range candidates {
+		job := &candidates[i]
+		now := time.Now()
+
+		r := h.DB.Model(&Job{}).Where("id = ? AND attempts = ? AND state IN (?)", job.ID, job.Attempts, []string{JobPending, JobRunning}).
+			Updates(map[string]interface{}{
+				"state":        JobRunning,
+				"worker":       worker,
+				"attempts":     job.Attempts + 1,
+				"heartbeat_at": now,
+				"started_at":   gorm.Expr("COALESCE(started_at, ?)", now),
+			})
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if r.RowsAffected == 0 {
+			continue
+		}
+
+		return h.FindJob(job.ID)
+	}
+
+	return nil, nil
+}
+
+func (h *PersistenceHandler) SaveJob(job *Job) error {
+	r := h.DB.Model(&Job{}).Where("id = ? AND attempts = ?", job.ID, job.Attempts).
+		Updates(map[string]interface{}{
+			"state":        job.State,
+			"total":        job.Total,
+			"processed":    job.Processed,
+			"affected":     job.Affected,
+			"failed":       job.Failed,
+			"last_id":      job.LastID,
+			"last_error":   job.LastError,
+			"result_size":  job.ResultSize,
+			"heartbeat_at": job.HeartbeatAt,
+			"finished_at":  job.FinishedAt,
+		})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errJobLost
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) CancelJob(id uint) (*Job, error) {
+	r := h.DB.Model(&Job{}).Where("id = ? AND state = ?", id, JobPending).
+		Updates(map[string]interface{}{"state": JobCancelled, "cancel_requested": true, "finished_at": time.Now()})
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	if r.RowsAffected == 0 {
+		err := h.DB.Model(&Job{}).Where("id = ? AND state = ?", id, JobRunning).Update("cancel_requested", true).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h.FindJob(id)
+}
@@ -0,0 +1,111 @@
+package main
+
+import "time"
+
+func (h *MemoryPersistence) CreateJob(job *Job) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextJobID++
+	job.ID = h.nextJobID
+	now := time.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	stored := *job
+	h.jobs[job.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindJob(id uint) (*Job, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+
+	job := *stored
+	return &job, nil
+}
+
+func (h *MemoryPersistence) ClaimJob(worker string, staleBefore time.Time) (*Job, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var claimed *Job
+	for _, job := range h.jobs {
+		stale := job.State == JobRunning && job.HeartbeatAt != nil && job.HeartbeatAt.Before(staleBefore)
+		if job.State != JobPending && !stale {
+			continue
+		}
+		if claimed == nil || job.ID < claimed.ID {
+			claimed = job
+		}
+	}
+	if claimed == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	claimed.State = JobRunning
+	claimed.Worker = worker
+	claimed.Attempts++
+	claimed.HeartbeatAt = &now
+	if claimed.StartedAt == nil {
+		claimed.StartedAt = &now
+	}
+	claimed.UpdatedAt = now
+
+	job := *claimed
+	return &job, nil
+}
+
+func (h *MemoryPersistence) SaveJob(job *Job) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.jobs[job.ID]
+	if !ok || stored.Attempts != job.Attempts {
+		return errJobLost
+	}
+
+	stored.State = job.State
+	stored.Total = job.Total
+	stored.Processed = job.Processed
+	stored.Affected = job.Affected
+	stored.Failed = job.Failed
+	stored.LastID = job.LastID
+	stored.LastError = job.LastError
+	stored.ResultSize = job.ResultSize
+	stored.HeartbeatAt = job.HeartbeatAt
+	stored.FinishedAt = job.FinishedAt
+	stored.UpdatedAt = time.Now()
+	return nil
+}
+
+func (h *MemoryPersistence) CancelJob(id uint) (*Job, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+
+	now := time.Now()
+	switch stored.State {
+	case JobPending:
+		stored.State = JobCancelled
+		stored.CancelRequested = true
+		stored.FinishedAt = &now
+		stored.UpdatedAt = now
+	case JobRunning:
+		stored.CancelRequested = true
+		stored.UpdatedAt = now
+	}
+
+	job := *stored
+	return &job, nil
+}
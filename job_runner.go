@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JobRunner executes the queued jobs in a pool of workers. Progress is saved
+// after every batch along with a heartbeat, and a running job whose heartbeat
+// went stale, because its process died or restarted, is resumed from its last
+// checkpoint by the next worker that polls.
+type JobRunner struct {
+	jobPersistence     JobPersistence
+	persistenceHandler Persistence
+	config             *Config
+	wake               chan struct{}
+}
+
+func NewJobRunner(jobPersistence JobPersistence, persistenceHandler Persistence, config *Config) *JobRunner {
+	return &JobRunner{
+		jobPersistence:     jobPersistence,
+		persistenceHandler: persistenceHandler,
+		config:             config,
+		wake:               make(chan struct{}, 1),
+	}
+}
+
+func (r *JobRunner) Start() {
+	host, _ := os.Hostname()
+	for i := 0; i < r.config.Jobs.Workers; i++ {
+		go r.work(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i))
+	}
+}
+
+// Notify wakes an idle worker so a new job doesn't wait for the next poll.
+func (r *JobRunner) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *JobRunner) work(worker string) {
+	poll := time.Duration(r.config.Jobs.PollIntervalInSeconds) * time.Second
+	stale := time.Duration(r.config.Jobs.StaleAfterInSeconds) * time.Second
+
+	for {
+		job, err := r.jobPersistence.ClaimJob(worker, time.Now().Add(-stale))
+		if err != nil {
+			log.Printf("job worker %s: %v", worker, err)
+		}
+		if job == nil {
+			select {
+			case <-r.wake:
+			case <-time.After(poll):
+			}
+			continue
+		}
+
+		r.run(job)
+	}
+}
+
+func (r *JobRunner) run(job *Job) {
+	defer func() {
+		if v := recover(); v != nil {
+			r.finish(job, JobFailed, fmt.Sprint(v))
+		}
+	}()
+
+	var filter FilterExpr
+	if job.Filter != "" {
+		var err error
+		filter, err = ParseFilter(job.Filter)
+		if err != nil {
+			r.finish(job, JobFailed, "invalid filter: "+err.Error())
+			return
+		}
+	}
+
+	var updates map[string]interface{}
+	if job.Action == JobUpdate {
+		var params map[string]string
+		err := json.Unmarshal([]byte(job.Updates), &params)
+		if err == nil {
+			updates, err = updatesFromParams(params)
+		}
+		if err != nil {
+			r.finish(job, JobFailed, "invalid updates: "+err.Error())
+			return
+		}
+	}
+
+	// The job only ever sees the users of its tenant
+	users := ScopeToTenant(r.persistenceHandler, job.TenantID)
+
+	var export *os.File
+	if job.Action == JobExport {
+		var err error
+		export, err = r.openExport(job)
+		if err != nil {
+			r.finish(job, JobFailed, err.Error())
+			return
+		}
+		defer export.Close()
+	}
+
+	for {
+		current, err := r.jobPersistence.FindJob(job.ID)
+		if err != nil {
+			// Left running, the job is resumed once its heartbeat goes stale
+			log.Printf("job %d: %v", job.ID, err)
+			return
+		}
+		if current.CancelRequested {
+			r.finish(job, JobCancelled, "")
+			return
+		}
+
+		batch := AndFilters(filter, FilterComparison{Column: "id", Op: ">", Value: uint64(job.LastID)})
+		models, err := users.Find(batch, Ordering{Column: "id"}, Page{Limit: r.config.Jobs.BatchSize}, nil)
+		if err != nil {
+			r.finish(job, JobFailed, err.Error())
+			return
+		}
+		if len(models) == 0 {
+			r.finish(job, JobSucceeded, "")
+			return
+		}
+
+		if job.Action == JobExport {
+			if err := r.exportBatch(job, export, models); err != nil {
+				r.finish(job, JobFailed, err.Error())
+				return
+			}
+		} else {
+			r.writeBatch(users, job, filter, updates, models)
+		}
+
+		job.Processed += len(models)
+		job.LastID = models[len(models)-1].ID
+		if err := r.save(job); err != nil {
+			log.Printf("job %d: %v", job.ID, err)
+			return
+		}
+	}
+}
+
+// writeBatch updates or deletes the users of a batch that still match the
+// filter. When the batch fails as a whole it's retried user by user, so a
+// single bad row is counted as failed instead of stopping the job.
+func (r *JobRunner) writeBatch(users Persistence, job *Job, filter FilterExpr, updates map[string]interface{}, models []Model) {
+	ids := make([]interface{}, len(models))
+	for i, m := range models {
+		ids[i] = uint64(m.ID)
+	}
+
+	affected, err := r.write(users, job.Action, updates, AndFilters(filter, FilterIn{Column: "id", Values: ids}))
+	if err == nil {
+		job.Affected += int(affected)
+		return
+	}
+
+	for _, m := range models {
+		affected, err := r.write(users, job.Action, updates, AndFilters(filter, FilterComparison{Column: "id", Op: "=", Value: uint64(m.ID)}))
+		if err != nil {
+			job.Failed++
+			job.LastError = fmt.Sprintf("user %d: %v", m.ID, err)
+			continue
+		}
+		job.Affected += int(affected)
+	}
+}
+
+func (r *JobRunner) write(users Persistence, action string, updates map[string]interface{}, filter FilterExpr) (int64, error) {
+	if action == JobDelete {
+		return users.DeleteMany(filter)
+	}
+	return users.UpdateMany(updates, filter)
+}
+
+// openExport opens the export file of job positioned at its checkpoint,
+// dropping whatever a previous attempt wrote after it.
+func (r *JobRunner) openExport(job *Job) (*os.File, error) {
+	path := jobExportPath(r.config, job.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(job.ResultSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(job.ResultSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// exportBatch appends the users of a batch as JSON lines, synced before the
+// checkpoint moves past them.
+func (r *JobRunner) exportBatch(job *Job, f *os.File, models []Model) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range models {
+		if err := encoder.Encode(&models[i]); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	job.ResultSize += int64(n)
+	job.Affected += len(models)
+	return nil
+}
+
+func (r *JobRunner) finish(job *Job, state string, message string) {
+	now := time.Now()
+	job.State = state
+	job.FinishedAt = &now
+	if message != "" {
+		job.LastError = message
+	}
+	if err := r.save(job); err != nil {
+		log.Printf("job %d: %v", job.ID, err)
+	}
+}
+
+func (r *JobRunner) save(job *Job) error {
+	now := time.Now()
+	job.HeartbeatAt = &now
+	return r.jobPersistence.SaveJob(job)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJobs returns the job usecases of the default tenant and the runner
+// of their jobs, which tests run by hand instead of starting its workers.
+func newTestJobs(t *testing.T, store *MemoryPersistence, users Persistence) (*JobUsecaseHandler, *JobRunner) {
+	config := &Config{}
+	config.Jobs.BatchSize = 2
+	config.Jobs.StaleAfterInSeconds = 60
+	config.Jobs.ExportDir = t.TempDir()
+	config.Bulk.MaxAffected = 3
+
+	runner := NewJobRunner(store, users, config)
+	jobs := (&JobUsecaseHandler{store, users, runner, config, 0}).ForTenant(defaultTenantID).(*JobUsecaseHandler)
+	return jobs, runner
+}
+
+// claim claims the next job, taking over the running ones when stale.
+func claim(t *testing.T, store *MemoryPersistence, worker string, stale bool) *Job {
+	staleBefore := time.Now().Add(-time.Minute)
+	if stale {
+		staleBefore = time.Now().Add(time.Minute)
+	}
+	job, err := store.ClaimJob(worker, staleBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil {
+		t.Fatal("no job claimed")
+	}
+	return job
+}
+
+func findNames(t *testing.T, store Persistence) []string {
+	models, err := store.Find(nil, Ordering{Column: "id"}, Page{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return modelNames(models)
+}
+
+func TestJobCreate(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, _ := newTestJobs(t, store, store)
+	createTestModels(t, store, "a", "b", "c", "d", "e")
+
+	tests := []struct {
+		name    string
+		action  string
+		filter  string
+		params  map[string]string
+		confirm int
+		wantErr bool
+	}{
+		{"update", JobUpdate, "age>=22", map[string]string{"name": "x"}, 0, false},
+		{"update without filter", JobUpdate, "", map[string]string{"name": "x"}, 0, true},
+		{"update of nothing", JobUpdate, "age>=22", map[string]string{}, 0, true},
+		{"invalid update", JobUpdate, "age>=22", map[string]string{"age": "old"}, 0, true},
+		{"delete over the maximum", JobDelete, "age>=20", nil, 0, true},
+		{"delete over the maximum with the wrong count", JobDelete, "age>=20", nil, 4, true},
+		{"delete over the maximum confirmed", JobDelete, "age>=20", nil, 5, false},
+		{"export of everything", JobExport, "", nil, 0, false},
+		{"unknown action", "truncate", "age>=20", nil, 5, true},
+	}
+	for _, tt := range tests {
+		var filter FilterExpr
+		if tt.filter != "" {
+			filter = mustParseFilter(t, tt.filter)
+		}
+		job, err := jobs.Create(tt.action, filter, tt.params, tt.confirm)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: created job %d", tt.name, job.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if job.State != JobPending || job.TenantID != defaultTenantID {
+			t.Errorf("%s: created %+v", tt.name, job)
+		}
+	}
+
+	job, err := jobs.Create(JobExport, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.ForTenant(defaultTenantID + 1).Get(job.ID); err != errJobNotFound {
+		t.Errorf("another tenant got the job: %v", err)
+	}
+	if _, err := jobs.ExportFile(job.ID); err == nil {
+		t.Error("got the file of a pending export")
+	}
+}
+
+func TestJobClaim(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, _ := newTestJobs(t, store, store)
+	first, _ := jobs.Create(JobExport, nil, nil, 0)
+	second, _ := jobs.Create(JobExport, nil, nil, 0)
+
+	if job := claim(t, store, "w1", false); job.ID != first.ID || job.State != JobRunning || job.Worker != "w1" {
+		t.Errorf("claimed %+v, want the first job", job)
+	}
+	if job := claim(t, store, "w2", false); job.ID != second.ID {
+		t.Errorf("claimed %d, want the second job", job.ID)
+	}
+	if job, err := store.ClaimJob("w3", time.Now().Add(-time.Minute)); job != nil || err != nil {
+		t.Errorf("claimed job %v of a live worker: %v", job, err)
+	}
+
+	lost, _ := store.FindJob(first.ID)
+	job := claim(t, store, "w3", true)
+	if job.ID != first.ID || job.Attempts != 2 || job.Worker != "w3" {
+		t.Errorf("took over %+v, want the first job", job)
+	}
+	if err := store.SaveJob(lost); err != errJobLost {
+		t.Errorf("the worker that lost the job saved it: %v", err)
+	}
+}
+
+func TestJobRunnerUpdate(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, runner := newTestJobs(t, store, store)
+	createTestModels(t, store, "a", "b", "c", "d", "e")
+
+	job, err := jobs.Create(JobUpdate, mustParseFilter(t, "age>=21"), map[string]string{"name": "x"}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.run(claim(t, store, "w", false))
+
+	job, _ = store.FindJob(job.ID)
+	if job.State != JobSucceeded || job.Processed != 4 || job.Affected != 4 || job.Failed != 0 || job.FinishedAt == nil {
+		t.Errorf("finished as %+v", job)
+	}
+	if names := findNames(t, store); !equalStrings(names, []string{"a", "x", "x", "x", "x"}) {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestJobRunnerResumesFromCheckpoint(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, runner := newTestJobs(t, store, store)
+	models := createTestModels(t, store, "a", "b", "c", "d", "e")
+
+	job, err := jobs.Create(JobUpdate, mustParseFilter(t, "age>=20"), map[string]string{"name": "x"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker handled the first batch and died
+	died := claim(t, store, "w1", false)
+	died.Processed, died.Affected, died.LastID = 2, 2, models[1].ID
+	if err := store.SaveJob(died); err != nil {
+		t.Fatal(err)
+	}
+
+	runner.run(claim(t, store, "w2", true))
+
+	job, _ = store.FindJob(job.ID)
+	if job.State != JobSucceeded || job.Processed != 5 || job.Affected != 5 || job.Attempts != 2 {
+		t.Errorf("finished as %+v", job)
+	}
+	if names := findNames(t, store); !equalStrings(names, []string{"a", "b", "x", "x", "x"}) {
+		t.Errorf("got %v, the users before the checkpoint were updated again", names)
+	}
+}
+
+func TestJobRunnerCancel(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, runner := newTestJobs(t, store, store)
+	createTestModels(t, store, "a", "b", "c")
+
+	pending, _ := jobs.Create(JobDelete, mustParseFilter(t, "age>=20"), nil, 0)
+	if job, err := jobs.Cancel(pending.ID); err != nil || job.State != JobCancelled {
+		t.Errorf("cancelled a pending job as %+v: %v", job, err)
+	}
+	if _, err := jobs.Cancel(pending.ID); err == nil {
+		t.Error("cancelled a finished job")
+	}
+
+	running, _ := jobs.Create(JobDelete, mustParseFilter(t, "age>=20"), nil, 0)
+	job := claim(t, store, "w", false)
+	if cancelled, err := jobs.Cancel(running.ID); err != nil || cancelled.State != JobRunning || !cancelled.CancelRequested {
+		t.Errorf("cancelled a running job as %+v: %v", cancelled, err)
+	}
+	runner.run(job)
+
+	job, _ = store.FindJob(running.ID)
+	if job.State != JobCancelled || job.Processed != 0 {
+		t.Errorf("finished as %+v", job)
+	}
+	if names := findNames(t, store); len(names) != 3 {
+		t.Errorf("a cancelled job deleted users, %v are left", names)
+	}
+}
+
+// failingPersistence fails writes to the user bad, like a row the database
+// rejects.
+type failingPersistence struct {
+	Persistence
+	bad uint
+}
+
+func (p *failingPersistence) UpdateMany(updates map[string]interface{}, filter FilterExpr) (int64, error) {
+	models, err := p.Find(filter, Ordering{Column: "id"}, Page{}, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range models {
+		if m.ID == p.bad {
+			return 0, errors.New("rejected")
+		}
+	}
+	return p.Persistence.UpdateMany(updates, filter)
+}
+
+func TestJobRunnerRetriesFailedBatchByUser(t *testing.T) {
+	store := NewMemoryPersistence()
+	models := createTestModels(t, store, "a", "b", "c", "d", "e")
+	jobs, runner := newTestJobs(t, store, &failingPersistence{store, models[2].ID})
+
+	job, err := jobs.Create(JobUpdate, mustParseFilter(t, "age>=20"), map[string]string{"name": "x"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.run(claim(t, store, "w", false))
+
+	job, _ = store.FindJob(job.ID)
+	if job.State != JobSucceeded || job.Processed != 5 || job.Affected != 4 || job.Failed != 1 {
+		t.Errorf("finished as %+v", job)
+	}
+	if !strings.HasPrefix(job.LastError, fmt.Sprintf("user %d: ", models[2].ID)) {
+		t.Errorf("last error %q isn't about the bad user", job.LastError)
+	}
+	if names := findNames(t, store); !equalStrings(names, []string{"x", "x", "c", "x", "x"}) {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestJobRunnerExport(t *testing.T) {
+	store := NewMemoryPersistence()
+	jobs, runner := newTestJobs(t, store, store)
+	models := createTestModels(t, store, "a", "b", "c", "d", "e")
+
+	job, err := jobs.Create(JobExport, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker exported the first batch, wrote part of the second one and died
+	died := claim(t, store, "w1", false)
+	f, err := runner.openExport(died)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.exportBatch(died, f, []Model{*models[0], *models[1]}); err != nil {
+		t.Fatal(err)
+	}
+	died.Processed, died.LastID = 2, models[1].ID
+	if err := store.SaveJob(died); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"ID":3,"Name":"c","Ema`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	runner.run(claim(t, store, "w2", true))
+
+	job, _ = store.FindJob(job.ID)
+	if job.State != JobSucceeded || job.Affected != 5 {
+		t.Errorf("finished as %+v", job)
+	}
+	path, err := jobs.ExportFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer export.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(export)
+	for scanner.Scan() {
+		var m Model
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		names = append(names, m.Name)
+	}
+	if !equalStrings(names, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("exported %v", names)
+	}
+	if info, _ := export.Stat(); info.Size() != job.ResultSize {
+		t.Errorf("the file has %d bytes, the checkpoint %d", info.Size(), job.ResultSize)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+type JobUsecase interface {
+	// ForTenant returns the usecases confined to the jobs and users of a tenant
+	ForTenant(tenantID uint) JobUsecase
+	Create(action string, filter FilterExpr, params map[string]string, confirm int) (*Job, error)
+	Get(id uint) (*Job, error)
+	Cancel(id uint) (*Job, error)
+	ExportFile(id uint) (string, error)
+}
+
+type JobUsecaseHandler struct {
+	jobPersistence     JobPersistence
+	persistenceHandler Persistence
+	runner             *JobRunner
+	config             *Config
+	tenantID           uint
+}
+
+func (h *JobUsecaseHandler) ForTenant(tenantID uint) JobUsecase {
+	return &JobUsecaseHandler{h.jobPersistence, ScopeToTenant(h.persistenceHandler, tenantID), h.runner, h.config, tenantID}
+}
+
+// updateParams are the params an update job can set, like PUT / does, along
+// with the attributes of the profile schema.
+var updateParams = []string{"name", "age", "number", "date"}
+
+// Create queues a job. Updates and deletes follow the rules of their
+// synchronous counterparts: a filter is required and confirm must repeat the
+// number of matched users when it's over the configured maximum.
+func (h *JobUsecaseHandler) Create(action string, filter FilterExpr, params map[string]string, confirm int) (*Job, error) {
+
+	job := Job{TenantID: h.tenantID, Action: action, Filter: FormatFilter(filter), Updates: "{}", State: JobPending}
+
+	switch action {
+	case JobUpdate:
+		updates, err := updatesFromParams(params)
+		if err != nil {
+			return nil, err
+		}
+		if len(updates) == 0 {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Nothing to update"}
+		}
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			panic(err)
+		}
+		job.Updates = string(encoded)
+	case JobDelete, JobExport:
+	default:
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid action, use update, delete or export"}
+	}
+
+	if filter == nil && action != JobExport {
+		return nil, Error{Code: http.StatusBadRequest, Message: "A filter is required for bulk operations"}
+	}
+
+	matched, err := h.persistenceHandler.Count(filter)
+	if err != nil {
+		panic(err)
+	}
+	if action != JobExport && matched > h.config.Bulk.MaxAffected && confirm != matched {
+		msg := fmt.Sprintf("This would affect %d users, more than the %d allowed without confirmation. Repeat the request with confirm=%d", matched, h.config.Bulk.MaxAffected, matched)
+		return nil, Error{Code: http.StatusBadRequest, Message: msg}
+	}
+	job.Total = matched
+
+	if err := h.jobPersistence.CreateJob(&job); err != nil {
+		panic(err)
+	}
+	h.runner.Notify()
+
+	return &job, nil
+}
+
+func (h *JobUsecaseHandler) Get(id uint) (*Job, error) {
+
+	job, err := h.jobPersistence.FindJob(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if job.TenantID != h.tenantID {
+		return nil, errJobNotFound
+	}
+
+	return job, nil
+}
+
+func (h *JobUsecaseHandler) Cancel(id uint) (*Job, error) {
+
+	job, err := h.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Finished() {
+		return nil, Error{Code: http.StatusConflict, Message: "The job already finished"}
+	}
+
+	job, err = h.jobPersistence.CancelJob(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return job, nil
+}
+
+// ExportFile returns the path of the file written by a finished export job.
+func (h *JobUsecaseHandler) ExportFile(id uint) (string, error) {
+
+	job, err := h.Get(id)
+	if err != nil {
+		return "", err
+	}
+	if job.Action != JobExport {
+		return "", Error{Code: http.StatusNotFound, Message: "The job isn't an export"}
+	}
+	if job.State != JobSucceeded {
+		return "", Error{Code: http.StatusConflict, Message: "The export isn't finished"}
+	}
+
+	return jobExportPath(h.config, job.ID), nil
+}
+
+func jobExportPath(config *Config, id uint) string {
+	return filepath.Join(config.Jobs.ExportDir, "job-"+strconv.FormatUint(uint64(id), 10)+".jsonl")
+}
+
+// updatesFromParams validates the update params of a job and converts them to
+// the model fields they set.
+func updatesFromParams(params map[string]string) (map[string]interface{}, error) {
+
+	updates := map[string]interface{}{}
+	attributes := map[string]string{}
+
+	for key, param := range params {
+		switch key {
+		case "name":
+			updates["Name"] = param
+		case "age":
+			age, err := ParseAgeFromString(param)
+			if err != nil {
+				return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for age"}
+			}
+			updates["Age"] = age
+		case "number":
+			number, err := ParseNumberFromString(param)
+			if err != nil {
+				return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for number"}
+			}
+			updates["Number"] = number
+		case "date":
+			date, err := ParseDateFromString(param)
+			if err != nil {
+				return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for date"}
+			}
+			updates["Date"] = date
+		default:
+			attributes[key] = param
+		}
+	}
+
+	if len(attributes) > 0 {
+		parsed, err := profileSchema.Parse(attributes)
+		if err != nil {
+			return nil, err
+		}
+		updates["Attributes"] = AttributeUpdates(parsed)
+	}
+
+	if err := validateUpdates(updates); err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
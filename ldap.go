@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAPConfig is the LDAP directory, like the Active Directory of a company,
+// whose users log in with their password when Login.Verifiers has ldap. The
+// entry of a user is searched for under BaseDN with UserFilter, bound as
+// BindDN, and the user bound as with its password. Users log in for the
+// first time with the fields of their entry, in the tenant they log in to,
+// and without a password, the directory checking it.
+//
+// Attributes maps the fields of users, and their profile attributes, to the
+// LDAP attributes that fill them:
+//
+//	email   mail by default, the email logging in when missing
+//	name    cn by default
+//	groups  memberOf by default, the DNs of the groups of GroupRoles
+//	age, number, date and profile attributes, none by default
+//
+// The roles of GroupRoles are granted or revoked on each login, the others
+// left alone.
+type LDAPConfig struct {
+	URL                string // ldap://host:389, or ldaps://host:636 for TLS from the start
+	StartTLS           bool   // upgrades ldap:// connections to TLS
+	CACertFile         string // PEM of the CAs of the server, the ones of the system when empty
+	InsecureSkipVerify bool   // of the certificate of the server, for testing only
+	BindDN             string `env:"LDAP_BIND_DN"` // searching users, anonymously when empty
+	BindPassword       string `env:"LDAP_BIND_PASSWORD"`
+	BaseDN             string
+	UserFilter         string `default:"(mail={email})"` // {email} is replaced by the email logging in, escaped
+	Attributes         map[string]string
+	GroupRoles         map[string]string // the DN of the group granting each role, like admin: cn=admins,ou=groups,dc=example,dc=com
+	TimeoutInSeconds   uint              `default:"10"`
+}
+
+var defaultLDAPAttributes = map[string]string{
+	"email":  "mail",
+	"name":   "cn",
+	"groups": "memberOf",
+}
+
+var errDirectoryFailed = Error{Code: http.StatusBadGateway, Message: "The directory failed, try again later"}
+
+// LDAPVerifier checks passwords by binding to an LDAP directory as their
+// users.
+type LDAPVerifier struct {
+	LDAPConfig
+	address   string
+	tlsConfig *tls.Config
+}
+
+// NewLDAPVerifier returns the verifier of config.LDAP, checking its filter
+// and roles.
+func NewLDAPVerifier(config *Config) (*LDAPVerifier, error) {
+	c := config.LDAP
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("ldap: invalid URL %q, use ldap://host or ldaps://host", c.URL)
+	}
+	if u.Scheme == "ldaps" && c.StartTLS {
+		return nil, errors.New("ldap: ldaps:// URLs use TLS from the start, StartTLS is for ldap:// ones")
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"ldap": "389", "ldaps": "636"}[u.Scheme]
+	}
+	if c.BaseDN == "" {
+		return nil, errors.New("ldap: the base DN to search users under is missing")
+	}
+	if !strings.Contains(c.UserFilter, "{email}") {
+		return nil, fmt.Errorf("ldap: user filter %q doesn't match {email}", c.UserFilter)
+	}
+	if _, err := parseLDAPFilter(strings.Replace(c.UserFilter, "{email}", "user@example.com", -1)); err != nil {
+		return nil, fmt.Errorf("ldap: user filter %q: %v", c.UserFilter, err)
+	}
+	for role := range c.GroupRoles {
+		if !validRoles[role] {
+			return nil, fmt.Errorf("ldap: invalid role %q in the group roles", role)
+		}
+	}
+
+	attributes := map[string]string{}
+	for field, name := range defaultLDAPAttributes {
+		attributes[field] = name
+	}
+	for field, name := range c.Attributes {
+		attributes[field] = name
+	}
+	c.Attributes = attributes
+
+	verifier := &LDAPVerifier{LDAPConfig: c, address: net.JoinHostPort(u.Hostname(), port)}
+	if u.Scheme == "ldaps" || c.StartTLS {
+		verifier.tlsConfig = &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: c.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		}
+		if c.CACertFile != "" {
+			certificates, err := readCertificates(c.CACertFile)
+			if err != nil {
+				return nil, fmt.Errorf("ldap: %v", err)
+			}
+			verifier.tlsConfig.RootCAs = x509.NewCertPool()
+			for _, certificate := range certificates {
+				verifier.tlsConfig.RootCAs.AddCert(certificate)
+			}
+		}
+	}
+	return verifier, nil
+}
+
+// Verify binds as the entry of the email, which it searches for, with the
+// password, then returns its user, creating it on its first login.
+func (v *LDAPVerifier) Verify(users *UsecaseHandler, email string, password string) (*Model, error) {
+
+	// Servers take binds without a password as anonymous ones, which succeed
+	if password == "" {
+		return nil, errCredentialsIncorrect
+	}
+
+	conn, err := v.connect()
+	if err != nil {
+		return nil, v.failed("connecting", err)
+	}
+	defer conn.Close()
+
+	if v.BindDN != "" {
+		if err := conn.bind(v.BindDN, v.BindPassword); err != nil {
+			return nil, v.failed("binding as "+v.BindDN, err)
+		}
+	}
+
+	filter, err := parseLDAPFilter(strings.Replace(v.UserFilter, "{email}", escapeLDAPFilter(email), -1))
+	if err != nil {
+		return nil, errCredentialsUnknown
+	}
+	var attributes []string
+	for _, name := range v.Attributes {
+		attributes = append(attributes, name)
+	}
+	entries, err := conn.search(v.BaseDN, filter, attributes, 1, int(v.TimeoutInSeconds))
+	if err != nil {
+		if e, ok := err.(ldapResultError); ok && e.Code == ldapSizeLimitExceeded {
+			log.Printf("ldap: several entries match %s, none logs in", email)
+			return nil, errCredentialsUnknown
+		}
+		return nil, v.failed("searching "+email, err)
+	}
+	if len(entries) == 0 {
+		return nil, errCredentialsUnknown
+	}
+	entry := entries[0]
+
+	if err := conn.bind(entry.DN, password); err != nil {
+		if e, ok := err.(ldapResultError); ok && e.Code == ldapInvalidCredentials {
+			return nil, errCredentialsIncorrect
+		}
+		return nil, v.failed("binding as "+entry.DN, err)
+	}
+
+	return v.syncUser(users, email, &entry)
+}
+
+func (v *LDAPVerifier) connect() (*ldapConn, error) {
+	deadline := time.Now().Add(time.Duration(v.TimeoutInSeconds) * time.Second)
+	if !v.StartTLS {
+		return dialLDAP(v.address, v.tlsConfig, deadline)
+	}
+
+	conn, err := dialLDAP(v.address, nil, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.startTLS(v.tlsConfig); err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// syncUser returns the user of entry, creating it on its first login, with
+// the roles of its groups. Users that signed up with its email must have
+// verified it.
+func (v *LDAPVerifier) syncUser(users *UsecaseHandler, email string, entry *ldapEntry) (*Model, error) {
+
+	external := ExternalUser{Subject: entry.DN, Email: email, Fields: map[string]string{}}
+	for field, name := range v.Attributes {
+		value := entry.first(name)
+		switch field {
+		case "email":
+			if value != "" {
+				external.Email = value
+			}
+		case "name":
+			external.Name = value
+		case "groups":
+		default:
+			if value != "" {
+				external.Fields[field] = value
+			}
+		}
+	}
+
+	user, err := users.FindByEmail(NormalizeString("email", external.Email))
+	if err != nil {
+		if e, ok := err.(Error); !ok || e.Code != http.StatusNotFound {
+			return nil, err
+		}
+		if user, err = createExternalUser(users, &external); err != nil {
+			return nil, err
+		}
+	} else if user.Password != "" && !user.EmailVerified {
+		// Whoever signed up with the email of an entry could otherwise have
+		// the account its owner logs in to
+		return nil, Error{Code: http.StatusConflict, Message: "A user has the email of this directory entry, which the user didn't verify"}
+	}
+
+	if len(v.GroupRoles) == 0 {
+		return user, nil
+	}
+	groups := entry.Attributes[strings.ToLower(v.Attributes["groups"])]
+	roles := Roles{}
+	for _, role := range user.Roles {
+		if _, ok := v.GroupRoles[role]; !ok {
+			roles = append(roles, role)
+		}
+	}
+	for role, group := range v.GroupRoles {
+		for _, dn := range groups {
+			if strings.EqualFold(dn, group) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	if sameRoles(roles, user.Roles) {
+		return user, nil
+	}
+	return users.UpdateOne(user, map[string]interface{}{"Roles": roles})
+}
+
+func sameRoles(a Roles, b Roles) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, role := range a {
+		if !b.Has(role) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *LDAPVerifier) failed(what string, err error) error {
+	return logFailure("ldap", what, err, errDirectoryFailed)
+}
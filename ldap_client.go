@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The client below speaks the little of LDAPv3 (RFC 4511) logging users in
+// takes: simple binds, searches and StartTLS, one request at a time.
+
+// berValue is a BER element, the content of constructed ones holding their
+// children.
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+// maxLDAPMessageSize bounds the messages read, so servers can't exhaust the
+// memory.
+const maxLDAPMessageSize = 1 << 20
+
+func (v berValue) children() ([]berValue, error) {
+	var children []berValue
+	for data := v.content; len(data) > 0; {
+		tag, content, rest, err := splitBER(data)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, berValue{tag, content})
+		data = rest
+	}
+	return children, nil
+}
+
+func (v berValue) integer() (int, error) {
+	if len(v.content) == 0 || len(v.content) > 4 {
+		return 0, fmt.Errorf("ldap: integer of %d bytes", len(v.content))
+	}
+	n := int(int8(v.content[0]))
+	for _, b := range v.content[1:] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+// berLength parses the length at the start of data, returning the bytes it
+// took.
+func berLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+	size := int(data[0] & 0x7f)
+	if size == 0 || size > 4 {
+		return 0, 0, errors.New("ldap: unsupported length encoding")
+	}
+	if len(data) < 1+size {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	length := 0
+	for _, b := range data[1 : 1+size] {
+		length = length<<8 | int(b)
+	}
+	if length < 0 || length > maxLDAPMessageSize {
+		return 0, 0, fmt.Errorf("ldap: element of %d bytes", length)
+	}
+	return length, 1 + size, nil
+}
+
+func splitBER(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	if data[0]&0x1f == 0x1f {
+		return 0, nil, nil, errors.New("ldap: unsupported high tag number")
+	}
+	length, size, err := berLength(data[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(data) < 1+size+length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return data[0], data[1+size : 1+size+length], data[1+size+length:], nil
+}
+
+func readBER(r *bufio.Reader) (berValue, error) {
+	header, err := r.Peek(2)
+	if err != nil {
+		return berValue{}, err
+	}
+	if header[1] >= 0x80 {
+		if header, err = r.Peek(2 + int(header[1]&0x7f)); err != nil {
+			return berValue{}, err
+		}
+	}
+	length, size, err := berLength(header[1:])
+	if err != nil {
+		return berValue{}, err
+	}
+	message := make([]byte, 1+size+length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return berValue{}, err
+	}
+	return berValue{message[0], message[1+size:]}, nil
+}
+
+func berElement(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, c := range content {
+		length += len(c)
+	}
+
+	var element []byte
+	switch {
+	case length < 0x80:
+		element = []byte{tag, byte(length)}
+	case length < 0x100:
+		element = []byte{tag, 0x81, byte(length)}
+	case length < 0x10000:
+		element = []byte{tag, 0x82, byte(length >> 8), byte(length)}
+	default:
+		element = []byte{tag, 0x84, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}
+	}
+	for _, c := range content {
+		element = append(element, c...)
+	}
+	return element
+}
+
+func berNumber(tag byte, n int) []byte {
+	content := []byte{byte(n)}
+	for n >>= 8; n != 0 && n != -1; n >>= 8 {
+		content = append([]byte{byte(n)}, content...)
+	}
+	if (n == 0) != (content[0]&0x80 == 0) {
+		content = append([]byte{byte(n)}, content...)
+	}
+	return berElement(tag, content)
+}
+
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest        = 0x60
+	ldapBindResponse       = 0x61
+	ldapUnbindRequest      = 0x42
+	ldapSearchRequest      = 0x63
+	ldapSearchResultEntry  = 0x64
+	ldapSearchResultDone   = 0x65
+	ldapSearchResultRef    = 0x73
+	ldapExtendedRequest    = 0x77
+	ldapExtendedResponse   = 0x78
+	ldapStartTLSOID        = "1.3.6.1.4.1.1466.20037"
+	ldapInvalidCredentials = 49
+	ldapSizeLimitExceeded  = 4
+)
+
+// ldapResultError is a request the server didn't complete, with the result
+// code it replied.
+type ldapResultError struct {
+	Code    int
+	Message string
+}
+
+func (e ldapResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// ldapEntry is an entry searched for, its attributes by lowercase name.
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+func (e *ldapEntry) first(attribute string) string {
+	if values := e.Attributes[strings.ToLower(attribute)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int
+}
+
+// dialLDAP connects to the server at address, with TLS from the start when
+// tlsConfig isn't nil, until the deadline.
+func dialLDAP(address string, tlsConfig *tls.Config, deadline time.Time) (*ldapConn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close unbinds, which servers take as closing the connection too.
+func (c *ldapConn) Close() error {
+	c.send(berElement(ldapUnbindRequest))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.messageID++
+	_, err := c.conn.Write(berElement(berSequence, berNumber(berInteger, c.messageID), op))
+	return c.messageID, err
+}
+
+// receive returns the operation of the next reply to the request of
+// messageID.
+func (c *ldapConn) receive(messageID int) (berValue, error) {
+	for {
+		message, err := readBER(c.r)
+		if err != nil {
+			return berValue{}, err
+		}
+		if message.tag != berSequence {
+			return berValue{}, errors.New("ldap: malformed message")
+		}
+		children, err := message.children()
+		if err != nil {
+			return berValue{}, err
+		}
+		if len(children) < 2 || children[0].tag != berInteger {
+			return berValue{}, errors.New("ldap: malformed message")
+		}
+		id, err := children[0].integer()
+		if err != nil {
+			return berValue{}, err
+		}
+		if id == 0 {
+			return berValue{}, errors.New("ldap: the server closed the connection")
+		}
+		if id == messageID {
+			return children[1], nil
+		}
+	}
+}
+
+// result checks the LDAPResult starting op, of the tag expected.
+func (c *ldapConn) result(op berValue, tag byte) error {
+	if op.tag != tag {
+		return fmt.Errorf("ldap: unexpected reply 0x%02x", op.tag)
+	}
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 || fields[0].tag != berEnumerated {
+		return errors.New("ldap: malformed result")
+	}
+	code, err := fields[0].integer()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return ldapResultError{code, string(fields[2].content)}
+	}
+	return nil
+}
+
+// startTLS upgrades the connection to TLS.
+func (c *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	id, err := c.send(berElement(ldapExtendedRequest, berElement(0x80, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if err := c.result(op, ldapExtendedResponse); err != nil {
+		return err
+	}
+
+	// The deadline of the connection bounds the handshake too.
+	conn := tls.Client(c.conn, tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	return nil
+}
+
+// bind authenticates the connection as dn, failing with an ldapResultError
+// of ldapInvalidCredentials when the password is wrong.
+func (c *ldapConn) bind(dn string, password string) error {
+	request := berElement(ldapBindRequest,
+		berNumber(berInteger, 3),
+		berElement(berOctetString, []byte(dn)),
+		berElement(0x80, []byte(password)),
+	)
+	id, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	return c.result(op, ldapBindResponse)
+}
+
+// search returns the entries under base matching filter, encoded by
+// parseLDAPFilter, failing with an ldapResultError of ldapSizeLimitExceeded
+// when there are more than limit.
+func (c *ldapConn) search(base string, filter []byte, attributes []string, limit int, timeLimit int) ([]ldapEntry, error) {
+	var selection [][]byte
+	for _, attribute := range attributes {
+		selection = append(selection, berElement(berOctetString, []byte(attribute)))
+	}
+	request := berElement(ldapSearchRequest,
+		berElement(berOctetString, []byte(base)),
+		berNumber(berEnumerated, 2), // wholeSubtree
+		berNumber(berEnumerated, 0), // neverDerefAliases
+		berNumber(berInteger, limit),
+		berNumber(berInteger, timeLimit),
+		berElement(berBoolean, []byte{0}),
+		filter,
+		berElement(berSequence, selection...),
+	)
+	id, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchResultEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchResultRef:
+			// Referrals to other servers aren't followed.
+		default:
+			if err := c.result(op, ldapSearchResultDone); err != nil {
+				return nil, err
+			}
+			if len(entries) > limit {
+				return nil, ldapResultError{ldapSizeLimitExceeded, "too many entries"}
+			}
+			return entries, nil
+		}
+	}
+}
+
+func parseLDAPEntry(op berValue) (ldapEntry, error) {
+	fields, err := op.children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	if len(fields) != 2 || fields[0].tag != berOctetString || fields[1].tag != berSequence {
+		return ldapEntry{}, errors.New("ldap: malformed entry")
+	}
+	entry := ldapEntry{DN: string(fields[0].content), Attributes: map[string][]string{}}
+
+	attributes, err := fields[1].children()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		if len(parts) != 2 || parts[0].tag != berOctetString || parts[1].tag != berSet {
+			return ldapEntry{}, errors.New("ldap: malformed attribute")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// escapeLDAPFilter escapes value to be matched as is in a filter, as RFC 4515
+// requires.
+func escapeLDAPFilter(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch b := value[i]; b {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&escaped, "\\%02x", b)
+		default:
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
+
+// parseLDAPFilter encodes the filter in the string representation of RFC
+// 4515, but for extensible matches.
+func parseLDAPFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseLDAPFilterItem(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: unexpected %q after the filter", rest)
+	}
+	return encoded, nil
+}
+
+func parseLDAPFilterItem(filter string) ([]byte, string, error) {
+	if !strings.HasPrefix(filter, "(") {
+		return nil, "", errors.New("ldap: filters start with (")
+	}
+	filter = filter[1:]
+	if filter == "" {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+
+	switch filter[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[filter[0]]
+		var items [][]byte
+		rest := filter[1:]
+		for strings.HasPrefix(rest, "(") {
+			item, after, err := parseLDAPFilterItem(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+			rest = after
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("ldap: unterminated filter")
+		}
+		if len(items) == 0 || tag == 0xa2 && len(items) != 1 {
+			return nil, "", errors.New("ldap: wrong number of filters in " + filter[:1])
+		}
+		return berElement(tag, items...), rest[1:], nil
+	}
+
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+	item, rest := filter[:end], filter[end+1:]
+
+	equals := strings.IndexByte(item, '=')
+	if equals < 1 {
+		return nil, "", fmt.Errorf("ldap: malformed filter (%s)", item)
+	}
+	attribute, value := item[:equals], item[equals+1:]
+	tag := byte(0xa3)
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case '~':
+		tag = 0xa8
+	case ':':
+		return nil, "", errors.New("ldap: extensible match filters aren't supported")
+	}
+	if tag != 0xa3 {
+		attribute = attribute[:len(attribute)-1]
+	}
+	if attribute == "" || strings.ContainsAny(attribute, "()*\\=<>~: ") {
+		return nil, "", fmt.Errorf("ldap: malformed attribute in (%s)", item)
+	}
+	description := berElement(berOctetString, []byte(attribute))
+
+	if tag == 0xa3 && value == "*" {
+		return berElement(0x87, []byte(attribute)), rest, nil
+	}
+	if tag != 0xa3 || !strings.Contains(value, "*") {
+		assertion, err := unescapeLDAPFilter(value)
+		if err != nil {
+			return nil, "", err
+		}
+		return berElement(tag, description, berElement(berOctetString, assertion)), rest, nil
+	}
+
+	parts := strings.Split(value, "*")
+	var substrings [][]byte
+	for i, part := range parts {
+		if part == "" {
+			if i == 0 || i == len(parts)-1 {
+				continue
+			}
+			return nil, "", fmt.Errorf("ldap: malformed substrings in (%s)", item)
+		}
+		substring, err := unescapeLDAPFilter(part)
+		if err != nil {
+			return nil, "", err
+		}
+		choice := byte(0x81) // any
+		switch i {
+		case 0:
+			choice = 0x80 // initial
+		case len(parts) - 1:
+			choice = 0x82 // final
+		}
+		substrings = append(substrings, berElement(choice, substring))
+	}
+	return berElement(0xa4, description, berElement(berSequence, substrings...)), rest, nil
+}
+
+func unescapeLDAPFilter(value string) ([]byte, error) {
+	var unescaped []byte
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+2 >= len(value) {
+				return nil, errors.New("ldap: truncated escape in filter value")
+			}
+			b, err := hex.DecodeString(value[i+1 : i+3])
+			if err != nil {
+				return nil, errors.New("ldap: malformed escape in filter value")
+			}
+			unescaped = append(unescaped, b...)
+			i += 2
+		case '(', ')', '*':
+			return nil, fmt.Errorf("ldap: unescaped %q in filter value", value[i])
+		default:
+			unescaped = append(unescaped, value[i])
+		}
+	}
+	return unescaped, nil
+}
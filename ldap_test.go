@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLDAPServer is a directory of entries, with their passwords by DN,
+// answering the requests of ldapConn. It records the binds and search
+// filters it got.
+type fakeLDAPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config // for StartTLS
+	entries   []ldapEntry
+	passwords map[string]string
+
+	mu      sync.Mutex
+	binds   []fakeLDAPBind
+	filters []berValue
+}
+
+type fakeLDAPBind struct {
+	DN  string
+	TLS bool
+}
+
+const testLDAPBaseDN = "dc=example,dc=com"
+
+func newFakeLDAPServer(t *testing.T) *fakeLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeLDAPServer{
+		listener:  listener,
+		passwords: map[string]string{"cn=service," + testLDAPBaseDN: "service"},
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// addEntry adds the entry of uid, with its password, email and groups.
+func (s *fakeLDAPServer) addEntry(uid string, password string, mail string, groups ...string) string {
+	dn := "uid=" + uid + ",ou=people," + testLDAPBaseDN
+	s.entries = append(s.entries, ldapEntry{DN: dn, Attributes: map[string][]string{
+		"objectclass": {"inetOrgPerson"},
+		"mail":        {mail},
+		"cn":          {strings.ToUpper(uid[:1]) + uid[1:]},
+		"memberof":    groups,
+	}})
+	s.passwords[dn] = password
+	return dn
+}
+
+func (s *fakeLDAPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	tlsUsed := false
+	for {
+		message, err := readBER(r)
+		if err != nil {
+			return
+		}
+		children, err := message.children()
+		if err != nil || len(children) < 2 {
+			return
+		}
+		id, _ := children[0].integer()
+		reply := func(op ...[]byte) {
+			for _, o := range op {
+				conn.Write(berElement(berSequence, berNumber(berInteger, id), o))
+			}
+		}
+		fields, _ := children[1].children()
+
+		switch children[1].tag {
+		case ldapBindRequest:
+			dn, password := string(fields[1].content), string(fields[2].content)
+			s.mu.Lock()
+			s.binds = append(s.binds, fakeLDAPBind{dn, tlsUsed})
+			s.mu.Unlock()
+			code := ldapInvalidCredentials
+			if stored, ok := s.passwords[dn]; ok && password != "" && password == stored {
+				code = 0
+			}
+			reply(ldapResult(ldapBindResponse, code))
+
+		case ldapSearchRequest:
+			limit, _ := fields[3].integer()
+			s.mu.Lock()
+			s.filters = append(s.filters, fields[6])
+			s.mu.Unlock()
+			var ops [][]byte
+			code := 0
+			for _, entry := range s.entries {
+				if !matchLDAPFilter(fields[6], entry) {
+					continue
+				}
+				if len(ops) == limit {
+					code = ldapSizeLimitExceeded
+					break
+				}
+				ops = append(ops, ldapEntryOp(entry))
+			}
+			reply(append(ops, ldapResult(ldapSearchResultDone, code))...)
+
+		case ldapExtendedRequest:
+			if s.tlsConfig == nil || string(fields[0].content) != ldapStartTLSOID {
+				reply(ldapResult(ldapExtendedResponse, 2)) // protocolError
+				continue
+			}
+			reply(ldapResult(ldapExtendedResponse, 0))
+			server := tls.Server(conn, s.tlsConfig)
+			if err := server.Handshake(); err != nil {
+				return
+			}
+			conn, r, tlsUsed = server, bufio.NewReader(server), true
+
+		default:
+			return
+		}
+	}
+}
+
+func ldapResult(tag byte, code int) []byte {
+	return berElement(tag, berNumber(berEnumerated, code), berElement(berOctetString), berElement(berOctetString))
+}
+
+func ldapEntryOp(entry ldapEntry) []byte {
+	var attributes [][]byte
+	for name, values := range entry.Attributes {
+		var set [][]byte
+		for _, value := range values {
+			set = append(set, berElement(berOctetString, []byte(value)))
+		}
+		attributes = append(attributes, berElement(berSequence, berElement(berOctetString, []byte(name)), berElement(berSet, set...)))
+	}
+	return berElement(ldapSearchResultEntry, berElement(berOctetString, []byte(entry.DN)), berElement(berSequence, attributes...))
+}
+
+// matchLDAPFilter matches and, or, presence and equality filters, the ones
+// of the tests.
+func matchLDAPFilter(filter berValue, entry ldapEntry) bool {
+	if filter.tag == 0x87 {
+		return len(entry.Attributes[strings.ToLower(string(filter.content))]) > 0
+	}
+	children, err := filter.children()
+	if err != nil {
+		return false
+	}
+	switch filter.tag {
+	case 0xa0, 0xa1:
+		for _, child := range children {
+			if matchLDAPFilter(child, entry) != (filter.tag == 0xa0) {
+				return filter.tag != 0xa0
+			}
+		}
+		return filter.tag == 0xa0
+	case 0xa3:
+		for _, value := range entry.Attributes[strings.ToLower(string(children[0].content))] {
+			if strings.EqualFold(value, string(children[1].content)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// take returns the binds and search filters since it was last called.
+func (s *fakeLDAPServer) take() ([]fakeLDAPBind, []berValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	binds, filters := s.binds, s.filters
+	s.binds, s.filters = nil, nil
+	return binds, filters
+}
+
+// userDNs are the DNs of binds, but the ones of the service account.
+func userDNs(binds []fakeLDAPBind) []string {
+	var dns []string
+	for _, bind := range binds {
+		if bind.DN != "cn=service,"+testLDAPBaseDN {
+			dns = append(dns, bind.DN)
+		}
+	}
+	return dns
+}
+
+func newTestLDAPVerifier(t *testing.T, s *fakeLDAPServer, change func(c *LDAPConfig)) (*LDAPVerifier, *UsecaseHandler, *MemoryPersistence) {
+	config := &Config{JwtSecret: "secret", AppName: "test"}
+	config.LDAP = LDAPConfig{
+		URL:              "ldap://" + s.listener.Addr().String(),
+		BindDN:           "cn=service," + testLDAPBaseDN,
+		BindPassword:     "service",
+		BaseDN:           testLDAPBaseDN,
+		UserFilter:       "(&(objectClass=*)(mail={email}))",
+		TimeoutInSeconds: 5,
+	}
+	change(&config.LDAP)
+	verifier, err := NewLDAPVerifier(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryPersistence()
+	return verifier, &UsecaseHandler{store, store, nil, nil, config}, store
+}
+
+func TestLDAPVerify(t *testing.T) {
+	s := newFakeLDAPServer(t)
+	alice := s.addEntry("alice", "secret", "alice@example.com")
+	s.addEntry("twin1", "secret", "twin@example.com")
+	s.addEntry("twin2", "secret", "twin@example.com")
+	verifier, users, store := newTestLDAPVerifier(t, s, func(c *LDAPConfig) {})
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		wantErr  error
+		wantBind string // as the user, none when empty
+	}{
+		{"searches then binds", "Alice@Example.com", "secret", nil, alice},
+		{"invalid credentials", "alice@example.com", "wrong", errCredentialsIncorrect, alice},
+		{"empty password", "alice@example.com", "", errCredentialsIncorrect, ""},
+		{"unknown email", "bob@example.com", "secret", errCredentialsUnknown, ""},
+		{"several entries", "twin@example.com", "secret", errCredentialsUnknown, ""},
+		{"filter injection", "*)(mail=*", "secret", errCredentialsUnknown, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := verifier.Verify(users, tt.email, tt.password)
+			if err != tt.wantErr {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (user.Email != "alice@example.com" || user.Name != "Alice" || user.Password != "") {
+				t.Errorf("logged in %+v", user)
+			}
+			binds, _ := s.take()
+			if dns := userDNs(binds); tt.wantBind == "" && len(dns) != 0 || tt.wantBind != "" && (len(dns) != 1 || dns[0] != tt.wantBind) {
+				t.Errorf("bound as %v, want %q", dns, tt.wantBind)
+			}
+		})
+	}
+	if count, _ := store.Count(nil); count != 1 {
+		t.Errorf("counted %d users, want 1", count)
+	}
+}
+
+// TestLDAPFilterEscaping checks the email is matched as is, whatever
+// characters of filters it has.
+func TestLDAPFilterEscaping(t *testing.T) {
+	s := newFakeLDAPServer(t)
+	verifier, users, _ := newTestLDAPVerifier(t, s, func(c *LDAPConfig) { c.UserFilter = "(mail={email})" })
+
+	for _, email := range []string{"*", "a*b@example.com", "*)(uid=*", "a\\2a@example.com", "(a)@example.com"} {
+		if _, err := verifier.Verify(users, email, "secret"); err != errCredentialsUnknown {
+			t.Errorf("%s: got %v, want %v", email, err, errCredentialsUnknown)
+		}
+		_, filters := s.take()
+		if len(filters) != 1 || filters[0].tag != 0xa3 {
+			t.Fatalf("%s: searched with %v, want an equality match", email, filters)
+		}
+		parts, err := filters[0].children()
+		if err != nil || len(parts) != 2 || string(parts[0].content) != "mail" || string(parts[1].content) != email {
+			t.Errorf("%s: searched with %v", email, parts)
+		}
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	s := newFakeLDAPServer(t)
+	alice := s.addEntry("alice", "secret", "alice@example.com")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	verifier, users, _ := newTestLDAPVerifier(t, s, func(c *LDAPConfig) {
+		c.StartTLS = true
+		c.CACertFile = file
+	})
+	if _, err := verifier.Verify(users, "alice@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	binds, _ := s.take()
+	for _, bind := range binds {
+		if !bind.TLS {
+			t.Errorf("bound as %s without TLS", bind.DN)
+		}
+	}
+	if dns := userDNs(binds); len(dns) != 1 || dns[0] != alice {
+		t.Errorf("bound as %v, want %s", dns, alice)
+	}
+
+	// Without the CA, the certificate of the server isn't trusted, and no
+	// password is sent
+	untrusted, users, _ := newTestLDAPVerifier(t, s, func(c *LDAPConfig) { c.StartTLS = true })
+	if _, err := untrusted.Verify(users, "alice@example.com", "secret"); err != errDirectoryFailed {
+		t.Errorf("got %v, want %v", err, errDirectoryFailed)
+	}
+	if binds, _ := s.take(); len(binds) != 0 {
+		t.Errorf("bound as %v", binds)
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	const admins = "cn=admins,ou=groups," + testLDAPBaseDN
+	s := newFakeLDAPServer(t)
+	s.addEntry("alice", "secret", "alice@example.com", "cn=staff,ou=groups,"+testLDAPBaseDN, strings.ToUpper(admins))
+	verifier, users, store := newTestLDAPVerifier(t, s, func(c *LDAPConfig) {
+		c.GroupRoles = map[string]string{RoleAdmin: admins}
+	})
+
+	user, err := verifier.Verify(users, "alice@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameRoles(user.Roles, Roles{RoleAdmin}) {
+		t.Errorf("got roles %v, want %v", user.Roles, Roles{RoleAdmin})
+	}
+
+	// Roles of no group are left alone, the others follow the groups
+	if err := store.UpdateFields(user, map[string]interface{}{"Roles": Roles{RoleAdmin, RoleSuperadmin}}); err != nil {
+		t.Fatal(err)
+	}
+	s.entries[0].Attributes["memberof"] = nil
+	if user, err = verifier.Verify(users, "alice@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !sameRoles(user.Roles, Roles{RoleSuperadmin}) {
+		t.Errorf("got roles %v, want %v", user.Roles, Roles{RoleSuperadmin})
+	}
+}
+
+func TestLDAPExistingUsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string // of the local user
+		verified bool
+		wantErr  bool
+	}{
+		{name: "signed up and verified the email", password: "protected", verified: true},
+		{name: "has no password", password: ""},
+		{name: "signed up without verifying the email", password: "protected", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeLDAPServer(t)
+			s.addEntry("alice", "secret", "alice@example.com")
+			verifier, users, store := newTestLDAPVerifier(t, s, func(c *LDAPConfig) {})
+
+			local := newTestModel("alice@example.com", "local", 30)
+			local.Password = tt.password
+			local.EmailVerified = tt.verified
+			if err := store.Create(local); err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := verifier.Verify(users, "alice@example.com", "secret")
+			if tt.wantErr {
+				if v, ok := err.(Error); !ok || v.Code != http.StatusConflict {
+					t.Errorf("got %v, want a conflict", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != local.ID {
+				t.Errorf("logged in user %d, want %d", user.ID, local.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MagicLinkEndpointHandler struct {
+	magicLinkUsecaseHandler MagicLinkUsecase
+}
+
+// magicLinkCookie carries the nonce of the browser asking for links, so
+// they only log in there. It's kept across requests, so every link sent to
+// the browser works.
+const magicLinkCookie = "magic_link"
+
+func (h *MagicLinkEndpointHandler) Send(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultSend(c, config)
+	}
+}
+
+func (h *MagicLinkEndpointHandler) Login(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultLogin(c, config)
+	}
+}
+
+// defaultSend accepts every request, whether a link was sent or not.
+func (h *MagicLinkEndpointHandler) defaultSend(c *gin.Context, config *Config) {
+
+	email, ok := c.GetPostForm("email")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter email missing")
+		return
+	}
+
+	nonce, err := c.Cookie(magicLinkCookie)
+	if err != nil || nonce == "" {
+		nonce, _ = newOpaqueToken()
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    nonce,
+		Path:     "/login/magic",
+		MaxAge:   int(config.MagicLinks.ExpiryInMinutes) * 60,
+		Secure:   strings.HasPrefix(config.Issuer, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if err := h.magicLinkUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint)).Send(email, nonce); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{})
+}
+
+// defaultLogin replies like defaultCallback, with the token /login replies,
+// or with the options of the passkey confirming the login.
+func (h *MagicLinkEndpointHandler) defaultLogin(c *gin.Context, config *Config) {
+
+	nonce, _ := c.Cookie(magicLinkCookie)
+
+	token, user, err := h.magicLinkUsecaseHandler.Login(c.Param("token"), nonce)
+	if err != nil {
+		if v, ok := err.(SecondFactorRequired); ok {
+			secondFactorRequired(c, config, v)
+		} else if v, ok := err.(Error); ok {
+			loginFailed(c, config, v.Code, "access_denied", RequestMessage(c, v))
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	loggedIn(c, config, token, user)
+}
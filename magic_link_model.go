@@ -0,0 +1,20 @@
+package main
+
+import (
+	"time"
+)
+
+// MagicLink logs a user in through a single use link emailed to it, in the
+// browser that asked for it. Only the hashes of the token in the link and of
+// the nonce in the cookie of the browser are stored.
+type MagicLink struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	TenantID  uint   `gorm:"not null;index:idx_magic_links_tenant_id_email"`
+	Email     string `gorm:"type:varchar(255);index:idx_magic_links_tenant_id_email"` // the links sent to it are throttled
+	UserID    uint   `gorm:"not null"`
+	TokenHash string `gorm:"type:varchar(64);unique_index"`
+	NonceHash string `gorm:"type:varchar(64)"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
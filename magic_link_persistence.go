@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type MagicLinkPersistence interface {
+	// CreateMagicLink forgets the links that expired over an hour ago first,
+	// which CountMagicLinks doesn't count anymore.
+	CreateMagicLink(link *MagicLink) error
+	// CountMagicLinks counts the links sent to email since then.
+	CountMagicLinks(tenantID uint, email string, since time.Time) (int, error)
+	FindMagicLink(tokenHash string) (*MagicLink, error)
+	// UseMagicLink records link was used, failing with errMagicLinkInvalid
+	// if it was used already.
+	UseMagicLink(link *MagicLink) error
+}
+
+var errMagicLinkInvalid = Error{Code: http.StatusBadRequest, Message: "Invalid, expired or used link, ask for another one"}
+
+func (h *PersistenceHandler) CreateMagicLink(link *MagicLink) error {
+	if err := h.DB.Where("expires_at < ?", time.Now().Add(-time.Hour)).Delete(MagicLink{}).Error; err != nil {
+		return err
+	}
+	return h.DB.Create(link).Error
+}
+
+func (h *PersistenceHandler) CountMagicLinks(tenantID uint, email string, since time.Time) (int, error) {
+	var count int
+
+	err := h.DB.Model(&MagicLink{}).Where("tenant_id = ? AND email = ? AND created_at > ?", tenantID, email, since).Count(&count).Error
+	return count, err
+}
+
+func (h *PersistenceHandler) FindMagicLink(tokenHash string) (*MagicLink, error) {
+	var link MagicLink
+
+	r := h.DB.Where("token_hash = ?", tokenHash).First(&link)
+	if r.RecordNotFound() {
+		return nil, errMagicLinkInvalid
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &link, nil
+}
+
+func (h *PersistenceHandler) UseMagicLink(link *MagicLink) error {
+	now := time.Now()
+
+	// Of concurrent uses, only the one updating it gets it
+	r := h.DB.Model(&MagicLink{}).Where("id = ? AND used_at IS NULL", link.ID).Update("used_at", now)
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errMagicLinkInvalid
+	}
+
+	link.UsedAt = &now
+	return nil
+}
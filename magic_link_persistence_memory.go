@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+)
+
+func (h *MemoryPersistence) CreateMagicLink(link *MagicLink) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for id, stored := range h.magicLinks {
+		if stored.ExpiresAt.Before(now.Add(-time.Hour)) {
+			delete(h.magicLinks, id)
+		}
+	}
+
+	h.nextMagicLinkID++
+	link.ID = h.nextMagicLinkID
+	link.CreatedAt = now
+
+	stored := *link
+	h.magicLinks[link.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) CountMagicLinks(tenantID uint, email string, since time.Time) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	count := 0
+	for _, stored := range h.magicLinks {
+		if stored.TenantID == tenantID && stored.Email == email && stored.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (h *MemoryPersistence) FindMagicLink(tokenHash string) (*MagicLink, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.magicLinks {
+		if stored.TokenHash == tokenHash {
+			link := *stored
+			return &link, nil
+		}
+	}
+	return nil, errMagicLinkInvalid
+}
+
+func (h *MemoryPersistence) UseMagicLink(link *MagicLink) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.magicLinks[link.ID]
+	if !ok || stored.UsedAt != nil {
+		return errMagicLinkInvalid
+	}
+
+	now := time.Now()
+	stored.UsedAt = &now
+	link.UsedAt = &now
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type MagicLinkUsecase interface {
+	// ForTenant returns the usecases confined to the users of a tenant
+	ForTenant(tenantID uint) MagicLinkUsecase
+	// Send emails a link logging in the user of email, in the browser with
+	// nonce, unless there's none or too many were sent to it already
+	Send(email string, nonce string) error
+	// Login logs in the user of the link of token, in the tenant it was sent
+	// for
+	Login(token string, nonce string) (string, *Model, error)
+}
+
+type MagicLinkUsecaseHandler struct {
+	magicLinkPersistence MagicLinkPersistence
+	persistenceHandler   Persistence
+	usecaseHandler       Usecase
+	issuer               *TokenIssuer
+	mailer               Mailer
+	secondFactor         SecondFactor // confirms the logins when set, as it does the password ones
+	config               *Config
+	tenantID             uint
+}
+
+func (h *MagicLinkUsecaseHandler) ForTenant(tenantID uint) MagicLinkUsecase {
+	return &MagicLinkUsecaseHandler{h.magicLinkPersistence, h.persistenceHandler, h.usecaseHandler, h.issuer, h.mailer, h.secondFactor, h.config, tenantID}
+}
+
+var errMagicLinkOtherBrowser = Error{Code: http.StatusBadRequest, Message: "Open the link in the browser you asked for it with"}
+
+// Send tells nothing about the email, so whether it has a user can't be
+// guessed from it. Links are URLs under the issuer, so it needs one.
+func (h *MagicLinkUsecaseHandler) Send(email string, nonce string) error {
+
+	if h.config.Issuer == "" {
+		return Error{Code: http.StatusNotFound, Message: "Magic links need the issuer of the service configured"}
+	}
+
+	email, err := ValidateString("email", email)
+	if err != nil {
+		return err
+	}
+
+	filter := FilterComparison{Column: "email", Op: "=", Value: email}
+	existing, err := h.usecaseHandler.ForTenant(h.tenantID).Find(filter, Ordering{Column: "id"}, Page{Limit: 1}, false, nil)
+	if err != nil {
+		return err
+	}
+	if len(existing.Models) == 0 {
+		return nil
+	}
+	user := existing.Models[0]
+
+	now := time.Now()
+	sent, err := h.magicLinkPersistence.CountMagicLinks(h.tenantID, email, now.Add(-time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	if uint(sent) >= h.config.MagicLinks.MaxPerHour {
+		log.Printf("magic link for user %d not sent, %d were in the last hour", user.ID, sent)
+		return nil
+	}
+
+	token, hash := newOpaqueToken()
+	link := MagicLink{
+		TenantID:  h.tenantID,
+		Email:     email,
+		UserID:    user.ID,
+		TokenHash: hash,
+		NonceHash: hashOpaqueToken(nonce),
+		ExpiresAt: now.Add(time.Duration(h.config.MagicLinks.ExpiryInMinutes) * time.Minute),
+	}
+	if err := h.magicLinkPersistence.CreateMagicLink(&link); err != nil {
+		panic(err)
+	}
+
+	// Sent in the background, so the time replies take doesn't tell either
+	body := fmt.Sprintf("Log in with this link before %s, in the browser you asked for it with:\n\n%s\n\nIf you didn't ask for it, ignore this email.\n",
+		link.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), h.config.Issuer+"/login/magic/"+token)
+	go func() {
+		if err := h.mailer.Send(user.Email, "Your login link", body); err != nil {
+			log.Printf("sending magic link %d: %v", link.ID, err)
+		}
+	}()
+
+	return nil
+}
+
+// Login uses the link up, after checking it's opened in the browser that
+// asked for it, so links a scanner of the email opens still work. Then it
+// asks for the second factor of the user, if any, like password logins.
+func (h *MagicLinkUsecaseHandler) Login(token string, nonce string) (string, *Model, error) {
+
+	link, err := h.magicLinkPersistence.FindMagicLink(hashOpaqueToken(token))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, err
+		}
+		panic(err)
+	}
+	if link.UsedAt != nil || !time.Now().Before(link.ExpiresAt) {
+		return "", nil, errMagicLinkInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashOpaqueToken(nonce)), []byte(link.NonceHash)) != 1 {
+		return "", nil, errMagicLinkOtherBrowser
+	}
+
+	if err := h.magicLinkPersistence.UseMagicLink(link); err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, err
+		}
+		panic(err)
+	}
+
+	user, err := ScopeToTenant(h.persistenceHandler, link.TenantID).FindOne(link.UserID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, errMagicLinkInvalid
+		}
+		panic(err)
+	}
+
+	// The link was sent to the email, so the user owns it
+	if !user.EmailVerified {
+		if user, err = h.usecaseHandler.ForTenant(link.TenantID).UpdateOne(user, map[string]interface{}{"EmailVerified": true}); err != nil {
+			return "", nil, err
+		}
+	}
+	if h.secondFactor != nil {
+		if err := h.secondFactor.Challenge(user); err != nil {
+			return "", nil, err
+		}
+	}
+
+	issued, err := h.issuer.LoginToken(user)
+	if err != nil {
+		panic(err)
+	}
+
+	return issued, user, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testMailer hands the emails it's asked to send to a channel.
+type testMailer chan string
+
+func (m testMailer) Send(to string, subject string, body string) error {
+	m <- body
+	return nil
+}
+
+// newTestMagicLinks returns the magic link usecases of the default tenant,
+// which send their links to mailer, with the user usecases.
+func newTestMagicLinks(config *Config, store *MemoryPersistence, mailer testMailer) (*MagicLinkUsecaseHandler, *UsecaseHandler) {
+	config.MagicLinks.MaxPerHour = 5
+	config.MagicLinks.ExpiryInMinutes = 15
+	users := (&UsecaseHandler{store, store, nil, nil, config}).ForTenant(defaultTenantID).(*UsecaseHandler)
+	return &MagicLinkUsecaseHandler{store, store, users, &TokenIssuer{store, config, nil}, mailer, nil, config, defaultTenantID}, users
+}
+
+// sentMagicLink is the token of the magic link mailer got.
+func sentMagicLink(t *testing.T, mailer testMailer) string {
+	select {
+	case body := <-mailer:
+		return regexp.MustCompile(`/login/magic/(\S+)`).FindStringSubmatch(body)[1]
+	case <-time.After(time.Second):
+		t.Fatal("no link sent")
+	}
+	return ""
+}
+
+func TestMagicLinkVerifiesEmail(t *testing.T) {
+	for _, verified := range []bool{true, false} {
+		config := &Config{JwtSecret: "secret", AppName: "test", Issuer: "http://localhost"}
+		store := NewMemoryPersistence()
+		mailer := make(testMailer, 1)
+		links, users := newTestMagicLinks(config, store, mailer)
+
+		user, err := users.Create("alice@example.com", "password", "Alice", 30, 0, time.Time{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateFields(user, map[string]interface{}{"EmailVerified": verified}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := links.Send("alice@example.com", "nonce"); err != nil {
+			t.Fatal(err)
+		}
+		token := sentMagicLink(t, mailer)
+
+		if _, _, err := links.Login(token, "other nonce"); err != errMagicLinkOtherBrowser {
+			t.Errorf("logged in from another browser: %v", err)
+		}
+		_, user, err = links.Login(token, "nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.EmailVerified {
+			t.Errorf("verified %t: the email isn't verified", verified)
+		}
+		if _, _, err := links.Login(token, "nonce"); err == nil {
+			t.Errorf("verified %t: logged in twice with a link", verified)
+		}
+
+		if _, err := (LocalVerifier{}).Verify(users, "alice@example.com", "password"); err != nil {
+			t.Errorf("verified %t: logging in with the password: %v", verified, err)
+		}
+	}
+}
+
+func TestMagicLinkNeedsIssuer(t *testing.T) {
+	store := NewMemoryPersistence()
+	mailer := make(testMailer, 1)
+	links, users := newTestMagicLinks(&Config{JwtSecret: "secret", AppName: "test"}, store, mailer)
+	if _, err := users.Create("alice@example.com", "password", "Alice", 30, 0, time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := links.Send("alice@example.com", "nonce"); err == nil {
+		t.Error("sent a link without an issuer")
+	}
+	if len(mailer) != 0 {
+		t.Errorf("sent %q", <-mailer)
+	}
+}
+
+// TestMagicLinkSecondFactor checks users with passkeys confirm the logins of
+// their links with one, as they do password logins.
+func TestMagicLinkSecondFactor(t *testing.T) {
+	webAuthn, user := newTestWebAuthn(t, "preferred")
+	mailer := make(testMailer, 1)
+	links, _ := newTestMagicLinks(&Config{JwtSecret: "secret", AppName: "test", Issuer: "https://example.com"}, webAuthn.webAuthnPersistence.(*MemoryPersistence), mailer)
+	links.secondFactor = webAuthn
+
+	login := func() error {
+		if err := links.Send(user.Email, "nonce"); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := links.Login(sentMagicLink(t, mailer), "nonce")
+		return err
+	}
+	if err := login(); err != nil {
+		t.Errorf("a user without passkeys got %v", err)
+	}
+
+	authenticator := newTestAuthenticator(t)
+	options, err := webAuthn.StartRegistration(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webAuthn.FinishRegistration(user.ID, "", authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))); err != nil {
+		t.Fatal(err)
+	}
+
+	required, ok := login().(SecondFactorRequired)
+	if !ok || len(required.Options.AllowCredentials) != 1 {
+		t.Fatalf("a user with a passkey got %+v", required)
+	}
+	c := authenticator.ceremony("webauthn.get", required.Options.Challenge)
+	c.SignCount = 1
+	token, confirmed, err := webAuthn.FinishLogin(authenticator.assert(c, nil))
+	if err != nil || token == "" || confirmed.ID != user.ID {
+		t.Errorf("confirming the login got %v, %v", confirmed, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer sends the emails of the service, such as invitations.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+func NewMailer(config *Config) (Mailer, error) {
+	switch config.Mail.Driver {
+	case "log":
+		return LogMailer{}, nil
+	case "smtp":
+		if config.Mail.SMTP.Host == "" || config.Mail.From == "" {
+			return nil, errors.New("mail: the smtp driver needs a host and a from address")
+		}
+		var auth smtp.Auth
+		if config.Mail.SMTP.Username != "" {
+			auth = smtp.PlainAuth("", config.Mail.SMTP.Username, config.Mail.SMTP.Password, config.Mail.SMTP.Host)
+		}
+		return &SMTPMailer{Addr: config.Mail.SMTP.Host + ":" + config.Mail.SMTP.Port, From: config.Mail.From, Auth: auth}, nil
+	default:
+		return nil, fmt.Errorf("mail: unsupported driver %q, use log or smtp", config.Mail.Driver)
+	}
+}
+
+// LogMailer writes the emails to the log instead of sending them, for local
+// development.
+type LogMailer struct{}
+
+func (LogMailer) Send(to string, subject string, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends plain text emails through an SMTP server.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth // nil for servers without authentication
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("mail: invalid recipient %q", to)
+	}
+
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(message))
+}
@@ -1,53 +1,268 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/configor"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 func main() {
 
 	config := initConfig()
-	db := initDatabase(config)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(config, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	serve(config)
+}
+
+func serve(config *Config) {
+
+	store := initPersistence(config)
 	//awsSession := initAWS()
 	//TODO add recovery handler
 	if config.Env != "develop" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	persistenceHandler := PersistenceHandler{db}
-	usecaseHandler := UsecaseHandler{&persistenceHandler, config}
+	jobRunner := NewJobRunner(store, store, config)
+	jobRunner.Start()
+
+	verifiers, err := NewCredentialVerifiers(config)
+	if err != nil {
+		panic(err)
+	}
+	usecaseHandler := UsecaseHandler{store, store, verifiers, nil, config}
 	endpointHandler := EndpointHandler{&usecaseHandler}
 
+	jobUsecaseHandler := JobUsecaseHandler{store, store, jobRunner, config, 0}
+	jobEndpointHandler := JobEndpointHandler{&jobUsecaseHandler}
+
+	tenantUsecaseHandler := TenantUsecaseHandler{store}
+	tenantEndpointHandler := TenantEndpointHandler{&tenantUsecaseHandler}
+
+	groupUsecaseHandler := GroupUsecaseHandler{store, store, 0}
+	groupEndpointHandler := GroupEndpointHandler{&groupUsecaseHandler}
+
+	mailer, err := NewMailer(config)
+	if err != nil {
+		panic(err)
+	}
+	invitationUsecaseHandler := InvitationUsecaseHandler{store, store, &usecaseHandler, mailer, config, 0}
+	invitationEndpointHandler := InvitationEndpointHandler{&invitationUsecaseHandler}
+
+	signingKey, err := NewSigningKey(config)
+	if err != nil {
+		panic(err)
+	}
+	oauthUsecaseHandler := OAuthUsecaseHandler{store, store, &TokenIssuer{store, config, signingKey}, config, 0}
+	oauthEndpointHandler := OAuthEndpointHandler{&oauthUsecaseHandler}
+
+	providers, err := NewProviders(config)
+	if err != nil {
+		panic(err)
+	}
+	samlProviders, err := NewSAMLProviders(config)
+	if err != nil {
+		panic(err)
+	}
+	identityUsecaseHandler := IdentityUsecaseHandler{store, store, store, &usecaseHandler, &TokenIssuer{store, config, nil}, providers, samlProviders, config, 0}
+	identityEndpointHandler := IdentityEndpointHandler{&identityUsecaseHandler}
+
+	magicLinkUsecaseHandler := MagicLinkUsecaseHandler{store, store, &usecaseHandler, &TokenIssuer{store, config, nil}, mailer, nil, config, 0}
+	magicLinkEndpointHandler := MagicLinkEndpointHandler{&magicLinkUsecaseHandler}
+
+	rp, err := NewRelyingParty(config)
+	if err != nil {
+		panic(err)
+	}
+	webAuthnUsecaseHandler := WebAuthnUsecaseHandler{store, store, &TokenIssuer{store, config, nil}, rp, config, 0}
+	webAuthnEndpointHandler := WebAuthnEndpointHandler{&webAuthnUsecaseHandler}
+	if config.WebAuthn.SecondFactor {
+		usecaseHandler.secondFactor = &webAuthnUsecaseHandler
+		magicLinkUsecaseHandler.secondFactor = &webAuthnUsecaseHandler
+	}
+
 	router := gin.New()
 
-	router.POST("/signup", endpointHandler.Signup())
-	router.POST("/login", endpointHandler.Login())
+	router.POST("/signup", ResolveTenant(store, config), endpointHandler.Signup(config))
 
-	auth := router.Group("/", Authenticate(config))
+	auth := router.Group("/", Authenticate(store, config), ResolveTenant(store, config))
 	{
-		//auth.GET("/", AuthenticatedID(), FindOne(db), endpointHandler.GetOne())
-		//auth.PUT("/", AuthenticatedID(), FindOne(db), endpointHandler.PutOne())
-		//auth.DELETE("/", AuthenticatedID(), FindOne(db), endpointHandler.DeleteOne())
+		//auth.GET("/", AuthenticatedID(), FindOne(store), endpointHandler.GetOne())
+		//auth.PUT("/", AuthenticatedID(), FindOne(store), endpointHandler.PutOne())
+		//auth.DELETE("/", AuthenticatedID(), FindOne(store), endpointHandler.DeleteOne())
 
-		admin := router.Group("/") //TODO add auth middleware
+		admin := auth.Group("/", RequireRole(RoleAdmin, RoleSuperadmin))
 		{
-			admin.POST("/", endpointHandler.Post())
+			admin.POST("/", endpointHandler.Post(config))
+			admin.POST("/import", endpointHandler.Import(config))
 
-			auth.GET("/:id", GetID(), FindOne(db), endpointHandler.GetOne())
-			auth.PUT("/:id", GetID(), FindOne(db), endpointHandler.PutOne())
-			auth.DELETE("/:id", GetID(), FindOne(db), endpointHandler.DeleteOne())
+			auth.GET("/:id", GetID(), SelfOrRole(RoleAdmin, RoleSuperadmin), Fields(), FindOne(store), endpointHandler.GetOne())
+			auth.PUT("/:id", GetID(), SelfOrRole(RoleAdmin, RoleSuperadmin), FindOne(store), IfMatch(config), endpointHandler.PutOne())
+			auth.DELETE("/:id", GetID(), SelfOrRole(RoleAdmin, RoleSuperadmin), FindOne(store), IfMatch(config), endpointHandler.DeleteOne())
 
-			admin.GET("/", Filter(), Order(), Paginate(), endpointHandler.Get())
+			admin.GET("/", Filter(), GroupFilter(store), Order(), Paginate(config), Fields(), endpointHandler.Get())
 			admin.PUT("/", Filter(), endpointHandler.Put())
 			admin.DELETE("/", Filter(), endpointHandler.Delete())
 		}
 	}
 
-	router.Run(":" + config.Port)
+	// Resources whose paths start with a static segment, see PrefixRouter
+	resources := gin.New()
+
+	login := resources.Group("/login")
+	{
+		login.POST("", ResolveTenant(store, config), endpointHandler.Login())
+		// Links are URLs under the issuer
+		if config.Issuer != "" {
+			login.POST("/magic", ResolveTenant(store, config), magicLinkEndpointHandler.Send(config))
+			login.GET("/magic/:token", magicLinkEndpointHandler.Login(config))
+		} else {
+			log.Print("no issuer configured, magic links are disabled, as their links are URLs under it")
+		}
+	}
+
+	jobs := resources.Group("/jobs", Authenticate(store, config), ResolveTenant(store, config), RequireRole(RoleAdmin, RoleSuperadmin))
+	{
+		jobs.POST("", Filter(), jobEndpointHandler.Post())
+		jobs.GET("/:id", GetID(), jobEndpointHandler.GetOne())
+		jobs.POST("/:id/cancel", GetID(), jobEndpointHandler.Cancel())
+		jobs.GET("/:id/export", GetID(), jobEndpointHandler.Export())
+	}
+
+	resources.GET("/export", Authenticate(store, config), ResolveTenant(store, config), RequireRole(RoleAdmin, RoleSuperadmin), Filter(), Order(), endpointHandler.Export())
+
+	tenants := resources.Group("/tenants", Authenticate(store, config), RequireRole(RoleSuperadmin))
+	{
+		tenants.POST("", tenantEndpointHandler.Post())
+		tenants.GET("", tenantEndpointHandler.Get())
+		tenants.GET("/:id", GetID(), tenantEndpointHandler.GetOne())
+	}
+
+	groups := resources.Group("/groups", Authenticate(store, config), ResolveTenant(store, config), RequireRole(RoleAdmin, RoleSuperadmin))
+	{
+		groups.POST("", groupEndpointHandler.Post())
+		groups.GET("", groupEndpointHandler.Get())
+		groups.GET("/:id", GetID(), groupEndpointHandler.GetOne())
+		groups.PUT("/:id", GetID(), groupEndpointHandler.PutOne())
+		groups.DELETE("/:id", GetID(), groupEndpointHandler.DeleteOne())
+
+		groups.GET("/:id/members", GetID(), GroupMembers(store), Order(), Paginate(config), Fields(), endpointHandler.Get())
+		groups.POST("/:id/members", GetID(), groupEndpointHandler.AddMember())
+		groups.DELETE("/:id/members/:user", GetID(), groupEndpointHandler.RemoveMember())
+
+		groups.GET("/:id/subgroups", GetID(), groupEndpointHandler.Subgroups())
+		groups.POST("/:id/subgroups", GetID(), groupEndpointHandler.AddSubgroup())
+		groups.DELETE("/:id/subgroups/:group", GetID(), groupEndpointHandler.RemoveSubgroup())
+	}
+
+	invitations := resources.Group("/invitations")
+	{
+		invitations.POST("/:id/accept", GetID(), invitationEndpointHandler.Accept(config))
+
+		admin := invitations.Group("", Authenticate(store, config), ResolveTenant(store, config), RequireRole(RoleAdmin, RoleSuperadmin))
+		admin.POST("", invitationEndpointHandler.Post())
+		admin.GET("", invitationEndpointHandler.Get())
+		admin.POST("/:id/resend", GetID(), invitationEndpointHandler.Resend())
+		admin.DELETE("/:id", GetID(), invitationEndpointHandler.Revoke())
+	}
+
+	oauth := resources.Group("/oauth")
+	{
+		// Without ResolveTenant, users authorize the clients and devices of their own tenant
+		oauth.GET("/authorize", LoginRedirect(config), Authenticate(store, config), oauthEndpointHandler.Authorize())
+		oauth.POST("/authorize", Authenticate(store, config), oauthEndpointHandler.Consent())
+		oauth.GET("/device", Authenticate(store, config), oauthEndpointHandler.Device())
+		oauth.POST("/device", Authenticate(store, config), oauthEndpointHandler.DecideDevice())
+		oauth.POST("/token", oauthEndpointHandler.Token())
+		oauth.POST("/device_authorization", oauthEndpointHandler.DeviceAuthorization())
+		oauth.POST("/introspect", oauthEndpointHandler.Introspect())
+		oauth.POST("/revoke", oauthEndpointHandler.Revoke())
+		oauth.GET("/logout", oauthEndpointHandler.Logout(config))
+		oauth.POST("/logout", oauthEndpointHandler.Logout(config))
+
+		clients := oauth.Group("/clients", Authenticate(store, config), ResolveTenant(store, config), RequireRole(RoleAdmin, RoleSuperadmin))
+		clients.POST("", oauthEndpointHandler.PostClient())
+		clients.GET("", oauthEndpointHandler.GetClients())
+		clients.GET("/:id", GetID(), oauthEndpointHandler.GetClient())
+		clients.DELETE("/:id", GetID(), oauthEndpointHandler.DeleteClient())
+	}
+
+	resources.GET("/userinfo", AccessToken(config, store), oauthEndpointHandler.UserInfo())
+	resources.POST("/userinfo", AccessToken(config, store), oauthEndpointHandler.UserInfo())
+
+	providerRoutes := resources.Group("/providers")
+	{
+		providerRoutes.GET("", identityEndpointHandler.GetProviders())
+		providerRoutes.GET("/:provider/login", ResolveTenant(store, config), identityEndpointHandler.Login(config))
+		providerRoutes.GET("/:provider/callback", identityEndpointHandler.Callback(config))
+	}
+
+	saml := resources.Group("/saml")
+	{
+		saml.GET("/:provider/metadata", identityEndpointHandler.SAMLMetadata())
+		saml.GET("/:provider/login", identityEndpointHandler.SAMLLogin())
+		saml.POST("/:provider/acs", identityEndpointHandler.AssertionConsumer(config))
+		saml.GET("/:provider/acs", identityEndpointHandler.AssertionConsumer(config))
+	}
+
+	identities := resources.Group("/identities", Authenticate(store, config))
+	{
+		identities.GET("", identityEndpointHandler.Get())
+		identities.DELETE("/:id", GetID(), identityEndpointHandler.DeleteOne())
+	}
+
+	webAuthn := resources.Group("/webauthn")
+	{
+		webAuthn.POST("/login/begin", ResolveTenant(store, config), webAuthnEndpointHandler.BeginLogin())
+		webAuthn.POST("/login/finish", webAuthnEndpointHandler.FinishLogin())
+
+		credentials := webAuthn.Group("/credentials", Authenticate(store, config))
+		credentials.POST("/begin", webAuthnEndpointHandler.BeginRegistration())
+		credentials.POST("/finish", webAuthnEndpointHandler.FinishRegistration())
+		credentials.GET("", webAuthnEndpointHandler.Get())
+		credentials.PUT("/:id", GetID(), webAuthnEndpointHandler.PutOne())
+		credentials.DELETE("/:id", GetID(), webAuthnEndpointHandler.DeleteOne())
+	}
+
+	resources.GET("/.well-known/openid-configuration", oauthEndpointHandler.Discovery(config))
+	resources.GET("/.well-known/jwks.json", oauthEndpointHandler.JWKS(signingKey))
+
+	mux := NewPrefixRouter(router)
+	mux.Mount("login", resources)
+	mux.Mount("jobs", resources)
+	mux.Mount("export", resources)
+	mux.Mount("tenants", resources)
+	mux.Mount("groups", resources)
+	mux.Mount("invitations", resources)
+	mux.Mount("oauth", resources)
+	mux.Mount("userinfo", resources)
+	mux.Mount(".well-known", resources)
+	mux.Mount("providers", resources)
+	mux.Mount("identities", resources)
+	mux.Mount("saml", resources)
+	mux.Mount("webauthn", resources)
+
+	if err := http.ListenAndServe(":"+config.Port, TenantPath(mux)); err != nil {
+		panic(err)
+	}
 }
 
 func initConfig() *Config {
@@ -56,29 +271,111 @@ func initConfig() *Config {
 	if err != nil {
 		panic(err)
 	}
+	if err := InitValidation(&config); err != nil {
+		panic(err)
+	}
+	if err := InitProfileSchema(&config); err != nil {
+		panic(err)
+	}
 	return &config
 }
 
+// initPersistence returns the in-memory store for the "memory" driver and the
+// gorm backed one for every SQL driver.
+func initPersistence(config *Config) Store {
+	if config.DB.Driver == "memory" {
+		return NewMemoryPersistence()
+	}
+	db := initDatabase(config)
+	warnPendingMigrations(db, config)
+	return &PersistenceHandler{db}
+}
+
 func initDatabase(config *Config) *gorm.DB {
+	dialect, connectionString, err := buildConnectionString(config)
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := gorm.Open(dialect, connectionString)
+	if err != nil {
+		panic(err)
+	}
+	if dialect == "sqlite3" {
+		// A single writer avoids "database is locked" errors between pooled connections
+		db.DB().SetMaxOpenConns(1)
+	}
+	return db
+}
+
+func buildConnectionString(config *Config) (string, string, error) {
 	name := config.DB.Name
 	host := config.DB.Host
 	port := config.DB.Port
 	user := config.DB.Username
 	pass := config.DB.Password
 
-	db, err := gorm.Open("mysql", buildMySQLConnectionString(host, port, name, user, pass))
+	if name == "" && config.DB.Driver != "memory" {
+		return "", "", errors.New("DB name is required")
+	}
+
+	switch config.DB.Driver {
+	case "mysql":
+		if host == "" || port == "" || user == "" {
+			return "", "", errors.New("DB host, port and username are required for mysql")
+		}
+		return "mysql", buildMySQLConnectionString(host, port, name, user, pass), nil
+	case "postgres":
+		if host == "" || port == "" || user == "" {
+			return "", "", errors.New("DB host, port and username are required for postgres")
+		}
+		return "postgres", buildPostgresConnectionString(host, port, name, user, pass, config.DB.SSLMode), nil
+	case "sqlite":
+		return "sqlite3", buildSQLiteConnectionString(name), nil
+	case "memory":
+		return "", "", errors.New("the memory driver doesn't use a database")
+	default:
+		return "", "", fmt.Errorf("unsupported DB driver %q, use mysql, postgres or sqlite", config.DB.Driver)
+	}
+}
+
+func warnPendingMigrations(db *gorm.DB, config *Config) {
+	migrator, err := NewMigrator(db, config)
 	if err != nil {
 		panic(err)
 	}
-	return db
+	pending, err := migrator.Pending()
+	if err != nil {
+		panic(err)
+	}
+	if len(pending) > 0 {
+		log.Printf("%d pending migrations, run \"%s migrate up\"", len(pending), os.Args[0])
+	}
 }
 
 func buildMySQLConnectionString(host, port, name, user, pass string) string {
 	str := user + ":" + pass + "@" + "tcp(" + host + ":" + port + ")" + "/" + name + "?"
-	str += "charset=utf8&parseTime=True&loc=Local"
+	// clientFoundRows makes RowsAffected count the matched rows, changed or not,
+	// which the conditional updates of versions and jobs rely on
+	str += "charset=utf8&parseTime=True&loc=Local&clientFoundRows=true"
 	return str
 }
 
+func buildPostgresConnectionString(host, port, name, user, pass, sslMode string) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, pass),
+		Host:     host + ":" + port,
+		Path:     "/" + name,
+		RawQuery: "sslmode=" + url.QueryEscape(sslMode),
+	}
+	return u.String()
+}
+
+func buildSQLiteConnectionString(path string) string {
+	return "file:" + path + "?_busy_timeout=5000&_foreign_keys=1"
+}
+
 func initAWS() *session.Session {
 	return session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
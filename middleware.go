@@ -1,17 +1,56 @@
 package main
 
 import (
-	"github.com/dgrijalva/jwt-go"
+	"crypto/sha256"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/jinzhu/gorm"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func Authenticate(config *Config) gin.HandlerFunc {
+// Authenticate takes the roles of the user from users rather than from its
+// token, so revoking them, or deleting the user, takes effect at once.
+func Authenticate(users Persistence, config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		defaultAuthenticate(c, config)
+		defaultAuthenticate(c, users, config)
+	}
+}
+
+// AccessToken authenticates users by the access tokens of OAuth clients,
+// which Authenticate rejects, setting the client and scope of the token too.
+// Revoked tokens are rejected.
+func AccessToken(config *Config, revocations OAuthPersistence) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultAccessToken(c, config, revocations)
+	}
+}
+
+// LoginRedirect sends requests without an Authorization header to the login
+// page, when configured.
+func LoginRedirect(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultLoginRedirect(c, config)
+	}
+}
+
+func ResolveTenant(tenants TenantPersistence, config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultResolveTenant(c, tenants, config)
+	}
+}
+
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultRequireRole(c, false, roles)
+	}
+}
+
+// SelfOrRole is RequireRole also letting the user given by GetID through.
+func SelfOrRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultRequireRole(c, true, roles)
 	}
 }
 
@@ -21,6 +60,21 @@ func Filter() gin.HandlerFunc {
 	}
 }
 
+// GroupFilter narrows the filter to the members of the group= group, nested
+// ones included.
+func GroupFilter(groups GroupPersistence) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultGroupFilter(c, groups)
+	}
+}
+
+// GroupMembers sets the filter to the members of the group given by GetID.
+func GroupMembers(groups GroupPersistence) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultGroupMembers(c, groups)
+	}
+}
+
 func AuthenticatedID() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defaultAuthenticatedID(c)
@@ -33,9 +87,21 @@ func GetID() gin.HandlerFunc {
 	}
 }
 
-func FindOne(db *gorm.DB) gin.HandlerFunc {
+func FindOne(persistence Persistence) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultFindOne(c, persistence)
+	}
+}
+
+func IfMatch(config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		defaultFindOne(c, db)
+		defaultIfMatch(c, config)
+	}
+}
+
+func Fields() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defaultFields(c)
 	}
 }
 
@@ -45,73 +111,146 @@ func Order() gin.HandlerFunc {
 	}
 }
 
-func Paginate() gin.HandlerFunc {
+func Paginate(config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		defaultPaginate(c)
+		defaultPaginate(c, config)
 	}
 }
 
-func defaultAuthenticate(c *gin.Context, config *Config) {
+func defaultAuthenticate(c *gin.Context, users Persistence, config *Config) {
 
-	authorizationHeader := strings.ToLower(c.Request.Header.Get("Authorization"))
-	if strings.HasPrefix(authorizationHeader, "bearer ") == false {
+	claims := bearerClaims(c, config)
+	if claims == nil {
 		ErrorReply(c, http.StatusUnauthorized, "")
 		return
 	}
-	tokenString := strings.TrimPrefix(authorizationHeader, "bearer ")
-
-	token, err := jwt.ParseWithClaims(tokenString, &JWTCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JwtSecret), nil
-	})
-	if err != nil {
-		panic(err)
-	}
-
-	claims, ok := token.Claims.(*JWTCustomClaims)
-	if ok == false || token.Valid == false {
+	// The access tokens of OAuth clients are for their apps, not this API
+	if claims.ClientID != "" {
 		ErrorReply(c, http.StatusUnauthorized, "")
 		return
 	}
 
-	//Lib only checks validity of "exp, iat, nbf" and only if the claims are present. So...
-	if claims.IssuedAt == 0 {
+	id, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil {
 		ErrorReply(c, http.StatusUnauthorized, "")
 		return
 	}
-	if claims.ExpiresAt == 0 {
+	c.Set("authenticatedID", uint(id))
+	// Tokens of logins are issued when users log in
+	c.Set("authTime", time.Unix(claims.IssuedAt, 0))
+
+	tenantID := claims.TenantID()
+	c.Set("tenantID", tenantID)
+
+	user, err := ScopeToTenant(users, tenantID).FindOne(uint(id))
+	if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
 		ErrorReply(c, http.StatusUnauthorized, "")
 		return
 	}
-	if claims.Issuer != config.AppName {
-		ErrorReply(c, http.StatusUnauthorized, "")
+	PanicIf(c, err)
+	c.Set("roles", user.Roles)
+
+	c.Next()
+}
+
+// defaultResolveTenant sets the tenant the request acts on. The one named by
+// the path, the header or the subdomain, in that order, must be the tenant of
+// the token unless it's a superadmin's. Without a token the named tenant or
+// else the default one is used.
+func defaultResolveTenant(c *gin.Context, tenants TenantPersistence, config *Config) {
+
+	slug := requestedTenant(c, config)
+
+	claimed, authenticated := c.Get("tenantID")
+	if slug == "" && authenticated {
+		c.Next()
 		return
 	}
-	if claims.Subject == "" {
-		ErrorReply(c, http.StatusUnauthorized, "")
+	if slug == "" {
+		slug = config.Tenants.Default
+	}
+	if slug == "" {
+		ErrorReply(c, http.StatusBadRequest, "Tenant missing")
 		return
 	}
-	if claims.Audience != config.AppName {
-		ErrorReply(c, http.StatusUnauthorized, "")
+
+	tenant, err := tenants.FindTenantBySlug(slug)
+	if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+		ErrorReply(c, http.StatusNotFound, "Tenant not found")
 		return
 	}
+	PanicIf(c, err)
 
-	id, err := strconv.ParseUint(claims.Subject, 10, 32)
-	if err != nil {
-		ErrorReply(c, http.StatusUnauthorized, "")
+	if authenticated && claimed.(uint) != tenant.ID && !hasRole(c, RoleSuperadmin) {
+		ErrorReply(c, http.StatusForbidden, "The token isn't valid for this tenant")
 		return
 	}
-	c.Set("authenticatedID", id)
+	c.Set("tenantID", tenant.ID)
 
 	c.Next()
 }
 
+func requestedTenant(c *gin.Context, config *Config) string {
+	if slug := tenantFromPath(c.Request); slug != "" {
+		return slug
+	}
+	if slug := c.GetHeader(config.Tenants.Header); slug != "" {
+		return slug
+	}
+	if config.Tenants.Domain != "" {
+		host := c.Request.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		if strings.HasSuffix(host, "."+config.Tenants.Domain) {
+			return strings.TrimSuffix(host, "."+config.Tenants.Domain)
+		}
+	}
+	return ""
+}
+
+// defaultRequireRole lets through the users with any of roles, as loaded by
+// Authenticate, and with self the user given by GetID too.
+func defaultRequireRole(c *gin.Context, self bool, roles []string) {
+	if self && c.MustGet("authenticatedID").(uint) == c.MustGet("id").(uint) {
+		c.Next()
+		return
+	}
+	for _, role := range roles {
+		if hasRole(c, role) {
+			c.Next()
+			return
+		}
+	}
+	ErrorReply(c, http.StatusForbidden, "Forbidden")
+}
+
+func hasRole(c *gin.Context, role string) bool {
+	roles, _ := c.Get("roles")
+	granted, _ := roles.(Roles)
+	return granted.Has(role)
+}
+
 func defaultFilter(c *gin.Context) {
 
-	var queries []map[string]string
+	var queries []FilterExpr
+
+	if param := c.Query("filter"); param != "" {
+		expr, err := ParseFilter(param)
+		if err != nil {
+			if v, ok := err.(*FilterError); ok {
+				c.JSON(http.StatusBadRequest, gin.H{"msg": "Invalid filter: " + v.Error(), "position": v.Position})
+				c.Abort()
+				return
+			}
+			panic(err)
+		}
+		queries = append(queries, expr)
+	}
 
 	name := c.Query("name")
 	if name != "" {
-		queries = append(queries, map[string]string{"name = ?": name})
+		queries = append(queries, FilterComparison{Column: "name", Op: "=", Value: name})
 	}
 	age := c.Query("age")
 	if age != "" {
@@ -120,12 +259,12 @@ func defaultFilter(c *gin.Context) {
 			ErrorReply(c, http.StatusBadRequest, "Invalid operator for age")
 			return
 		}
-		_, err := ParseAgeFromString(age)
+		value, err := ParseAgeFromString(age)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for age")
 			return
 		}
-		queries = append(queries, map[string]string{"age " + operator + " ?": age})
+		queries = append(queries, FilterComparison{Column: "age", Op: operator, Value: uint64(value)})
 	}
 	number := c.Query("number")
 	if number != "" {
@@ -134,12 +273,12 @@ func defaultFilter(c *gin.Context) {
 			ErrorReply(c, http.StatusBadRequest, "Invalid operator for number")
 			return
 		}
-		_, err := ParseNumberFromString(number)
+		value, err := ParseNumberFromString(number)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for number")
 			return
 		}
-		queries = append(queries, map[string]string{"number " + operator + " ?": number})
+		queries = append(queries, FilterComparison{Column: "number", Op: operator, Value: int64(value)})
 	}
 	date := c.Query("date")
 	if date != "" {
@@ -148,15 +287,67 @@ func defaultFilter(c *gin.Context) {
 			ErrorReply(c, http.StatusBadRequest, "Invalid operator for date")
 			return
 		}
-		_, err := ParseDateFromString(date)
+		value, err := ParseDateFromString(date)
 		if err != nil {
 			ErrorReply(c, http.StatusBadRequest, "Invalid value for date")
 			return
 		}
-		queries = append(queries, map[string]string{"date " + operator + " ?": date})
+		queries = append(queries, FilterComparison{Column: "date", Op: operator, Value: value})
+	}
+
+	c.Set("filter", AndFilters(queries...))
+
+	c.Next()
+}
+
+func defaultGroupFilter(c *gin.Context, groups GroupPersistence) {
+
+	name := c.Query("group")
+	if name == "" {
+		c.Next()
+		return
 	}
 
-	c.Set("filter", queries)
+	group, err := groups.FindGroupByName(c.MustGet("tenantID").(uint), name)
+	if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+		ErrorReply(c, http.StatusBadRequest, "Invalid value for group")
+		return
+	}
+	PanicIf(c, err)
+
+	members, err := memberFilter(groups, group, true)
+	PanicIf(c, err)
+
+	filter, _ := c.MustGet("filter").(FilterExpr)
+	c.Set("filter", AndFilters(filter, members))
+
+	c.Next()
+}
+
+// defaultGroupMembers takes the direct members unless nested=true.
+func defaultGroupMembers(c *gin.Context, groups GroupPersistence) {
+
+	nested := c.Query("nested")
+	if nested != "" && nested != "true" && nested != "false" {
+		ErrorReply(c, http.StatusBadRequest, "Invalid value for nested")
+		return
+	}
+
+	group, err := groups.FindGroup(c.MustGet("id").(uint))
+	if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+		ErrorReply(c, http.StatusNotFound, "Group not found")
+		return
+	}
+	PanicIf(c, err)
+	if group.TenantID != c.MustGet("tenantID").(uint) {
+		ErrorReply(c, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	members, err := memberFilter(groups, group, nested == "true")
+	PanicIf(c, err)
+
+	c.Set("filter", members)
 
 	c.Next()
 }
@@ -188,6 +379,68 @@ func getFilterOperator(v []byte) (string, string, bool) {
 	return string(v), "=", true
 }
 
+// bearerClaims are the claims of the bearer token of the request, nil when
+// it's missing or invalid.
+func bearerClaims(c *gin.Context, config *Config) *JWTCustomClaims {
+
+	// The scheme is case insensitive, the token isn't
+	authorizationHeader := c.Request.Header.Get("Authorization")
+	if strings.HasPrefix(strings.ToLower(authorizationHeader), "bearer ") == false {
+		return nil
+	}
+
+	claims, ok := ValidateToken(config, authorizationHeader[len("bearer "):])
+	if !ok {
+		return nil
+	}
+	return claims
+}
+
+// defaultAccessToken replies as RFC 6750 says, the apps being OAuth clients.
+func defaultAccessToken(c *gin.Context, config *Config, revocations OAuthPersistence) {
+
+	claims := bearerClaims(c, config)
+	if claims == nil || claims.ClientID == "" {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ErrorReply(c, http.StatusUnauthorized, "")
+		return
+	}
+	revoked, err := revocations.IsAccessTokenRevoked(claims.Id)
+	PanicIf(c, err)
+	if revoked {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ErrorReply(c, http.StatusUnauthorized, "")
+		return
+	}
+
+	// Tokens of clients acting on their own behalf have no user
+	id, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ErrorReply(c, http.StatusUnauthorized, "")
+		return
+	}
+	c.Set("authenticatedID", uint(id))
+	c.Set("tenantID", claims.TenantID())
+	c.Set("clientID", claims.ClientID)
+	c.Set("scope", Strings(strings.Fields(claims.Scope)))
+
+	c.Next()
+}
+
+// defaultLoginRedirect sends browsers to the login page with the params of
+// the request, as they can't send a token themselves.
+func defaultLoginRedirect(c *gin.Context, config *Config) {
+
+	if c.Request.Header.Get("Authorization") == "" && config.OAuth.LoginURL != "" {
+		c.Redirect(http.StatusFound, addQuery(config.OAuth.LoginURL, c.Request.URL.RawQuery))
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
 func defaultAuthenticatedID(c *gin.Context) {
 
 	c.Set("id", c.MustGet("authenticatedID").(uint))
@@ -213,42 +466,141 @@ func defaultGetID(c *gin.Context) {
 	c.Next()
 }
 
-func defaultFindOne(c *gin.Context, db *gorm.DB) {
-	var component Model
-
-	r := db.First(&component, c.MustGet("id"))
-	if r.RecordNotFound() {
+// defaultFindOne only finds the users of the tenant set by ResolveTenant.
+func defaultFindOne(c *gin.Context, persistence Persistence) {
+	persistence = ScopeToTenant(persistence, c.MustGet("tenantID").(uint))
+	component, err := persistence.FindOne(c.MustGet("id").(uint))
+	if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
 		ErrorReply(c, http.StatusNotFound, "Not found")
 		return
 	}
-	PanicIf(c, r.Error)
+	PanicIf(c, err)
 
-	c.Set("one", &component)
+	c.Set("one", component)
 
 	c.Next()
 }
 
-func defaultOrder(c *gin.Context) {
-	validFields := map[string]struct{}{
-		"id":     {},
-		"name":   {},
-		"age":    {},
-		"number": {},
-		"date":   {},
+// defaultIfMatch rejects writes based on a stale copy of the user loaded by FindOne.
+func defaultIfMatch(c *gin.Context, config *Config) {
+	model := c.MustGet("one").(*Model)
+
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		if !config.Concurrency.IfMatchOptional {
+			ErrorReply(c, http.StatusPreconditionRequired, "If-Match header required")
+			return
+		}
+		c.Next()
+		return
+	}
+
+	if !VersionMatches(header, model.Version) {
+		ErrorReply(c, http.StatusPreconditionFailed, "The user was modified by someone else")
+		return
+	}
+
+	c.Next()
+}
+
+// ModelETag tags the representation of m showing fields, all of them when
+// empty, and the private attributes when self. The same version renders
+// differently for each, so they're hashed after it.
+func ModelETag(m *Model, fields []string, self bool) string {
+	hash := sha256.New()
+	for _, field := range fields {
+		fmt.Fprintf(hash, "%s,", field)
 	}
+	fmt.Fprintf(hash, "%t", self)
+	return fmt.Sprintf("\"%d-%x\"", m.Version, hash.Sum(nil)[:8])
+}
 
+// VersionMatches checks an If-Match header against the version of a user:
+// any representation of the version ModelETag tagged is current enough to
+// write to.
+func VersionMatches(header string, version uint) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		candidate = strings.Trim(candidate, "\"")
+		if i := strings.IndexByte(candidate, '-'); i >= 0 {
+			candidate = candidate[:i]
+		}
+		if candidate == strconv.FormatUint(uint64(version), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagMatches checks etag against an If-Match (strong comparison) or
+// If-None-Match (weak comparison) header value.
+func ETagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFields reads the fields to return, from the public ones, and the
+// related resources to embed in each user.
+func defaultFields(c *gin.Context) {
+
+	fields, invalid, ok := ParseFieldList(c.Query("fields"), func(name string) bool {
+		_, ok := publicFields[name]
+		return ok
+	})
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Invalid field "+invalid)
+		return
+	}
+
+	expand, invalid, ok := ParseFieldList(c.Query("expand"), func(name string) bool {
+		_, ok := userExpansions[name]
+		return ok
+	})
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Invalid expand "+invalid)
+		return
+	}
+
+	c.Set("fields", fields)
+	c.Set("expand", expand)
+
+	c.Next()
+}
+
+func defaultOrder(c *gin.Context) {
 	var orderField string = "id"
-	var orderDir string = "DESC"
+	var orderDesc bool = true
 
 	orderParam := c.Query("Order")
 	orderDirParam := c.Query("OrderDir")
 
 	if orderParam != "" {
-		if _, ok := validFields[orderParam]; !ok {
+		column, ok := sortableFields[orderParam]
+		if !ok {
 			ErrorReply(c, http.StatusBadRequest, "Invalid order field")
 			return
 		}
-		orderField = orderParam
+		orderField = column
 	}
 
 	if orderDirParam != "" {
@@ -256,20 +608,20 @@ func defaultOrder(c *gin.Context) {
 			ErrorReply(c, http.StatusBadRequest, "Invalid order direction")
 			return
 		}
-		orderDir = orderDirParam
+		orderDesc = orderDirParam == "DESC"
 	}
 
-	c.Set("order", map[string]string{orderField: orderDir})
+	c.Set("order", Ordering{Column: orderField, Desc: orderDesc})
 
 	c.Next()
 }
 
-func defaultPaginate(c *gin.Context) {
-	var offset int = -1
-	var limit int = -1
+func defaultPaginate(c *gin.Context, config *Config) {
+	limit := config.Pagination.DefaultLimit
 
 	limitParam := c.Query("Limit")
-	offsetParam := c.Query("Offset")
+	cursorParam := c.Query("Cursor")
+	totalParam := c.Query("Total")
 
 	if limitParam != "" {
 		tmp, err := strconv.ParseInt(limitParam, 10, 32)
@@ -278,27 +630,42 @@ func defaultPaginate(c *gin.Context) {
 			ErrorReply(c, http.StatusBadRequest, "Invalid limit")
 			return
 		}
+		if limit > config.Pagination.MaxLimit {
+			ErrorReply(c, http.StatusBadRequest, "Limit can't be greater than "+strconv.Itoa(config.Pagination.MaxLimit))
+			return
+		}
 	}
-	c.Set("limit", limit)
 
-	if limit != -1 && offsetParam != "" {
-		tmp, err := strconv.ParseInt(offsetParam, 10, 32)
-		offset = int(tmp)
-		if err != nil || !genIsOffsetValid(offset) {
-			ErrorReply(c, http.StatusBadRequest, "Invalid offset")
+	var cursor *Cursor
+	if cursorParam != "" {
+		var err error
+		cursor, err = DecodeCursor(cursorParam, config.JwtSecret)
+		if err != nil {
+			ErrorReply(c, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		order := c.MustGet("order").(Ordering)
+		if cursor.Column != order.Column || cursor.Desc != order.Desc {
+			ErrorReply(c, http.StatusBadRequest, "Cursor doesn't match the requested order")
+			return
+		}
+		filter, _ := c.Get("filter")
+		filterExpr, _ := filter.(FilterExpr)
+		if cursor.Query != CursorQuery(filterExpr, order) {
+			ErrorReply(c, http.StatusBadRequest, "Cursor doesn't match the requested filter")
 			return
 		}
 	}
-	c.Set("offset", offset)
 
-	c.Next()
-}
+	c.Set("page", Page{Limit: limit, Cursor: cursor})
 
-func genIsOffsetValid(o int) bool {
-	if o >= 0 {
-		return true
+	if totalParam != "" && totalParam != "true" && totalParam != "false" {
+		ErrorReply(c, http.StatusBadRequest, "Invalid total")
+		return
 	}
-	return false
+	c.Set("total", totalParam == "true")
+
+	c.Next()
 }
 
 func genIsLimitValid(l int) bool {
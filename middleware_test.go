@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestRequireRoleUsesStoredRoles checks that roles granted or revoked after
+// a token was issued apply to it.
+func TestRequireRoleUsesStoredRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := &Config{JwtSecret: "secret", AppName: "test"}
+	store := NewMemoryPersistence()
+	issuer := &TokenIssuer{store, config, nil}
+
+	router := gin.New()
+	router.GET("/", Authenticate(store, config), RequireRole(RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	setRoles := func(m *Model, roles Roles) {
+		if err := store.UpdateFields(m, map[string]interface{}{"Roles": roles}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := createTestModels(t, store, "admin", "user")
+	admin, user := users[0], users[1]
+	setRoles(admin, Roles{RoleAdmin})
+
+	adminToken, err := issuer.LoginToken(admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := issuer.LoginToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get(adminToken); code != http.StatusOK {
+		t.Errorf("admin: got %d, want %d", code, http.StatusOK)
+	}
+	if code := get(userToken); code != http.StatusForbidden {
+		t.Errorf("user: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	setRoles(admin, nil)
+	if code := get(adminToken); code != http.StatusForbidden {
+		t.Errorf("admin whose role was revoked: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	setRoles(user, Roles{RoleAdmin})
+	if code := get(userToken); code != http.StatusOK {
+		t.Errorf("user granted admin: got %d, want %d", code, http.StatusOK)
+	}
+
+	if err := store.Delete(user); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(userToken); code != http.StatusUnauthorized {
+		t.Errorf("deleted user: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// TestModelETag checks that each representation of a version has its own
+// ETag, and that writes accept any of them.
+func TestModelETag(t *testing.T) {
+	model := &Model{Version: 3}
+	etags := map[string]bool{}
+	for _, tag := range []string{
+		ModelETag(model, nil, false),
+		ModelETag(model, nil, true),
+		ModelETag(model, []string{"name"}, false),
+		ModelETag(model, []string{"name", "email"}, false),
+	} {
+		if etags[tag] {
+			t.Errorf("two representations are tagged %s", tag)
+		}
+		etags[tag] = true
+		if !VersionMatches(tag, 3) {
+			t.Errorf("If-Match %s doesn't match its version", tag)
+		}
+		if VersionMatches(tag, 4) {
+			t.Errorf("If-Match %s matches another version", tag)
+		}
+		if VersionMatches("W/"+tag, 3) {
+			t.Errorf("If-Match W/%s matches", tag)
+		}
+	}
+	if ModelETag(model, []string{"name"}, true) != ModelETag(&Model{Version: 3}, []string{"name"}, true) {
+		t.Error("a representation isn't tagged the same twice")
+	}
+	if !VersionMatches(`"1-0", "3"`, 3) || !VersionMatches("*", 3) || VersionMatches(`"33"`, 3) {
+		t.Error("If-Match lists aren't compared by version")
+	}
+}
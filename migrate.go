@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+const migrationsDir = "migrations"
+
+// migrationDialects maps a gorm dialect to the directory holding its scripts.
+var migrationDialects = map[string]string{
+	"mysql":    "mysql",
+	"postgres": "postgres",
+	"sqlite3":  "sqlite",
+}
+
+type Migration struct {
+	Version  uint64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationRecord is an applied migration. It's dirty while a migration runs
+// outside a transaction, on MySQL, and stays so when it fails partway.
+type MigrationRecord struct {
+	Version   uint64 `gorm:"primary_key"`
+	Name      string `gorm:"type:varchar(255)"`
+	Checksum  string `gorm:"type:char(64)"`
+	AppliedAt time.Time
+	Dirty     bool
+}
+
+func (MigrationRecord) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool
+	Dirty     bool
+}
+
+type Migrator struct {
+	DB          *gorm.DB
+	Dialect     string
+	Migrations  []Migration
+	LockName    string
+	LockTimeout time.Duration
+}
+
+func NewMigrator(db *gorm.DB, config *Config) (*Migrator, error) {
+	dialect := db.Dialect().GetName()
+	dir, ok := migrationDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for the %s dialect", dialect)
+	}
+	migrations, err := LoadMigrations(migrationFiles, path.Join(migrationsDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		DB:          db,
+		Dialect:     dialect,
+		Migrations:  migrations,
+		LockName:    config.AppName + ".schema_migrations",
+		LockTimeout: time.Duration(config.DB.MigrationLockTimeoutInSeconds) * time.Second,
+	}, nil
+}
+
+// LoadMigrations reads every "<version>_<name>.up.sql" / "<version>_<name>.down.sql" pair in dir.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint64]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		version, name, direction, ok := parseMigrationFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		m.Checksum = fmt.Sprintf("%x", sha256.Sum256([]byte(m.Up)))
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func parseMigrationFileName(fileName string) (uint64, string, string, bool) {
+	var direction string
+	switch {
+	case strings.HasSuffix(fileName, ".up.sql"):
+		direction = "up"
+	case strings.HasSuffix(fileName, ".down.sql"):
+		direction = "down"
+	default:
+		return 0, "", "", false
+	}
+	base := strings.TrimSuffix(fileName, "."+direction+".sql")
+
+	parts := strings.SplitN(base, "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", "", false
+	}
+	version, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return version, parts[1], direction, true
+}
+
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range m.Migrations {
+		status := MigrationStatus{Migration: migration}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = record.AppliedAt
+			status.Modified = record.Checksum != migration.Checksum
+			status.Dirty = record.Dirty
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	// Applied migrations that are no longer shipped in the binary
+	for _, record := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Migration: Migration{Version: record.Version, Name: record.Name, Checksum: record.Checksum},
+			Applied:   true,
+			AppliedAt: record.AppliedAt,
+			Modified:  true,
+			Dirty:     record.Dirty,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// Up applies at most n pending migrations in version order; n <= 0 applies all of them.
+func (m *Migrator) Up(n int) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(func() error {
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if err := status.check(); err != nil {
+				return err
+			}
+		}
+
+		for _, status := range statuses {
+			if status.Applied {
+				continue
+			}
+			if n > 0 && len(done) >= n {
+				break
+			}
+			if err := m.apply(status.Migration); err != nil {
+				return err
+			}
+			done = append(done, status.Migration)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the n most recently applied migrations; n <= 0 reverts one.
+func (m *Migrator) Down(n int) ([]Migration, error) {
+	if n <= 0 {
+		n = 1
+	}
+
+	var done []Migration
+
+	err := m.withLock(func() error {
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.Dirty {
+				return status.check()
+			}
+		}
+
+		for i := len(statuses) - 1; i >= 0 && len(done) < n; i-- {
+			status := statuses[i]
+			if !status.Applied {
+				continue
+			}
+			if err := status.check(); err != nil {
+				return err
+			}
+			if err := m.revert(status.Migration); err != nil {
+				return err
+			}
+			done = append(done, status.Migration)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+func (s MigrationStatus) check() error {
+	if s.Dirty {
+		return fmt.Errorf("migration %d_%s failed partway and left the schema dirty: repair it by hand, then run \"migrate force %d\"", s.Version, s.Name, s.Version)
+	}
+	if s.Modified {
+		return fmt.Errorf("applied migration %d_%s does not match the shipped one", s.Version, s.Name)
+	}
+	return nil
+}
+
+// Force records the dirty migration of version as applied, once its schema
+// was repaired by hand.
+func (m *Migrator) Force(version uint64) error {
+	return m.withLock(func() error {
+		if err := m.ensureTable(); err != nil {
+			return err
+		}
+		r := m.DB.Model(&MigrationRecord{}).Where("version = ? AND dirty = ?", version, true).Update("dirty", false)
+		if r.Error != nil {
+			return r.Error
+		}
+		if r.RowsAffected == 0 {
+			return fmt.Errorf("migration %d isn't dirty", version)
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) Pending() ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// transactionalDDL tells whether schema changes can be rolled back. MySQL
+// commits each of them implicitly, so a migration failing partway there
+// can't be undone, and is left dirty instead.
+func (m *Migrator) transactionalDDL() bool {
+	return m.Dialect != "mysql"
+}
+
+func (m *Migrator) apply(migration Migration) error {
+	if !m.transactionalDDL() {
+		return m.applyDirty(migration)
+	}
+	tx := m.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, statement := range splitSQLStatements(migration.Up, m.Dialect) {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+	}
+	record := MigrationRecord{
+		Version:   migration.Version,
+		Name:      migration.Name,
+		Checksum:  migration.Checksum,
+		AppliedAt: time.Now(),
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// applyDirty records the migration as dirty until all its statements ran.
+func (m *Migrator) applyDirty(migration Migration) error {
+	record := MigrationRecord{
+		Version:   migration.Version,
+		Name:      migration.Name,
+		Checksum:  migration.Checksum,
+		AppliedAt: time.Now(),
+		Dirty:     true,
+	}
+	if err := m.DB.Create(&record).Error; err != nil {
+		return err
+	}
+	for _, statement := range splitSQLStatements(migration.Up, m.Dialect) {
+		if err := m.DB.Exec(statement).Error; err != nil {
+			return fmt.Errorf("migration %d_%s: %v, the schema is left dirty", migration.Version, migration.Name, err)
+		}
+	}
+	return m.DB.Model(&record).Update("dirty", false).Error
+}
+
+func (m *Migrator) revert(migration Migration) error {
+	if migration.Down == "" {
+		return fmt.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+	}
+	if !m.transactionalDDL() {
+		return m.revertDirty(migration)
+	}
+	tx := m.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for _, statement := range splitSQLStatements(migration.Down, m.Dialect) {
+		if err := tx.Exec(statement).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+	}
+	if err := tx.Delete(MigrationRecord{}, "version = ?", migration.Version).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// revertDirty records the migration as dirty until all its statements ran.
+func (m *Migrator) revertDirty(migration Migration) error {
+	if err := m.DB.Model(&MigrationRecord{}).Where("version = ?", migration.Version).Update("dirty", true).Error; err != nil {
+		return err
+	}
+	for _, statement := range splitSQLStatements(migration.Down, m.Dialect) {
+		if err := m.DB.Exec(statement).Error; err != nil {
+			return fmt.Errorf("migration %d_%s: %v, the schema is left dirty", migration.Version, migration.Name, err)
+		}
+	}
+	return m.DB.Delete(MigrationRecord{}, "version = ?", migration.Version).Error
+}
+
+func (m *Migrator) ensureTable() error {
+	err := m.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint NOT NULL PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		checksum char(64) NOT NULL,
+		applied_at timestamp NULL,
+		dirty boolean NOT NULL DEFAULT false
+	)`).Error
+	if err != nil {
+		return err
+	}
+	// Tables created before the dirty flag
+	if !m.DB.Dialect().HasColumn("schema_migrations", "dirty") {
+		return m.DB.Exec("ALTER TABLE schema_migrations ADD COLUMN dirty boolean NOT NULL DEFAULT false").Error
+	}
+	return nil
+}
+
+func (m *Migrator) applied() (map[uint64]MigrationRecord, error) {
+	var records []MigrationRecord
+	if err := m.DB.Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := map[uint64]MigrationRecord{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// withLock holds a database-wide named lock while fn runs, so replicas starting
+// at the same time don't apply the same migration twice.
+func (m *Migrator) withLock(fn func() error) error {
+	switch m.Dialect {
+	case "mysql":
+		return m.withMySQLLock(fn)
+	case "postgres":
+		return m.withPostgresLock(fn)
+	default:
+		// SQLite is a single local file and DDL is transactional there, so a
+		// racing process fails on the schema_migrations primary key and rolls back.
+		return fn()
+	}
+}
+
+func (m *Migrator) withMySQLLock(fn func() error) error {
+	conn, err := m.DB.DB().Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var acquired int
+	timeout := int(m.LockTimeout / time.Second)
+	if err := conn.QueryRowContext(context.Background(), "SELECT GET_LOCK(?, ?)", m.LockName, timeout).Scan(&acquired); err != nil {
+		return err
+	}
+	if acquired != 1 {
+		return errMigrationLocked
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", m.LockName)
+
+	return fn()
+}
+
+func (m *Migrator) withPostgresLock(fn func() error) error {
+	conn, err := m.DB.DB().Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := int64(crc32.ChecksumIEEE([]byte(m.LockName)))
+	deadline := time.Now().Add(m.LockTimeout)
+	for {
+		var acquired bool
+		if err := conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errMigrationLocked
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+
+	return fn()
+}
+
+var errMigrationLocked = errors.New("could not acquire the migration lock, is another migration running?")
+
+// splitSQLStatements splits a script of dialect on top level semicolons,
+// ignoring the ones inside quotes, dollar quoted bodies and comments.
+// Backslashes escape characters in MySQL strings and PostgreSQL E'...' strings
+// only, everywhere else they're taken literally.
+func splitSQLStatements(script string, dialect string) []string {
+	var statements []string
+	var current strings.Builder
+
+	flush := func() {
+		statement := strings.TrimSpace(current.String())
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	var quote byte
+	var escapes bool
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+
+		if quote != 0 {
+			current.WriteByte(c)
+			if c == '\\' && escapes && i+1 < len(script) {
+				i++
+				current.WriteByte(script[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			escapes = c != '`' && dialect == "mysql" ||
+				c == '\'' && dialect == "postgres" && i > 0 && (script[i-1] == 'E' || script[i-1] == 'e') &&
+					(i == 1 || !isSQLIdentifierByte(script[i-2]))
+			current.WriteByte(c)
+		case c == '$' && dialect == "postgres" && (i == 0 || !isSQLIdentifierByte(script[i-1])):
+			tag := dollarQuoteTag(script[i:])
+			if tag == "" {
+				current.WriteByte(c)
+				continue
+			}
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				end = len(script)
+			} else {
+				end += i + 2*len(tag)
+			}
+			current.WriteString(script[i:end])
+			i = end - 1
+		case c == '-' && i+1 < len(script) && script[i+1] == '-':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			current.WriteByte('\n')
+		case c == '/' && i+1 < len(script) && script[i+1] == '*':
+			// Block comments are kept, MySQL runs the /*! ... */ ones.
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script)
+			} else {
+				end += i + 4
+			}
+			current.WriteString(script[i:end])
+			i = end - 1
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// dollarQuoteTag returns the $tag$ that opens s, or "" when s doesn't start
+// with a PostgreSQL dollar quote.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case c >= '0' && c <= '9':
+			// $1 is a parameter, and tags can't start with a digit.
+			if i == 1 {
+				return ""
+			}
+		case !isSQLIdentifierByte(c):
+			return ""
+		}
+	}
+	return ""
+}
+
+func isSQLIdentifierByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// CreateMigrationFiles writes an empty up/down pair for the next version into
+// the directory of every dialect under dir, and returns the created paths.
+func CreateMigrationFiles(dir, name string) ([]string, error) {
+	name = strings.Trim(strings.ToLower(strings.Join(strings.Fields(name), "_")), "_")
+	if name == "" {
+		return nil, errors.New("migration name can't be empty")
+	}
+
+	var dialectDirs []string
+	for _, d := range migrationDialects {
+		dialectDirs = append(dialectDirs, filepath.Join(dir, d))
+	}
+	sort.Strings(dialectDirs)
+
+	var version uint64 = 1
+	for _, d := range dialectDirs {
+		migrations, err := LoadMigrations(os.DirFS(d), ".")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(migrations) > 0 && migrations[len(migrations)-1].Version >= version {
+			version = migrations[len(migrations)-1].Version + 1
+		}
+	}
+
+	base := fmt.Sprintf("%04d_%s", version, name)
+
+	var created []string
+	for _, d := range dialectDirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return created, err
+		}
+		for _, direction := range []string{"up", "down"} {
+			file := filepath.Join(d, base+"."+direction+".sql")
+			if err := ioutil.WriteFile(file, []byte("-- "+base+" "+direction+"\n"), 0644); err != nil {
+				return created, err
+			}
+			created = append(created, file)
+		}
+	}
+
+	return created, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testMigrationFiles = fstest.MapFS{
+	"db/10_add_notes.up.sql":           {Data: []byte("CREATE TABLE notes (id integer PRIMARY KEY, body text);")},
+	"db/10_add_notes.down.sql":         {Data: []byte("DROP TABLE notes;")},
+	"db/2_add_email.up.sql":            {Data: []byte("ALTER TABLE things ADD COLUMN email varchar(255);")},
+	"db/2_add_email.down.sql":          {Data: []byte("ALTER TABLE things DROP COLUMN email;")},
+	"db/1_create_things.up.sql":        {Data: []byte("CREATE TABLE things (id integer PRIMARY KEY);\nINSERT INTO things (id) VALUES (1);")},
+	"db/1_create_things.down.sql":      {Data: []byte("DROP TABLE things;")},
+	"db/README.md":                     {Data: []byte("not a migration")},
+	"db/nameless.up.sql":               {Data: []byte("SELECT 1;")},
+	"db/subdir/3_ignored.up.sql":       {Data: []byte("SELECT 1;")},
+	"other/1_create_things.up.sql":     {Data: []byte("CREATE TABLE things (id integer PRIMARY KEY);")},
+	"other/1_create_stuff.down.sql":    {Data: []byte("DROP TABLE stuff;")},
+	"missing/1_create_things.down.sql": {Data: []byte("DROP TABLE things;")},
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(testMigrationFiles, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range migrations {
+		names = append(names, fmt.Sprintf("%d_%s", m.Version, m.Name))
+		if m.Checksum != fmt.Sprintf("%x", sha256.Sum256([]byte(m.Up))) {
+			t.Errorf("%d_%s: checksum %s isn't the one of the up script", m.Version, m.Name, m.Checksum)
+		}
+		if m.Down == "" {
+			t.Errorf("%d_%s: no down script", m.Version, m.Name)
+		}
+	}
+	if want := []string{"1_create_things", "2_add_email", "10_add_notes"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if _, err := LoadMigrations(testMigrationFiles, "other"); err == nil || !strings.Contains(err.Error(), "conflicting names") {
+		t.Errorf("conflicting names: got %v", err)
+	}
+	if _, err := LoadMigrations(testMigrationFiles, "missing"); err == nil || !strings.Contains(err.Error(), "no up script") {
+		t.Errorf("no up script: got %v", err)
+	}
+}
+
+// newTestMigrator returns a migrator of the "db" migrations in
+// testMigrationFiles, against a new SQLite database file.
+func newTestMigrator(t *testing.T) *Migrator {
+	config := &Config{AppName: "test"}
+	config.DB.Driver = "sqlite"
+	config.DB.Name = filepath.Join(t.TempDir(), "test.db")
+
+	db := initDatabase(config)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := NewMigrator(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator.Migrations, err = LoadMigrations(testMigrationFiles, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func migrationVersions(migrations []Migration) []uint64 {
+	var versions []uint64
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	m := newTestMigrator(t)
+
+	done, err := m.Up(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("up 2 applied %v", got)
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(pending); !reflect.DeepEqual(got, []uint64{10}) {
+		t.Errorf("pending %v, want [10]", got)
+	}
+	if err := m.DB.Exec("INSERT INTO things (id, email) VALUES (2, 'a;b')").Error; err != nil {
+		t.Fatalf("the schema of 2_add_email isn't there: %v", err)
+	}
+
+	if done, err = m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []uint64{10}) {
+		t.Errorf("up applied %v", got)
+	}
+	if done, err = m.Up(0); err != nil || len(done) != 0 {
+		t.Errorf("up with nothing pending applied %v: %v", migrationVersions(done), err)
+	}
+
+	if done, err = m.Down(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []uint64{10}) {
+		t.Errorf("down reverted %v", got)
+	}
+	if done, err = m.Down(5); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(done); !reflect.DeepEqual(got, []uint64{2, 1}) {
+		t.Errorf("down 5 reverted %v", got)
+	}
+	if m.DB.HasTable("things") || m.DB.HasTable("notes") {
+		t.Error("the tables outlived their migrations")
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Errorf("%d_%s is still applied", status.Version, status.Name)
+		}
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Errorf("up again: %v", err)
+	}
+}
+
+func TestShippedMigrationsRoundTrip(t *testing.T) {
+	m := newTestMigrator(t)
+	var err error
+	if m.Migrations, err = LoadMigrations(migrationFiles, path.Join(migrationsDir, migrationDialects[m.Dialect])); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	done, err := m.Down(len(m.Migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(m.Migrations) {
+		t.Errorf("reverted %d of %d migrations", len(done), len(m.Migrations))
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Errorf("up after reverting everything: %v", err)
+	}
+}
+
+func TestMigratorRefusesModifiedMigrations(t *testing.T) {
+	m := newTestMigrator(t)
+	if _, err := m.Up(2); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Migrations[1].Up += "\n-- edited after it was applied"
+	m.Migrations[1].Checksum = fmt.Sprintf("%x", sha256.Sum256([]byte(m.Migrations[1].Up)))
+
+	if done, err := m.Up(0); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("up applied %v: %v", migrationVersions(done), err)
+	}
+	if done, err := m.Down(0); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("down reverted %v: %v", migrationVersions(done), err)
+	}
+	if m.DB.HasTable("notes") {
+		t.Error("applied a migration after the modified one")
+	}
+}
+
+func TestMigratorDirty(t *testing.T) {
+	m := newTestMigrator(t)
+	if _, err := m.Up(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Force(2); err == nil {
+		t.Error("forced a migration that isn't dirty")
+	}
+
+	if err := m.DB.Model(&MigrationRecord{}).Where("version = ?", 2).Update("dirty", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	if done, err := m.Up(0); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("up applied %v: %v", migrationVersions(done), err)
+	}
+	if done, err := m.Down(0); err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Errorf("down reverted %v: %v", migrationVersions(done), err)
+	}
+	if err := m.Force(10); err == nil {
+		t.Error("forced a migration that wasn't applied")
+	}
+
+	if err := m.Force(2); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := m.Up(0); err != nil || !reflect.DeepEqual(migrationVersions(done), []uint64{10}) {
+		t.Errorf("up after force applied %v: %v", migrationVersions(done), err)
+	}
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		script  string
+		want    []string
+	}{
+		{"statements", "sqlite3", "SELECT 1;\n\n SELECT 2 ;;\nSELECT 3", []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{"semicolons in quotes", "sqlite3", `SELECT 'a;b', "c;d", ` + "`e;f`;SELECT 2", []string{`SELECT 'a;b', "c;d", ` + "`e;f`", "SELECT 2"}},
+		{"doubled quotes", "sqlite3", "SELECT 'it''s; fine'; SELECT 2", []string{"SELECT 'it''s; fine'", "SELECT 2"}},
+		{"line comments", "sqlite3", "-- drop; everything\nSELECT 1; -- trailing;\nSELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"dashes in quotes", "sqlite3", "SELECT '--;'; SELECT 2", []string{"SELECT '--;'", "SELECT 2"}},
+		{"block comments", "sqlite3", "SELECT /* a; b */ 1; SELECT 2", []string{"SELECT /* a; b */ 1", "SELECT 2"}},
+		{"MySQL executable comments", "mysql", "/*!40101 SET NAMES utf8; */; SELECT 2", []string{"/*!40101 SET NAMES utf8; */", "SELECT 2"}},
+		{"unterminated block comment", "sqlite3", "SELECT 1; /* a; b", []string{"SELECT 1", "/* a; b"}},
+		{"backslash in SQLite", "sqlite3", `SELECT 'C:\'; SELECT 2`, []string{`SELECT 'C:\'`, "SELECT 2"}},
+		{"backslash in PostgreSQL", "postgres", `SELECT 'C:\'; SELECT 2`, []string{`SELECT 'C:\'`, "SELECT 2"}},
+		{"backslash in MySQL", "mysql", `SELECT 'a\'; b'; SELECT "c\"; d"; SELECT 2`, []string{`SELECT 'a\'; b'`, `SELECT "c\"; d"`, "SELECT 2"}},
+		{"backtick in MySQL", "mysql", "SELECT `a\\`; SELECT 2", []string{"SELECT `a\\`", "SELECT 2"}},
+		{"PostgreSQL escape string", "postgres", `SELECT E'a\'; b', e'\\'; SELECT 2`, []string{`SELECT E'a\'; b', e'\\'`, "SELECT 2"}},
+		{"identifier ending in E", "postgres", `SELECT name'C:\'; SELECT 2`, []string{`SELECT name'C:\'`, "SELECT 2"}},
+		{"dollar quotes", "postgres", "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT 2",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT 2"}},
+		{"tagged dollar quotes", "postgres", "DO $body$ BEGIN PERFORM '$$;'; END $body$; SELECT 2",
+			[]string{"DO $body$ BEGIN PERFORM '$$;'; END $body$", "SELECT 2"}},
+		{"dollar quoted quotes and comments", "postgres", "SELECT $$it's -- not; a comment$$; SELECT 2",
+			[]string{"SELECT $$it's -- not; a comment$$", "SELECT 2"}},
+		{"parameters", "postgres", "SELECT $1; SELECT $2", []string{"SELECT $1", "SELECT $2"}},
+		{"dollar in identifiers", "postgres", "SELECT a$b$; SELECT 2", []string{"SELECT a$b$", "SELECT 2"}},
+		{"dollar quotes outside PostgreSQL", "mysql", "SELECT $$; SELECT 2$$", []string{"SELECT $$", "SELECT 2$$"}},
+	}
+	for _, tt := range tests {
+		if got := splitSQLStatements(tt.script, tt.dialect); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+-- Matches the table gorm's AutoMigrate used to create, so existing databases are adopted as is.
+CREATE TABLE IF NOT EXISTS `models` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `deleted_at` timestamp NULL,
+  `email` varchar(254),
+  `password` char(192),
+  `compromised` boolean,
+  `protection_scheme` char(32),
+  `name` varchar(255),
+  `age` int unsigned,
+  `number` int,
+  `date` timestamp NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_models_deleted_at` (`deleted_at`),
+  UNIQUE INDEX `uix_models_email` (`email`)
+);
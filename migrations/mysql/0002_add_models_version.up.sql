@@ -0,0 +1 @@
+ALTER TABLE `models` ADD COLUMN `version` int unsigned NOT NULL DEFAULT 1;
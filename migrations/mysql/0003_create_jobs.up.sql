@@ -0,0 +1,24 @@
+CREATE TABLE `jobs` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `action` varchar(16) NOT NULL,
+  `filter` text NOT NULL,
+  `updates` text NOT NULL,
+  `state` varchar(16) NOT NULL,
+  `total` int NOT NULL DEFAULT 0,
+  `processed` int NOT NULL DEFAULT 0,
+  `affected` int NOT NULL DEFAULT 0,
+  `failed` int NOT NULL DEFAULT 0,
+  `last_id` int unsigned NOT NULL DEFAULT 0,
+  `last_error` text NOT NULL,
+  `result_size` bigint NOT NULL DEFAULT 0,
+  `cancel_requested` boolean NOT NULL DEFAULT false,
+  `worker` varchar(128) NOT NULL DEFAULT '',
+  `attempts` int NOT NULL DEFAULT 0,
+  `heartbeat_at` timestamp NULL,
+  `started_at` timestamp NULL,
+  `finished_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_jobs_state` (`state`)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE `jobs` DROP COLUMN `tenant_id`;
+ALTER TABLE `models` DROP INDEX `uix_models_tenant_id_email`, ADD UNIQUE INDEX `uix_models_email` (`email`);
+ALTER TABLE `models` DROP COLUMN `tenant_id`, DROP COLUMN `roles`;
+DROP TABLE `tenants`;
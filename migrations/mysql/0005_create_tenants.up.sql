@@ -0,0 +1,13 @@
+CREATE TABLE `tenants` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `slug` varchar(63) NOT NULL,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_tenants_slug` (`slug`)
+);
+INSERT INTO `tenants` (`id`, `created_at`, `updated_at`, `slug`, `name`) VALUES (1, NOW(), NOW(), 'default', 'Default');
+ALTER TABLE `models` ADD COLUMN `tenant_id` int unsigned NOT NULL DEFAULT 1, ADD COLUMN `roles` text NULL;
+ALTER TABLE `models` DROP INDEX `uix_models_email`, ADD UNIQUE INDEX `uix_models_tenant_id_email` (`tenant_id`, `email`);
+ALTER TABLE `jobs` ADD COLUMN `tenant_id` int unsigned NOT NULL DEFAULT 1;
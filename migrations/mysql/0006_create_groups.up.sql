@@ -0,0 +1,24 @@
+CREATE TABLE `groups` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `name` varchar(63) NOT NULL,
+  `description` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_groups_tenant_id_name` (`tenant_id`, `name`)
+);
+CREATE TABLE `group_members` (
+  `group_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `created_at` timestamp NULL,
+  PRIMARY KEY (`group_id`, `user_id`),
+  INDEX `idx_group_members_user_id` (`user_id`)
+);
+CREATE TABLE `group_subgroups` (
+  `parent_id` int unsigned NOT NULL,
+  `child_id` int unsigned NOT NULL,
+  `created_at` timestamp NULL,
+  PRIMARY KEY (`parent_id`, `child_id`),
+  INDEX `idx_group_subgroups_child_id` (`child_id`)
+);
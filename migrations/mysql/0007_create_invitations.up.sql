@@ -0,0 +1,18 @@
+CREATE TABLE `invitations` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `roles` text NULL,
+  `groups` text NULL,
+  `invited_by` int unsigned NOT NULL DEFAULT 0,
+  `token_hash` varchar(64) NOT NULL,
+  `expires_at` timestamp NULL,
+  `sent_at` timestamp NULL,
+  `accepted_at` timestamp NULL,
+  `revoked_at` timestamp NULL,
+  `user_id` int unsigned NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_invitations_tenant_id` (`tenant_id`)
+);
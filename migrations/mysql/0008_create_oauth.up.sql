@@ -0,0 +1,54 @@
+CREATE TABLE `oauth_clients` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `client_id` varchar(64) NOT NULL,
+  `secret_hash` varchar(64) NOT NULL DEFAULT '',
+  `name` varchar(255) NOT NULL,
+  `confidential` boolean NOT NULL DEFAULT false,
+  `redirect_uris` text NULL,
+  `scopes` text NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_oauth_clients_client_id` (`client_id`),
+  INDEX `idx_oauth_clients_tenant_id` (`tenant_id`)
+);
+CREATE TABLE `oauth_codes` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `code_hash` varchar(64) NOT NULL,
+  `client_id` int unsigned NOT NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `redirect_uri` text NOT NULL,
+  `scope` text NULL,
+  `code_challenge` varchar(128) NOT NULL,
+  `expires_at` timestamp NULL,
+  `used_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_oauth_codes_code_hash` (`code_hash`),
+  INDEX `idx_oauth_codes_client_id` (`client_id`)
+);
+CREATE TABLE `oauth_refresh_tokens` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `token_hash` varchar(64) NOT NULL,
+  `client_id` int unsigned NOT NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `scope` text NULL,
+  `expires_at` timestamp NULL,
+  `revoked_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_oauth_refresh_tokens_token_hash` (`token_hash`),
+  INDEX `idx_oauth_refresh_tokens_client_id` (`client_id`)
+);
+CREATE TABLE `oauth_consents` (
+  `user_id` int unsigned NOT NULL,
+  `client_id` int unsigned NOT NULL,
+  `created_at` timestamp NULL,
+  `updated_at` timestamp NULL,
+  `scope` text NULL,
+  PRIMARY KEY (`user_id`, `client_id`),
+  INDEX `idx_oauth_consents_client_id` (`client_id`)
+);
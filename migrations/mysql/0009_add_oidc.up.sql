@@ -0,0 +1,5 @@
+ALTER TABLE `models` ADD COLUMN `email_verified` boolean NOT NULL DEFAULT false;
+ALTER TABLE `oauth_clients` ADD COLUMN `post_logout_redirect_uris` text NULL;
+ALTER TABLE `oauth_codes` ADD COLUMN `nonce` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `oauth_codes` ADD COLUMN `auth_time` timestamp NULL;
+ALTER TABLE `oauth_refresh_tokens` ADD COLUMN `auth_time` timestamp NULL;
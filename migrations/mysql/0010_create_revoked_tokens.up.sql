@@ -0,0 +1,8 @@
+CREATE TABLE `revoked_tokens` (
+  `jti` varchar(64) NOT NULL,
+  `created_at` timestamp NULL,
+  `client_id` int unsigned NOT NULL,
+  `expires_at` timestamp NULL,
+  PRIMARY KEY (`jti`),
+  INDEX `idx_revoked_tokens_expires_at` (`expires_at`)
+);
@@ -0,0 +1,21 @@
+CREATE TABLE `oauth_device_codes` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `device_code_hash` varchar(64) NOT NULL,
+  `user_code` varchar(16) NOT NULL,
+  `client_id` int unsigned NOT NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `scope` text NULL,
+  `poll_interval` int unsigned NOT NULL,
+  `polled_at` timestamp NULL,
+  `user_id` int unsigned NOT NULL DEFAULT 0,
+  `auth_time` timestamp NULL,
+  `approved_at` timestamp NULL,
+  `denied_at` timestamp NULL,
+  `expires_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_oauth_device_codes_device_code_hash` (`device_code_hash`),
+  UNIQUE INDEX `uix_oauth_device_codes_user_code` (`user_code`),
+  INDEX `idx_oauth_device_codes_client_id` (`client_id`),
+  INDEX `idx_oauth_device_codes_expires_at` (`expires_at`)
+);
@@ -0,0 +1,2 @@
+DROP TABLE `provider_logins`;
+DROP TABLE `identities`;
@@ -0,0 +1,26 @@
+CREATE TABLE `identities` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `provider` varchar(64) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `email` varchar(254) NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_identities_tenant_id_provider_subject` (`tenant_id`, `provider`, `subject`),
+  INDEX `idx_identities_user_id` (`user_id`)
+);
+
+CREATE TABLE `provider_logins` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `state_hash` varchar(64) NOT NULL,
+  `provider` varchar(64) NOT NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `nonce` varchar(64) NOT NULL,
+  `code_verifier` varchar(64) NOT NULL,
+  `expires_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_provider_logins_state_hash` (`state_hash`),
+  INDEX `idx_provider_logins_expires_at` (`expires_at`)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE `saml_assertions` (
+  `id` varchar(128) NOT NULL,
+  `created_at` timestamp NULL,
+  `provider` varchar(64) NOT NULL,
+  `expires_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  INDEX `idx_saml_assertions_expires_at` (`expires_at`)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE `magic_links` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `email` varchar(255) NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `token_hash` varchar(64) NOT NULL,
+  `nonce_hash` varchar(64) NOT NULL,
+  `expires_at` timestamp NULL,
+  `used_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_magic_links_token_hash` (`token_hash`),
+  INDEX `idx_magic_links_tenant_id_email` (`tenant_id`, `email`),
+  INDEX `idx_magic_links_expires_at` (`expires_at`)
+);
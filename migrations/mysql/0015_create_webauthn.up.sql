@@ -0,0 +1,33 @@
+CREATE TABLE `webauthn_credentials` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL,
+  `credential_id` varchar(255) NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `public_key` blob NOT NULL,
+  `algorithm` int NOT NULL,
+  `sign_count` int unsigned NOT NULL DEFAULT 0,
+  `aaguid` varchar(36) NULL,
+  `attestation_type` varchar(16) NOT NULL,
+  `user_verified` boolean NOT NULL DEFAULT false,
+  `backup_eligible` boolean NOT NULL DEFAULT false,
+  `backed_up` boolean NOT NULL DEFAULT false,
+  `last_used_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_webauthn_credentials_credential_id` (`credential_id`),
+  INDEX `idx_webauthn_credentials_user_id` (`user_id`)
+);
+
+CREATE TABLE `webauthn_challenges` (
+  `id` int unsigned AUTO_INCREMENT,
+  `created_at` timestamp NULL,
+  `challenge_hash` varchar(64) NOT NULL,
+  `ceremony` varchar(16) NOT NULL,
+  `tenant_id` int unsigned NOT NULL,
+  `user_id` int unsigned NOT NULL DEFAULT 0,
+  `expires_at` timestamp NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `uix_webauthn_challenges_challenge_hash` (`challenge_hash`),
+  INDEX `idx_webauthn_challenges_expires_at` (`expires_at`)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS models (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  deleted_at timestamp with time zone,
+  email varchar(254),
+  password varchar(192),
+  compromised boolean,
+  protection_scheme varchar(32),
+  name varchar(255),
+  age integer,
+  number integer,
+  date timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_models_deleted_at ON models (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_models_email ON models (email);
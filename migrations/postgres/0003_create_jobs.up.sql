@@ -0,0 +1,24 @@
+CREATE TABLE jobs (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  action varchar(16) NOT NULL,
+  filter text NOT NULL,
+  updates text NOT NULL,
+  state varchar(16) NOT NULL,
+  total integer NOT NULL DEFAULT 0,
+  processed integer NOT NULL DEFAULT 0,
+  affected integer NOT NULL DEFAULT 0,
+  failed integer NOT NULL DEFAULT 0,
+  last_id integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  result_size bigint NOT NULL DEFAULT 0,
+  cancel_requested boolean NOT NULL DEFAULT false,
+  worker varchar(128) NOT NULL DEFAULT '',
+  attempts integer NOT NULL DEFAULT 0,
+  heartbeat_at timestamp with time zone,
+  started_at timestamp with time zone,
+  finished_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE INDEX idx_jobs_state ON jobs (state);
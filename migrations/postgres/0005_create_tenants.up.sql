@@ -0,0 +1,16 @@
+CREATE TABLE tenants (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  slug varchar(63) NOT NULL,
+  name varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_tenants_slug ON tenants (slug);
+INSERT INTO tenants (id, created_at, updated_at, slug, name) VALUES (1, now(), now(), 'default', 'Default');
+SELECT setval('tenants_id_seq', 1);
+ALTER TABLE models ADD COLUMN tenant_id integer NOT NULL DEFAULT 1;
+ALTER TABLE models ADD COLUMN roles text;
+DROP INDEX uix_models_email;
+CREATE UNIQUE INDEX uix_models_tenant_id_email ON models (tenant_id, email);
+ALTER TABLE jobs ADD COLUMN tenant_id integer NOT NULL DEFAULT 1;
@@ -0,0 +1,24 @@
+CREATE TABLE groups (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  name varchar(63) NOT NULL,
+  description varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_groups_tenant_id_name ON groups (tenant_id, name);
+CREATE TABLE group_members (
+  group_id integer NOT NULL,
+  user_id integer NOT NULL,
+  created_at timestamp with time zone,
+  PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX idx_group_members_user_id ON group_members (user_id);
+CREATE TABLE group_subgroups (
+  parent_id integer NOT NULL,
+  child_id integer NOT NULL,
+  created_at timestamp with time zone,
+  PRIMARY KEY (parent_id, child_id)
+);
+CREATE INDEX idx_group_subgroups_child_id ON group_subgroups (child_id);
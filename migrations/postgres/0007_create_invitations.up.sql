@@ -0,0 +1,18 @@
+CREATE TABLE invitations (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  email varchar(255) NOT NULL,
+  roles text,
+  groups text,
+  invited_by integer NOT NULL DEFAULT 0,
+  token_hash varchar(64) NOT NULL,
+  expires_at timestamp with time zone,
+  sent_at timestamp with time zone,
+  accepted_at timestamp with time zone,
+  revoked_at timestamp with time zone,
+  user_id integer,
+  PRIMARY KEY (id)
+);
+CREATE INDEX idx_invitations_tenant_id ON invitations (tenant_id);
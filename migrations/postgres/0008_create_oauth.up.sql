@@ -0,0 +1,54 @@
+CREATE TABLE oauth_clients (
+  id serial,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  client_id varchar(64) NOT NULL,
+  secret_hash varchar(64) NOT NULL DEFAULT '',
+  name varchar(255) NOT NULL,
+  confidential boolean NOT NULL DEFAULT false,
+  redirect_uris text,
+  scopes text,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_oauth_clients_client_id ON oauth_clients (client_id);
+CREATE INDEX idx_oauth_clients_tenant_id ON oauth_clients (tenant_id);
+CREATE TABLE oauth_codes (
+  id serial,
+  created_at timestamp with time zone,
+  code_hash varchar(64) NOT NULL,
+  client_id integer NOT NULL,
+  tenant_id integer NOT NULL,
+  user_id integer NOT NULL,
+  redirect_uri text NOT NULL,
+  scope text,
+  code_challenge varchar(128) NOT NULL,
+  expires_at timestamp with time zone,
+  used_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_oauth_codes_code_hash ON oauth_codes (code_hash);
+CREATE INDEX idx_oauth_codes_client_id ON oauth_codes (client_id);
+CREATE TABLE oauth_refresh_tokens (
+  id serial,
+  created_at timestamp with time zone,
+  token_hash varchar(64) NOT NULL,
+  client_id integer NOT NULL,
+  tenant_id integer NOT NULL,
+  user_id integer NOT NULL,
+  scope text,
+  expires_at timestamp with time zone,
+  revoked_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_oauth_refresh_tokens_token_hash ON oauth_refresh_tokens (token_hash);
+CREATE INDEX idx_oauth_refresh_tokens_client_id ON oauth_refresh_tokens (client_id);
+CREATE TABLE oauth_consents (
+  user_id integer NOT NULL,
+  client_id integer NOT NULL,
+  created_at timestamp with time zone,
+  updated_at timestamp with time zone,
+  scope text,
+  PRIMARY KEY (user_id, client_id)
+);
+CREATE INDEX idx_oauth_consents_client_id ON oauth_consents (client_id);
@@ -0,0 +1,5 @@
+ALTER TABLE oauth_refresh_tokens DROP COLUMN auth_time;
+ALTER TABLE oauth_codes DROP COLUMN auth_time;
+ALTER TABLE oauth_codes DROP COLUMN nonce;
+ALTER TABLE oauth_clients DROP COLUMN post_logout_redirect_uris;
+ALTER TABLE models DROP COLUMN email_verified;
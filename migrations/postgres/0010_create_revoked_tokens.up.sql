@@ -0,0 +1,8 @@
+CREATE TABLE revoked_tokens (
+  jti varchar(64) NOT NULL,
+  created_at timestamp with time zone,
+  client_id integer NOT NULL,
+  expires_at timestamp with time zone,
+  PRIMARY KEY (jti)
+);
+CREATE INDEX idx_revoked_tokens_expires_at ON revoked_tokens (expires_at);
@@ -0,0 +1,21 @@
+CREATE TABLE oauth_device_codes (
+  id serial,
+  created_at timestamp with time zone,
+  device_code_hash varchar(64) NOT NULL,
+  user_code varchar(16) NOT NULL,
+  client_id integer NOT NULL,
+  tenant_id integer NOT NULL,
+  scope text,
+  poll_interval integer NOT NULL,
+  polled_at timestamp with time zone,
+  user_id integer NOT NULL DEFAULT 0,
+  auth_time timestamp with time zone,
+  approved_at timestamp with time zone,
+  denied_at timestamp with time zone,
+  expires_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_oauth_device_codes_device_code_hash ON oauth_device_codes (device_code_hash);
+CREATE UNIQUE INDEX uix_oauth_device_codes_user_code ON oauth_device_codes (user_code);
+CREATE INDEX idx_oauth_device_codes_client_id ON oauth_device_codes (client_id);
+CREATE INDEX idx_oauth_device_codes_expires_at ON oauth_device_codes (expires_at);
@@ -0,0 +1,26 @@
+CREATE TABLE identities (
+  id serial,
+  created_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  user_id integer NOT NULL,
+  provider varchar(64) NOT NULL,
+  subject varchar(255) NOT NULL,
+  email varchar(254),
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_identities_tenant_id_provider_subject ON identities (tenant_id, provider, subject);
+CREATE INDEX idx_identities_user_id ON identities (user_id);
+
+CREATE TABLE provider_logins (
+  id serial,
+  created_at timestamp with time zone,
+  state_hash varchar(64) NOT NULL,
+  provider varchar(64) NOT NULL,
+  tenant_id integer NOT NULL,
+  nonce varchar(64) NOT NULL,
+  code_verifier varchar(64) NOT NULL,
+  expires_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_provider_logins_state_hash ON provider_logins (state_hash);
+CREATE INDEX idx_provider_logins_expires_at ON provider_logins (expires_at);
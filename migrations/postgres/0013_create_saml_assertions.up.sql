@@ -0,0 +1,8 @@
+CREATE TABLE saml_assertions (
+  id varchar(128) NOT NULL,
+  created_at timestamp with time zone,
+  provider varchar(64) NOT NULL,
+  expires_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE INDEX idx_saml_assertions_expires_at ON saml_assertions (expires_at);
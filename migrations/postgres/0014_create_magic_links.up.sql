@@ -0,0 +1,15 @@
+CREATE TABLE magic_links (
+  id serial,
+  created_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  email varchar(255) NOT NULL,
+  user_id integer NOT NULL,
+  token_hash varchar(64) NOT NULL,
+  nonce_hash varchar(64) NOT NULL,
+  expires_at timestamp with time zone,
+  used_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_magic_links_token_hash ON magic_links (token_hash);
+CREATE INDEX idx_magic_links_tenant_id_email ON magic_links (tenant_id, email);
+CREATE INDEX idx_magic_links_expires_at ON magic_links (expires_at);
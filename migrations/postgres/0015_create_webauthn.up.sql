@@ -0,0 +1,33 @@
+CREATE TABLE webauthn_credentials (
+  id serial,
+  created_at timestamp with time zone,
+  tenant_id integer NOT NULL,
+  user_id integer NOT NULL,
+  credential_id varchar(255) NOT NULL,
+  name varchar(64) NOT NULL,
+  public_key bytea NOT NULL,
+  algorithm integer NOT NULL,
+  sign_count bigint NOT NULL DEFAULT 0,
+  aaguid varchar(36),
+  attestation_type varchar(16) NOT NULL,
+  user_verified boolean NOT NULL DEFAULT false,
+  backup_eligible boolean NOT NULL DEFAULT false,
+  backed_up boolean NOT NULL DEFAULT false,
+  last_used_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_webauthn_credentials_credential_id ON webauthn_credentials (credential_id);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+CREATE TABLE webauthn_challenges (
+  id serial,
+  created_at timestamp with time zone,
+  challenge_hash varchar(64) NOT NULL,
+  ceremony varchar(16) NOT NULL,
+  tenant_id integer NOT NULL,
+  user_id integer NOT NULL DEFAULT 0,
+  expires_at timestamp with time zone,
+  PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX uix_webauthn_challenges_challenge_hash ON webauthn_challenges (challenge_hash);
+CREATE INDEX idx_webauthn_challenges_expires_at ON webauthn_challenges (expires_at);
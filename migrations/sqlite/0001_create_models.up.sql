@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS models (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime,
+  updated_at datetime,
+  deleted_at datetime,
+  email varchar(254),
+  password varchar(192),
+  compromised bool,
+  protection_scheme varchar(32),
+  name varchar(255),
+  age integer,
+  number integer,
+  date datetime
+);
+CREATE INDEX IF NOT EXISTS idx_models_deleted_at ON models (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_models_email ON models (email);
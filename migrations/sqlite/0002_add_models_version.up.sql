@@ -0,0 +1 @@
+ALTER TABLE models ADD COLUMN version integer NOT NULL DEFAULT 1;
@@ -0,0 +1,23 @@
+CREATE TABLE jobs (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime,
+  updated_at datetime,
+  action varchar(16) NOT NULL,
+  filter text NOT NULL,
+  updates text NOT NULL,
+  state varchar(16) NOT NULL,
+  total integer NOT NULL DEFAULT 0,
+  processed integer NOT NULL DEFAULT 0,
+  affected integer NOT NULL DEFAULT 0,
+  failed integer NOT NULL DEFAULT 0,
+  last_id integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  result_size integer NOT NULL DEFAULT 0,
+  cancel_requested bool NOT NULL DEFAULT false,
+  worker varchar(128) NOT NULL DEFAULT '',
+  attempts integer NOT NULL DEFAULT 0,
+  heartbeat_at datetime,
+  started_at datetime,
+  finished_at datetime
+);
+CREATE INDEX idx_jobs_state ON jobs (state);
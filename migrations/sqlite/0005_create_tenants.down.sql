@@ -0,0 +1,6 @@
+ALTER TABLE jobs DROP COLUMN tenant_id;
+DROP INDEX uix_models_tenant_id_email;
+CREATE UNIQUE INDEX uix_models_email ON models (email);
+ALTER TABLE models DROP COLUMN roles;
+ALTER TABLE models DROP COLUMN tenant_id;
+DROP TABLE tenants;
@@ -0,0 +1,14 @@
+CREATE TABLE tenants (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime,
+  updated_at datetime,
+  slug varchar(63) NOT NULL,
+  name varchar(255) NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX uix_tenants_slug ON tenants (slug);
+INSERT INTO tenants (id, created_at, updated_at, slug, name) VALUES (1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'default', 'Default');
+ALTER TABLE models ADD COLUMN tenant_id integer NOT NULL DEFAULT 1;
+ALTER TABLE models ADD COLUMN roles text;
+DROP INDEX uix_models_email;
+CREATE UNIQUE INDEX uix_models_tenant_id_email ON models (tenant_id, email);
+ALTER TABLE jobs ADD COLUMN tenant_id integer NOT NULL DEFAULT 1;
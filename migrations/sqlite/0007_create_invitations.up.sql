@@ -0,0 +1,17 @@
+CREATE TABLE invitations (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime,
+  updated_at datetime,
+  tenant_id integer NOT NULL,
+  email varchar(255) NOT NULL,
+  roles text,
+  groups text,
+  invited_by integer NOT NULL DEFAULT 0,
+  token_hash varchar(64) NOT NULL,
+  expires_at datetime,
+  sent_at datetime,
+  accepted_at datetime,
+  revoked_at datetime,
+  user_id integer
+);
+CREATE INDEX idx_invitations_tenant_id ON invitations (tenant_id);
@@ -0,0 +1,20 @@
+CREATE TABLE oauth_device_codes (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime,
+  device_code_hash varchar(64) NOT NULL,
+  user_code varchar(16) NOT NULL,
+  client_id integer NOT NULL,
+  tenant_id integer NOT NULL,
+  scope text,
+  poll_interval integer NOT NULL,
+  polled_at datetime,
+  user_id integer NOT NULL DEFAULT 0,
+  auth_time datetime,
+  approved_at datetime,
+  denied_at datetime,
+  expires_at datetime
+);
+CREATE UNIQUE INDEX uix_oauth_device_codes_device_code_hash ON oauth_device_codes (device_code_hash);
+CREATE UNIQUE INDEX uix_oauth_device_codes_user_code ON oauth_device_codes (user_code);
+CREATE INDEX idx_oauth_device_codes_client_id ON oauth_device_codes (client_id);
+CREATE INDEX idx_oauth_device_codes_expires_at ON oauth_device_codes (expires_at);
@@ -0,0 +1,8 @@
+CREATE TABLE saml_assertions (
+  id varchar(128) NOT NULL,
+  created_at datetime,
+  provider varchar(64) NOT NULL,
+  expires_at datetime,
+  PRIMARY KEY (id)
+);
+CREATE INDEX idx_saml_assertions_expires_at ON saml_assertions (expires_at);
@@ -10,14 +10,19 @@ type Model struct {
 	CreatedAt        time.Time
 	UpdatedAt        time.Time
 	DeletedAt        *time.Time `sql:"index"`
-	Email            string     `gorm:"type:varchar(254);unique_index"`
-	Password         string     `gorm:"type:char(192)"`
+	TenantID         uint       `gorm:"not null;unique_index:uix_models_tenant_id_email"`
+	Email            string     `gorm:"type:varchar(254);unique_index:uix_models_tenant_id_email"`
+	EmailVerified    bool       // set once the user proved it owns the email, like accepting an invitation
+	Password         string     `gorm:"type:char(192)" json:"-"`
 	Compromised      bool
-	ProtectionScheme string `gorm:"type:char(32)"`
+	ProtectionScheme string `gorm:"type:char(32)" json:"-"`
 	Name             string
 	Age              uint
 	Number           int
 	Date             time.Time
+	Attributes       Attributes
+	Roles            Roles `gorm:"type:text"`
+	Version          uint  `gorm:"not null"`
 }
 
 func ParseAgeFromString(s string) (uint, error) {
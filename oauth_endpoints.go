@@ -0,0 +1,580 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OAuthEndpointHandler struct {
+	oauthUsecaseHandler OAuthUsecase
+}
+
+func (h *OAuthEndpointHandler) PostClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPostClient(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) GetClients() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetClients(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) GetClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetClient(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) DeleteClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDeleteClient(c)
+	}
+}
+
+// Authorize tells the app showing the consent screen who asks for what,
+// validating the request first.
+func (h *OAuthEndpointHandler) Authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultAuthorize(c)
+	}
+}
+
+// Consent answers a request of the authorization endpoint for the user,
+// replying the URL to send its browser to.
+func (h *OAuthEndpointHandler) Consent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultConsent(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) Token() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultToken(c)
+	}
+}
+
+// DeviceAuthorization starts the login of a device, as RFC 8628 says.
+func (h *OAuthEndpointHandler) DeviceAuthorization() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDeviceAuthorization(c)
+	}
+}
+
+// Device tells the app showing the page where users enter user codes what
+// the device of a code asks for.
+func (h *OAuthEndpointHandler) Device() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDevice(c)
+	}
+}
+
+// DecideDevice approves or denies the login of a device for the user.
+func (h *OAuthEndpointHandler) DecideDevice() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDecideDevice(c)
+	}
+}
+
+// Introspect tells resource servers about tokens, as RFC 7662 says.
+func (h *OAuthEndpointHandler) Introspect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultIntrospect(c)
+	}
+}
+
+// Revoke revokes the tokens of clients, as RFC 7009 says.
+func (h *OAuthEndpointHandler) Revoke() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultRevoke(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) UserInfo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultUserInfo(c)
+	}
+}
+
+func (h *OAuthEndpointHandler) Logout(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultLogout(c, config)
+	}
+}
+
+// Discovery replies the OpenID Provider Metadata, for apps to configure
+// themselves.
+func (h *OAuthEndpointHandler) Discovery(config *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDiscovery(c, config)
+	}
+}
+
+func (h *OAuthEndpointHandler) JWKS(key *SigningKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultJWKS(c, key)
+	}
+}
+
+// usecases are the ones of the tenant set by ResolveTenant, or by
+// Authenticate for the authorization endpoint, as users authorize clients
+// of their own tenant.
+func (h *OAuthEndpointHandler) usecases(c *gin.Context) OAuthUsecase {
+	return h.oauthUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+func (h *OAuthEndpointHandler) defaultPostClient(c *gin.Context) {
+
+	name, ok := c.GetPostForm("name")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
+		return
+	}
+
+	confidential := false
+	if param, ok := c.GetPostForm("confidential"); ok {
+		var err error
+		if confidential, err = strconv.ParseBool(param); err != nil {
+			ErrorReply(c, http.StatusBadRequest, "Invalid value for confidential")
+			return
+		}
+	}
+
+	// Lists are space separated, like scopes are in OAuth
+	redirectURIs := strings.Fields(c.PostForm("redirect_uris"))
+	postLogoutRedirectURIs := strings.Fields(c.PostForm("post_logout_redirect_uris"))
+	scopes := strings.Fields(c.PostForm("scope"))
+
+	client, secret, err := h.usecases(c).CreateClient(name, confidential, redirectURIs, postLogoutRedirectURIs, scopes)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	reply := gin.H{"client": client}
+	if secret != "" {
+		reply["secret"] = secret
+	}
+	c.JSON(http.StatusCreated, reply)
+}
+
+func (h *OAuthEndpointHandler) defaultGetClients(c *gin.Context) {
+
+	clients, err := h.usecases(c).ListClients()
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+func (h *OAuthEndpointHandler) defaultGetClient(c *gin.Context) {
+
+	client, err := h.usecases(c).GetClient(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"client": client})
+}
+
+func (h *OAuthEndpointHandler) defaultDeleteClient(c *gin.Context) {
+
+	if err := h.usecases(c).DeleteClient(c.MustGet("id").(uint)); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// authorizeRequest validates the params of the authorization endpoint,
+// replying the error when they're invalid.
+func (h *OAuthEndpointHandler) authorizeRequest(c *gin.Context) (*AuthorizeRequest, bool) {
+
+	param := func(name string) string {
+		if value, ok := c.GetPostForm(name); ok {
+			return value
+		}
+		return c.Query(name)
+	}
+
+	request, err := h.usecases(c).Authorize(param("response_type"), param("client_id"), param("redirect_uri"),
+		param("scope"), param("state"), param("nonce"), param("code_challenge"), param("code_challenge_method"))
+	switch v := err.(type) {
+	case nil:
+		return request, true
+	case OAuthError:
+		params := url.Values{"error": {v.Code}, "error_description": {v.Description}}
+		c.JSON(v.Status, gin.H{"error": v.Code, "error_description": v.Description, "redirect": request.RedirectURL(params)})
+	case Error:
+		c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+	default:
+		panic(err)
+	}
+	return nil, false
+}
+
+func (h *OAuthEndpointHandler) defaultAuthorize(c *gin.Context) {
+
+	request, ok := h.authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	consented, err := h.usecases(c).Consented(c.MustGet("authenticatedID").(uint), request)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"client":    gin.H{"ClientID": request.Client.ClientID, "Name": request.Client.Name},
+		"scope":     request.Scope,
+		"consented": consented,
+	})
+}
+
+// defaultConsent takes consent=allow or deny, which can be left out once
+// the user allowed the scope of the request.
+func (h *OAuthEndpointHandler) defaultConsent(c *gin.Context) {
+
+	request, ok := h.authorizeRequest(c)
+	if !ok {
+		return
+	}
+	userID := c.MustGet("authenticatedID").(uint)
+
+	switch c.PostForm("consent") {
+	case "deny":
+		c.JSON(http.StatusOK, gin.H{"redirect": request.RedirectURL(url.Values{"error": {"access_denied"}})})
+		return
+	case "allow":
+	case "":
+		consented, err := h.usecases(c).Consented(userID, request)
+		if err != nil {
+			panic(err)
+		}
+		if !consented {
+			ErrorReply(c, http.StatusBadRequest, "Parameter consent missing")
+			return
+		}
+	default:
+		ErrorReply(c, http.StatusBadRequest, "Invalid value for consent, use allow or deny")
+		return
+	}
+
+	redirect, err := h.usecases(c).Approve(userID, c.MustGet("authTime").(time.Time), request)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": redirect})
+}
+
+// clientCredentials are the ones of HTTP Basic, telling so, or else the
+// client_id and client_secret params.
+func clientCredentials(c *gin.Context) (string, string, bool) {
+
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	return clientID, secret, basic
+}
+
+// oauthErrorReply replies err as RFC 6749 says, challenging clients that
+// failed to authenticate with HTTP Basic to retry.
+func oauthErrorReply(c *gin.Context, err error, basic bool) {
+
+	v, ok := err.(OAuthError)
+	if !ok {
+		panic(err)
+	}
+	if v.Code == errInvalidClient.Code && basic {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.JSON(v.Status, gin.H{"error": v.Code, "error_description": v.Description})
+}
+
+// defaultToken authenticates clients with clientCredentials, and replies as
+// RFC 6749 says, errors included.
+func (h *OAuthEndpointHandler) defaultToken(c *gin.Context) {
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, secret, basic := clientCredentials(c)
+	reply, err := h.token(c, clientID, secret)
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	c.JSON(http.StatusOK, reply)
+}
+
+func (h *OAuthEndpointHandler) token(c *gin.Context, clientID string, secret string) (*TokenResponse, error) {
+
+	client, err := h.oauthUsecaseHandler.AuthenticateClient(clientID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		code, redirectURI, verifier := c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier")
+		if code == "" || redirectURI == "" || verifier == "" {
+			return nil, OAuthError{http.StatusBadRequest, "invalid_request", "Parameters code, redirect_uri and code_verifier are required"}
+		}
+		return h.oauthUsecaseHandler.ExchangeCode(client, code, redirectURI, verifier)
+	case "refresh_token":
+		refreshToken := c.PostForm("refresh_token")
+		if refreshToken == "" {
+			return nil, OAuthError{http.StatusBadRequest, "invalid_request", "Parameter refresh_token missing"}
+		}
+		return h.oauthUsecaseHandler.Refresh(client, refreshToken, c.PostForm("scope"))
+	case "client_credentials":
+		return h.oauthUsecaseHandler.ClientCredentials(client, c.PostForm("scope"))
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		deviceCode := c.PostForm("device_code")
+		if deviceCode == "" {
+			return nil, OAuthError{http.StatusBadRequest, "invalid_request", "Parameter device_code missing"}
+		}
+		return h.oauthUsecaseHandler.DeviceToken(client, deviceCode)
+	case "":
+		return nil, OAuthError{http.StatusBadRequest, "invalid_request", "Parameter grant_type missing"}
+	default:
+		return nil, OAuthError{http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type " + grantType}
+	}
+}
+
+func (h *OAuthEndpointHandler) defaultDeviceAuthorization(c *gin.Context) {
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, secret, basic := clientCredentials(c)
+	client, err := h.oauthUsecaseHandler.AuthenticateClient(clientID, secret)
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	reply, err := h.oauthUsecaseHandler.DeviceAuthorization(client, c.PostForm("scope"))
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	c.JSON(http.StatusOK, reply)
+}
+
+func (h *OAuthEndpointHandler) defaultDevice(c *gin.Context) {
+
+	userCode, ok := c.GetQuery("user_code")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter user_code missing")
+		return
+	}
+
+	request, err := h.usecases(c).DeviceRequest(userCode)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"client":    gin.H{"ClientID": request.Client.ClientID, "Name": request.Client.Name},
+		"scope":     request.Scope,
+		"user_code": request.UserCode,
+	})
+}
+
+// defaultDecideDevice takes the user_code and consent=allow or deny.
+func (h *OAuthEndpointHandler) defaultDecideDevice(c *gin.Context) {
+
+	userCode, ok := c.GetPostForm("user_code")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter user_code missing")
+		return
+	}
+
+	var approve bool
+	switch c.PostForm("consent") {
+	case "allow":
+		approve = true
+	case "deny":
+	case "":
+		ErrorReply(c, http.StatusBadRequest, "Parameter consent missing")
+		return
+	default:
+		ErrorReply(c, http.StatusBadRequest, "Invalid value for consent, use allow or deny")
+		return
+	}
+
+	userID := c.MustGet("authenticatedID").(uint)
+	if err := h.usecases(c).DecideDevice(userID, c.MustGet("authTime").(time.Time), userCode, approve); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// defaultIntrospect ignores token_type_hint, as the tokens tell their type.
+func (h *OAuthEndpointHandler) defaultIntrospect(c *gin.Context) {
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	clientID, secret, basic := clientCredentials(c)
+	client, err := h.oauthUsecaseHandler.AuthenticateClient(clientID, secret)
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthErrorReply(c, OAuthError{http.StatusBadRequest, "invalid_request", "Parameter token missing"}, basic)
+		return
+	}
+
+	reply, err := h.oauthUsecaseHandler.Introspect(client, token)
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	c.JSON(http.StatusOK, reply)
+}
+
+// defaultRevoke ignores token_type_hint too, replying 200 without a body for
+// the tokens that need no revoking as well.
+func (h *OAuthEndpointHandler) defaultRevoke(c *gin.Context) {
+
+	clientID, secret, basic := clientCredentials(c)
+	client, err := h.oauthUsecaseHandler.AuthenticateClient(clientID, secret)
+	if err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthErrorReply(c, OAuthError{http.StatusBadRequest, "invalid_request", "Parameter token missing"}, basic)
+		return
+	}
+
+	if err := h.oauthUsecaseHandler.Revoke(client, token); err != nil {
+		oauthErrorReply(c, err, basic)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// defaultUserInfo serves the users authenticated by AccessToken.
+func (h *OAuthEndpointHandler) defaultUserInfo(c *gin.Context) {
+
+	claims, err := h.usecases(c).UserInfo(c.MustGet("authenticatedID").(uint), c.MustGet("scope").(Strings))
+	if err != nil {
+		v, ok := err.(OAuthError)
+		if !ok {
+			panic(err)
+		}
+		c.Header("WWW-Authenticate", `Bearer error="`+v.Code+`"`)
+		c.JSON(v.Status, gin.H{"error": v.Code, "error_description": v.Description})
+		return
+	}
+
+	c.JSON(http.StatusOK, claims)
+}
+
+// defaultLogout takes the params of RP-initiated logout, by GET or POST, and
+// goes through the logout page, when configured, so it forgets the login of
+// the user before continuing to the app.
+func (h *OAuthEndpointHandler) defaultLogout(c *gin.Context, config *Config) {
+
+	param := func(name string) string {
+		if value, ok := c.GetPostForm(name); ok {
+			return value
+		}
+		return c.Query(name)
+	}
+
+	redirect, err := h.oauthUsecaseHandler.Logout(param("id_token_hint"), param("client_id"), param("post_logout_redirect_uri"), param("state"))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	switch {
+	case config.OAuth.LogoutURL != "":
+		query := ""
+		if redirect != "" {
+			query = url.Values{"redirect": {redirect}}.Encode()
+		}
+		c.Redirect(http.StatusFound, addQuery(config.OAuth.LogoutURL, query))
+	case redirect != "":
+		c.Redirect(http.StatusFound, redirect)
+	default:
+		c.JSON(http.StatusOK, gin.H{"msg": "Logged out"})
+	}
+}
+
+func (h *OAuthEndpointHandler) defaultDiscovery(c *gin.Context, config *Config) {
+
+	// The endpoints are absolute URLs under the issuer
+	if config.Issuer == "" {
+		ErrorReply(c, http.StatusNotFound, "OpenID Connect needs the issuer of the service configured")
+		return
+	}
+
+	c.JSON(http.StatusOK, discovery(config))
+}
+
+func (h *OAuthEndpointHandler) defaultJWKS(c *gin.Context, key *SigningKey) {
+
+	c.JSON(http.StatusOK, gin.H{"keys": []interface{}{key.JWK()}})
+}
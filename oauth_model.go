@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// OAuthClient is an app signing its users in through this service. Public
+// clients, like single page and mobile apps, can't keep a secret and rely on
+// PKCE alone. Only the hash of the secret of confidential ones is stored.
+type OAuthClient struct {
+	ID           uint `gorm:"primary_key"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	TenantID     uint    `gorm:"not null;index" json:"-"`
+	ClientID     string  `gorm:"type:varchar(64);unique_index"`
+	SecretHash   string  `gorm:"type:varchar(64)" json:"-"`
+	Name         string  `gorm:"type:varchar(255)"`
+	Confidential bool    `gorm:"not null"`
+	RedirectURIs Strings `gorm:"type:text"`
+	Scopes       Strings `gorm:"type:text"` // the ones the client can ask for
+
+	PostLogoutRedirectURIs Strings `gorm:"type:text"`
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// OAuthCode is an authorization code, exchanged once for tokens by the client
+// it was issued to, with the verifier of its PKCE challenge.
+type OAuthCode struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	CodeHash      string `gorm:"type:varchar(64);unique_index"`
+	ClientID      uint   // the ID of the OAuthClient
+	TenantID      uint
+	UserID        uint
+	RedirectURI   string    `gorm:"type:text"`
+	Scope         string    `gorm:"type:text"`
+	CodeChallenge string    `gorm:"type:varchar(128)"` // S256 only
+	Nonce         string    `gorm:"type:varchar(255)"`
+	AuthTime      time.Time // when the user logged in
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+func (OAuthCode) TableName() string {
+	return "oauth_codes"
+}
+
+// OAuthRefreshToken is replaced by a new one each time it's used.
+type OAuthRefreshToken struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	TokenHash string `gorm:"type:varchar(64);unique_index"`
+	ClientID  uint   // the ID of the OAuthClient
+	TenantID  uint
+	UserID    uint
+	Scope     string `gorm:"type:text"`
+	AuthTime  time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+func (OAuthRefreshToken) TableName() string {
+	return "oauth_refresh_tokens"
+}
+
+// OAuthDeviceCode is a login of a device without a browser, like a CLI or a
+// TV, which polls with the device code until a user enters the user code on
+// another device and approves or denies it.
+type OAuthDeviceCode struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	DeviceCodeHash string `gorm:"type:varchar(64);unique_index"`
+	UserCode       string `gorm:"type:varchar(16);unique_index"` // normalized, without the dash
+	ClientID       uint   // the ID of the OAuthClient
+	TenantID       uint
+	Scope          string `gorm:"type:text"`
+	PollInterval   uint   // the seconds the device waits between polls
+	PolledAt       *time.Time
+	UserID         uint       // the user who approved or denied
+	AuthTime       *time.Time // when that user logged in
+	ApprovedAt     *time.Time
+	DeniedAt       *time.Time
+	ExpiresAt      time.Time
+}
+
+func (OAuthDeviceCode) TableName() string {
+	return "oauth_device_codes"
+}
+
+// RevokedToken is an access token revoked before it expires, kept until then.
+type RevokedToken struct {
+	JTI       string `gorm:"primary_key;type:varchar(64)"`
+	CreatedAt time.Time
+	ClientID  uint // the ID of the OAuthClient
+	ExpiresAt time.Time
+}
+
+func (RevokedToken) TableName() string {
+	return "revoked_tokens"
+}
+
+// OAuthConsent is the scope a user allowed a client, so it isn't asked again
+// for it.
+type OAuthConsent struct {
+	UserID    uint `gorm:"primary_key;auto_increment:false"`
+	ClientID  uint `gorm:"primary_key;auto_increment:false"` // the ID of the OAuthClient
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Scope     string `gorm:"type:text"`
+}
+
+func (OAuthConsent) TableName() string {
+	return "oauth_consents"
+}
+
+// Strings are stored as a JSON array.
+type Strings []string
+
+func (s Strings) Has(value string) bool {
+	for _, v := range s {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Strings) Value() (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal([]string(s))
+	return string(encoded), err
+}
+
+func (s *Strings) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*s = Strings{}
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return errors.New("strings: can't scan " + reflect.TypeOf(src).String())
+	}
+	if len(raw) == 0 {
+		*s = Strings{}
+		return nil
+	}
+	return json.Unmarshal(raw, (*[]string)(s))
+}
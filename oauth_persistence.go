@@ -0,0 +1,311 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type OAuthPersistence interface {
+	CreateClient(client *OAuthClient) error
+	FindClient(id uint) (*OAuthClient, error)
+	FindClientByClientID(clientID string) (*OAuthClient, error)
+	ListClients(tenantID uint) ([]OAuthClient, error)
+	// DeleteClient deletes client with its codes, refresh tokens and consents
+	DeleteClient(client *OAuthClient) error
+
+	CreateCode(code *OAuthCode) error
+	// UseCode marks the code with codeHash as used and returns it, failing
+	// with errOAuthCodeNotFound if it was used already, so it's used once,
+	// or if it expired or was issued to another client or redirect URI, so
+	// no one else can burn it.
+	UseCode(codeHash string, clientID uint, redirectURI string, at time.Time) (*OAuthCode, error)
+
+	CreateRefreshToken(token *OAuthRefreshToken) error
+	FindRefreshToken(tokenHash string) (*OAuthRefreshToken, error)
+	// RevokeRefreshToken revokes the token with tokenHash and returns it,
+	// failing with errRefreshTokenNotFound if it was revoked already, or if
+	// it expired or was issued to another client, so no one else can burn it.
+	RevokeRefreshToken(tokenHash string, clientID uint, at time.Time) (*OAuthRefreshToken, error)
+	// RevokeRefreshTokens revokes the tokens the client has for the user
+	RevokeRefreshTokens(userID uint, clientID uint, at time.Time) error
+
+	// CreateDeviceCode forgets the expired device codes first, and fails
+	// with errUserCodeInUse when another code has the user code of code.
+	CreateDeviceCode(code *OAuthDeviceCode) error
+	FindDeviceCode(deviceCodeHash string) (*OAuthDeviceCode, error)
+	FindDeviceCodeByUserCode(userCode string) (*OAuthDeviceCode, error)
+	// PollDeviceCode records a poll of the code with id, and the interval
+	// the device keeps from then on.
+	PollDeviceCode(id uint, at time.Time, interval uint) error
+	// DecideDeviceCode stores the user, auth time and approval or denial of
+	// code, failing with errDeviceCodeNotFound if it was decided already.
+	DecideDeviceCode(code *OAuthDeviceCode) error
+	// DeleteDeviceCode fails with errDeviceCodeNotFound if the code with id
+	// was deleted already, so its tokens are issued once.
+	DeleteDeviceCode(id uint) error
+
+	// RevokeAccessToken keeps token until it expires, forgetting the
+	// revoked tokens that did. Revoking a token twice is fine.
+	RevokeAccessToken(token *RevokedToken) error
+	IsAccessTokenRevoked(jti string) (bool, error)
+
+	// FindConsent returns nil when the user didn't consent to the client
+	FindConsent(userID uint, clientID uint) (*OAuthConsent, error)
+	SaveConsent(consent *OAuthConsent) error
+}
+
+var errOAuthClientNotFound = Error{Code: http.StatusNotFound, Message: "Client not found"}
+
+var errOAuthCodeNotFound = Error{Code: http.StatusBadRequest, Message: "Invalid or used authorization code"}
+
+var errRefreshTokenNotFound = Error{Code: http.StatusBadRequest, Message: "Invalid or revoked refresh token"}
+
+var errDeviceCodeNotFound = Error{Code: http.StatusNotFound, Message: "Invalid, expired or used code"}
+
+var errUserCodeInUse = Error{Code: http.StatusConflict, Message: "User code is already in use"}
+
+func (h *PersistenceHandler) CreateClient(client *OAuthClient) error {
+	return h.DB.Create(client).Error
+}
+
+func (h *PersistenceHandler) FindClient(id uint) (*OAuthClient, error) {
+	var client OAuthClient
+
+	r := h.DB.First(&client, id)
+	if r.RecordNotFound() {
+		return nil, errOAuthClientNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &client, nil
+}
+
+func (h *PersistenceHandler) FindClientByClientID(clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+
+	r := h.DB.Where("client_id = ?", clientID).First(&client)
+	if r.RecordNotFound() {
+		return nil, errOAuthClientNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &client, nil
+}
+
+func (h *PersistenceHandler) ListClients(tenantID uint) ([]OAuthClient, error) {
+	var clients []OAuthClient
+
+	if err := h.DB.Where("tenant_id = ?", tenantID).Order("id").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (h *PersistenceHandler) DeleteClient(client *OAuthClient) error {
+	return h.Transaction(func(tx Persistence) error {
+		db := tx.(*PersistenceHandler).DB
+		if err := db.Where("client_id = ?", client.ID).Delete(OAuthCode{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("client_id = ?", client.ID).Delete(OAuthRefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("client_id = ?", client.ID).Delete(OAuthConsent{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("client_id = ?", client.ID).Delete(OAuthDeviceCode{}).Error; err != nil {
+			return err
+		}
+		return db.Delete(client).Error
+	})
+}
+
+func (h *PersistenceHandler) CreateCode(code *OAuthCode) error {
+	return h.DB.Create(code).Error
+}
+
+func (h *PersistenceHandler) UseCode(codeHash string, clientID uint, redirectURI string, at time.Time) (*OAuthCode, error) {
+	r := h.DB.Model(&OAuthCode{}).
+		Where("code_hash = ? AND client_id = ? AND redirect_uri = ? AND expires_at > ? AND used_at IS NULL", codeHash, clientID, redirectURI, at).
+		Update("used_at", at)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	if r.RowsAffected == 0 {
+		return nil, errOAuthCodeNotFound
+	}
+
+	var code OAuthCode
+	if err := h.DB.Where("code_hash = ?", codeHash).First(&code).Error; err != nil {
+		return nil, err
+	}
+
+	return &code, nil
+}
+
+func (h *PersistenceHandler) CreateRefreshToken(token *OAuthRefreshToken) error {
+	return h.DB.Create(token).Error
+}
+
+func (h *PersistenceHandler) FindRefreshToken(tokenHash string) (*OAuthRefreshToken, error) {
+	var token OAuthRefreshToken
+
+	r := h.DB.Where("token_hash = ?", tokenHash).First(&token)
+	if r.RecordNotFound() {
+		return nil, errRefreshTokenNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &token, nil
+}
+
+func (h *PersistenceHandler) RevokeRefreshToken(tokenHash string, clientID uint, at time.Time) (*OAuthRefreshToken, error) {
+	r := h.DB.Model(&OAuthRefreshToken{}).
+		Where("token_hash = ? AND client_id = ? AND expires_at > ? AND revoked_at IS NULL", tokenHash, clientID, at).
+		Update("revoked_at", at)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	if r.RowsAffected == 0 {
+		return nil, errRefreshTokenNotFound
+	}
+
+	var token OAuthRefreshToken
+	if err := h.DB.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (h *PersistenceHandler) RevokeRefreshTokens(userID uint, clientID uint, at time.Time) error {
+	return h.DB.Model(&OAuthRefreshToken{}).
+		Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", userID, clientID).
+		Update("revoked_at", at).Error
+}
+
+func (h *PersistenceHandler) CreateDeviceCode(code *OAuthDeviceCode) error {
+	if err := h.DB.Where("expires_at < ?", time.Now()).Delete(OAuthDeviceCode{}).Error; err != nil {
+		return err
+	}
+	if err := h.DB.Create(code).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errUserCodeInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) FindDeviceCode(deviceCodeHash string) (*OAuthDeviceCode, error) {
+	return h.findDeviceCode("device_code_hash = ?", deviceCodeHash)
+}
+
+func (h *PersistenceHandler) FindDeviceCodeByUserCode(userCode string) (*OAuthDeviceCode, error) {
+	return h.findDeviceCode("user_code = ?", userCode)
+}
+
+func (h *PersistenceHandler) findDeviceCode(query string, value string) (*OAuthDeviceCode, error) {
+	var code OAuthDeviceCode
+
+	r := h.DB.Where(query, value).First(&code)
+	if r.RecordNotFound() {
+		return nil, errDeviceCodeNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &code, nil
+}
+
+func (h *PersistenceHandler) PollDeviceCode(id uint, at time.Time, interval uint) error {
+	return h.DB.Model(&OAuthDeviceCode{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"polled_at": at, "poll_interval": interval}).Error
+}
+
+func (h *PersistenceHandler) DecideDeviceCode(code *OAuthDeviceCode) error {
+	r := h.DB.Model(&OAuthDeviceCode{}).
+		Where("id = ? AND approved_at IS NULL AND denied_at IS NULL", code.ID).
+		Updates(map[string]interface{}{
+			"user_id":     code.UserID,
+			"auth_time":   code.AuthTime,
+			"approved_at": code.ApprovedAt,
+			"denied_at":   code.DeniedAt,
+		})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errDeviceCodeNotFound
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) DeleteDeviceCode(id uint) error {
+	r := h.DB.Where("id = ?", id).Delete(OAuthDeviceCode{})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected == 0 {
+		return errDeviceCodeNotFound
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) RevokeAccessToken(token *RevokedToken) error {
+	if err := h.DB.Where("expires_at < ?", time.Now()).Delete(RevokedToken{}).Error; err != nil {
+		return err
+	}
+	if err := h.DB.Create(token).Error; err != nil && !isUniqueViolation(err) {
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) IsAccessTokenRevoked(jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+
+	var count int
+	if err := h.DB.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (h *PersistenceHandler) FindConsent(userID uint, clientID uint) (*OAuthConsent, error) {
+	var consent OAuthConsent
+
+	r := h.DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent)
+	if r.RecordNotFound() {
+		return nil, nil
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &consent, nil
+}
+
+func (h *PersistenceHandler) SaveConsent(consent *OAuthConsent) error {
+	r := h.DB.Model(&OAuthConsent{}).
+		Where("user_id = ? AND client_id = ?", consent.UserID, consent.ClientID).
+		Updates(map[string]interface{}{"scope": consent.Scope, "updated_at": time.Now()})
+	if r.Error != nil {
+		return r.Error
+	}
+	if r.RowsAffected > 0 {
+		return nil
+	}
+	return h.DB.Create(consent).Error
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateClient(client *OAuthClient) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextClientID++
+	client.ID = h.nextClientID
+	now := time.Now()
+	client.CreatedAt, client.UpdatedAt = now, now
+
+	stored := *client
+	h.clients[client.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindClient(id uint) (*OAuthClient, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.clients[id]
+	if !ok {
+		return nil, errOAuthClientNotFound
+	}
+
+	client := *stored
+	return &client, nil
+}
+
+func (h *MemoryPersistence) FindClientByClientID(clientID string) (*OAuthClient, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.clients {
+		if stored.ClientID == clientID {
+			client := *stored
+			return &client, nil
+		}
+	}
+	return nil, errOAuthClientNotFound
+}
+
+func (h *MemoryPersistence) ListClients(tenantID uint) ([]OAuthClient, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var clients []OAuthClient
+	for _, stored := range h.clients {
+		if stored.TenantID == tenantID {
+			clients = append(clients, *stored)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients, nil
+}
+
+func (h *MemoryPersistence) DeleteClient(client *OAuthClient) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for hash, code := range h.codes {
+		if code.ClientID == client.ID {
+			delete(h.codes, hash)
+		}
+	}
+	for hash, token := range h.refreshTokens {
+		if token.ClientID == client.ID {
+			delete(h.refreshTokens, hash)
+		}
+	}
+	for key := range h.consents {
+		if key[1] == client.ID {
+			delete(h.consents, key)
+		}
+	}
+	for id, code := range h.deviceCodes {
+		if code.ClientID == client.ID {
+			delete(h.deviceCodes, id)
+		}
+	}
+	delete(h.clients, client.ID)
+	return nil
+}
+
+func (h *MemoryPersistence) CreateCode(code *OAuthCode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextCodeID++
+	code.ID = h.nextCodeID
+	code.CreatedAt = time.Now()
+
+	stored := *code
+	h.codes[code.CodeHash] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) UseCode(codeHash string, clientID uint, redirectURI string, at time.Time) (*OAuthCode, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.codes[codeHash]
+	if !ok || stored.ClientID != clientID || stored.RedirectURI != redirectURI || !at.Before(stored.ExpiresAt) || stored.UsedAt != nil {
+		return nil, errOAuthCodeNotFound
+	}
+	stored.UsedAt = &at
+
+	code := *stored
+	return &code, nil
+}
+
+func (h *MemoryPersistence) CreateRefreshToken(token *OAuthRefreshToken) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextRefreshTokenID++
+	token.ID = h.nextRefreshTokenID
+	token.CreatedAt = time.Now()
+
+	stored := *token
+	h.refreshTokens[token.TokenHash] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindRefreshToken(tokenHash string) (*OAuthRefreshToken, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.refreshTokens[tokenHash]
+	if !ok {
+		return nil, errRefreshTokenNotFound
+	}
+
+	token := *stored
+	return &token, nil
+}
+
+func (h *MemoryPersistence) RevokeRefreshToken(tokenHash string, clientID uint, at time.Time) (*OAuthRefreshToken, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.refreshTokens[tokenHash]
+	if !ok || stored.ClientID != clientID || !at.Before(stored.ExpiresAt) || stored.RevokedAt != nil {
+		return nil, errRefreshTokenNotFound
+	}
+	stored.RevokedAt = &at
+
+	token := *stored
+	return &token, nil
+}
+
+func (h *MemoryPersistence) RevokeRefreshTokens(userID uint, clientID uint, at time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, stored := range h.refreshTokens {
+		if stored.UserID == userID && stored.ClientID == clientID && stored.RevokedAt == nil {
+			revokedAt := at
+			stored.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (h *MemoryPersistence) CreateDeviceCode(code *OAuthDeviceCode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for id, stored := range h.deviceCodes {
+		if stored.ExpiresAt.Before(now) {
+			delete(h.deviceCodes, id)
+		}
+	}
+	for _, stored := range h.deviceCodes {
+		if stored.UserCode == code.UserCode {
+			return errUserCodeInUse
+		}
+	}
+
+	h.nextDeviceCodeID++
+	code.ID = h.nextDeviceCodeID
+	code.CreatedAt = now
+
+	stored := *code
+	h.deviceCodes[code.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindDeviceCode(deviceCodeHash string) (*OAuthDeviceCode, error) {
+	return h.findDeviceCode(func(code *OAuthDeviceCode) bool { return code.DeviceCodeHash == deviceCodeHash })
+}
+
+func (h *MemoryPersistence) FindDeviceCodeByUserCode(userCode string) (*OAuthDeviceCode, error) {
+	return h.findDeviceCode(func(code *OAuthDeviceCode) bool { return code.UserCode == userCode })
+}
+
+func (h *MemoryPersistence) findDeviceCode(match func(code *OAuthDeviceCode) bool) (*OAuthDeviceCode, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.deviceCodes {
+		if match(stored) {
+			code := *stored
+			return &code, nil
+		}
+	}
+	return nil, errDeviceCodeNotFound
+}
+
+func (h *MemoryPersistence) PollDeviceCode(id uint, at time.Time, interval uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if stored, ok := h.deviceCodes[id]; ok {
+		stored.PolledAt = &at
+		stored.PollInterval = interval
+	}
+	return nil
+}
+
+func (h *MemoryPersistence) DecideDeviceCode(code *OAuthDeviceCode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.deviceCodes[code.ID]
+	if !ok || stored.ApprovedAt != nil || stored.DeniedAt != nil {
+		return errDeviceCodeNotFound
+	}
+	stored.UserID = code.UserID
+	stored.AuthTime = code.AuthTime
+	stored.ApprovedAt = code.ApprovedAt
+	stored.DeniedAt = code.DeniedAt
+	return nil
+}
+
+func (h *MemoryPersistence) DeleteDeviceCode(id uint) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.deviceCodes[id]; !ok {
+		return errDeviceCodeNotFound
+	}
+	delete(h.deviceCodes, id)
+	return nil
+}
+
+func (h *MemoryPersistence) RevokeAccessToken(token *RevokedToken) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for jti, stored := range h.revokedTokens {
+		if stored.ExpiresAt.Before(now) {
+			delete(h.revokedTokens, jti)
+		}
+	}
+	if _, ok := h.revokedTokens[token.JTI]; ok {
+		return nil
+	}
+	token.CreatedAt = now
+
+	stored := *token
+	h.revokedTokens[token.JTI] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) IsAccessTokenRevoked(jti string) (bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := h.revokedTokens[jti]
+	return ok, nil
+}
+
+func (h *MemoryPersistence) FindConsent(userID uint, clientID uint) (*OAuthConsent, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.consents[[2]uint{userID, clientID}]
+	if !ok {
+		return nil, nil
+	}
+
+	consent := *stored
+	return &consent, nil
+}
+
+func (h *MemoryPersistence) SaveConsent(consent *OAuthConsent) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	key := [2]uint{consent.UserID, consent.ClientID}
+	if stored, ok := h.consents[key]; ok {
+		stored.Scope = consent.Scope
+		stored.UpdatedAt = now
+		return nil
+	}
+	consent.CreatedAt, consent.UpdatedAt = now, now
+
+	stored := *consent
+	h.consents[key] = &stored
+	return nil
+}
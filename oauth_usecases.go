@@ -0,0 +1,922 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type OAuthUsecase interface {
+	// ForTenant returns the usecases confined to the clients of a tenant
+	ForTenant(tenantID uint) OAuthUsecase
+	// CreateClient returns the secret of confidential clients, which can't be
+	// read again
+	CreateClient(name string, confidential bool, redirectURIs []string, postLogoutRedirectURIs []string, scopes []string) (*OAuthClient, string, error)
+	ListClients() ([]OAuthClient, error)
+	GetClient(id uint) (*OAuthClient, error)
+	DeleteClient(id uint) error
+	// Authorize validates a request of the authorization endpoint. Errors
+	// other than OAuthError come with no request, as the redirect URI can't
+	// be trusted, and OAuthError ones with the request to redirect them to.
+	Authorize(responseType string, clientID string, redirectURI string, scope string, state string, nonce string, codeChallenge string, codeChallengeMethod string) (*AuthorizeRequest, error)
+	// Consented tells whether the user allowed the client the scope of
+	// request before
+	Consented(userID uint, request *AuthorizeRequest) (bool, error)
+	// Approve issues a code for the user, who logged in at authTime,
+	// remembering its consent, and returns the URL redirecting the code to
+	// the client
+	Approve(userID uint, authTime time.Time, request *AuthorizeRequest) (string, error)
+	// AuthenticateClient checks the secret of confidential clients, public
+	// ones having none
+	AuthenticateClient(clientID string, secret string) (*OAuthClient, error)
+	ExchangeCode(client *OAuthClient, code string, redirectURI string, codeVerifier string) (*TokenResponse, error)
+	Refresh(client *OAuthClient, refreshToken string, scope string) (*TokenResponse, error)
+	ClientCredentials(client *OAuthClient, scope string) (*TokenResponse, error)
+	// DeviceAuthorization starts a login of a device of the client, which
+	// shows the user code and verification URI to its user
+	DeviceAuthorization(client *OAuthClient, scope string) (*DeviceAuthorization, error)
+	// DeviceRequest tells the user who entered userCode what it's asked
+	DeviceRequest(userCode string) (*DeviceRequest, error)
+	// DecideDevice approves or denies the login of the device of userCode
+	// for the user, who logged in at authTime
+	DecideDevice(userID uint, authTime time.Time, userCode string, approve bool) error
+	// DeviceToken answers the polls of the device, issuing its tokens once
+	// the login is approved
+	DeviceToken(client *OAuthClient, deviceCode string) (*TokenResponse, error)
+	// Introspect tells the client whether token is active, and about it if
+	// so. Tokens it can't know about are inactive, not errors.
+	Introspect(client *OAuthClient, token string) (*Introspection, error)
+	// Revoke revokes an access or refresh token issued to the client.
+	// Invalid and expired tokens need no revoking, so they aren't errors.
+	Revoke(client *OAuthClient, token string) error
+	// UserInfo are the claims about the user its access token grants
+	UserInfo(userID uint, scope []string) (map[string]interface{}, error)
+	// Logout ends the session of the user of idTokenHint with its client,
+	// returning where to redirect it to, if anywhere
+	Logout(idTokenHint string, clientID string, postLogoutRedirectURI string, state string) (string, error)
+}
+
+type OAuthUsecaseHandler struct {
+	oauthPersistence   OAuthPersistence
+	persistenceHandler Persistence
+	issuer             *TokenIssuer
+	config             *Config
+	tenantID           uint
+}
+
+func (h *OAuthUsecaseHandler) ForTenant(tenantID uint) OAuthUsecase {
+	return &OAuthUsecaseHandler{h.oauthPersistence, h.persistenceHandler, h.issuer, h.config, tenantID}
+}
+
+// OAuthError is an error of the OAuth protocol, replied with the error codes
+// of RFC 6749.
+type OAuthError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+var errInvalidClient = OAuthError{http.StatusUnauthorized, "invalid_client", "Client authentication failed"}
+
+var errInvalidGrant = OAuthError{http.StatusBadRequest, "invalid_grant", "The grant is invalid, expired, used or issued to another client"}
+
+// AuthorizeRequest is a validated request of the authorization endpoint.
+type AuthorizeRequest struct {
+	Client        *OAuthClient
+	RedirectURI   string
+	Scope         []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+// RedirectURL adds params and the state of the request to its redirect URI.
+func (r *AuthorizeRequest) RedirectURL(params url.Values) string {
+	if r.State != "" {
+		params.Set("state", r.State)
+	}
+	return addQuery(r.RedirectURI, params.Encode())
+}
+
+// TokenResponse is the reply of the token endpoint.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// DeviceAuthorization is the reply of the device authorization endpoint, as
+// RFC 8628 says.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                uint   `json:"interval"`
+}
+
+// DeviceRequest is a pending login of a device, as its user sees it.
+type DeviceRequest struct {
+	Client   *OAuthClient
+	Scope    []string
+	UserCode string
+}
+
+// Introspection is the reply of the introspection endpoint, as RFC 7662 says.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Subject   string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// CreateClient takes no redirect URIs for the clients that only log in
+// devices or act on their own behalf, like CLI tools.
+func (h *OAuthUsecaseHandler) CreateClient(name string, confidential bool, redirectURIs []string, postLogoutRedirectURIs []string, scopes []string) (*OAuthClient, string, error) {
+
+	if name = strings.TrimSpace(name); name == "" || len(name) > 255 {
+		return nil, "", Error{Code: http.StatusBadRequest, Message: "Invalid value for name"}
+	}
+	for _, uris := range [][]string{redirectURIs, postLogoutRedirectURIs} {
+		for _, uri := range uris {
+			if !validRedirectURI(uri) {
+				return nil, "", Error{Code: http.StatusBadRequest, Message: "Invalid redirect URI " + uri + ", use an absolute URI without fragment, with https unless on localhost"}
+			}
+		}
+	}
+	for _, scope := range scopes {
+		if !h.validScope(scope) {
+			return nil, "", Error{Code: http.StatusBadRequest, Message: "Invalid scope " + scope}
+		}
+	}
+
+	clientID, _ := newOpaqueToken()
+	client := OAuthClient{
+		TenantID:     h.tenantID,
+		ClientID:     clientID,
+		Name:         name,
+		Confidential: confidential,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+
+		PostLogoutRedirectURIs: postLogoutRedirectURIs,
+	}
+	var secret string
+	if confidential {
+		secret, client.SecretHash = newOpaqueToken()
+	}
+	if err := h.oauthPersistence.CreateClient(&client); err != nil {
+		panic(err)
+	}
+
+	return &client, secret, nil
+}
+
+func (h *OAuthUsecaseHandler) ListClients() ([]OAuthClient, error) {
+
+	clients, err := h.oauthPersistence.ListClients(h.tenantID)
+	if err != nil {
+		panic(err)
+	}
+
+	return clients, nil
+}
+
+func (h *OAuthUsecaseHandler) GetClient(id uint) (*OAuthClient, error) {
+
+	client, err := h.oauthPersistence.FindClient(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if client.TenantID != h.tenantID {
+		return nil, errOAuthClientNotFound
+	}
+
+	return client, nil
+}
+
+// DeleteClient stops its refresh tokens from working, while its access
+// tokens last until they expire.
+func (h *OAuthUsecaseHandler) DeleteClient(id uint) error {
+
+	client, err := h.GetClient(id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.oauthPersistence.DeleteClient(client); err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+func (h *OAuthUsecaseHandler) Authorize(responseType string, clientID string, redirectURI string, scope string, state string, nonce string, codeChallenge string, codeChallengeMethod string) (*AuthorizeRequest, error) {
+
+	client, err := h.oauthPersistence.FindClientByClientID(clientID)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			panic(err)
+		}
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for client_id"}
+	}
+	if client.TenantID != h.tenantID {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for client_id"}
+	}
+
+	// Redirect URIs are matched exactly, and always required so the token
+	// endpoint can match them too
+	if redirectURI == "" {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Parameter redirect_uri missing"}
+	}
+	if !client.RedirectURIs.Has(redirectURI) {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for redirect_uri, it isn't registered for the client"}
+	}
+
+	request := &AuthorizeRequest{Client: client, RedirectURI: redirectURI, State: state, Nonce: nonce, CodeChallenge: codeChallenge}
+
+	if responseType != "code" {
+		return request, OAuthError{http.StatusBadRequest, "unsupported_response_type", "Only the code response type is supported"}
+	}
+	if codeChallenge == "" {
+		return request, OAuthError{http.StatusBadRequest, "invalid_request", "PKCE is required, send code_challenge"}
+	}
+	if codeChallengeMethod != "S256" {
+		return request, OAuthError{http.StatusBadRequest, "invalid_request", "Only the S256 code_challenge_method is supported"}
+	}
+	if len(codeChallenge) != 43 {
+		return request, OAuthError{http.StatusBadRequest, "invalid_request", "Invalid code_challenge"}
+	}
+	if len(nonce) > 255 {
+		return request, OAuthError{http.StatusBadRequest, "invalid_request", "Invalid nonce, use up to 255 characters"}
+	}
+
+	if request.Scope, err = clientScope(client.Scopes, scope); err != nil {
+		return request, err
+	}
+
+	return request, nil
+}
+
+func (h *OAuthUsecaseHandler) Consented(userID uint, request *AuthorizeRequest) (bool, error) {
+
+	consent, err := h.oauthPersistence.FindConsent(userID, request.Client.ID)
+	if err != nil {
+		panic(err)
+	}
+	if consent == nil {
+		return false, nil
+	}
+
+	allowed := Strings(strings.Fields(consent.Scope))
+	for _, scope := range request.Scope {
+		if !allowed.Has(scope) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (h *OAuthUsecaseHandler) Approve(userID uint, authTime time.Time, request *AuthorizeRequest) (string, error) {
+
+	consent, err := h.oauthPersistence.FindConsent(userID, request.Client.ID)
+	if err != nil {
+		panic(err)
+	}
+	allowed := Strings{}
+	if consent != nil {
+		allowed = strings.Fields(consent.Scope)
+	}
+	for _, scope := range request.Scope {
+		if !allowed.Has(scope) {
+			allowed = append(allowed, scope)
+		}
+	}
+	if err := h.oauthPersistence.SaveConsent(&OAuthConsent{UserID: userID, ClientID: request.Client.ID, Scope: strings.Join(allowed, " ")}); err != nil {
+		panic(err)
+	}
+
+	code, hash := newOpaqueToken()
+	authorization := OAuthCode{
+		CodeHash:      hash,
+		ClientID:      request.Client.ID,
+		TenantID:      request.Client.TenantID,
+		UserID:        userID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         strings.Join(request.Scope, " "),
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+		AuthTime:      authTime,
+		ExpiresAt:     time.Now().Add(time.Duration(h.config.OAuth.CodeExpiryInSeconds) * time.Second),
+	}
+	if err := h.oauthPersistence.CreateCode(&authorization); err != nil {
+		panic(err)
+	}
+
+	return request.RedirectURL(url.Values{"code": {code}}), nil
+}
+
+func (h *OAuthUsecaseHandler) AuthenticateClient(clientID string, secret string) (*OAuthClient, error) {
+
+	client, err := h.oauthPersistence.FindClientByClientID(clientID)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			panic(err)
+		}
+		return nil, errInvalidClient
+	}
+
+	if client.Confidential {
+		if subtle.ConstantTimeCompare([]byte(hashOpaqueToken(secret)), []byte(client.SecretHash)) != 1 {
+			return nil, errInvalidClient
+		}
+	} else if secret != "" {
+		return nil, errInvalidClient
+	}
+
+	return client, nil
+}
+
+// ExchangeCode only uses the code when it was issued to client for
+// redirectURI, so another client can't burn it.
+func (h *OAuthUsecaseHandler) ExchangeCode(client *OAuthClient, code string, redirectURI string, codeVerifier string) (*TokenResponse, error) {
+
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return nil, OAuthError{http.StatusBadRequest, "invalid_request", "Invalid code_verifier"}
+	}
+
+	authorization, err := h.oauthPersistence.UseCode(hashOpaqueToken(code), client.ID, redirectURI, time.Now())
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+
+	sum := sha256.Sum256([]byte(codeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(authorization.CodeChallenge)) != 1 {
+		return nil, errInvalidGrant
+	}
+
+	scope := strings.Fields(authorization.Scope)
+	return h.userTokens(client, authorization.TenantID, authorization.UserID, scope, scope, authorization.Nonce, authorization.AuthTime)
+}
+
+// Refresh replaces refreshToken, so each one is used once, and only by the
+// client it was issued to. The scope of the access token can be narrowed,
+// but not widened, the new refresh token keeping the whole scope. Asking for
+// a wider one leaves refreshToken usable.
+func (h *OAuthUsecaseHandler) Refresh(client *OAuthClient, refreshToken string, scope string) (*TokenResponse, error) {
+
+	hash := hashOpaqueToken(refreshToken)
+	token, err := h.oauthPersistence.FindRefreshToken(hash)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+	if token.ClientID != client.ID || token.RevokedAt != nil || !time.Now().Before(token.ExpiresAt) {
+		return nil, errInvalidGrant
+	}
+
+	granted := strings.Fields(token.Scope)
+	narrowed, err := clientScope(granted, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if token, err = h.oauthPersistence.RevokeRefreshToken(hash, client.ID, time.Now()); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+
+	return h.userTokens(client, token.TenantID, token.UserID, granted, narrowed, "", token.AuthTime)
+}
+
+// ClientCredentials issues a token for the client itself, only to the
+// confidential ones.
+func (h *OAuthUsecaseHandler) ClientCredentials(client *OAuthClient, scope string) (*TokenResponse, error) {
+
+	if !client.Confidential {
+		return nil, OAuthError{http.StatusBadRequest, "unauthorized_client", "Public clients can't use the client_credentials grant"}
+	}
+
+	granted, err := clientScope(client.Scopes, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Duration(h.config.OAuth.AccessTokenExpiryInMinutes) * time.Minute
+	accessToken, err := h.issuer.ClientToken(client, granted, expiry)
+	if err != nil {
+		panic(err)
+	}
+
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(expiry.Seconds()),
+		Scope:       strings.Join(granted, " "),
+	}, nil
+}
+
+// DeviceAuthorization needs the page where users enter user codes
+// configured. Those codes are short, for users to type them, but expire.
+func (h *OAuthUsecaseHandler) DeviceAuthorization(client *OAuthClient, scope string) (*DeviceAuthorization, error) {
+
+	if h.config.OAuth.DeviceURL == "" {
+		return nil, OAuthError{http.StatusBadRequest, "unauthorized_client", "The device authorization grant isn't configured"}
+	}
+
+	granted, err := clientScope(client.Scopes, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Duration(h.config.OAuth.DeviceCodeExpiryInSeconds) * time.Second
+	deviceCode, hash := newOpaqueToken()
+	code := OAuthDeviceCode{
+		DeviceCodeHash: hash,
+		ClientID:       client.ID,
+		TenantID:       client.TenantID,
+		Scope:          strings.Join(granted, " "),
+		PollInterval:   h.config.OAuth.DevicePollIntervalInSeconds,
+		ExpiresAt:      time.Now().Add(expiry),
+	}
+	// User codes are unique among the pending ones, which seldom collide
+	for attempt := 0; ; attempt++ {
+		code.UserCode = newUserCode()
+		err := h.oauthPersistence.CreateDeviceCode(&code)
+		if err == nil {
+			break
+		}
+		if err != errUserCodeInUse || attempt == 2 {
+			panic(err)
+		}
+	}
+
+	userCode := formatUserCode(code.UserCode)
+	return &DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         h.config.OAuth.DeviceURL,
+		VerificationURIComplete: addQuery(h.config.OAuth.DeviceURL, url.Values{"user_code": {userCode}}.Encode()),
+		ExpiresIn:               int64(expiry.Seconds()),
+		Interval:                code.PollInterval,
+	}, nil
+}
+
+func (h *OAuthUsecaseHandler) DeviceRequest(userCode string) (*DeviceRequest, error) {
+
+	code, client, err := h.pendingDeviceCode(userCode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceRequest{Client: client, Scope: strings.Fields(code.Scope), UserCode: formatUserCode(code.UserCode)}, nil
+}
+
+// DecideDevice asks for the consent of the user each time, as a user code
+// can be passed on to phish the user.
+func (h *OAuthUsecaseHandler) DecideDevice(userID uint, authTime time.Time, userCode string, approve bool) error {
+
+	code, _, err := h.pendingDeviceCode(userCode)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	code.UserID = userID
+	code.AuthTime = &authTime
+	if approve {
+		code.ApprovedAt = &now
+	} else {
+		code.DeniedAt = &now
+	}
+	if err := h.oauthPersistence.DecideDeviceCode(code); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		panic(err)
+	}
+
+	return nil
+}
+
+// pendingDeviceCode is the device code of userCode, if it's for a client of
+// the tenant and neither expired nor decided, with its client.
+func (h *OAuthUsecaseHandler) pendingDeviceCode(userCode string) (*OAuthDeviceCode, *OAuthClient, error) {
+
+	code, err := h.oauthPersistence.FindDeviceCodeByUserCode(normalizeUserCode(userCode))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, nil, err
+		}
+		panic(err)
+	}
+	if code.TenantID != h.tenantID || !time.Now().Before(code.ExpiresAt) || code.ApprovedAt != nil || code.DeniedAt != nil {
+		return nil, nil, errDeviceCodeNotFound
+	}
+
+	client, err := h.oauthPersistence.FindClient(code.ClientID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, nil, errDeviceCodeNotFound
+		}
+		panic(err)
+	}
+
+	return code, client, nil
+}
+
+// DeviceToken tells devices polling faster than their interval to slow
+// down, adding 5 seconds to it, as RFC 8628 says.
+func (h *OAuthUsecaseHandler) DeviceToken(client *OAuthClient, deviceCode string) (*TokenResponse, error) {
+
+	now := time.Now()
+	code, err := h.oauthPersistence.FindDeviceCode(hashOpaqueToken(deviceCode))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+	if code.ClientID != client.ID {
+		return nil, errInvalidGrant
+	}
+	if !now.Before(code.ExpiresAt) {
+		return nil, OAuthError{http.StatusBadRequest, "expired_token", "The device code expired, start over"}
+	}
+
+	switch {
+	case code.DeniedAt != nil:
+		if err := h.oauthPersistence.DeleteDeviceCode(code.ID); err != nil {
+			if _, ok := err.(Error); !ok {
+				panic(err)
+			}
+		}
+		return nil, OAuthError{http.StatusBadRequest, "access_denied", "The user denied the login"}
+	case code.ApprovedAt == nil:
+		interval := code.PollInterval
+		tooSoon := code.PolledAt != nil && now.Sub(*code.PolledAt) < time.Duration(interval)*time.Second
+		if tooSoon {
+			interval += 5
+		}
+		if err := h.oauthPersistence.PollDeviceCode(code.ID, now, interval); err != nil {
+			panic(err)
+		}
+		if tooSoon {
+			return nil, OAuthError{http.StatusBadRequest, "slow_down", "Polling too fast, wait " + strconv.FormatUint(uint64(interval), 10) + " seconds between polls"}
+		}
+		return nil, OAuthError{http.StatusBadRequest, "authorization_pending", "The user hasn't approved the login yet"}
+	}
+
+	if err := h.oauthPersistence.DeleteDeviceCode(code.ID); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+
+	scope := strings.Fields(code.Scope)
+	return h.userTokens(client, code.TenantID, code.UserID, scope, scope, "", *code.AuthTime)
+}
+
+// Introspect is for the resource servers of a tenant, registered as
+// confidential clients of it. They learn about the access tokens of the
+// tenant, the ones of logins included, and about their own refresh tokens.
+func (h *OAuthUsecaseHandler) Introspect(client *OAuthClient, token string) (*Introspection, error) {
+
+	if !client.Confidential {
+		return nil, OAuthError{http.StatusBadRequest, "unauthorized_client", "Public clients can't introspect tokens"}
+	}
+
+	if claims, ok := ValidateToken(h.config, token); ok {
+		revoked, err := h.oauthPersistence.IsAccessTokenRevoked(claims.Id)
+		if err != nil {
+			panic(err)
+		}
+		if revoked || claims.TenantID() != client.TenantID {
+			return &Introspection{}, nil
+		}
+		return &Introspection{
+			Active:    true,
+			Subject:   claims.Subject,
+			ExpiresAt: claims.ExpiresAt,
+			IssuedAt:  claims.IssuedAt,
+			Issuer:    claims.Issuer,
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			TokenType: "Bearer",
+		}, nil
+	}
+
+	refreshToken, err := h.oauthPersistence.FindRefreshToken(hashOpaqueToken(token))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return &Introspection{}, nil
+		}
+		panic(err)
+	}
+	if refreshToken.ClientID != client.ID || refreshToken.RevokedAt != nil || !time.Now().Before(refreshToken.ExpiresAt) {
+		return &Introspection{}, nil
+	}
+
+	return &Introspection{
+		Active:    true,
+		Subject:   strconv.FormatUint(uint64(refreshToken.UserID), 10),
+		ExpiresAt: refreshToken.ExpiresAt.Unix(),
+		IssuedAt:  refreshToken.CreatedAt.Unix(),
+		Issuer:    tokenIssuer(h.config),
+		Scope:     refreshToken.Scope,
+		ClientID:  client.ClientID,
+		TokenType: "refresh_token",
+	}, nil
+}
+
+// Revoke keeps revoked access tokens until they expire, for AccessToken and
+// Introspect to reject them. The tokens issued before access tokens had ids
+// can't be revoked, but expire soon.
+func (h *OAuthUsecaseHandler) Revoke(client *OAuthClient, token string) error {
+
+	errOtherClient := OAuthError{http.StatusBadRequest, "unauthorized_client", "The token was issued to another client"}
+
+	if claims, ok := ValidateToken(h.config, token); ok {
+		if claims.ClientID != client.ClientID {
+			return errOtherClient
+		}
+		if claims.Id == "" {
+			return nil
+		}
+		revoked := RevokedToken{JTI: claims.Id, ClientID: client.ID, ExpiresAt: time.Unix(claims.ExpiresAt, 0)}
+		if err := h.oauthPersistence.RevokeAccessToken(&revoked); err != nil {
+			panic(err)
+		}
+		return nil
+	}
+
+	hash := hashOpaqueToken(token)
+	refreshToken, err := h.oauthPersistence.FindRefreshToken(hash)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil
+		}
+		panic(err)
+	}
+	if refreshToken.ClientID != client.ID {
+		return errOtherClient
+	}
+	if _, err := h.oauthPersistence.RevokeRefreshToken(hash, client.ID, time.Now()); err != nil {
+		if _, ok := err.(Error); !ok {
+			panic(err)
+		}
+	}
+
+	return nil
+}
+
+// userTokens issues an access token with scope and a refresh token with
+// granted to client for the user, if it still exists, and an ID token with
+// openid.
+func (h *OAuthUsecaseHandler) userTokens(client *OAuthClient, tenantID uint, userID uint, granted []string, scope []string, nonce string, authTime time.Time) (*TokenResponse, error) {
+
+	user, err := ScopeToTenant(h.persistenceHandler, tenantID).FindOne(userID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, errInvalidGrant
+		}
+		panic(err)
+	}
+
+	expiry := time.Duration(h.config.OAuth.AccessTokenExpiryInMinutes) * time.Minute
+	accessToken, err := h.issuer.UserToken(user, client, scope, expiry)
+	if err != nil {
+		panic(err)
+	}
+
+	refreshToken, hash := newOpaqueToken()
+	token := OAuthRefreshToken{
+		TokenHash: hash,
+		ClientID:  client.ID,
+		TenantID:  tenantID,
+		UserID:    userID,
+		Scope:     strings.Join(granted, " "),
+		AuthTime:  authTime,
+		ExpiresAt: time.Now().Add(time.Duration(h.config.OAuth.RefreshTokenExpiryInDays) * 24 * time.Hour),
+	}
+	if err := h.oauthPersistence.CreateRefreshToken(&token); err != nil {
+		panic(err)
+	}
+
+	reply := &TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(expiry.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scope, " "),
+	}
+	if hasScope(scope, ScopeOpenID) {
+		if reply.IDToken, err = h.issuer.IDToken(user, client, scope, nonce, authTime, accessToken); err != nil {
+			panic(err)
+		}
+	}
+
+	return reply, nil
+}
+
+func (h *OAuthUsecaseHandler) UserInfo(userID uint, scope []string) (map[string]interface{}, error) {
+
+	if !hasScope(scope, ScopeOpenID) {
+		return nil, OAuthError{http.StatusForbidden, "insufficient_scope", "The access token doesn't have the openid scope"}
+	}
+
+	user, err := ScopeToTenant(h.persistenceHandler, h.tenantID).FindOne(userID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, OAuthError{http.StatusUnauthorized, "invalid_token", "The user of the access token doesn't exist anymore"}
+		}
+		panic(err)
+	}
+
+	claims, err := h.issuer.UserInfo(user, scope)
+	if err != nil {
+		panic(err)
+	}
+
+	return claims, nil
+}
+
+// Logout revokes the refresh tokens the client has for the user, as the
+// tokens of logins can't be revoked. Redirecting is only allowed to the
+// post logout redirect URIs of the client, which the ID token hint or
+// clientID name.
+func (h *OAuthUsecaseHandler) Logout(idTokenHint string, clientID string, postLogoutRedirectURI string, state string) (string, error) {
+
+	var userID uint
+	if idTokenHint != "" {
+		claims, ok := h.issuer.signingKey.Verify(idTokenHint)
+		if !ok || claims["iss"] != tokenIssuer(h.config) {
+			return "", Error{Code: http.StatusBadRequest, Message: "Invalid value for id_token_hint"}
+		}
+		audience, _ := claims["aud"].(string)
+		if clientID != "" && clientID != audience {
+			return "", Error{Code: http.StatusBadRequest, Message: "Invalid value for client_id, it isn't the audience of id_token_hint"}
+		}
+		clientID = audience
+		subject, _ := claims["sub"].(string)
+		id, err := strconv.ParseUint(subject, 10, 32)
+		if err != nil {
+			return "", Error{Code: http.StatusBadRequest, Message: "Invalid value for id_token_hint"}
+		}
+		userID = uint(id)
+	}
+
+	var client *OAuthClient
+	if clientID != "" {
+		var err error
+		if client, err = h.oauthPersistence.FindClientByClientID(clientID); err != nil {
+			if _, ok := err.(Error); !ok {
+				panic(err)
+			}
+			return "", Error{Code: http.StatusBadRequest, Message: "Invalid value for client_id"}
+		}
+	}
+
+	if client != nil && userID != 0 {
+		if err := h.oauthPersistence.RevokeRefreshTokens(userID, client.ID, time.Now()); err != nil {
+			panic(err)
+		}
+	}
+
+	if postLogoutRedirectURI == "" {
+		return "", nil
+	}
+	if client == nil || !client.PostLogoutRedirectURIs.Has(postLogoutRedirectURI) {
+		return "", Error{Code: http.StatusBadRequest, Message: "Invalid value for post_logout_redirect_uri, it isn't registered for the client"}
+	}
+	if state == "" {
+		return postLogoutRedirectURI, nil
+	}
+	return addQuery(postLogoutRedirectURI, url.Values{"state": {state}}.Encode()), nil
+}
+
+func (h *OAuthUsecaseHandler) validScope(scope string) bool {
+	switch scope {
+	case ScopeOpenID, ScopeProfile, ScopeEmail, ScopeRoles, ScopeGroups:
+		return true
+	}
+	return Strings(h.config.OAuth.Scopes).Has(scope)
+}
+
+// clientScope is the requested scope, space separated, if allowed has all of
+// it, or allowed when none is requested.
+func clientScope(allowed Strings, requested string) ([]string, error) {
+	if requested == "" {
+		return allowed, nil
+	}
+	var scope []string
+	for _, s := range strings.Fields(requested) {
+		if !allowed.Has(s) {
+			return nil, OAuthError{http.StatusBadRequest, "invalid_scope", "The scope " + s + " isn't allowed"}
+		}
+		if !Strings(scope).Has(s) {
+			scope = append(scope, s)
+		}
+	}
+	return scope, nil
+}
+
+// userCodeAlphabet has no vowels, so user codes spell no words, nor
+// characters easily mistaken for each other.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// newUserCode returns 8 random characters of userCodeAlphabet.
+func newUserCode() string {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			panic(err)
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// formatUserCode splits a user code in halves for users to read it.
+func formatUserCode(code string) string {
+	return code[:4] + "-" + code[4:]
+}
+
+// normalizeUserCode undoes formatUserCode, and the case and spaces of users.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
+// validRedirectURI accepts absolute https URIs without fragment, plain http
+// only on localhost, and the private-use schemes of native apps, which are
+// reverse domain names like com.example.app (RFC 8252 section 7.1). Any other
+// scheme, like javascript: or data:, is rejected.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Fragment != "" || strings.Contains(uri, "#") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	labels := strings.Split(u.Scheme, ".")
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+	}
+	return len(labels) > 1
+}
+
+// addQuery appends an encoded query to uri, which may have one already.
+func addQuery(uri string, query string) string {
+	if query == "" {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + query
+	}
+	return uri + "?" + query
+}
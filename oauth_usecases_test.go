@@ -0,0 +1,574 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// oauthFixture is a tenant with a user, a public client of a web app and a
+// confidential one of an API, which has its secret.
+type oauthFixture struct {
+	store        *MemoryPersistence
+	config       *Config
+	issuer       *TokenIssuer
+	oauth        OAuthUsecase
+	user         *Model
+	public       *OAuthClient
+	confidential *OAuthClient
+	secret       string
+}
+
+func newOAuthFixture(t *testing.T) *oauthFixture {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{JwtSecret: "secret", AppName: "test", Issuer: "https://id.example.com"}
+	config.OAuth.CodeExpiryInSeconds = 60
+	config.OAuth.AccessTokenExpiryInMinutes = 60
+	config.OAuth.RefreshTokenExpiryInDays = 30
+	config.OAuth.DeviceURL = "https://id.example.com/device"
+	config.OAuth.DeviceCodeExpiryInSeconds = 600
+	config.OAuth.DevicePollIntervalInSeconds = 5
+	config.OIDC.IDTokenExpiryInMinutes = 60
+
+	store := NewMemoryPersistence()
+	issuer := &TokenIssuer{store, config, &SigningKey{"test", private}}
+	f := &oauthFixture{
+		store:  store,
+		config: config,
+		issuer: issuer,
+		oauth:  (&OAuthUsecaseHandler{store, store, issuer, config, 0}).ForTenant(defaultTenantID),
+		user:   createTestModels(t, store, "alice")[0],
+	}
+	if f.public, _, err = f.oauth.CreateClient("app", false, []string{"https://app.example.com/cb"}, nil, []string{ScopeOpenID, ScopeEmail, ScopeProfile}); err != nil {
+		t.Fatal(err)
+	}
+	if f.confidential, f.secret, err = f.oauth.CreateClient("api", true, []string{"https://api.example.com/cb"}, nil, []string{ScopeOpenID, ScopeEmail}); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// newVerifier returns a PKCE code verifier and its S256 challenge.
+func newVerifier() (string, string) {
+	verifier, _ := newOpaqueToken()
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// code is a code the user approved for client, with its verifier.
+func (f *oauthFixture) code(t *testing.T, client *OAuthClient, scope string, nonce string) (string, string) {
+	verifier, challenge := newVerifier()
+	request, err := f.oauth.Authorize("code", client.ClientID, client.RedirectURIs[0], scope, "state", nonce, challenge, "S256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect, err := f.oauth.Approve(f.user.ID, time.Now(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != "state" {
+		t.Errorf("redirected to %s", redirect)
+	}
+	return location.Query().Get("code"), verifier
+}
+
+// tokens are the tokens of a code the user approved for client.
+func (f *oauthFixture) tokens(t *testing.T, client *OAuthClient, scope string) *TokenResponse {
+	code, verifier := f.code(t, client, scope, "")
+	tokens, err := f.oauth.ExchangeCode(client, code, client.RedirectURIs[0], verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func oauthErrorCode(err error) string {
+	if v, ok := err.(OAuthError); ok {
+		return v.Code
+	}
+	return ""
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	f := newOAuthFixture(t)
+	other, _, err := f.oauth.ForTenant(defaultTenantID+1).CreateClient("other", false, []string{"https://other.example.com/cb"}, nil, []string{ScopeOpenID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge := newVerifier()
+
+	tests := []struct {
+		name         string
+		responseType string
+		clientID     string
+		redirectURI  string
+		scope        string
+		challenge    string
+		method       string
+		wantCode     string // of the OAuthError, none for errors not redirected
+	}{
+		{"unknown client", "code", "nobody", "https://app.example.com/cb", "openid", challenge, "S256", ""},
+		{"client of another tenant", "code", other.ClientID, "https://other.example.com/cb", "openid", challenge, "S256", ""},
+		{"no redirect URI", "code", f.public.ClientID, "", "openid", challenge, "S256", ""},
+		{"unregistered redirect URI", "code", f.public.ClientID, "https://app.example.com/cb/", "openid", challenge, "S256", ""},
+		{"implicit flow", "token", f.public.ClientID, "https://app.example.com/cb", "openid", challenge, "S256", "unsupported_response_type"},
+		{"no PKCE", "code", f.public.ClientID, "https://app.example.com/cb", "openid", "", "", "invalid_request"},
+		{"plain PKCE", "code", f.public.ClientID, "https://app.example.com/cb", "openid", challenge, "plain", "invalid_request"},
+		{"short challenge", "code", f.public.ClientID, "https://app.example.com/cb", "openid", challenge[:42], "S256", "invalid_request"},
+		{"scope not allowed", "code", f.public.ClientID, "https://app.example.com/cb", "openid roles", challenge, "S256", "invalid_scope"},
+	}
+	for _, tt := range tests {
+		request, err := f.oauth.Authorize(tt.responseType, tt.clientID, tt.redirectURI, tt.scope, "", "", tt.challenge, tt.method)
+		if err == nil {
+			t.Errorf("%s: authorized", tt.name)
+			continue
+		}
+		if got := oauthErrorCode(err); got != tt.wantCode || (got != "") != (request != nil) {
+			t.Errorf("%s: got %v with request %v, want %q", tt.name, err, request, tt.wantCode)
+		}
+	}
+
+	request, err := f.oauth.Authorize("code", f.public.ClientID, "https://app.example.com/cb", "", "", "", challenge, "S256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(request.Scope, []string{ScopeOpenID, ScopeEmail, ScopeProfile}) {
+		t.Errorf("got scope %v for none", request.Scope)
+	}
+}
+
+func TestOAuthExchangeCode(t *testing.T) {
+	f := newOAuthFixture(t)
+	redirectURI := f.public.RedirectURIs[0]
+
+	code, verifier := f.code(t, f.public, "openid email", "n-0S6_WzA2Mj")
+	tokens, err := f.oauth.ExchangeCode(f.public, code, redirectURI, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, ok := ValidateToken(f.config, tokens.AccessToken)
+	if !ok || claims.ClientID != f.public.ClientID || claims.Scope != "openid email" || claims.Email != f.user.Email || claims.TenantID() != defaultTenantID {
+		t.Errorf("issued the access token %+v", claims)
+	}
+	if tokens.RefreshToken == "" || tokens.Scope != "openid email" {
+		t.Errorf("issued %+v", tokens)
+	}
+
+	idToken, ok := f.issuer.signingKey.Verify(tokens.IDToken)
+	if !ok {
+		t.Fatalf("issued the ID token %q", tokens.IDToken)
+	}
+	sum := sha256.Sum256([]byte(tokens.AccessToken))
+	if idToken["aud"] != f.public.ClientID || idToken["nonce"] != "n-0S6_WzA2Mj" || idToken["at_hash"] != base64.RawURLEncoding.EncodeToString(sum[:16]) || idToken["iss"] != f.config.Issuer {
+		t.Errorf("issued the ID token %v", idToken)
+	}
+
+	if _, err := f.oauth.ExchangeCode(f.public, code, redirectURI, verifier); err != errInvalidGrant {
+		t.Errorf("used a code twice: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		client      *OAuthClient
+		redirectURI string
+		verifier    func(verifier string) string
+		wantCode    string
+		burned      bool // whether the real client can't use the code after
+	}{
+		{"by another client", f.confidential, redirectURI, nil, "invalid_grant", false},
+		{"to another redirect URI", f.public, "https://app.example.com/other", nil, "invalid_grant", false},
+		{"with a short verifier", f.public, redirectURI, func(v string) string { return v[:42] }, "invalid_request", false},
+		{"with a long verifier", f.public, redirectURI, func(v string) string { return v + v + v + v[:1] }, "invalid_request", false},
+		{"with another verifier", f.public, redirectURI, func(v string) string { other, _ := newVerifier(); return other }, "invalid_grant", true},
+	}
+	for _, tt := range tests {
+		code, verifier := f.code(t, f.public, "openid", "")
+		attempt := verifier
+		if tt.verifier != nil {
+			attempt = tt.verifier(verifier)
+		}
+		if _, err := f.oauth.ExchangeCode(tt.client, code, tt.redirectURI, attempt); oauthErrorCode(err) != tt.wantCode {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.wantCode)
+		}
+		_, err := f.oauth.ExchangeCode(f.public, code, redirectURI, verifier)
+		if tt.burned && err != errInvalidGrant || !tt.burned && err != nil {
+			t.Errorf("%s: then the client got %v", tt.name, err)
+		}
+	}
+
+	f.config.OAuth.CodeExpiryInSeconds = 0
+	code, verifier = f.code(t, f.public, "openid", "")
+	if _, err := f.oauth.ExchangeCode(f.public, code, redirectURI, verifier); err != errInvalidGrant {
+		t.Errorf("used an expired code: %v", err)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	f := newOAuthFixture(t)
+	tokens := f.tokens(t, f.public, "openid email profile")
+
+	rotated, err := f.oauth.Refresh(f.public, tokens.RefreshToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken || rotated.Scope != "openid email profile" {
+		t.Errorf("refreshed to %+v", rotated)
+	}
+	if _, err := f.oauth.Refresh(f.public, tokens.RefreshToken, ""); err != errInvalidGrant {
+		t.Errorf("used a refresh token twice: %v", err)
+	}
+
+	if _, err := f.oauth.Refresh(f.confidential, rotated.RefreshToken, ""); err != errInvalidGrant {
+		t.Errorf("another client refreshed: %v", err)
+	}
+	if _, err := f.oauth.Refresh(f.public, rotated.RefreshToken, "openid roles"); oauthErrorCode(err) != "invalid_scope" {
+		t.Errorf("widened the scope: %v", err)
+	}
+
+	narrowed, err := f.oauth.Refresh(f.public, rotated.RefreshToken, "email")
+	if err != nil {
+		t.Fatalf("the failed refreshes revoked the token: %v", err)
+	}
+	if claims, _ := ValidateToken(f.config, narrowed.AccessToken); narrowed.Scope != "email" || narrowed.IDToken != "" || claims.Scope != "email" {
+		t.Errorf("narrowed to %+v", narrowed)
+	}
+	widened, err := f.oauth.Refresh(f.public, narrowed.RefreshToken, "")
+	if err != nil || widened.Scope != "openid email profile" {
+		t.Errorf("the narrowed refresh token got %+v, %v", widened, err)
+	}
+
+	f.config.OAuth.RefreshTokenExpiryInDays = 0
+	expired := f.tokens(t, f.public, "openid")
+	if _, err := f.oauth.Refresh(f.public, expired.RefreshToken, ""); err != errInvalidGrant {
+		t.Errorf("used an expired refresh token: %v", err)
+	}
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	f := newOAuthFixture(t)
+
+	if _, err := f.oauth.ClientCredentials(f.public, ""); oauthErrorCode(err) != "unauthorized_client" {
+		t.Errorf("a public client got a token: %v", err)
+	}
+	if _, err := f.oauth.ClientCredentials(f.confidential, "profile"); oauthErrorCode(err) != "invalid_scope" {
+		t.Errorf("got a scope not allowed: %v", err)
+	}
+
+	client, err := f.oauth.AuthenticateClient(f.confidential.ClientID, f.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.oauth.AuthenticateClient(f.confidential.ClientID, f.secret+"x"); err != errInvalidClient {
+		t.Errorf("authenticated with another secret: %v", err)
+	}
+	tokens, err := f.oauth.ClientCredentials(client, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, ok := ValidateToken(f.config, tokens.AccessToken)
+	if !ok || claims.Subject != client.ClientID || claims.ClientID != client.ClientID || claims.Scope != "email" || tokens.RefreshToken != "" {
+		t.Errorf("issued %+v with the claims %+v", tokens, claims)
+	}
+}
+
+func TestOAuthIntrospect(t *testing.T) {
+	f := newOAuthFixture(t)
+	tokens := f.tokens(t, f.public, "openid email")
+	own := f.tokens(t, f.confidential, "openid")
+
+	loginToken, err := f.issuer.LoginToken(f.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tokens of logins before tenants had none
+	legacyToken, err := f.issuer.sign(f.issuer.claims("1", 0, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger := &Model{TenantID: defaultTenantID + 1, Email: "eve@example.com", Name: "eve"}
+	if err := f.store.Create(stranger); err != nil {
+		t.Fatal(err)
+	}
+	strangerToken, err := f.issuer.LoginToken(stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := f.tokens(t, f.public, "openid")
+	if err := f.oauth.Revoke(f.public, revoked.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.oauth.Introspect(f.public, tokens.AccessToken); oauthErrorCode(err) != "unauthorized_client" {
+		t.Errorf("a public client introspected: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		active    bool
+		tokenType string
+	}{
+		{"access token of another client", tokens.AccessToken, true, "Bearer"},
+		{"login token", loginToken, true, "Bearer"},
+		{"login token without a tenant", legacyToken, true, "Bearer"},
+		{"login token of another tenant", strangerToken, false, ""},
+		{"revoked access token", revoked.AccessToken, false, ""},
+		{"own refresh token", own.RefreshToken, true, "refresh_token"},
+		{"refresh token of another client", tokens.RefreshToken, false, ""},
+		{"unknown token", "garbage", false, ""},
+	}
+	for _, tt := range tests {
+		introspection, err := f.oauth.Introspect(f.confidential, tt.token)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if introspection.Active != tt.active || introspection.TokenType != tt.tokenType {
+			t.Errorf("%s: got %+v", tt.name, introspection)
+		}
+	}
+}
+
+func TestOAuthRevoke(t *testing.T) {
+	f := newOAuthFixture(t)
+	tokens := f.tokens(t, f.public, "openid")
+
+	if err := f.oauth.Revoke(f.confidential, tokens.AccessToken); oauthErrorCode(err) != "unauthorized_client" {
+		t.Errorf("another client revoked an access token: %v", err)
+	}
+	if err := f.oauth.Revoke(f.confidential, tokens.RefreshToken); oauthErrorCode(err) != "unauthorized_client" {
+		t.Errorf("another client revoked a refresh token: %v", err)
+	}
+	if err := f.oauth.Revoke(f.public, "garbage"); err != nil {
+		t.Errorf("revoking an unknown token: %v", err)
+	}
+
+	if err := f.oauth.Revoke(f.public, tokens.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.oauth.Refresh(f.public, tokens.RefreshToken, ""); err != errInvalidGrant {
+		t.Errorf("refreshed with a revoked token: %v", err)
+	}
+	if err := f.oauth.Revoke(f.public, tokens.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := f.store.IsAccessTokenRevoked(mustClaims(t, f.config, tokens.AccessToken).Id); !revoked {
+		t.Error("didn't revoke the access token")
+	}
+}
+
+func mustClaims(t *testing.T, config *Config, token string) *JWTCustomClaims {
+	claims, ok := ValidateToken(config, token)
+	if !ok {
+		t.Fatalf("invalid token %q", token)
+	}
+	return claims
+}
+
+func TestOAuthDeviceGrant(t *testing.T) {
+	f := newOAuthFixture(t)
+
+	device, err := f.oauth.DeviceAuthorization(f.public, "openid email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Interval != 5 || device.ExpiresIn != 600 || device.VerificationURIComplete != f.config.OAuth.DeviceURL+"?user_code="+device.UserCode {
+		t.Errorf("started %+v", device)
+	}
+
+	if _, err := f.oauth.DeviceToken(f.public, device.DeviceCode); oauthErrorCode(err) != "authorization_pending" {
+		t.Errorf("first poll: %v", err)
+	}
+	if _, err := f.oauth.DeviceToken(f.confidential, device.DeviceCode); err != errInvalidGrant {
+		t.Errorf("another client polled: %v", err)
+	}
+
+	code, err := f.store.FindDeviceCode(hashOpaqueToken(device.DeviceCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		since        time.Duration // from the previous poll
+		interval     uint
+		wantCode     string
+		wantInterval uint
+	}{
+		{"too soon", 0, 5, "slow_down", 10},
+		{"sooner than the slowed down interval", 7 * time.Second, 10, "slow_down", 15},
+		{"after the interval", 16 * time.Second, 15, "authorization_pending", 15},
+	}
+	for _, tt := range tests {
+		if err := f.store.PollDeviceCode(code.ID, time.Now().Add(-tt.since), tt.interval); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.oauth.DeviceToken(f.public, device.DeviceCode); oauthErrorCode(err) != tt.wantCode {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.wantCode)
+		}
+		if polled, _ := f.store.FindDeviceCode(code.DeviceCodeHash); polled.PollInterval != tt.wantInterval {
+			t.Errorf("%s: the interval is %d, want %d", tt.name, polled.PollInterval, tt.wantInterval)
+		}
+	}
+
+	request, err := f.oauth.DeviceRequest(" " + device.UserCode[:4] + device.UserCode[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Client.ID != f.public.ID || request.UserCode != device.UserCode || !equalStrings(request.Scope, []string{ScopeOpenID, ScopeEmail}) {
+		t.Errorf("asked %+v", request)
+	}
+	if err := f.oauth.ForTenant(defaultTenantID+1).DecideDevice(f.user.ID, time.Now(), device.UserCode, true); err != errDeviceCodeNotFound {
+		t.Errorf("another tenant approved: %v", err)
+	}
+	if err := f.oauth.DecideDevice(f.user.ID, time.Now(), device.UserCode, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.oauth.DecideDevice(f.user.ID, time.Now(), device.UserCode, false); err != errDeviceCodeNotFound {
+		t.Errorf("decided twice: %v", err)
+	}
+
+	tokens, err := f.oauth.DeviceToken(f.public, device.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := mustClaims(t, f.config, tokens.AccessToken); claims.Subject != "1" || claims.Scope != "openid email" || tokens.IDToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("issued %+v", tokens)
+	}
+	if _, err := f.oauth.DeviceToken(f.public, device.DeviceCode); err != errInvalidGrant {
+		t.Errorf("issued the tokens twice: %v", err)
+	}
+
+	denied, err := f.oauth.DeviceAuthorization(f.public, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.oauth.DecideDevice(f.user.ID, time.Now(), denied.UserCode, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.oauth.DeviceToken(f.public, denied.DeviceCode); oauthErrorCode(err) != "access_denied" {
+		t.Errorf("polled a denied login: %v", err)
+	}
+	if _, err := f.oauth.DeviceToken(f.public, denied.DeviceCode); err != errInvalidGrant {
+		t.Errorf("polled a denied login twice: %v", err)
+	}
+
+	f.config.OAuth.DeviceCodeExpiryInSeconds = 0
+	expired, err := f.oauth.DeviceAuthorization(f.public, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.oauth.DecideDevice(f.user.ID, time.Now(), expired.UserCode, true); err != errDeviceCodeNotFound {
+		t.Errorf("approved an expired login: %v", err)
+	}
+	if _, err := f.oauth.DeviceToken(f.public, expired.DeviceCode); oauthErrorCode(err) != "expired_token" {
+		t.Errorf("polled an expired login: %v", err)
+	}
+}
+
+// TestOAuthPersistenceConditions checks that codes and refresh tokens are
+// only used by the client they were issued to, unexpired, in both stores.
+func TestOAuthPersistenceConditions(t *testing.T) {
+	stores := map[string]OAuthPersistence{
+		"memory": NewMemoryPersistence(),
+		"sqlite": newSQLitePersistence(t).(*PersistenceHandler),
+	}
+	for name, store := range stores {
+		now := time.Now()
+		codes := map[string]*OAuthCode{
+			"valid":   {CodeHash: "valid", ClientID: 1, RedirectURI: "https://app.example.com/cb", ExpiresAt: now.Add(time.Minute)},
+			"expired": {CodeHash: "expired", ClientID: 1, RedirectURI: "https://app.example.com/cb", ExpiresAt: now.Add(-time.Minute)},
+		}
+		for _, code := range codes {
+			code.TenantID, code.UserID, code.AuthTime = defaultTenantID, 1, now
+			if err := store.CreateCode(code); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		useTests := []struct {
+			hash        string
+			clientID    uint
+			redirectURI string
+			wantErr     bool
+		}{
+			{"valid", 2, "https://app.example.com/cb", true},
+			{"valid", 1, "https://app.example.com/other", true},
+			{"expired", 1, "https://app.example.com/cb", true},
+			{"unknown", 1, "https://app.example.com/cb", true},
+			{"valid", 1, "https://app.example.com/cb", false},
+			{"valid", 1, "https://app.example.com/cb", true},
+		}
+		for i, tt := range useTests {
+			code, err := store.UseCode(tt.hash, tt.clientID, tt.redirectURI, now)
+			if tt.wantErr != (err != nil) || !tt.wantErr && code.CodeHash != tt.hash {
+				t.Errorf("%s: use %d got %v, %v", name, i, code, err)
+			}
+		}
+
+		tokens := map[string]*OAuthRefreshToken{
+			"valid":   {TokenHash: "valid", ClientID: 1, ExpiresAt: now.Add(time.Hour)},
+			"expired": {TokenHash: "expired", ClientID: 1, ExpiresAt: now.Add(-time.Hour)},
+		}
+		for _, token := range tokens {
+			token.TenantID, token.UserID, token.AuthTime = defaultTenantID, 1, now
+			if err := store.CreateRefreshToken(token); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		revokeTests := []struct {
+			hash     string
+			clientID uint
+			wantErr  bool
+		}{
+			{"valid", 2, true},
+			{"expired", 1, true},
+			{"valid", 1, false},
+			{"valid", 1, true},
+		}
+		for i, tt := range revokeTests {
+			token, err := store.RevokeRefreshToken(tt.hash, tt.clientID, now)
+			if tt.wantErr != (err != nil) || !tt.wantErr && token.TokenHash != tt.hash {
+				t.Errorf("%s: revoke %d got %v, %v", name, i, token, err)
+			}
+		}
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{"https://app.example.com/cb", true},
+		{"https://app.example.com/cb?x=1", true},
+		{"https://app.example.com/cb#token", false},
+		{"http://localhost:8080/cb", true},
+		{"http://127.0.0.1/cb", true},
+		{"http://[::1]:3000/cb", true},
+		{"http://example.com/cb", false},
+		{"com.example.app:/cb", true},
+		{"myapp:/cb", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"file:///etc/passwd", false},
+		{"/cb", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validRedirectURI(tt.uri); got != tt.want {
+			t.Errorf("%q: got %t, want %t", tt.uri, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// standardProfileClaims are the claims of the profile scope of OpenID
+// Connect that profile attributes named after them are mapped to.
+var standardProfileClaims = []string{"given_name", "family_name", "middle_name", "nickname", "preferred_username",
+	"profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale"}
+
+// SigningKey signs the ID tokens of OpenID Connect, which apps verify with
+// its public part, published as a JSON Web Key.
+type SigningKey struct {
+	ID      string
+	private *rsa.PrivateKey
+}
+
+func NewSigningKey(config *Config) (*SigningKey, error) {
+	var private *rsa.PrivateKey
+	if config.OIDC.KeyFile == "" {
+		log.Print("no OIDC key file configured, ID tokens are signed with a key generated now, which won't verify them after a restart")
+		var err error
+		if private, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, err
+		}
+	} else {
+		encoded, err := ioutil.ReadFile(config.OIDC.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if private, err = jwt.ParseRSAPrivateKeyFromPEM(encoded); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", config.OIDC.KeyFile, err)
+		}
+	}
+
+	// The id changes with the key, so apps know to fetch the new one
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return &SigningKey{base64.RawURLEncoding.EncodeToString(sum[:12]), private}, nil
+}
+
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.ID
+	return token.SignedString(k.private)
+}
+
+// Verify returns the claims of a token the key signed, expired ones
+// included, which logouts accept.
+func (k *SigningKey) Verify(tokenString string) (jwt.MapClaims, bool) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return &k.private.PublicKey, nil
+	})
+	if err != nil {
+		if v, ok := err.(*jwt.ValidationError); !ok || v.Errors != jwt.ValidationErrorExpired {
+			return nil, false
+		}
+	}
+	return claims, true
+}
+
+// JWK is the public key as a JSON Web Key.
+func (k *SigningKey) JWK() map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": k.ID,
+		"n":   base64.RawURLEncoding.EncodeToString(k.private.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.private.E)).Bytes()),
+	}
+}
+
+// UserInfo are the claims about user that scope grants: its name and the
+// profile attributes named after standard claims with profile, its email
+// with email, and its roles and groups with the scopes named so.
+func (t *TokenIssuer) UserInfo(user *Model, scope []string) (map[string]interface{}, error) {
+
+	claims := map[string]interface{}{"sub": strconv.FormatUint(uint64(user.ID), 10)}
+	if hasScope(scope, ScopeProfile) {
+		claims["name"] = user.Name
+		claims["updated_at"] = user.UpdatedAt.Unix()
+		attributes := profileSchema.Visible(user.Attributes, true)
+		for _, name := range standardProfileClaims {
+			if value, ok := attributes[name]; ok {
+				claims[name] = value
+			}
+		}
+	}
+	if hasScope(scope, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	if hasScope(scope, ScopeRoles) {
+		claims["roles"] = user.Roles
+	}
+	if hasScope(scope, ScopeGroups) {
+		groups, err := groupNames(t.groupPersistence, user)
+		if err != nil {
+			return nil, err
+		}
+		if groups == nil {
+			groups = []string{}
+		}
+		claims["groups"] = groups
+	}
+
+	return claims, nil
+}
+
+// IDToken tells client who user is, with the claims of UserInfo, binding
+// itself to the access token issued with it by at_hash.
+func (t *TokenIssuer) IDToken(user *Model, client *OAuthClient, scope []string, nonce string, authTime time.Time, accessToken string) (string, error) {
+
+	claims, err := t.UserInfo(user, scope)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims["iss"] = tokenIssuer(t.config)
+	claims["aud"] = client.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(t.config.OIDC.IDTokenExpiryInMinutes) * time.Minute).Unix()
+	claims["auth_time"] = authTime.Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	// The left half of the hash of the access token, as RS256 uses SHA-256
+	sum := sha256.Sum256([]byte(accessToken))
+	claims["at_hash"] = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+
+	return t.signingKey.Sign(jwt.MapClaims(claims))
+}
+
+// discovery is the OpenID Provider Metadata of the service.
+func discovery(config *Config) map[string]interface{} {
+	issuer := config.Issuer
+
+	scopes := []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeRoles, ScopeGroups}
+	scopes = append(scopes, config.OAuth.Scopes...)
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash",
+		"name", "updated_at", "email", "email_verified", "roles", "groups"}
+	claims = append(claims, standardProfileClaims...)
+	grantTypes := []string{"authorization_code", "refresh_token", "client_credentials"}
+
+	metadata := map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"revocation_endpoint":                   issuer + "/oauth/revoke",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"end_session_endpoint":                  issuer + "/oauth/logout",
+		"scopes_supported":                      scopes,
+		"claims_supported":                      claims,
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 grantTypes,
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	}
+	if config.OAuth.DeviceURL != "" {
+		metadata["device_authorization_endpoint"] = issuer + "/oauth/device_authorization"
+		metadata["grant_types_supported"] = append(grantTypes, "urn:ietf:params:oauth:grant-type:device_code")
+	}
+
+	return metadata
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sortableFields are the fields a list can be ordered by, with the column each
+// one maps to. The profile schema adds its sortable fields.
+var sortableFields = map[string]string{
+	"id":     "id",
+	"name":   "name",
+	"age":    "age",
+	"number": "number",
+	"date":   "date",
+}
+
+type Ordering struct {
+	Column string
+	Desc   bool
+}
+
+// Page selects up to Limit rows following (or, with Cursor.Before, preceding)
+// the row the cursor points at. Rows are always sorted by the order column and
+// then by id, so the position is unambiguous.
+type Page struct {
+	Limit  int
+	Cursor *Cursor
+}
+
+type Cursor struct {
+	Column string
+	Desc   bool
+	Value  interface{}
+	ID     uint
+	Before bool
+	// Query is the hash of the filter and order of the pages the cursor is
+	// for, see CursorQuery
+	Query string
+}
+
+// ResultPage holds a page of models and the encoded cursors of its neighbours,
+// empty when there's no such page.
+type ResultPage struct {
+	Models []Model
+	Next   string
+	Prev   string
+	Total  *int
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// CursorQuery hashes the filter and order a cursor is valid with. The Go
+// syntax of the expression covers every node, group membership included,
+// which the filter language doesn't.
+func CursorQuery(filter FilterExpr, order Ordering) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v\x00%#v", filter, order)))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+type cursorPayload struct {
+	Column string      `json:"c"`
+	Desc   bool        `json:"d,omitempty"`
+	Value  interface{} `json:"v"`
+	ID     uint        `json:"i"`
+	Before bool        `json:"b,omitempty"`
+	Query  string      `json:"q"`
+}
+
+func CursorFromModel(m *Model, order Ordering, before bool) (*Cursor, error) {
+	field, ok := modelField(m, order.Column)
+	if !ok {
+		return nil, errors.New("unknown order column " + order.Column)
+	}
+	return &Cursor{
+		Column: order.Column,
+		Desc:   order.Desc,
+		Value:  field.Interface(),
+		ID:     m.ID,
+		Before: before,
+	}, nil
+}
+
+// EncodeCursor serializes c into an opaque, url safe token signed with secret.
+func EncodeCursor(c *Cursor, secret string) (string, error) {
+	value := c.Value
+	if t, ok := value.(time.Time); ok {
+		value = t.Format(time.RFC3339Nano)
+	}
+
+	payload, err := json.Marshal(cursorPayload{c.Column, c.Desc, value, c.ID, c.Before, c.Query})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signCursor(encoded, secret), nil
+}
+
+// DecodeCursor verifies the signature of s and restores the typed value of the
+// cursor from the type of its column.
+func DecodeCursor(s string, secret string) (*Cursor, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signCursor(parts[0], secret))) {
+		return nil, errInvalidCursor
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var payload cursorPayload
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var fieldType FilterFieldType
+	if field, ok := profileSchema.Field(payload.Column); ok {
+		fieldType = field.filterType()
+	} else if field, ok := filterableFields[payload.Column]; ok {
+		fieldType = field.Type
+	} else {
+		return nil, errInvalidCursor
+	}
+
+	c := &Cursor{Column: payload.Column, Desc: payload.Desc, ID: payload.ID, Before: payload.Before, Query: payload.Query}
+	switch fieldType {
+	case FilterString:
+		v, ok := payload.Value.(string)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		c.Value = v
+	case FilterInt:
+		n, ok := payload.Value.(json.Number)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		v, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		c.Value = v
+	case FilterUint:
+		n, ok := payload.Value.(json.Number)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		v, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		c.Value = v
+	case FilterTime:
+		s, ok := payload.Value.(string)
+		if !ok {
+			return nil, errInvalidCursor
+		}
+		v, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, errInvalidCursor
+		}
+		c.Value = v
+	}
+
+	return c, nil
+}
+
+func signCursor(payload, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("cursor." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
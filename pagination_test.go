@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestCursorQuery checks that cursors only page the filter and order they
+// were issued for.
+func TestCursorQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	config := &Config{JwtSecret: "secret"}
+	config.Pagination.DefaultLimit = 2
+	config.Pagination.MaxLimit = 10
+
+	store := NewMemoryPersistence()
+	createTestModels(t, store, "alice", "bob", "carol", "dan", "erin")
+	usecases := &UsecaseHandler{store, store, nil, nil, config}
+
+	router := gin.New()
+	router.GET("/", Filter(), Order(), Paginate(config), func(c *gin.Context) {
+		filter, _ := c.MustGet("filter").(FilterExpr)
+		result, err := usecases.Find(filter, c.MustGet("order").(Ordering), c.MustGet("page").(Page), false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.JSON(http.StatusOK, gin.H{"next": result.Next})
+	})
+
+	get := func(query url.Values) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/?"+query.Encode(), nil))
+		var body struct{ Next string }
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Next
+	}
+
+	code, next := get(url.Values{"filter": {"age>=21"}})
+	if code != http.StatusOK || next == "" {
+		t.Fatalf("first page: got %d with next cursor %q", code, next)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		code  int
+	}{
+		{"same filter and order", url.Values{"filter": {"age>=21"}, "Cursor": {next}}, http.StatusOK},
+		{"other filter", url.Values{"filter": {"age>=22"}, "Cursor": {next}}, http.StatusBadRequest},
+		{"no filter", url.Values{"Cursor": {next}}, http.StatusBadRequest},
+		{"other order", url.Values{"filter": {"age>=21"}, "OrderDir": {"ASC"}, "Cursor": {next}}, http.StatusBadRequest},
+		{"tampered", url.Values{"filter": {"age>=21"}, "Cursor": {next + "x"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, _ := get(tt.query); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
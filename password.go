@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Passwords are stored in the protected form of their ProtectionScheme. New
+// passwords always use lizard.v1, the others come from imports and are
+// upgraded to it on the next successful login.
+//
+//	lizard.v1      hex of a 32 byte salt followed by its scrypt hash
+//	bcrypt         $2a$, $2b$ or $2y$ modular crypt format
+//	pbkdf2_sha256  pbkdf2_sha256$iterations$salt$base64 hash, as written by Django
+//	               (also pbkdf2_sha1 and pbkdf2_sha512)
+const defaultProtectionScheme = "lizard.v1"
+
+var pbkdf2Hashes = map[string]func() hash.Hash{
+	"pbkdf2_sha1":   sha1.New,
+	"pbkdf2_sha256": sha256.New,
+	"pbkdf2_sha512": sha512.New,
+}
+
+var errMalformedProtectedForm = errors.New("malformed protected form")
+
+// Imported PBKDF2 hashes are recomputed on every login, so their cost is
+// capped: Django uses less than a million iterations and 32 byte hashes.
+const (
+	maxPBKDF2Iterations = 10000000
+	maxPBKDF2HashLength = 64
+)
+
+// ValidateProtectedForm checks that protectedForm is well formed for scheme,
+// without verifying any password against it.
+func ValidateProtectedForm(scheme, protectedForm string) error {
+	switch {
+	case scheme == defaultProtectionScheme:
+		if len(protectedForm) != 192 || strings.Trim(protectedForm, "0123456789abcdef") != "" {
+			return errMalformedProtectedForm
+		}
+		return nil
+	case scheme == "bcrypt":
+		if _, err := bcrypt.Cost([]byte(protectedForm)); err != nil {
+			return errMalformedProtectedForm
+		}
+		return nil
+	case pbkdf2Hashes[scheme] != nil:
+		_, _, _, err := parsePBKDF2(scheme, protectedForm)
+		return err
+	}
+	return errors.New("unsupported protection scheme " + strconv.Quote(scheme))
+}
+
+// ComparePasswordWithScheme verifies password against a protected form of any
+// supported scheme.
+func (h *UsecaseHandler) ComparePasswordWithScheme(password, scheme, protectedForm string) (bool, error) {
+	switch {
+	case scheme == defaultProtectionScheme:
+		return h.ComparePasswordAndProtectedForm(password, protectedForm)
+	case scheme == "bcrypt":
+		err := bcrypt.CompareHashAndPassword([]byte(protectedForm), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case pbkdf2Hashes[scheme] != nil:
+		iterations, salt, oldHash, err := parsePBKDF2(scheme, protectedForm)
+		if err != nil {
+			return false, err
+		}
+		newHash := pbkdf2.Key([]byte(password), salt, iterations, len(oldHash), pbkdf2Hashes[scheme])
+		return subtle.ConstantTimeCompare(newHash, oldHash) == 1, nil
+	}
+	return false, errors.New("unsupported protection scheme " + strconv.Quote(scheme))
+}
+
+func parsePBKDF2(scheme, protectedForm string) (int, []byte, []byte, error) {
+	parts := strings.Split(protectedForm, "$")
+	if len(parts) != 4 || parts[0] != scheme || parts[2] == "" {
+		return 0, nil, nil, errMalformedProtectedForm
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxPBKDF2Iterations {
+		return 0, nil, nil, errMalformedProtectedForm
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 || len(hash) > maxPBKDF2HashLength {
+		return 0, nil, nil, errMalformedProtectedForm
+	}
+	return iterations, []byte(parts[2]), hash, nil
+}
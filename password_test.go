@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidatePBKDF2ProtectedForm(t *testing.T) {
+	hash := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	pbkdf2 := func(iterations int, hash string) string {
+		return "pbkdf2_sha256$" + strconv.Itoa(iterations) + "$salt$" + hash
+	}
+
+	tests := []struct {
+		protectedForm string
+		valid         bool
+	}{
+		{pbkdf2(600000, hash), true},
+		{pbkdf2(maxPBKDF2Iterations, hash), true},
+		{pbkdf2(maxPBKDF2Iterations+1, hash), false},
+		{pbkdf2(0, hash), false},
+		{pbkdf2(1000, ""), false},
+		{pbkdf2(1000, base64.StdEncoding.EncodeToString(make([]byte, maxPBKDF2HashLength+1))), false},
+		{strings.Replace(pbkdf2(1000, hash), "$salt$", "$$", 1), false},
+	}
+	for _, tt := range tests {
+		err := ValidateProtectedForm("pbkdf2_sha256", tt.protectedForm)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %v", tt.protectedForm, err, tt.valid)
+		}
+	}
+}
@@ -1,18 +1,45 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
-	"os"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Persistence interface {
 	Create(c *Model) error
-	Migrate(c *Model) error
+	FindOne(id uint) (*Model, error)
 	UpdateFields(c *Model, updates map[string]interface{}) error
 	Delete(c *Model) error
-	Find(filter []map[string]string, order map[string]string, offset, limit int) ([]Model, error)
-	UpdateMany(updates map[string]interface{}, filter []map[string]string) error
-	DeleteMany(filter []map[string]string) error
+	// Find loads only columns, or all of them when empty.
+	Find(filter FilterExpr, order Ordering, page Page, columns []string) ([]Model, error)
+	Count(filter FilterExpr) (int, error)
+	// Iterate calls fn with every model matching filter, in order, stopping at
+	// the first error. Only columns are loaded, or all of them when empty.
+	Iterate(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error
+	UpdateMany(updates map[string]interface{}, filter FilterExpr) (int64, error)
+	DeleteMany(filter FilterExpr) (int64, error)
+	// Transaction runs fn with a Persistence whose writes are committed
+	// together if fn returns nil and rolled back otherwise.
+	Transaction(fn func(tx Persistence) error) error
+}
+
+// Store is everything the service persists, each part used by its own usecases.
+type Store interface {
+	Persistence
+	JobPersistence
+	TenantPersistence
+	GroupPersistence
+	InvitationPersistence
+	OAuthPersistence
+	IdentityPersistence
+	MagicLinkPersistence
+	WebAuthnPersistence
 }
 
 type PersistenceHandler struct {
@@ -20,125 +47,362 @@ type PersistenceHandler struct {
 }
 
 func (h *PersistenceHandler) Create(c *Model) error {
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
+	if c.Version == 0 {
+		c.Version = 1
 	}
 	if err := h.DB.Create(c).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errEmailInUse
+		}
 		return err
 	}
 	return nil
 }
 
-func (h *PersistenceHandler) Migrate(c *Model) error {
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
+func (h *PersistenceHandler) FindOne(id uint) (*Model, error) {
+	var model Model
+
+	r := h.DB.First(&model, id)
+	if r.RecordNotFound() {
+		return nil, errNotFound
 	}
-	if err := h.DB.AutoMigrate(c).Error; err != nil {
-		return err
+	if r.Error != nil {
+		return nil, r.Error
 	}
-	return nil
+
+	return &model, nil
 }
 
+// UpdateFields only applies when the stored version still is c.Version, and
+// bumps it, so concurrent writers can't overwrite each other.
 func (h *PersistenceHandler) UpdateFields(c *Model, updates map[string]interface{}) error {
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
+	bumped, err := h.withVersionBump(updates)
+	if err != nil {
+		return err
 	}
-	if err := h.DB.Model(c).Updates(updates).Error; err != nil {
+	r := h.DB.Model(c).Where("version = ?", c.Version).Updates(bumped)
+	if err := r.Error; err != nil {
+		if isUniqueViolation(err) {
+			return errEmailInUse
+		}
 		return err
 	}
+	if r.RowsAffected == 0 {
+		return errVersionConflict
+	}
+	c.Version++
+	for _, v := range updates {
+		if patch, ok := v.(AttributeUpdates); ok {
+			c.Attributes = c.Attributes.merge(patch)
+		}
+	}
 	return nil
 }
 
 func (h *PersistenceHandler) Delete(c *Model) error {
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
-	}
-	if err := h.DB.Delete(c).Error; err != nil {
+	r := h.DB.Where("version = ?", c.Version).Delete(c)
+	if err := r.Error; err != nil {
 		return err
 	}
+	if r.RowsAffected == 0 {
+		return errVersionConflict
+	}
 	return nil
 }
 
-func (h *PersistenceHandler) Find(filter []map[string]string, order map[string]string, offset, limit int) ([]Model, error) {
+func (h *PersistenceHandler) Find(filter FilterExpr, order Ordering, page Page, columns []string) ([]Model, error) {
 
 	var models []Model
 
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return models, nil
-	}
-
 	db := h.DB
 
 	db = h.applyFilter(db, filter)
-	db = h.applyOrder(db, order)
-	db = h.applyPagination(db, offset, limit)
+	db = h.applyPagination(db, order, page)
+	if len(columns) > 0 {
+		db = db.Select(strings.Join(columns, ", "))
+	}
 
 	if err := db.Find(&models).Error; err != nil {
 		return models, err
 	}
 
+	if page.Cursor != nil && page.Cursor.Before {
+		reverseModels(models)
+	}
+
 	return models, nil
 }
 
-func (h *PersistenceHandler) UpdateMany(updates map[string]interface{}, filter []map[string]string) error {
+func (h *PersistenceHandler) Count(filter FilterExpr) (int, error) {
 
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
+	var count int
+
+	db := h.applyFilter(h.DB.Model(&Model{}), filter)
+
+	if err := db.Count(&count).Error; err != nil {
+		return 0, err
 	}
 
-	db := h.DB
+	return count, nil
+}
 
-	db = h.applyFilter(db, filter)
+// Iterate reads the models from a database cursor, so memory use doesn't
+// depend on how many match.
+func (h *PersistenceHandler) Iterate(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error {
 
-	var model Model
-	if err := db.Model(&model).Updates(updates).Error; err != nil {
+	db := h.applyFilter(h.DB.Model(&Model{}), filter)
+	db = h.applyPagination(db, order, Page{})
+	if len(columns) > 0 {
+		db = db.Select(strings.Join(columns, ", "))
+	}
+
+	rows, err := db.Rows()
+	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	return nil
+	for rows.Next() {
+		var model Model
+		if err := db.ScanRows(rows, &model); err != nil {
+			return err
+		}
+		if err := fn(&model); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
 
-func (h *PersistenceHandler) DeleteMany(filter []map[string]string) error {
+func (h *PersistenceHandler) UpdateMany(updates map[string]interface{}, filter FilterExpr) (int64, error) {
+
+	db := h.DB
+
+	db = h.applyFilter(db, filter)
+
+	bumped, err := h.withVersionBump(updates)
+	if err != nil {
+		return 0, err
+	}
 
-	v, _ := os.LookupEnv("ENV")
-	if v == "test" {
-		return nil
+	var model Model
+	r := db.Model(&model).Updates(bumped)
+	if err := r.Error; err != nil {
+		if isUniqueViolation(err) {
+			return 0, errEmailInUse
+		}
+		return 0, err
 	}
 
+	return r.RowsAffected, nil
+}
+
+func (h *PersistenceHandler) DeleteMany(filter FilterExpr) (int64, error) {
+
 	db := h.DB
 
 	db = h.applyFilter(db, filter)
 
 	var model Model
-	if err := db.Delete(&model).Error; err != nil {
+	r := db.Delete(&model)
+	if err := r.Error; err != nil {
+		return 0, err
+	}
+
+	return r.RowsAffected, nil
+}
+
+func (h *PersistenceHandler) Transaction(fn func(tx Persistence) error) error {
+
+	tx := h.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			tx.Rollback()
+			panic(v)
+		}
+	}()
+
+	if err := fn(&PersistenceHandler{tx}); err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	return nil
+	return tx.Commit().Error
+}
+
+func (h *PersistenceHandler) applyFilter(db *gorm.DB, filter FilterExpr) *gorm.DB {
+	if filter == nil {
+		return db
+	}
+	query, args := h.filterToSQL(filter)
+	return db.Where(query, args...)
 }
 
-func (h *PersistenceHandler) applyFilter(db *gorm.DB, filter []map[string]string) *gorm.DB {
-	for _, q := range filter {
-		for k, v := range q {
-			db = db.Where(k, v)
+// applyPagination sorts by the order column and then by id, and positions the
+// page after the cursor. Pages before the cursor are read in reverse order.
+func (h *PersistenceHandler) applyPagination(db *gorm.DB, order Ordering, page Page) *gorm.DB {
+	desc := order.Desc
+	if page.Cursor != nil {
+		query, args := h.keysetToSQL(page.Cursor)
+		db = db.Where(query, args...)
+		if page.Cursor.Before {
+			desc = !desc
 		}
 	}
+
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	db = db.Order(h.columnSQL(order.Column) + " " + direction)
+	if order.Column != "id" {
+		db = db.Order("id " + direction)
+	}
+
+	if page.Limit > 0 {
+		db = db.Limit(page.Limit)
+	}
 	return db
 }
 
-func (h *PersistenceHandler) applyOrder(db *gorm.DB, order map[string]string) *gorm.DB {
-	for k, v := range order {
-		db = db.Order(k + " " + v)
+// keysetToSQL selects the rows strictly past the cursor in its direction.
+func (h *PersistenceHandler) keysetToSQL(c *Cursor) (string, []interface{}) {
+	op := ">"
+	if c.Desc != c.Before {
+		op = "<"
 	}
-	return db
+	if c.Column == "id" {
+		return "id " + op + " ?", []interface{}{c.ID}
+	}
+	column, value := h.columnSQL(c.Column), h.columnArg(c.Column, c.Value)
+	return "(" + column + " " + op + " ?) OR (" + column + " = ? AND id " + op + " ?)", []interface{}{value, value, c.ID}
+}
+
+// columnSQL is the expression reading column, which for attributes of the
+// profile schema depends on the dialect.
+func (h *PersistenceHandler) columnSQL(column string) string {
+	if field, ok := profileSchema.Field(column); ok {
+		return attributeSQL(h.DB.Dialect().GetName(), field)
+	}
+	return column
+}
+
+// columnArg converts v to the way column stores it.
+func (h *PersistenceHandler) columnArg(column string, v interface{}) interface{} {
+	if field, ok := profileSchema.Field(column); ok {
+		return attributeArg(field, v)
+	}
+	return v
 }
 
-func (h *PersistenceHandler) applyPagination(db *gorm.DB, offset, limit int) *gorm.DB {
-	return db.Offset(offset).Limit(limit)
+// withVersionBump also turns attribute updates into a merge into the JSON column.
+func (h *PersistenceHandler) withVersionBump(updates map[string]interface{}) (map[string]interface{}, error) {
+	bumped := map[string]interface{}{"version": gorm.Expr("version + 1")}
+	for k, v := range updates {
+		if patch, ok := v.(AttributeUpdates); ok {
+			encoded, err := Attributes(patch).Value()
+			if err != nil {
+				return nil, err
+			}
+			v = gorm.Expr(attributeMergeSQL(h.DB.Dialect().GetName()), encoded)
+		}
+		bumped[k] = v
+	}
+	return bumped, nil
+}
+
+func reverseModels(models []Model) {
+	for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+		models[i], models[j] = models[j], models[i]
+	}
+}
+
+// filterToSQL translates a parsed filter into a parameterized condition. Column
+// names come from filterableFields and every value is bound as an argument.
+func (h *PersistenceHandler) filterToSQL(expr FilterExpr) (string, []interface{}) {
+	switch e := expr.(type) {
+	case FilterAnd:
+		return h.joinFilterSQL([]FilterExpr(e), " AND ")
+	case FilterOr:
+		return h.joinFilterSQL([]FilterExpr(e), " OR ")
+	case FilterNot:
+		query, args := h.filterToSQL(e.Expr)
+		return "NOT (" + query + ")", args
+	case FilterComparison:
+		column := h.columnSQL(e.Column)
+		if e.Op == "~" {
+			return "LOWER(" + column + ") LIKE ? ESCAPE '!'", []interface{}{likePattern(e.Value.(string))}
+		}
+		return column + " " + e.Op + " ?", []interface{}{h.columnArg(e.Column, e.Value)}
+	case FilterIn:
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(e.Values)), ",")
+		values := make([]interface{}, len(e.Values))
+		for i, v := range e.Values {
+			values[i] = h.columnArg(e.Column, v)
+		}
+		return h.columnSQL(e.Column) + " IN (" + placeholders + ")", values
+	case FilterMember:
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(e.GroupIDs)), ",")
+		values := make([]interface{}, len(e.GroupIDs))
+		for i, id := range e.GroupIDs {
+			values[i] = id
+		}
+		return "id IN (SELECT user_id FROM group_members WHERE group_id IN (" + placeholders + "))", values
+	}
+	panic(fmt.Sprintf("unknown filter node %T", expr))
+}
+
+func (h *PersistenceHandler) joinFilterSQL(terms []FilterExpr, separator string) (string, []interface{}) {
+	var queries []string
+	var args []interface{}
+	for _, term := range terms {
+		query, termArgs := h.filterToSQL(term)
+		queries = append(queries, "("+query+")")
+		args = append(args, termArgs...)
+	}
+	return strings.Join(queries, separator), args
+}
+
+// likePattern turns a "~" pattern into a lower cased LIKE pattern escaped with "!",
+// the escape character being portable across MySQL, PostgreSQL and SQLite.
+func likePattern(pattern string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(pattern) {
+		switch r {
+		case '!', '%', '_':
+			b.WriteRune('!')
+			b.WriteRune(r)
+		case '*':
+			b.WriteRune('%')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var errNotFound = Error{Code: http.StatusNotFound, Message: "Not found"}
+
+var errVersionConflict = Error{Code: http.StatusPreconditionFailed, Message: "The user was modified by someone else"}
+
+var errEmailInUse = Error{Code: http.StatusConflict, Message: "Email is already in use"}
+
+// isUniqueViolation reports whether err is the driver error for a unique index
+// or primary key violation, which for models can only be the one of emails
+// within a tenant.
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		return e.Number == 1062
+	case *pq.Error:
+		return e.Code == "23505"
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
 }
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MemoryPersistence keeps the models in memory and evaluates filters, order,
+// pagination, soft deletes and the email unique index of each tenant the same
+// way the SQL backed PersistenceHandler does. It's meant for tests and local
+// development.
+type MemoryPersistence struct {
+	mu        sync.RWMutex
+	txMu      sync.Mutex
+	models    map[uint]*Model
+	nextID    uint
+	jobs      map[uint]*Job
+	nextJobID uint
+
+	tenants      map[uint]*Tenant
+	nextTenantID uint
+
+	groups       map[uint]*Group
+	nextGroupID  uint
+	groupMembers map[uint]map[uint]bool // users by group
+	subgroups    map[uint]map[uint]bool // child groups by parent
+
+	invitations      map[uint]*Invitation
+	nextInvitationID uint
+
+	clients            map[uint]*OAuthClient
+	nextClientID       uint
+	codes              map[string]*OAuthCode // by hash
+	nextCodeID         uint
+	refreshTokens      map[string]*OAuthRefreshToken // by hash
+	nextRefreshTokenID uint
+	consents           map[[2]uint]*OAuthConsent // by user and client
+	deviceCodes        map[uint]*OAuthDeviceCode
+	nextDeviceCodeID   uint
+	revokedTokens      map[string]*RevokedToken // by jti
+
+	identities          map[uint]*Identity
+	nextIdentityID      uint
+	providerLogins      map[string]*ProviderLogin // by state hash
+	nextProviderLoginID uint
+	samlAssertions      map[string]*SAMLAssertion
+
+	magicLinks      map[uint]*MagicLink
+	nextMagicLinkID uint
+
+	webAuthnChallenges       map[string]*WebAuthnChallenge // by hash
+	nextWebAuthnChallengeID  uint
+	webAuthnCredentials      map[uint]*WebAuthnCredential
+	nextWebAuthnCredentialID uint
+}
+
+// NewMemoryPersistence starts with the default tenant, like the migrations do.
+func NewMemoryPersistence() *MemoryPersistence {
+	now := time.Now()
+	return &MemoryPersistence{
+		models:              map[uint]*Model{},
+		jobs:                map[uint]*Job{},
+		tenants:             map[uint]*Tenant{defaultTenantID: {ID: defaultTenantID, CreatedAt: now, UpdatedAt: now, Slug: "default", Name: "Default"}},
+		nextTenantID:        defaultTenantID,
+		groups:              map[uint]*Group{},
+		groupMembers:        map[uint]map[uint]bool{},
+		subgroups:           map[uint]map[uint]bool{},
+		invitations:         map[uint]*Invitation{},
+		clients:             map[uint]*OAuthClient{},
+		codes:               map[string]*OAuthCode{},
+		refreshTokens:       map[string]*OAuthRefreshToken{},
+		consents:            map[[2]uint]*OAuthConsent{},
+		deviceCodes:         map[uint]*OAuthDeviceCode{},
+		revokedTokens:       map[string]*RevokedToken{},
+		identities:          map[uint]*Identity{},
+		providerLogins:      map[string]*ProviderLogin{},
+		samlAssertions:      map[string]*SAMLAssertion{},
+		magicLinks:          map[uint]*MagicLink{},
+		webAuthnChallenges:  map[string]*WebAuthnChallenge{},
+		webAuthnCredentials: map[uint]*WebAuthnCredential{},
+	}
+}
+
+func (h *MemoryPersistence) Create(c *Model) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.isEmailInUse(c.TenantID, c.Email, 0) {
+		return errEmailInUse
+	}
+
+	if c.Version == 0 {
+		c.Version = 1
+	}
+	if c.ID == 0 {
+		h.nextID++
+		c.ID = h.nextID
+	} else if _, ok := h.models[c.ID]; ok {
+		return fmt.Errorf("duplicate primary key %d", c.ID)
+	} else if c.ID > h.nextID {
+		h.nextID = c.ID
+	}
+
+	now := time.Now()
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now
+	}
+	if c.UpdatedAt.IsZero() {
+		c.UpdatedAt = now
+	}
+
+	stored := *c
+	h.models[c.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindOne(id uint) (*Model, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.models[id]
+	if !ok || stored.DeletedAt != nil {
+		return nil, errNotFound
+	}
+
+	model := *stored
+	return &model, nil
+}
+
+func (h *MemoryPersistence) UpdateFields(c *Model, updates map[string]interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.models[c.ID]
+	if !ok || stored.DeletedAt != nil || stored.Version != c.Version {
+		return errVersionConflict
+	}
+
+	updated := *c
+	if err := applyUpdates(&updated, updates); err != nil {
+		return err
+	}
+	if h.isEmailInUse(updated.TenantID, updated.Email, updated.ID) {
+		return errEmailInUse
+	}
+	updated.Version++
+	*c = updated
+
+	if err := applyUpdates(stored, updates); err != nil {
+		return err
+	}
+	stored.UpdatedAt = c.UpdatedAt
+	stored.Version = c.Version
+	return nil
+}
+
+func (h *MemoryPersistence) Delete(c *Model) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.models[c.ID]
+	if !ok || stored.DeletedAt != nil || stored.Version != c.Version {
+		return errVersionConflict
+	}
+	now := time.Now()
+	stored.DeletedAt = &now
+	return nil
+}
+
+// Find always loads every column.
+func (h *MemoryPersistence) Find(filter FilterExpr, order Ordering, page Page, columns []string) ([]Model, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	matches, err := h.match(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Cursor != nil && page.Cursor.Before {
+		order.Desc = !order.Desc
+	}
+	if err := sortModels(matches, order); err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, 0, len(matches))
+	for _, m := range matches {
+		if page.Cursor != nil && !isPastCursor(m, page.Cursor) {
+			continue
+		}
+		models = append(models, *m)
+		if page.Limit > 0 && len(models) == page.Limit {
+			break
+		}
+	}
+
+	if page.Cursor != nil && page.Cursor.Before {
+		reverseModels(models)
+	}
+	return models, nil
+}
+
+func (h *MemoryPersistence) Count(filter FilterExpr) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	matches, err := h.match(filter)
+	if err != nil {
+		return 0, err
+	}
+	return len(matches), nil
+}
+
+// Iterate copies the matching models before calling fn, so fn can use the store.
+func (h *MemoryPersistence) Iterate(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error {
+	h.mu.RLock()
+	matches, err := h.match(filter)
+	if err == nil {
+		err = sortModels(matches, order)
+	}
+	models := make([]Model, len(matches))
+	for i, m := range matches {
+		models[i] = *m
+	}
+	h.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	for i := range models {
+		if err := fn(&models[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *MemoryPersistence) UpdateMany(updates map[string]interface{}, filter FilterExpr) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matches, err := h.match(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	// Validate every row first so a failure leaves the store untouched, like a single UPDATE statement
+	updated := make([]Model, len(matches))
+	for i, m := range matches {
+		updated[i] = *m
+		if err := applyUpdates(&updated[i], updates); err != nil {
+			return 0, err
+		}
+	}
+	emails := map[string]uint{}
+	for id, m := range h.models {
+		emails[m.Email] = id
+	}
+	for i := range updated {
+		if id, ok := emails[updated[i].Email]; ok && id != updated[i].ID {
+			return 0, errEmailInUse
+		}
+		emails[updated[i].Email] = updated[i].ID
+	}
+
+	for i, m := range matches {
+		updated[i].Version++
+		*m = updated[i]
+	}
+	return int64(len(matches)), nil
+}
+
+func (h *MemoryPersistence) DeleteMany(filter FilterExpr) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matches, err := h.match(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, m := range matches {
+		deletedAt := now
+		m.DeletedAt = &deletedAt
+	}
+	return int64(len(matches)), nil
+}
+
+// Transaction restores the models as they were before fn when it fails.
+// Transactions run one at a time but aren't isolated from writes made outside
+// of one, which is enough for tests and local development.
+func (h *MemoryPersistence) Transaction(fn func(tx Persistence) error) error {
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	h.mu.RLock()
+	snapshot := make(map[uint]*Model, len(h.models))
+	for id, m := range h.models {
+		model := *m
+		snapshot[id] = &model
+	}
+	h.mu.RUnlock()
+
+	committed := false
+	defer func() {
+		if !committed {
+			h.mu.Lock()
+			h.models = snapshot
+			h.mu.Unlock()
+		}
+	}()
+
+	if err := fn(h); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// isEmailInUse checks the unique index of emails within a tenant, which also
+// covers soft deleted rows.
+func (h *MemoryPersistence) isEmailInUse(tenantID uint, email string, exceptID uint) bool {
+	for id, m := range h.models {
+		if id != exceptID && m.TenantID == tenantID && m.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the stored, not deleted, models satisfying every condition of filter.
+func (h *MemoryPersistence) match(filter FilterExpr) ([]*Model, error) {
+	filter = h.resolveMembers(filter)
+
+	var matches []*Model
+	for _, m := range h.models {
+		if m.DeletedAt != nil {
+			continue
+		}
+		ok, err := evaluateFilter(m, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+	return matches, nil
+}
+
+func evaluateFilter(m *Model, filter FilterExpr) (bool, error) {
+	switch e := filter.(type) {
+	case nil:
+		return true, nil
+	case FilterAnd:
+		for _, term := range e {
+			ok, err := evaluateFilter(m, term)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case FilterOr:
+		for _, term := range e {
+			ok, err := evaluateFilter(m, term)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case FilterNot:
+		ok, err := evaluateFilter(m, e.Expr)
+		return !ok, err
+	case FilterComparison:
+		field, ok := modelField(m, e.Column)
+		if !ok {
+			return false, fmt.Errorf("unknown column %q", e.Column)
+		}
+		if e.Op == "~" {
+			return wildcardMatch(strings.ToLower(e.Value.(string)), strings.ToLower(field.String())), nil
+		}
+		c := compareValues(field, reflect.ValueOf(e.Value))
+		switch e.Op {
+		case "=":
+			return c == 0, nil
+		case "<>":
+			return c != 0, nil
+		case ">":
+			return c > 0, nil
+		case "<":
+			return c < 0, nil
+		case ">=":
+			return c >= 0, nil
+		case "<=":
+			return c <= 0, nil
+		}
+		return false, fmt.Errorf("unsupported operator %q", e.Op)
+	case FilterIn:
+		field, ok := modelField(m, e.Column)
+		if !ok {
+			return false, fmt.Errorf("unknown column %q", e.Column)
+		}
+		for _, v := range e.Values {
+			if compareValues(field, reflect.ValueOf(v)) == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown filter node %T", filter)
+}
+
+// wildcardMatch reports whether s matches pattern, "*" matching any run of characters.
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// sortModels sorts by the order column and then by id, like PersistenceHandler does.
+func sortModels(models []*Model, order Ordering) error {
+	if _, ok := modelField(&Model{}, order.Column); !ok {
+		return fmt.Errorf("unknown column %q", order.Column)
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		a, _ := modelField(models[i], order.Column)
+		b, _ := modelField(models[j], order.Column)
+		c := compareValues(a, b)
+		if c == 0 {
+			c = compareUint64(uint64(models[i].ID), uint64(models[j].ID))
+		}
+		if order.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	return nil
+}
+
+// isPastCursor reports whether m comes strictly after the cursor in its direction.
+func isPastCursor(m *Model, cursor *Cursor) bool {
+	field, _ := modelField(m, cursor.Column)
+	c := 0
+	if cursor.Column != "id" {
+		c = compareValues(field, reflect.ValueOf(cursor.Value))
+	}
+	if c == 0 {
+		c = compareUint64(uint64(m.ID), uint64(cursor.ID))
+	}
+	if cursor.Desc != cursor.Before {
+		return c < 0
+	}
+	return c > 0
+}
+
+// modelField finds a field of m by its Go name ("ProtectionScheme") or its
+// column name ("protection_scheme"), the two forms gorm accepts, and reads
+// attributes of the profile schema by their "attributes.<name>" column.
+func modelField(m *Model, key string) (reflect.Value, bool) {
+	if field, ok := profileSchema.Field(key); ok {
+		return attributeValue(m, field), true
+	}
+
+	v := reflect.ValueOf(m).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == key || gorm.ToDBName(name) == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func applyUpdates(m *Model, updates map[string]interface{}) error {
+	for key, value := range updates {
+		if patch, ok := value.(AttributeUpdates); ok {
+			m.Attributes = m.Attributes.merge(patch)
+			continue
+		}
+		field, ok := modelField(m, key)
+		if !ok {
+			return fmt.Errorf("unknown column %q", key)
+		}
+		if value == nil {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+		v := reflect.ValueOf(value)
+		if !v.Type().ConvertibleTo(field.Type()) {
+			return fmt.Errorf("can't assign %T to %s", value, key)
+		}
+		field.Set(v.Convert(field.Type()))
+	}
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+// compareValues returns -1, 0 or 1 comparing two values of the same kind.
+// Nil time pointers sort first, like NULLs do in ascending SQL order.
+func compareValues(a, b reflect.Value) int {
+	a, b = derefTime(a), derefTime(b)
+	if !a.IsValid() || !b.IsValid() {
+		switch {
+		case !a.IsValid() && !b.IsValid():
+			return 0
+		case !a.IsValid():
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case !a.Bool():
+			return -1
+		default:
+			return 1
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareInt64(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareUint64(a.Uint(), b.Uint())
+	}
+
+	if ta, ok := a.Interface().(time.Time); ok {
+		tb := b.Interface().(time.Time)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+func derefTime(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		return v.Elem()
+	}
+	return v
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestMemoryPersistence(t *testing.T) {
+	runPersistenceTests(t, func(t *testing.T) Persistence {
+		return NewMemoryPersistence()
+	})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// persistenceTests is the contract of Persistence, which the SQL and the
+// memory implementations both meet. Each test starts with an empty store.
+var persistenceTests = []struct {
+	name string
+	test func(t *testing.T, p Persistence)
+}{
+	{"create and find", testCreateAndFind},
+	{"update fields", testUpdateFields},
+	{"delete", testDelete},
+	{"find and count", testFindAndCount},
+	{"iterate", testIterate},
+	{"transaction", testTransaction},
+	{"filters", testFilters},
+	{"keyset pages", testKeysetPages},
+	{"version conflicts", testVersionConflicts},
+	{"update many", testUpdateMany},
+	{"delete many", testDeleteMany},
+	{"unique email per tenant", testUniqueEmailPerTenant},
+}
+
+func runPersistenceTests(t *testing.T, newPersistence func(t *testing.T) Persistence) {
+	for _, tt := range persistenceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newPersistence(t))
+		})
+	}
+}
+
+func TestSQLitePersistence(t *testing.T) {
+	runPersistenceTests(t, newSQLitePersistence)
+}
+
+// newSQLitePersistence migrates a new database file the way "migrate up"
+// does.
+func newSQLitePersistence(t *testing.T) Persistence {
+	config := &Config{}
+	config.DB.Driver = "sqlite"
+	config.DB.Name = filepath.Join(t.TempDir(), "test.db")
+
+	db := initDatabase(config)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := NewMigrator(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+
+	return &PersistenceHandler{db}
+}
+
+func newTestModel(email string, name string, age uint) *Model {
+	return &Model{
+		TenantID: defaultTenantID,
+		Email:    email,
+		Name:     name,
+		Age:      age,
+		Date:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// createTestModels creates a model of each name, aged by its position.
+func createTestModels(t *testing.T, p Persistence, names ...string) []*Model {
+	var models []*Model
+	for i, name := range names {
+		m := newTestModel(name+"@example.com", name, uint(20+i))
+		if err := p.Create(m); err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		models = append(models, m)
+	}
+	return models
+}
+
+func mustParseFilter(t *testing.T, s string) FilterExpr {
+	filter, err := ParseFilter(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return filter
+}
+
+func modelNames(models []Model) []string {
+	names := []string{}
+	for _, m := range models {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCreateAndFind(t *testing.T, p Persistence) {
+	m := newTestModel("alice@example.com", "Alice", 30)
+	if err := p.Create(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID == 0 || m.Version != 1 {
+		t.Fatalf("created model has ID %d and version %d", m.ID, m.Version)
+	}
+
+	found, err := p.FindOne(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Email != m.Email || found.Name != m.Name || found.Age != m.Age || !found.Date.Equal(m.Date) {
+		t.Errorf("found %+v, created %+v", found, m)
+	}
+
+	if _, err := p.FindOne(m.ID + 1); err != errNotFound {
+		t.Errorf("finding a missing model: got %v, want %v", err, errNotFound)
+	}
+}
+
+func testUpdateFields(t *testing.T, p Persistence) {
+	m := createTestModels(t, p, "alice")[0]
+
+	if err := p.UpdateFields(m, map[string]interface{}{"name": "Alicia", "age": uint(31)}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 2 {
+		t.Errorf("version is %d after an update, want 2", m.Version)
+	}
+
+	found, err := p.FindOne(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alicia" || found.Age != 31 || found.Version != 2 {
+		t.Errorf("found %s aged %d at version %d", found.Name, found.Age, found.Version)
+	}
+}
+
+func testDelete(t *testing.T, p Persistence) {
+	m := createTestModels(t, p, "alice")[0]
+
+	if err := p.Delete(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.FindOne(m.ID); err != errNotFound {
+		t.Errorf("finding a deleted model: got %v, want %v", err, errNotFound)
+	}
+	if count, err := p.Count(nil); err != nil || count != 0 {
+		t.Errorf("counted %d models after deleting the only one (%v)", count, err)
+	}
+}
+
+func testFindAndCount(t *testing.T, p Persistence) {
+	createTestModels(t, p, "carol", "alice", "bob")
+
+	models, err := p.Find(nil, Ordering{Column: "name"}, Page{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := modelNames(models); !equalStrings(names, []string{"alice", "bob", "carol"}) {
+		t.Errorf("found %v ordered by name", names)
+	}
+
+	models, err = p.Find(nil, Ordering{Column: "id", Desc: true}, Page{Limit: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := modelNames(models); !equalStrings(names, []string{"bob", "alice"}) {
+		t.Errorf("found %v ordered by id descending, 2 at most", names)
+	}
+
+	count, err := p.Count(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("counted %d models, want 3", count)
+	}
+}
+
+func testIterate(t *testing.T, p Persistence) {
+	createTestModels(t, p, "carol", "alice", "bob")
+
+	var names []string
+	err := p.Iterate(nil, Ordering{Column: "name", Desc: true}, nil, func(m *Model) error {
+		names = append(names, m.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(names, []string{"carol", "bob", "alice"}) {
+		t.Errorf("iterated %v ordered by name descending", names)
+	}
+
+	stop := Error{Code: 500, Message: "stop"}
+	calls := 0
+	err = p.Iterate(nil, Ordering{Column: "id"}, nil, func(m *Model) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("iteration returned %v after %d calls, want it to stop at the first error", err, calls)
+	}
+}
+
+func testTransaction(t *testing.T, p Persistence) {
+	rollback := Error{Code: 500, Message: "rollback"}
+	err := p.Transaction(func(tx Persistence) error {
+		if err := tx.Create(newTestModel("alice@example.com", "alice", 20)); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatalf("transaction returned %v, want %v", err, rollback)
+	}
+	if count, _ := p.Count(nil); count != 0 {
+		t.Errorf("counted %d models after a rollback, want 0", count)
+	}
+
+	err = p.Transaction(func(tx Persistence) error {
+		return tx.Create(newTestModel("bob@example.com", "bob", 20))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := p.Count(nil); count != 1 {
+		t.Errorf("counted %d models after a commit, want 1", count)
+	}
+}
+
+func testFilters(t *testing.T, p Persistence) {
+	for _, m := range []*Model{
+		{Email: "alice@example.com", Name: "alice", Age: 20, Number: -5, Date: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Email: "bob@example.com", Name: "Bob", Age: 30, Number: 0, Date: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Email: "carol@example.org", Name: "carol", Age: 40, Number: 5, Date: time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Email: "dan@example.org", Name: "dan", Age: 50, Number: 10, Date: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Email: "d_n@example.org", Name: "d_n", Age: 60, Number: 15, Date: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		m.TenantID = defaultTenantID
+		if err := p.Create(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		names  []string
+	}{
+		{`name="alice"`, []string{"alice"}},
+		{`name!="alice"`, []string{"Bob", "carol", "dan", "d_n"}},
+		{`age>30`, []string{"carol", "dan", "d_n"}},
+		{`age<=30`, []string{"alice", "Bob"}},
+		{`number<0`, []string{"alice"}},
+		{`number>=0 and number<10`, []string{"Bob", "carol"}},
+		{`date>="2010-01-01T00:00:00Z"`, []string{"carol", "dan", "d_n"}},
+		{`date<"2000-01-01T00:00:00Z"`, []string{"alice"}},
+		{`name~"bob"`, []string{"Bob"}},
+		{`email~"*.org"`, []string{"carol", "dan", "d_n"}},
+		{`name~"d_*"`, []string{"d_n"}},
+		{`name in ["alice","dan"]`, []string{"alice", "dan"}},
+		{`name not in ["alice","dan"]`, []string{"Bob", "carol", "d_n"}},
+		{`age<30 or age>50`, []string{"alice", "d_n"}},
+		{`not (age<30 or age>50)`, []string{"Bob", "carol", "dan"}},
+		{`email~"*.com" and (age=20 or number=0)`, []string{"alice", "Bob"}},
+	}
+	for _, tt := range tests {
+		models, err := p.Find(mustParseFilter(t, tt.filter), Ordering{Column: "id"}, Page{}, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if names := modelNames(models); !equalStrings(names, tt.names) {
+			t.Errorf("%s: found %v, want %v", tt.filter, names, tt.names)
+		}
+		if count, err := p.Count(mustParseFilter(t, tt.filter)); err != nil || count != len(tt.names) {
+			t.Errorf("%s: counted %d (%v), want %d", tt.filter, count, err, len(tt.names))
+		}
+	}
+}
+
+// testKeysetPages walks the pages of models whose order column has ties,
+// which the id breaks.
+func testKeysetPages(t *testing.T, p Persistence) {
+	for i, age := range []uint{30, 20, 30, 10, 20, 30, 10} {
+		m := newTestModel(string(rune('a'+i))+"@example.com", string(rune('a'+i)), age)
+		if err := p.Create(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		order Ordering
+		pages [][]string
+	}{
+		{Ordering{Column: "age"}, [][]string{{"d", "g", "b"}, {"e", "a", "c"}, {"f"}}},
+		{Ordering{Column: "age", Desc: true}, [][]string{{"f", "c", "a"}, {"e", "b", "g"}, {"d"}}},
+		{Ordering{Column: "id", Desc: true}, [][]string{{"g", "f", "e"}, {"d", "c", "b"}, {"a"}}},
+	}
+	for _, tt := range tests {
+		var pages [][]Model
+		page := Page{Limit: 3}
+		for {
+			models, err := p.Find(nil, tt.order, page, nil)
+			if err != nil {
+				t.Fatalf("%+v: %v", tt.order, err)
+			}
+			if len(models) == 0 {
+				break
+			}
+			pages = append(pages, models)
+			if len(pages) > len(tt.pages) {
+				t.Fatalf("%+v: more than %d pages", tt.order, len(tt.pages))
+			}
+			cursor, err := CursorFromModel(&models[len(models)-1], tt.order, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page.Cursor = cursor
+		}
+		if len(pages) != len(tt.pages) {
+			t.Fatalf("%+v: walked %d pages, want %d", tt.order, len(pages), len(tt.pages))
+		}
+		for i := range pages {
+			if names := modelNames(pages[i]); !equalStrings(names, tt.pages[i]) {
+				t.Errorf("%+v: page %d is %v, want %v", tt.order, i, names, tt.pages[i])
+			}
+		}
+
+		// Back from the first model of the last page
+		cursor, err := CursorFromModel(&pages[len(pages)-1][0], tt.order, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		models, err := p.Find(nil, tt.order, Page{Limit: 3, Cursor: cursor}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names, want := modelNames(models), tt.pages[len(tt.pages)-2]; !equalStrings(names, want) {
+			t.Errorf("%+v: previous page is %v, want %v", tt.order, names, want)
+		}
+	}
+}
+
+func testVersionConflicts(t *testing.T, p Persistence) {
+	m := createTestModels(t, p, "alice")[0]
+	stale := *m
+
+	if err := p.UpdateFields(m, map[string]interface{}{"name": "Alicia"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdateFields(&stale, map[string]interface{}{"name": "Ally"}); err != errVersionConflict {
+		t.Errorf("updating a stale model: got %v, want %v", err, errVersionConflict)
+	}
+	if err := p.Delete(&stale); err != errVersionConflict {
+		t.Errorf("deleting a stale model: got %v, want %v", err, errVersionConflict)
+	}
+
+	found, err := p.FindOne(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alicia" {
+		t.Errorf("name is %q after a conflict, want the first update kept", found.Name)
+	}
+
+	if err := p.Delete(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdateFields(m, map[string]interface{}{"name": "Ally"}); err != errVersionConflict {
+		t.Errorf("updating a deleted model: got %v, want %v", err, errVersionConflict)
+	}
+}
+
+func testUpdateMany(t *testing.T, p Persistence) {
+	models := createTestModels(t, p, "alice", "bob", "carol")
+
+	n, err := p.UpdateMany(map[string]interface{}{"number": 7}, mustParseFilter(t, "age>=21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("updated %d models, want 2", n)
+	}
+	if n, _ := p.UpdateMany(map[string]interface{}{"number": 7}, mustParseFilter(t, "age>100")); n != 0 {
+		t.Errorf("updated %d models matching nothing", n)
+	}
+
+	for i, m := range models {
+		found, err := p.FindOne(m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		number, version := 0, uint(1)
+		if i > 0 {
+			number, version = 7, 2
+		}
+		if found.Number != number || found.Version != version {
+			t.Errorf("%s has number %d at version %d, want %d at %d", found.Name, found.Number, found.Version, number, version)
+		}
+	}
+}
+
+func testDeleteMany(t *testing.T, p Persistence) {
+	createTestModels(t, p, "alice", "bob", "carol")
+
+	n, err := p.DeleteMany(mustParseFilter(t, "age>=21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("deleted %d models, want 2", n)
+	}
+
+	// Deleted models are neither found nor deleted again
+	n, err = p.DeleteMany(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("deleted %d models, want the 1 left", n)
+	}
+	if count, _ := p.Count(nil); count != 0 {
+		t.Errorf("counted %d models after deleting them all", count)
+	}
+}
+
+func testUniqueEmailPerTenant(t *testing.T, p Persistence) {
+	alice := createTestModels(t, p, "alice")[0]
+
+	if err := p.Create(newTestModel("alice@example.com", "other", 20)); err != errEmailInUse {
+		t.Errorf("creating a duplicate email: got %v, want %v", err, errEmailInUse)
+	}
+
+	other := newTestModel("alice@example.com", "other", 20)
+	other.TenantID = defaultTenantID + 1
+	if err := p.Create(other); err != nil {
+		t.Errorf("creating the email in another tenant: %v", err)
+	}
+
+	bob := createTestModels(t, p, "bob")[0]
+	if err := p.UpdateFields(bob, map[string]interface{}{"email": alice.Email}); err != errEmailInUse {
+		t.Errorf("updating to a duplicate email: got %v, want %v", err, errEmailInUse)
+	}
+	if err := p.UpdateFields(bob, map[string]interface{}{"email": "robert@example.com"}); err != nil {
+		t.Errorf("updating to a free email: %v", err)
+	}
+}
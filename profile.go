@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The profile schema declares the custom attributes of the users of a
+// deployment in config.yml:
+//
+//	profile:
+//	  fields:
+//	    - name: nickname
+//	      type: string        # string, integer, boolean or date
+//	      required: true
+//	      min: 2              # length of strings, value of integers
+//	      max: 30
+//	      pattern: "^[a-z]+$"
+//	      normalize: NFC      # Unicode normalization of strings, see ValidationRule
+//	      filterable: true
+//	      sortable: true
+//	      visibility: public  # public, private (only to the user itself) or internal (never returned)
+//
+// Attributes are sent as form params named after their field, stored in the
+// attributes JSON column and referenced as "attributes.<name>" by filters and
+// order. A missing attribute reads as the zero value of its type.
+
+const attributePrefix = "attributes."
+
+const (
+	AttributeString  = "string"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+	AttributeDate    = "date"
+)
+
+const (
+	VisibilityPublic   = "public"
+	VisibilityPrivate  = "private"
+	VisibilityInternal = "internal"
+)
+
+// attributeDateLayout sorts chronologically as text, which is how dates are
+// compared inside the JSON column.
+const attributeDateLayout = "2006-01-02T15:04:05Z"
+
+type ProfileField struct {
+	Name       string
+	Type       string
+	Required   bool
+	Min        *float64
+	Max        *float64
+	Pattern    string
+	Normalize  string
+	Filterable bool
+	Sortable   bool
+	Visibility string
+}
+
+type ProfileSchema struct {
+	Fields     []ProfileField
+	byName     map[string]*ProfileField
+	validators map[string]*fieldValidator
+}
+
+// profileSchema is the schema in use, set up by InitProfileSchema.
+var profileSchema = &ProfileSchema{byName: map[string]*ProfileField{}}
+
+var profileFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// reservedProfileNames are the columns and request params attributes can't
+// take the name of.
+var reservedProfileNames = []string{
+	"id", "email", "password", "password_hash", "protection_scheme", "name", "age", "number", "date",
+	"compromised", "created_at", "updated_at", "deleted_at", "version", "attributes",
+	"filter", "fields", "expand", "limit", "cursor", "total", "order", "orderdir", "dryrun", "confirm",
+	"action", "format", "columns", "onconflict",
+}
+
+func LoadProfileSchema(fields []ProfileField) (*ProfileSchema, error) {
+	schema := ProfileSchema{byName: map[string]*ProfileField{}, validators: map[string]*fieldValidator{}}
+
+	for _, field := range fields {
+		if !profileFieldName.MatchString(field.Name) {
+			return nil, fmt.Errorf("profile field %q: names are lower case letters, digits and underscores", field.Name)
+		}
+		for _, reserved := range reservedProfileNames {
+			if field.Name == reserved {
+				return nil, fmt.Errorf("profile field %q: the name is reserved", field.Name)
+			}
+		}
+		if _, ok := schema.validators[field.Name]; ok {
+			return nil, fmt.Errorf("profile field %q: declared twice", field.Name)
+		}
+
+		switch field.Type {
+		case AttributeString, AttributeInteger:
+		case AttributeBoolean, AttributeDate:
+			if field.Min != nil || field.Max != nil {
+				return nil, fmt.Errorf("profile field %q: min and max don't apply to %s fields", field.Name, field.Type)
+			}
+		default:
+			return nil, fmt.Errorf("profile field %q: unknown type %q, use string, integer, boolean or date", field.Name, field.Type)
+		}
+		if field.Type == AttributeBoolean && (field.Filterable || field.Sortable) {
+			return nil, fmt.Errorf("profile field %q: boolean fields can't be filtered or sorted", field.Name)
+		}
+
+		if (field.Pattern != "" || field.Normalize != "") && field.Type != AttributeString {
+			return nil, fmt.Errorf("profile field %q: patterns and normalization only apply to string fields", field.Name)
+		}
+		validator, err := newFieldValidator(field.Name, field.rule())
+		if err != nil {
+			return nil, err
+		}
+		schema.validators[field.Name] = validator
+
+		switch field.Visibility {
+		case "":
+			field.Visibility = VisibilityPublic
+		case VisibilityPublic, VisibilityPrivate, VisibilityInternal:
+		default:
+			return nil, fmt.Errorf("profile field %q: unknown visibility %q, use public, private or internal", field.Name, field.Visibility)
+		}
+
+		schema.Fields = append(schema.Fields, field)
+	}
+
+	for i := range schema.Fields {
+		schema.byName[schema.Fields[i].Name] = &schema.Fields[i]
+	}
+	return &schema, nil
+}
+
+// InitProfileSchema loads the schema from config and makes its filterable and
+// sortable fields available to filters and order.
+func InitProfileSchema(config *Config) error {
+	schema, err := LoadProfileSchema(config.Profile.Fields)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range schema.Fields {
+		if field.Filterable {
+			filterableFields[field.Name] = filterableField{attributePrefix + field.Name, field.filterType()}
+		}
+		if field.Sortable {
+			sortableFields[field.Name] = attributePrefix + field.Name
+		}
+	}
+	profileSchema = schema
+	return nil
+}
+
+// rule is the validation rule of the field, min and max bounding the length of
+// strings and the value of integers.
+func (f *ProfileField) rule() ValidationRule {
+	rule := ValidationRule{Pattern: f.Pattern, Normalize: f.Normalize}
+	if f.Type != AttributeString {
+		rule.Min, rule.Max = f.Min, f.Max
+		return rule
+	}
+	if f.Min != nil {
+		length := int(*f.Min)
+		rule.MinLength = &length
+	}
+	if f.Max != nil {
+		length := int(*f.Max)
+		rule.MaxLength = &length
+	}
+	return rule
+}
+
+func (f *ProfileField) filterType() FilterFieldType {
+	switch f.Type {
+	case AttributeInteger:
+		return FilterInt
+	case AttributeDate:
+		return FilterTime
+	}
+	return FilterString
+}
+
+// Field returns the field of an "attributes.<name>" column.
+func (s *ProfileSchema) Field(column string) (*ProfileField, bool) {
+	if !strings.HasPrefix(column, attributePrefix) {
+		return nil, false
+	}
+	field, ok := s.byName[strings.TrimPrefix(column, attributePrefix)]
+	return field, ok
+}
+
+// Params picks the raw values of the attributes in a request, internal ones
+// only when withInternal.
+func (s *ProfileSchema) Params(get func(key string) (string, bool), withInternal bool) map[string]string {
+	params := map[string]string{}
+	for _, field := range s.Fields {
+		if field.Visibility == VisibilityInternal && !withInternal {
+			continue
+		}
+		if value, ok := get(field.Name); ok {
+			params[field.Name] = value
+		}
+	}
+	return params
+}
+
+// Parse converts raw values to attributes, validating each against its field.
+func (s *ProfileSchema) Parse(params map[string]string) (Attributes, error) {
+	attributes := Attributes{}
+	for name, raw := range params {
+		field, ok := s.byName[name]
+		if !ok {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Unknown parameter " + name}
+		}
+		value, err := s.parseValue(field, raw)
+		if err != nil {
+			return nil, err
+		}
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+func (s *ProfileSchema) parseValue(field *ProfileField, raw string) (interface{}, error) {
+	invalid := validationError("invalid", field.Name)
+	validator := s.validators[field.Name]
+
+	switch field.Type {
+	case AttributeString:
+		return validator.String(field.Name, raw)
+	case AttributeInteger:
+		value, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return nil, invalid
+		}
+		if err := validator.Number(field.Name, float64(value)); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case AttributeBoolean:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, invalid
+		}
+		return value, nil
+	case AttributeDate:
+		value, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, invalid
+		}
+		return value.UTC().Format(attributeDateLayout), nil
+	}
+	return nil, invalid
+}
+
+// CheckRequired rejects attributes missing a required field.
+func (s *ProfileSchema) CheckRequired(attributes Attributes) error {
+	for _, field := range s.Fields {
+		if _, ok := attributes[field.Name]; field.Required && !ok {
+			return validationError("required", field.Name)
+		}
+	}
+	return nil
+}
+
+// Visible drops the attributes a reader can't see: internal ones always and
+// private ones unless the reader is the user itself.
+func (s *ProfileSchema) Visible(attributes Attributes, self bool) Attributes {
+	visible := Attributes{}
+	for name, value := range attributes {
+		field, ok := s.byName[name]
+		if !ok || field.Visibility == VisibilityInternal || field.Visibility == VisibilityPrivate && !self {
+			continue
+		}
+		visible[name] = value
+	}
+	return visible
+}
+
+// attributeSQL reads an attribute from the JSON column in dialect, a missing
+// one reading as the zero value of its type. Field names are validated by
+// LoadProfileSchema, so they're safe to inline.
+func attributeSQL(dialect string, field *ProfileField) string {
+	path := "'$." + field.Name + "'"
+	integer := field.Type == AttributeInteger
+
+	switch dialect {
+	case "mysql":
+		if integer {
+			return "COALESCE(CAST(JSON_EXTRACT(attributes, " + path + ") AS SIGNED), 0)"
+		}
+		return "COALESCE(JSON_UNQUOTE(JSON_EXTRACT(attributes, " + path + ")), '')"
+	case "postgres":
+		if integer {
+			return "COALESCE((attributes->>'" + field.Name + "')::bigint, 0)"
+		}
+		return "COALESCE(attributes->>'" + field.Name + "', '')"
+	default:
+		if integer {
+			return "COALESCE(json_extract(attributes, " + path + "), 0)"
+		}
+		return "COALESCE(json_extract(attributes, " + path + "), '')"
+	}
+}
+
+// attributeMergeSQL merges a JSON object into the attributes column in dialect.
+func attributeMergeSQL(dialect string) string {
+	switch dialect {
+	case "mysql":
+		return "JSON_MERGE_PATCH(COALESCE(attributes, JSON_OBJECT()), CAST(? AS JSON))"
+	case "postgres":
+		return "COALESCE(attributes, '{}'::jsonb) || ?::jsonb"
+	default:
+		return "json_patch(COALESCE(attributes, '{}'), ?)"
+	}
+}
+
+// attributeArg converts a filter or cursor value to the way the attribute is stored.
+func attributeArg(field *ProfileField, v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok && field.Type == AttributeDate {
+		if t.IsZero() {
+			return "" // a missing date, see attributeValue
+		}
+		return t.UTC().Format(attributeDateLayout)
+	}
+	return v
+}
+
+// attributeValue reads an attribute of m the way the SQL expressions do,
+// dates as time.Time so they compare with filter values.
+func attributeValue(m *Model, field *ProfileField) reflect.Value {
+	value, ok := m.Attributes[field.Name]
+	switch field.Type {
+	case AttributeInteger:
+		n, _ := value.(int64)
+		return reflect.ValueOf(n)
+	case AttributeBoolean:
+		b, _ := value.(bool)
+		return reflect.ValueOf(b)
+	case AttributeDate:
+		var t time.Time
+		if s, isString := value.(string); ok && isString {
+			t, _ = time.Parse(time.RFC3339, s)
+		}
+		return reflect.ValueOf(t)
+	}
+	s, _ := value.(string)
+	return reflect.ValueOf(s)
+}
+
+// Attributes holds the profile of a user, stored as a JSON object. Values are
+// strings, int64 or bools, dates being strings.
+type Attributes map[string]interface{}
+
+// AttributeUpdates sets some attributes of a user, leaving the others as they are.
+type AttributeUpdates Attributes
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(map[string]interface{}(a))
+	return string(encoded), err
+}
+
+func (a *Attributes) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*a = Attributes{}
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return errors.New("attributes: can't scan " + reflect.TypeOf(src).String())
+	}
+	return a.UnmarshalJSON(raw)
+}
+
+func (a *Attributes) UnmarshalJSON(raw []byte) error {
+	var decoded map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+
+	attributes := Attributes{}
+	for name, value := range decoded {
+		if n, ok := value.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				value = i
+			}
+		}
+		attributes[name] = value
+	}
+	*a = attributes
+	return nil
+}
+
+// MarshalJSON never writes internal attributes.
+func (a Attributes) MarshalJSON() ([]byte, error) {
+	visible := map[string]interface{}{}
+	for name, value := range a {
+		if field, ok := profileSchema.byName[name]; ok && field.Visibility == VisibilityInternal {
+			continue
+		}
+		visible[name] = value
+	}
+	return json.Marshal(visible)
+}
+
+// merge returns the attributes updated by updates, leaving a untouched.
+func (a Attributes) merge(updates AttributeUpdates) Attributes {
+	merged := Attributes{}
+	for name, value := range a {
+		merged[name] = value
+	}
+	for name, value := range updates {
+		merged[name] = value
+	}
+	return merged
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// useProfileSchema makes fields the schema in use for the rest of the test.
+func useProfileSchema(t *testing.T, fields []ProfileField) *ProfileSchema {
+	schema, err := LoadProfileSchema(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := profileSchema
+	profileSchema = schema
+	t.Cleanup(func() { profileSchema = previous })
+	return schema
+}
+
+var testProfileFields = []ProfileField{
+	{Name: "nickname", Type: AttributeString, Required: true, Min: float(2), Max: float(5), Pattern: "^[a-zé]+$", Normalize: "NFC"},
+	{Name: "level", Type: AttributeInteger, Min: float(1), Max: float(10)},
+	{Name: "newsletter", Type: AttributeBoolean, Visibility: VisibilityPrivate},
+	{Name: "birthday", Type: AttributeDate},
+	{Name: "risk", Type: AttributeString, Visibility: VisibilityInternal},
+}
+
+func TestLoadProfileSchema(t *testing.T) {
+	tests := []struct {
+		name  string
+		field ProfileField
+	}{
+		{"upper case name", ProfileField{Name: "Nick", Type: AttributeString}},
+		{"reserved name", ProfileField{Name: "password", Type: AttributeString}},
+		{"unknown type", ProfileField{Name: "x", Type: "float"}},
+		{"bounded boolean", ProfileField{Name: "x", Type: AttributeBoolean, Max: float(1)}},
+		{"filterable boolean", ProfileField{Name: "x", Type: AttributeBoolean, Filterable: true}},
+		{"integer pattern", ProfileField{Name: "x", Type: AttributeInteger, Pattern: "^1$"}},
+		{"invalid pattern", ProfileField{Name: "x", Type: AttributeString, Pattern: "("}},
+		{"unknown normalization", ProfileField{Name: "x", Type: AttributeString, Normalize: "NFX"}},
+		{"unknown visibility", ProfileField{Name: "x", Type: AttributeString, Visibility: "friends"}},
+	}
+	for _, tt := range tests {
+		if _, err := LoadProfileSchema([]ProfileField{tt.field}); err == nil {
+			t.Errorf("%s: loaded", tt.name)
+		}
+	}
+
+	if _, err := LoadProfileSchema([]ProfileField{{Name: "x", Type: AttributeString}, {Name: "x", Type: AttributeInteger}}); err == nil {
+		t.Error("loaded a field declared twice")
+	}
+	schema, err := LoadProfileSchema(testProfileFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field, ok := schema.Field("attributes.birthday"); !ok || field.Visibility != VisibilityPublic {
+		t.Errorf("got field %+v", field)
+	}
+}
+
+func TestProfileSchemaParse(t *testing.T) {
+	schema := useProfileSchema(t, testProfileFields)
+
+	tests := []struct {
+		name  string
+		param string
+		raw   string
+		want  interface{}
+	}{
+		{"string", "nickname", "bob", "bob"},
+		{"string normalized before its length is checked", "nickname", "josé", "josé"},
+		{"short string", "nickname", "b", nil},
+		{"long string", "nickname", "bobbie", nil},
+		{"string not matching", "nickname", "Bob", nil},
+		{"integer", "level", "3", int64(3)},
+		{"integer under min", "level", "0", nil},
+		{"integer over max", "level", "11", nil},
+		{"not an integer", "level", "3.5", nil},
+		{"boolean", "newsletter", "true", true},
+		{"not a boolean", "newsletter", "yes please", nil},
+		{"date", "birthday", "2000-01-02T03:04:05+02:00", "2000-01-02T01:04:05Z"},
+		{"not a date", "birthday", "2000-01-02", nil},
+		{"unknown", "shoe_size", "42", nil},
+	}
+	for _, tt := range tests {
+		attributes, err := schema.Parse(map[string]string{tt.param: tt.raw})
+		if tt.want == nil {
+			if v, ok := err.(Error); !ok || v.Code != http.StatusBadRequest {
+				t.Errorf("%s: got %v, %v", tt.name, attributes, err)
+			}
+			continue
+		}
+		if err != nil || attributes[tt.param] != tt.want {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, attributes[tt.param], err, tt.want)
+		}
+	}
+
+	if err := schema.CheckRequired(Attributes{"level": int64(1)}); err == nil {
+		t.Error("accepted attributes without a nickname")
+	}
+	all := Attributes{"nickname": "bob", "newsletter": true, "risk": "high"}
+	if got := schema.Visible(all, false); !reflect.DeepEqual(got, Attributes{"nickname": "bob"}) {
+		t.Errorf("others see %v", got)
+	}
+	if got := schema.Visible(all, true); !reflect.DeepEqual(got, Attributes{"nickname": "bob", "newsletter": true}) {
+		t.Errorf("the user sees %v", got)
+	}
+	params := schema.Params(func(key string) (string, bool) { return "x", true }, false)
+	if _, ok := params["risk"]; ok {
+		t.Error("took an internal attribute from a request")
+	}
+}
+
+func TestProfileAttributes(t *testing.T) {
+	schema := useProfileSchema(t, testProfileFields)
+	store := NewMemoryPersistence()
+	config := &Config{JwtSecret: "secret", AppName: "test"}
+	users := (&UsecaseHandler{store, store, nil, nil, config}).ForTenant(defaultTenantID)
+
+	if _, err := users.Create("a@example.com", "password", "a", 20, 0, time.Time{}, map[string]string{"level": "2"}); err == nil {
+		t.Error("created a user without the required nickname")
+	}
+	user, err := users.Create("a@example.com", "password", "a", 20, 0, time.Time{}, map[string]string{"nickname": "bob", "level": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := schema.Parse(map[string]string{"level": "3", "newsletter": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err = users.UpdateOne(user, map[string]interface{}{"Attributes": AttributeUpdates(parsed)}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.FindOne(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Attributes{"nickname": "bob", "level": int64(3), "newsletter": true}
+	if !reflect.DeepEqual(stored.Attributes, want) {
+		t.Errorf("stored %#v, want %#v", stored.Attributes, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// PrefixRouter sends each request to the handler mounted on the first segment
+// of its path, or to Default. The users routes take that segment as an id
+// ("/:id") and gin can't register static segments such as "/jobs" next to it,
+// so every other resource gets its own engine mounted here.
+type PrefixRouter struct {
+	Default http.Handler
+	mounts  map[string]http.Handler
+}
+
+func NewPrefixRouter(defaultHandler http.Handler) *PrefixRouter {
+	return &PrefixRouter{Default: defaultHandler, mounts: map[string]http.Handler{}}
+}
+
+// Mount serves the paths starting with "/"+segment with handler, which sees
+// them unchanged.
+func (r *PrefixRouter) Mount(segment string, handler http.Handler) {
+	r.mounts[segment] = handler
+}
+
+func (r *PrefixRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segment := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.IndexByte(segment, '/'); i >= 0 {
+		segment = segment[:i]
+	}
+
+	if handler, ok := r.mounts[segment]; ok {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	r.Default.ServeHTTP(w, req)
+}
+
+type tenantPathKey struct{}
+
+// TenantPath serves the paths starting with "/t/"+slug as if they didn't,
+// keeping the slug for ResolveTenant, so every route can also be reached
+// under the tenant it acts on.
+func TenantPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/t/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rest := strings.TrimPrefix(req.URL.Path, "/t/")
+		slug, path := rest, "/"
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			slug, path = rest[:i], rest[i:]
+		}
+
+		u := *req.URL
+		u.Path, u.RawPath = path, ""
+		r := req.WithContext(context.WithValue(req.Context(), tenantPathKey{}, slug))
+		r.URL = &u
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantFromPath is the slug TenantPath took from the path of req, if any.
+func tenantFromPath(req *http.Request) string {
+	slug, _ := req.Context().Value(tenantPathKey{}).(string)
+	return slug
+}
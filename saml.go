@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SAMLProviderConfig is a SAML 2.0 identity provider the users of a tenant
+// log in with, like the ADFS, Okta or Azure AD of a company. Each gets a
+// service provider of its own, whose entity ID is the URL of its metadata,
+// Issuer+"/saml/"+Name+"/metadata", for the identity provider to register.
+// Its responses, or their assertions, must be signed by one of Certificates.
+// Encrypted assertions aren't supported.
+//
+// Attributes maps the fields of users, and their profile attributes, to the
+// SAML attributes that fill them:
+//
+//	subject  the NameID by default, which should be persistent
+//	email    email by default, or the NameID when it's an email address
+//	name     name by default
+//	age, number, date and profile attributes, none by default
+type SAMLProviderConfig struct {
+	Name              string   // in the paths of its service provider, like acme
+	EntityID          string   // of the identity provider
+	SSOURL            string   // its single sign-on service
+	SSOBinding        string   // of SSOURL, redirect by default, or post
+	Certificates      []string // PEM files of the certificates signing its responses, several while rotating them
+	Tenant            string   // slug of the tenant its users log in to, the default one when empty
+	AllowIdPInitiated bool     // lets users log in from the identity provider, without a request of the service
+	Attributes        map[string]string
+	TrustEmail        bool // links users to the users with their email, see IdentityUsecaseHandler.FinishLogin
+}
+
+const (
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	samlPOSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	samlSuccess        = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer         = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlEmailAddress   = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlUnspecifiedID  = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	samlClockSkew      = 3 * time.Minute
+	samlMaxAssertionID = 128
+)
+
+var defaultSAMLAttributes = map[string]string{
+	"email": "email",
+	"name":  "name",
+}
+
+// SAMLProvider logs users in with a SAML 2.0 identity provider.
+type SAMLProvider struct {
+	SAMLProviderConfig
+	entityID     string // of the service provider
+	acsURL       string // its assertion consumer service
+	certificates []*x509.Certificate
+}
+
+// SAMLRequest is an AuthnRequest sent with the binding of the single sign-on
+// service: a redirect to URL with Params, or a form posting them to it.
+type SAMLRequest struct {
+	URL    string
+	Params url.Values
+	Post   bool
+}
+
+// samlLogin is what a valid response of an identity provider tells.
+type samlLogin struct {
+	InResponseTo string    // the ID of the request, empty when the identity provider initiated the login
+	AssertionID  string    // used once
+	ExpiresAt    time.Time // when the assertion can't be used anymore
+	User         *ExternalUser
+}
+
+var errSAMLResponseInvalid = Error{Code: http.StatusBadRequest, Message: "Invalid SAML response, start over"}
+
+// NewSAMLProviders returns the SAML providers of config by name, with their
+// certificates, checking they don't take the names of OAuth providers, as
+// identities are linked by provider name.
+func NewSAMLProviders(config *Config) (map[string]*SAMLProvider, error) {
+	names := map[string]bool{}
+	for _, c := range config.Federation.Providers {
+		names[c.Name] = true
+	}
+
+	providers := map[string]*SAMLProvider{}
+	for _, c := range config.Federation.SAMLProviders {
+		if c.Name == "" || strings.ContainsAny(c.Name, "/?#") {
+			return nil, fmt.Errorf("federation: invalid SAML provider name %q", c.Name)
+		}
+		if _, ok := providers[c.Name]; ok || names[c.Name] {
+			return nil, fmt.Errorf("federation: provider %s is configured twice", c.Name)
+		}
+		if c.EntityID == "" || c.SSOURL == "" {
+			return nil, fmt.Errorf("federation: SAML provider %s needs an entity id and a single sign-on URL", c.Name)
+		}
+		if c.SSOBinding != "" && c.SSOBinding != "redirect" && c.SSOBinding != "post" {
+			return nil, fmt.Errorf("federation: SAML provider %s has an invalid binding %q", c.Name, c.SSOBinding)
+		}
+		if c.Tenant == "" && config.Tenants.Default == "" {
+			return nil, fmt.Errorf("federation: SAML provider %s needs a tenant", c.Name)
+		}
+		if config.Issuer == "" {
+			return nil, errors.New("federation: providers need the issuer of the service configured, for their redirect URIs")
+		}
+
+		var certificates []*x509.Certificate
+		for _, file := range c.Certificates {
+			certs, err := readCertificates(file)
+			if err != nil {
+				return nil, fmt.Errorf("federation: SAML provider %s: %v", c.Name, err)
+			}
+			certificates = append(certificates, certs...)
+		}
+		if len(certificates) == 0 {
+			return nil, fmt.Errorf("federation: SAML provider %s has no certificate", c.Name)
+		}
+
+		attributes := map[string]string{}
+		for field, name := range defaultSAMLAttributes {
+			attributes[field] = name
+		}
+		for field, name := range c.Attributes {
+			attributes[field] = name
+		}
+		c.Attributes = attributes
+
+		base := config.Issuer + "/saml/" + c.Name
+		providers[c.Name] = &SAMLProvider{
+			SAMLProviderConfig: c,
+			entityID:           base + "/metadata",
+			acsURL:             base + "/acs",
+			certificates:       certificates,
+		}
+	}
+	return providers, nil
+}
+
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New(file + " has no PEM certificate")
+	}
+	return certificates, nil
+}
+
+// Metadata describes the service provider to the identity provider, which
+// gets responses back by POST, or redirect when they're small enough.
+func (p *SAMLProvider) Metadata() []byte {
+
+	type endpoint struct {
+		Binding   string `xml:",attr"`
+		Location  string `xml:",attr"`
+		Index     int    `xml:"index,attr"`
+		IsDefault bool   `xml:"isDefault,attr,omitempty"`
+	}
+	metadata := struct {
+		XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+		EntityID        string   `xml:"entityID,attr"`
+		SPSSODescriptor struct {
+			AuthnRequestsSigned        bool       `xml:",attr"`
+			WantAssertionsSigned       bool       `xml:",attr"`
+			ProtocolSupportEnumeration string     `xml:"protocolSupportEnumeration,attr"`
+			NameIDFormat               string     `xml:"NameIDFormat"`
+			AssertionConsumerService   []endpoint `xml:"AssertionConsumerService"`
+		}
+	}{EntityID: p.entityID}
+	metadata.SPSSODescriptor.WantAssertionsSigned = true
+	metadata.SPSSODescriptor.ProtocolSupportEnumeration = samlProtocolNamespace
+	metadata.SPSSODescriptor.NameIDFormat = samlUnspecifiedID
+	metadata.SPSSODescriptor.AssertionConsumerService = []endpoint{
+		{Binding: samlPOSTBinding, Location: p.acsURL, Index: 0, IsDefault: true},
+		{Binding: samlRedirectBinding, Location: p.acsURL, Index: 1},
+	}
+
+	encoded, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte(xml.Header), encoded...)
+}
+
+// AuthnRequest asks the identity provider to log the user in, answering to
+// the request with id.
+func (p *SAMLProvider) AuthnRequest(id string) (*SAMLRequest, error) {
+
+	request := struct {
+		XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+		ID                          string   `xml:",attr"`
+		Version                     string   `xml:",attr"`
+		IssueInstant                string   `xml:",attr"`
+		Destination                 string   `xml:",attr"`
+		AssertionConsumerServiceURL string   `xml:",attr"`
+		ProtocolBinding             string   `xml:",attr"`
+		Issuer                      struct {
+			XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+			Value   string   `xml:",chardata"`
+		}
+		NameIDPolicy struct {
+			AllowCreate bool `xml:",attr"`
+		}
+	}{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(time.RFC3339),
+		Destination:                 p.SSOURL,
+		AssertionConsumerServiceURL: p.acsURL,
+		ProtocolBinding:             samlPOSTBinding,
+	}
+	request.Issuer.Value = p.entityID
+	request.NameIDPolicy.AllowCreate = true
+
+	encoded, err := xml.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.SSOBinding == "post" {
+		params := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(encoded)}}
+		return &SAMLRequest{URL: p.SSOURL, Params: params, Post: true}, nil
+	}
+
+	var deflated bytes.Buffer
+	w, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(encoded)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	params := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())}}
+	return &SAMLRequest{URL: addQuery(p.SSOURL, params.Encode()), Params: params}, nil
+}
+
+// ParseResponse checks the SAMLResponse param the identity provider posted,
+// or redirected with when deflated, returning the login it tells. Either the
+// response or its assertion must be signed, and only signed data is read.
+func (p *SAMLProvider) ParseResponse(encoded string, deflated bool) (*samlLogin, error) {
+
+	raw, err := decodeXMLBase64(encoded)
+	if err != nil {
+		return nil, p.failed("response", err)
+	}
+	if deflated {
+		if raw, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), 1<<20)); err != nil {
+			return nil, p.failed("response", err)
+		}
+	}
+
+	response, err := parseXML(raw)
+	if err != nil {
+		return nil, p.failed("response", err)
+	}
+	if !response.is(samlProtocolNamespace, "Response") {
+		return nil, p.failed("response", errors.New("it isn't a response"))
+	}
+	if !uniqueIDs(response) {
+		return nil, p.failed("response", errors.New("its IDs aren't unique"))
+	}
+	if destination := response.attr("Destination"); destination != "" && destination != p.acsURL {
+		return nil, p.failed("response", fmt.Errorf("its destination is %s", destination))
+	}
+	if issuer := response.child(samlAssertionNamespace, "Issuer"); issuer != nil && issuer.text() != p.EntityID {
+		return nil, p.failed("response", fmt.Errorf("its issuer is %s", issuer.text()))
+	}
+
+	status := response.child(samlProtocolNamespace, "Status")
+	if code := status.child(samlProtocolNamespace, "StatusCode").attr("Value"); code != samlSuccess {
+		log.Printf("SAML provider %s: the login failed with %s: %s", p.Name, code, status.child(samlProtocolNamespace, "StatusMessage").text())
+		return nil, Error{Code: http.StatusBadRequest, Message: "The identity provider didn't log the user in"}
+	}
+
+	if len(response.children(samlAssertionNamespace, "EncryptedAssertion")) > 0 {
+		return nil, p.failed("response", errors.New("encrypted assertions aren't supported"))
+	}
+	assertions := response.children(samlAssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return nil, p.failed("response", fmt.Errorf("it has %d assertions", len(assertions)))
+	}
+	assertion := assertions[0]
+
+	signed := false
+	for _, e := range []*xmlElement{response, assertion} {
+		if e.child(xmldsigNamespace, "Signature") == nil {
+			continue
+		}
+		if err := verifySignature(e, p.certificates); err != nil {
+			return nil, p.failed("signature", err)
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, p.failed("signature", errors.New("neither the response nor its assertion is signed"))
+	}
+
+	return p.login(response.attr("InResponseTo"), assertion)
+}
+
+// login checks the assertion is for the service provider, now, and the
+// request the response answers to, if any.
+func (p *SAMLProvider) login(inResponseTo string, assertion *xmlElement) (*samlLogin, error) {
+
+	now := time.Now()
+	if issuer := assertion.child(samlAssertionNamespace, "Issuer").text(); issuer != p.EntityID {
+		return nil, p.failed("assertion", fmt.Errorf("its issuer is %s", issuer))
+	}
+	id := assertion.attr("ID")
+	if id == "" || len(id) > samlMaxAssertionID {
+		return nil, p.failed("assertion", errors.New("its ID is missing or too long"))
+	}
+
+	subject := assertion.child(samlAssertionNamespace, "Subject")
+	var expiresAt time.Time
+	for _, confirmation := range subject.children(samlAssertionNamespace, "SubjectConfirmation") {
+		data := confirmation.child(samlAssertionNamespace, "SubjectConfirmationData")
+		notOnOrAfter, err := time.Parse(time.RFC3339, data.attr("NotOnOrAfter"))
+		if confirmation.attr("Method") != samlBearer || err != nil || data.attr("Recipient") != p.acsURL ||
+			data.attr("InResponseTo") != inResponseTo || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			continue
+		}
+		expiresAt = notOnOrAfter.Add(samlClockSkew)
+	}
+	if expiresAt.IsZero() {
+		return nil, p.failed("assertion", errors.New("no bearer subject confirmation is for this response, now"))
+	}
+
+	conditions := assertion.child(samlAssertionNamespace, "Conditions")
+	if notBefore := conditions.attr("NotBefore"); notBefore != "" {
+		if t, err := time.Parse(time.RFC3339, notBefore); err != nil || now.Add(samlClockSkew).Before(t) {
+			return nil, p.failed("assertion", fmt.Errorf("it's not valid before %s", notBefore))
+		}
+	}
+	if notOnOrAfter := conditions.attr("NotOnOrAfter"); notOnOrAfter != "" {
+		if t, err := time.Parse(time.RFC3339, notOnOrAfter); err != nil || !now.Before(t.Add(samlClockSkew)) {
+			return nil, p.failed("assertion", fmt.Errorf("it's not valid on or after %s", notOnOrAfter))
+		}
+	}
+	restrictions := conditions.children(samlAssertionNamespace, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, p.failed("assertion", errors.New("it has no audience"))
+	}
+	for _, restriction := range restrictions {
+		audience := false
+		for _, a := range restriction.children(samlAssertionNamespace, "Audience") {
+			audience = audience || a.text() == p.entityID
+		}
+		if !audience {
+			return nil, p.failed("assertion", errors.New("it isn't for this service provider"))
+		}
+	}
+
+	attributes := map[string]string{}
+	for _, statement := range assertion.children(samlAssertionNamespace, "AttributeStatement") {
+		for _, attribute := range statement.children(samlAssertionNamespace, "Attribute") {
+			if _, ok := attributes[attribute.attr("Name")]; !ok {
+				attributes[attribute.attr("Name")] = attribute.child(samlAssertionNamespace, "AttributeValue").text()
+			}
+		}
+	}
+
+	user, err := p.externalUser(subject.child(samlAssertionNamespace, "NameID"), attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &samlLogin{InResponseTo: inResponseTo, AssertionID: id, ExpiresAt: expiresAt, User: user}, nil
+}
+
+// externalUser maps the NameID and attributes of an assertion to a user with
+// the Attributes of the provider.
+func (p *SAMLProvider) externalUser(nameID *xmlElement, attributes map[string]string) (*ExternalUser, error) {
+
+	user := ExternalUser{Subject: nameID.text(), Fields: map[string]string{}}
+	for field, name := range p.Attributes {
+		value := attributes[name]
+		switch field {
+		case "subject":
+			user.Subject = value
+		case "email":
+			user.Email = value
+		case "name":
+			user.Name = value
+		default:
+			if value != "" {
+				user.Fields[field] = value
+			}
+		}
+	}
+	if user.Email == "" && nameID.attr("Format") == samlEmailAddress {
+		user.Email = nameID.text()
+	}
+	// SAML has no notion of verified emails, the provider is trusted or not
+	user.EmailVerified = p.TrustEmail
+
+	if user.Subject == "" {
+		return nil, p.failed("assertion", errors.New("its subject is missing"))
+	}
+	return &user, nil
+}
+
+func (p *SAMLProvider) failed(what string, err error) error {
+	return logFailure("SAML provider "+p.Name, what, err, errSAMLResponseInvalid)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samlFixture is an identity provider signing with key, and the service
+// provider of a tenant trusting its certificate.
+type samlFixture struct {
+	t        *testing.T
+	key      *rsa.PrivateKey
+	store    *MemoryPersistence
+	provider *SAMLProvider
+	handler  *IdentityUsecaseHandler
+}
+
+func newSAMLFixture(t *testing.T, allowIdPInitiated bool) *samlFixture {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "idp.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{JwtSecret: "secret", AppName: "test", Issuer: "http://localhost"}
+	config.Tenants.Default = "default"
+	config.Federation.LoginExpiryInSeconds = 600
+	config.Federation.SAMLProviders = []SAMLProviderConfig{{
+		Name:              "acme",
+		EntityID:          "https://idp.example.com",
+		SSOURL:            "https://idp.example.com/sso",
+		SSOBinding:        "post",
+		Certificates:      []string{file},
+		AllowIdPInitiated: allowIdPInitiated,
+		TrustEmail:        true,
+	}}
+	providers, err := NewSAMLProviders(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryPersistence()
+	users := &UsecaseHandler{store, store, nil, nil, config}
+	handler := &IdentityUsecaseHandler{store, store, store, users, &TokenIssuer{store, config, nil}, nil, providers, config, defaultTenantID}
+	return &samlFixture{t, key, store, providers["acme"], handler}
+}
+
+// samlTestAssertion is an assertion logging alice in, which tests change.
+type samlTestAssertion struct {
+	ID           string
+	Issuer       string
+	InResponseTo string
+	Recipient    string
+	Audience     string
+	Email        string
+	NotOnOrAfter time.Time
+}
+
+func (f *samlFixture) assertion(inResponseTo string) samlTestAssertion {
+	return samlTestAssertion{
+		ID:           "_assertion",
+		Issuer:       f.provider.EntityID,
+		InResponseTo: inResponseTo,
+		Recipient:    f.provider.acsURL,
+		Audience:     f.provider.entityID,
+		Email:        "alice@example.com",
+		NotOnOrAfter: time.Now().Add(5 * time.Minute),
+	}
+}
+
+func (a samlTestAssertion) String() string {
+	now := time.Now().UTC()
+	return fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">subject</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"/></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AttributeStatement><saml:Attribute Name="email"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="name"><saml:AttributeValue>Alice</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>`+
+		`</saml:Assertion>`,
+		samlAssertionNamespace, a.ID, now.Format(time.RFC3339), a.Issuer,
+		samlBearer, a.InResponseTo, a.NotOnOrAfter.UTC().Format(time.RFC3339), a.Recipient,
+		now.Add(-time.Minute).Format(time.RFC3339), a.NotOnOrAfter.UTC().Format(time.RFC3339), a.Audience, a.Email)
+}
+
+// response answers the request with inResponseTo, empty for logins the
+// identity provider initiated, with the assertions of content.
+func (f *samlFixture) response(inResponseTo string, content string) string {
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_response" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>%s</samlp:Response>`,
+		samlProtocolNamespace, samlAssertionNamespace, time.Now().UTC().Format(time.RFC3339), f.provider.acsURL, inResponseTo,
+		f.provider.EntityID, samlSuccess, content)
+}
+
+// signature is the enveloped signature of element by key, which is standalone
+// as exclusive canonicalization renders it the same within its document.
+func (f *samlFixture) signature(key *rsa.PrivateKey, element string) string {
+	e, err := parseXML([]byte(element))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	digest := sha256.Sum256(canonicalXML(e, nil, nil))
+
+	signedInfo := fmt.Sprintf(`<ds:SignedInfo xmlns:ds="%s"><ds:CanonicalizationMethod Algorithm="%s"/>`+
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>`+
+		`<ds:Reference URI="#%s"><ds:Transforms><ds:Transform Algorithm="%s"/><ds:Transform Algorithm="%s"/></ds:Transforms>`+
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><ds:DigestValue>%s</ds:DigestValue></ds:Reference></ds:SignedInfo>`,
+		xmldsigNamespace, exclusiveCanonicalization, e.attr("ID"), xmldsigEnveloped, exclusiveCanonicalization,
+		base64.StdEncoding.EncodeToString(digest[:]))
+	parsed, err := parseXML([]byte(signedInfo))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	sum := sha256.Sum256(canonicalXML(parsed, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	signedInfo = strings.Replace(signedInfo, fmt.Sprintf(` xmlns:ds="%s"`, xmldsigNamespace), "", 1)
+	return fmt.Sprintf(`<ds:Signature xmlns:ds="%s">%s<ds:SignatureValue>%s</ds:SignatureValue></ds:Signature>`,
+		xmldsigNamespace, signedInfo, base64.StdEncoding.EncodeToString(value))
+}
+
+// signed puts the signature of element by the identity provider in it.
+func (f *samlFixture) signed(element string) string {
+	return withSignature(element, f.signature(f.key, element))
+}
+
+// withSignature puts signature in element after its issuer, where SAML wants it.
+func withSignature(element string, signature string) string {
+	i := strings.Index(element, "</saml:Issuer>") + len("</saml:Issuer>")
+	return element[:i] + signature + element[i:]
+}
+
+func encodeSAMLResponse(response string) string {
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+func TestSAMLResponse(t *testing.T) {
+	f := newSAMLFixture(t, false)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := "_request"
+	assertion := f.assertion(request)
+	change := func(change func(a *samlTestAssertion)) string {
+		a := f.assertion(request)
+		change(&a)
+		return f.response(request, f.signed(a.String()))
+	}
+
+	tests := []struct {
+		name     string
+		response string
+		wantErr  bool
+	}{
+		{"signed assertion", f.response(request, f.signed(assertion.String())), false},
+		{"signed response", f.signed(f.response(request, assertion.String())), false},
+		{"unsigned", f.response(request, assertion.String()), true},
+		{"signed by another key", f.response(request, withSignature(assertion.String(), f.signature(otherKey, assertion.String()))), true},
+		{"tampered assertion", strings.Replace(f.response(request, f.signed(assertion.String())), "alice@", "mallory@", 1), true},
+		{"tampered digest", func() string {
+			// The digest matches the tampered assertion, but the signature is of the original one
+			evil := assertion
+			evil.Email = "mallory@example.com"
+			signatureValue := regexp.MustCompile(`<ds:SignatureValue>[^<]*`)
+			signature := signatureValue.ReplaceAllString(f.signature(f.key, evil.String()),
+				signatureValue.FindString(f.signature(f.key, assertion.String())))
+			return f.response(request, withSignature(evil.String(), signature))
+		}(), true},
+		{"duplicate IDs", func() string {
+			evil := assertion
+			evil.Email = "mallory@example.com"
+			original := f.signed(assertion.String())
+			copied := withSignature(evil.String(), f.signature(f.key, assertion.String()))
+			return f.response(request, copied+"<samlp:Extensions>"+original+"</samlp:Extensions>")
+		}(), true},
+		{"reference to another element", withSignature(f.response(request, assertion.String()), f.signature(f.key, assertion.String())), true},
+		{"wrong issuer", change(func(a *samlTestAssertion) { a.Issuer = "https://evil.example.com" }), true},
+		{"wrong audience", change(func(a *samlTestAssertion) { a.Audience = "https://other.example.com/metadata" }), true},
+		{"wrong recipient", change(func(a *samlTestAssertion) { a.Recipient = "https://other.example.com/acs" }), true},
+		{"answering another request", change(func(a *samlTestAssertion) { a.InResponseTo = "_other" }), true},
+		{"expired", change(func(a *samlTestAssertion) { a.NotOnOrAfter = time.Now().Add(-samlClockSkew - time.Minute) }), true},
+		{"long ID", change(func(a *samlTestAssertion) { a.ID = "_" + strings.Repeat("a", samlMaxAssertionID) }), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := f.provider.ParseResponse(encodeSAMLResponse(tt.response), false)
+			if tt.wantErr {
+				if err != errSAMLResponseInvalid {
+					t.Errorf("got %v, want %v", err, errSAMLResponseInvalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if login.InResponseTo != request || login.AssertionID != "_assertion" || login.User.Subject != "subject" ||
+				login.User.Email != "alice@example.com" || login.User.Name != "Alice" || !login.User.EmailVerified {
+				t.Errorf("got login %+v of %+v", login, login.User)
+			}
+		})
+	}
+}
+
+// requestID is the ID of the AuthnRequest of a login started at the service.
+func (f *samlFixture) requestID() string {
+	request, err := f.handler.StartSAMLLogin("acme")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	encoded, err := base64.StdEncoding.DecodeString(request.Params.Get("SAMLRequest"))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	match := regexp.MustCompile(`ID="([^"]+)"`).FindStringSubmatch(string(encoded))
+	if match == nil {
+		f.t.Fatalf("no ID in %s", encoded)
+	}
+	return match[1]
+}
+
+func TestSAMLLogin(t *testing.T) {
+	login := func(f *samlFixture, inResponseTo string) (string, error) {
+		response := f.response(inResponseTo, f.signed(f.assertion(inResponseTo).String()))
+		_, user, err := f.handler.FinishSAMLLogin("acme", encodeSAMLResponse(response), false)
+		if err != nil {
+			return response, err
+		}
+		if user.Email != "alice@example.com" || !user.EmailVerified {
+			t.Errorf("logged in %+v", user)
+		}
+		return response, nil
+	}
+	replay := func(f *samlFixture, response string) error {
+		_, _, err := f.handler.FinishSAMLLogin("acme", encodeSAMLResponse(response), false)
+		return err
+	}
+
+	t.Run("started at the service", func(t *testing.T) {
+		f := newSAMLFixture(t, false)
+		response, err := login(f, f.requestID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := replay(f, response); err != errProviderLoginNotFound {
+			t.Errorf("replayed: got %v, want %v", err, errProviderLoginNotFound)
+		}
+	})
+
+	t.Run("answering an unknown request", func(t *testing.T) {
+		f := newSAMLFixture(t, true)
+		f.requestID()
+		if _, err := login(f, "_unknown"); err != errProviderLoginNotFound {
+			t.Errorf("got %v, want %v", err, errProviderLoginNotFound)
+		}
+	})
+
+	t.Run("unsolicited", func(t *testing.T) {
+		f := newSAMLFixture(t, false)
+		_, err := login(f, "")
+		if v, ok := err.(Error); !ok || v.Code != http.StatusBadRequest {
+			t.Errorf("got %v, want a bad request", err)
+		}
+		if count, _ := f.store.Count(nil); count != 0 {
+			t.Errorf("created %d users", count)
+		}
+	})
+
+	t.Run("started at the identity provider", func(t *testing.T) {
+		f := newSAMLFixture(t, true)
+		response, err := login(f, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := replay(f, response); err != errSAMLAssertionUsed {
+			t.Errorf("replayed: got %v, want %v", err, errSAMLAssertionUsed)
+		}
+		if count, _ := f.store.Count(nil); count != 1 {
+			t.Errorf("counted %d users, want 1", count)
+		}
+	})
+}
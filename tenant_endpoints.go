@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TenantEndpointHandler struct {
+	tenantUsecaseHandler TenantUsecase
+}
+
+func (h *TenantEndpointHandler) Post() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPost(c)
+	}
+}
+
+func (h *TenantEndpointHandler) Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGet(c)
+	}
+}
+
+func (h *TenantEndpointHandler) GetOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGetOne(c)
+	}
+}
+
+func (h *TenantEndpointHandler) defaultPost(c *gin.Context) {
+
+	slug, ok := c.GetPostForm("slug")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter slug missing")
+		return
+	}
+	name, ok := c.GetPostForm("name")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
+		return
+	}
+
+	tenant, err := h.tenantUsecaseHandler.Create(slug, name)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.Header("Location", "/tenants/"+strconv.FormatUint(uint64(tenant.ID), 10))
+	c.JSON(http.StatusCreated, gin.H{"tenant": tenant})
+}
+
+func (h *TenantEndpointHandler) defaultGet(c *gin.Context) {
+
+	tenants, err := h.tenantUsecaseHandler.List()
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+}
+
+func (h *TenantEndpointHandler) defaultGetOne(c *gin.Context) {
+
+	tenant, err := h.tenantUsecaseHandler.Get(c.MustGet("id").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// defaultTenantID is the tenant created by the migration adding tenants, which
+// every user existing by then belongs to.
+const defaultTenantID = 1
+
+// Tenant is an organization using the service. Users, their emails and their
+// tokens belong to a single tenant.
+type Tenant struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Slug      string `gorm:"type:varchar(63);unique_index"` // names the tenant in subdomains, paths and headers
+	Name      string
+}
+
+const (
+	RoleAdmin      = "admin"      // manages the users of its tenant
+	RoleSuperadmin = "superadmin" // manages tenants and acts on any of them
+)
+
+var validRoles = map[string]bool{RoleAdmin: true, RoleSuperadmin: true}
+
+// Roles are the roles of a user within its tenant, stored as a JSON array.
+type Roles []string
+
+func (r Roles) Has(role string) bool {
+	for _, name := range r {
+		if name == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Roles) Value() (driver.Value, error) {
+	if r == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal([]string(r))
+	return string(encoded), err
+}
+
+func (r *Roles) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*r = Roles{}
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return errors.New("roles: can't scan " + reflect.TypeOf(src).String())
+	}
+	if len(raw) == 0 {
+		*r = Roles{}
+		return nil
+	}
+	return json.Unmarshal(raw, (*[]string)(r))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+)
+
+type TenantPersistence interface {
+	CreateTenant(tenant *Tenant) error
+	FindTenant(id uint) (*Tenant, error)
+	FindTenantBySlug(slug string) (*Tenant, error)
+	ListTenants() ([]Tenant, error)
+}
+
+var errTenantNotFound = Error{Code: http.StatusNotFound, Message: "Tenant not found"}
+
+var errTenantSlugInUse = Error{Code: http.StatusConflict, Message: "Slug is already in use"}
+
+func (h *PersistenceHandler) CreateTenant(tenant *Tenant) error {
+	if err := h.DB.Create(tenant).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errTenantSlugInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) FindTenant(id uint) (*Tenant, error) {
+	var tenant Tenant
+
+	r := h.DB.First(&tenant, id)
+	if r.RecordNotFound() {
+		return nil, errTenantNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &tenant, nil
+}
+
+func (h *PersistenceHandler) FindTenantBySlug(slug string) (*Tenant, error) {
+	var tenant Tenant
+
+	r := h.DB.Where("slug = ?", slug).First(&tenant)
+	if r.RecordNotFound() {
+		return nil, errTenantNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &tenant, nil
+}
+
+func (h *PersistenceHandler) ListTenants() ([]Tenant, error) {
+	var tenants []Tenant
+
+	if err := h.DB.Order("id").Find(&tenants).Error; err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+// tenantPersistence confines a Persistence to the users of a tenant: every
+// read and bulk write is filtered by it, users are created in it and the ones
+// of other tenants can't be loaded, written or deleted one by one either.
+type tenantPersistence struct {
+	Persistence
+	tenantID uint
+}
+
+func ScopeToTenant(persistence Persistence, tenantID uint) Persistence {
+	return &tenantPersistence{persistence, tenantID}
+}
+
+func (h *tenantPersistence) scope(filter FilterExpr) FilterExpr {
+	return AndFilters(FilterComparison{Column: "tenant_id", Op: "=", Value: uint64(h.tenantID)}, filter)
+}
+
+func (h *tenantPersistence) Create(c *Model) error {
+	c.TenantID = h.tenantID
+	return h.Persistence.Create(c)
+}
+
+func (h *tenantPersistence) FindOne(id uint) (*Model, error) {
+	model, err := h.Persistence.FindOne(id)
+	if err != nil {
+		return nil, err
+	}
+	if model.TenantID != h.tenantID {
+		return nil, errNotFound
+	}
+	return model, nil
+}
+
+func (h *tenantPersistence) UpdateFields(c *Model, updates map[string]interface{}) error {
+	if c.TenantID != h.tenantID {
+		return errNotFound
+	}
+	return h.Persistence.UpdateFields(c, updates)
+}
+
+func (h *tenantPersistence) Delete(c *Model) error {
+	if c.TenantID != h.tenantID {
+		return errNotFound
+	}
+	return h.Persistence.Delete(c)
+}
+
+func (h *tenantPersistence) Find(filter FilterExpr, order Ordering, page Page, columns []string) ([]Model, error) {
+	return h.Persistence.Find(h.scope(filter), order, page, columns)
+}
+
+func (h *tenantPersistence) Count(filter FilterExpr) (int, error) {
+	return h.Persistence.Count(h.scope(filter))
+}
+
+func (h *tenantPersistence) Iterate(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error {
+	return h.Persistence.Iterate(h.scope(filter), order, columns, fn)
+}
+
+func (h *tenantPersistence) UpdateMany(updates map[string]interface{}, filter FilterExpr) (int64, error) {
+	return h.Persistence.UpdateMany(updates, h.scope(filter))
+}
+
+func (h *tenantPersistence) DeleteMany(filter FilterExpr) (int64, error) {
+	return h.Persistence.DeleteMany(h.scope(filter))
+}
+
+func (h *tenantPersistence) Transaction(fn func(tx Persistence) error) error {
+	return h.Persistence.Transaction(func(tx Persistence) error {
+		return fn(ScopeToTenant(tx, h.tenantID))
+	})
+}
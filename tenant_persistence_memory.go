@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateTenant(tenant *Tenant) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, t := range h.tenants {
+		if t.Slug == tenant.Slug {
+			return errTenantSlugInUse
+		}
+	}
+
+	h.nextTenantID++
+	tenant.ID = h.nextTenantID
+	now := time.Now()
+	tenant.CreatedAt, tenant.UpdatedAt = now, now
+
+	stored := *tenant
+	h.tenants[tenant.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindTenant(id uint) (*Tenant, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stored, ok := h.tenants[id]
+	if !ok {
+		return nil, errTenantNotFound
+	}
+
+	tenant := *stored
+	return &tenant, nil
+}
+
+func (h *MemoryPersistence) FindTenantBySlug(slug string) (*Tenant, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.tenants {
+		if stored.Slug == slug {
+			tenant := *stored
+			return &tenant, nil
+		}
+	}
+	return nil, errTenantNotFound
+}
+
+func (h *MemoryPersistence) ListTenants() ([]Tenant, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tenants := make([]Tenant, 0, len(h.tenants))
+	for _, stored := range h.tenants {
+		tenants = append(tenants, *stored)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
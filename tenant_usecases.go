@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type TenantUsecase interface {
+	Create(slug string, name string) (*Tenant, error)
+	Get(id uint) (*Tenant, error)
+	List() ([]Tenant, error)
+}
+
+type TenantUsecaseHandler struct {
+	tenantPersistence TenantPersistence
+}
+
+// tenantSlugPattern keeps slugs usable as a DNS label, so they can name
+// tenants in subdomains.
+var tenantSlugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func (h *TenantUsecaseHandler) Create(slug string, name string) (*Tenant, error) {
+
+	if !tenantSlugPattern.MatchString(slug) {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for slug, use up to 63 lower case letters, digits and dashes"}
+	}
+	if strings.TrimSpace(name) == "" {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for name"}
+	}
+
+	tenant := Tenant{Slug: slug, Name: name}
+	if err := h.tenantPersistence.CreateTenant(&tenant); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return &tenant, nil
+}
+
+func (h *TenantUsecaseHandler) Get(id uint) (*Tenant, error) {
+
+	tenant, err := h.tenantPersistence.FindTenant(id)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return tenant, nil
+}
+
+func (h *TenantUsecaseHandler) List() ([]Tenant, error) {
+
+	tenants, err := h.tenantPersistence.ListTenants()
+	if err != nil {
+		panic(err)
+	}
+
+	return tenants, nil
+}
+
+// ParseRoles reads a comma separated list of roles, empty for none.
+func ParseRoles(param string) (Roles, error) {
+	roles := Roles{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !validRoles[name] {
+			return nil, Error{Code: http.StatusBadRequest, Message: "Invalid role " + name}
+		}
+		if !roles.Has(name) {
+			roles = append(roles, name)
+		}
+	}
+	return roles, nil
+}
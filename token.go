@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Scopes of OAuth access tokens that add claims to them, and to ID tokens
+// and userinfo with openid. Other scopes are only carried in the scope
+// claim, for the apps to interpret.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopeRoles   = "roles"
+	ScopeGroups  = "groups"
+)
+
+// TokenIssuer signs the tokens of the service: the ones of logins, the
+// access tokens of OAuth clients and, with signingKey, ID tokens.
+type TokenIssuer struct {
+	groupPersistence GroupPersistence
+	config           *Config
+	signingKey       *SigningKey
+}
+
+// UserToken carries the tenant and roles of user, and its groups when
+// configured, so changes to them apply from its next login. Tokens for a
+// client only carry the claims their scope grants.
+func (t *TokenIssuer) UserToken(user *Model, client *OAuthClient, scope []string, duration time.Duration) (string, error) {
+
+	claims := t.claims(strconv.FormatUint(uint64(user.ID), 10), user.TenantID, duration)
+	if client == nil {
+		claims.Email = user.Email
+		claims.Roles = user.Roles
+	} else {
+		claims.ClientID = client.ClientID
+		claims.Scope = strings.Join(scope, " ")
+		if hasScope(scope, ScopeEmail) {
+			claims.Email = user.Email
+		}
+		if hasScope(scope, ScopeRoles) {
+			claims.Roles = user.Roles
+		}
+	}
+
+	if (client == nil && t.config.Groups.InToken) || (client != nil && hasScope(scope, ScopeGroups)) {
+		groups, err := groupNames(t.groupPersistence, user)
+		if err != nil {
+			return "", err
+		}
+		claims.Groups = groups
+	}
+
+	return t.sign(claims)
+}
+
+// LoginToken is the token of user logging in to the service itself.
+func (t *TokenIssuer) LoginToken(user *Model) (string, error) {
+	return t.UserToken(user, nil, nil, time.Hour*24*30)
+}
+
+// ClientToken is the token of a client acting on its own behalf, its
+// subject being the id of the client.
+func (t *TokenIssuer) ClientToken(client *OAuthClient, scope []string, duration time.Duration) (string, error) {
+
+	claims := t.claims(client.ClientID, client.TenantID, duration)
+	claims.ClientID = client.ClientID
+	claims.Scope = strings.Join(scope, " ")
+
+	return t.sign(claims)
+}
+
+// claims identify each token by its jti, which revoking access tokens takes.
+func (t *TokenIssuer) claims(subject string, tenantID uint, duration time.Duration) JWTCustomClaims {
+	now := time.Now()
+	id, _ := newOpaqueToken()
+	return JWTCustomClaims{
+		Tenant: tenantID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(duration).Unix(),
+			Issuer:    tokenIssuer(t.config),
+			Subject:   subject,
+			Audience:  t.config.AppName,
+		},
+	}
+}
+
+func (t *TokenIssuer) sign(claims JWTCustomClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	tokenString, err := token.SignedString([]byte(t.config.JwtSecret))
+	if err != nil {
+		return "", err
+	}
+
+	return tokenString, nil
+}
+
+// ValidateToken returns the claims of tokenString if it's a valid token of
+// the service, one of a login or an OAuth access token.
+func ValidateToken(config *Config, tokenString string) (*JWTCustomClaims, bool) {
+
+	token, err := jwt.ParseWithClaims(tokenString, &JWTCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(config.JwtSecret), nil
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	claims, ok := token.Claims.(*JWTCustomClaims)
+	if ok == false || token.Valid == false {
+		return nil, false
+	}
+
+	//Lib only checks validity of "exp, iat, nbf" and only if the claims are present. So...
+	if claims.IssuedAt == 0 {
+		return nil, false
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, false
+	}
+	if claims.Issuer != tokenIssuer(config) {
+		return nil, false
+	}
+	if claims.Subject == "" {
+		return nil, false
+	}
+	if claims.Audience != config.AppName {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// tokenIssuer is the issuer of the tokens of the service. Configuring one
+// makes the tokens issued before it invalid.
+func tokenIssuer(config *Config) string {
+	if config.Issuer != "" {
+		return config.Issuer
+	}
+	return config.AppName
+}
+
+func hasScope(scope []string, name string) bool {
+	for _, s := range scope {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newOpaqueToken returns a random token, for links, secrets and codes, and
+// the hash stored for it.
+func newOpaqueToken() (string, string) {
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashOpaqueToken(token)
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,31 +2,46 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/scrypt"
 	"io"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 )
 
 type Usecase interface {
-	Create(email string, password string, name string, age uint, number int, date time.Time) (*Model, error)
+	// ForTenant returns the usecases confined to the users of a tenant
+	ForTenant(tenantID uint) Usecase
+	Create(email string, password string, name string, age uint, number int, date time.Time, attributes map[string]string) (*Model, error)
 	Login(email string, password string) (string, *Model, error)
-	Find(filter []map[string]string, order map[string]string, offset, limit int) ([]Model, error)
-	Update(updates map[string]interface{}, filter []map[string]string) error
-	Delete(filter []map[string]string) error
+	Find(filter FilterExpr, order Ordering, page Page, withTotal bool, fields []string) (*ResultPage, error)
+	Expand(models []Model, expand []string) (map[string]map[uint]interface{}, error)
+	Update(updates map[string]interface{}, filter FilterExpr, options BulkOptions) (*BulkResult, error)
+	Delete(filter FilterExpr, options BulkOptions) (*BulkResult, error)
 	UpdateOne(model *Model, updates map[string]interface{}) (*Model, error)
 	DeleteOne(model *Model) error
+	Import(r io.Reader, options ImportOptions) (*ImportReport, error)
+	Export(filter FilterExpr, order Ordering, columns []string, fn func(m *Model) error) error
 }
 
 type UsecaseHandler struct {
 	persistenceHandler Persistence
+	groupPersistence   GroupPersistence
+	verifiers          []CredentialVerifier // the local one alone when nil
+	secondFactor       SecondFactor         // confirms the password logins when set
 	config             *Config
 }
 
-func (h *UsecaseHandler) Create(email string, password string, name string, age uint, number int, date time.Time) (*Model, error) {
+func (h *UsecaseHandler) ForTenant(tenantID uint) Usecase {
+	return &UsecaseHandler{ScopeToTenant(h.persistenceHandler, tenantID), h.groupPersistence, h.verifiers, h.secondFactor, h.config}
+}
+
+// Create takes the attributes of the profile schema as they were sent.
+func (h *UsecaseHandler) Create(email string, password string, name string, age uint, number int, date time.Time, attributes map[string]string) (*Model, error) {
 
 	model := Model{
 		Email:  email,
@@ -34,44 +49,70 @@ func (h *UsecaseHandler) Create(email string, password string, name string, age
 		Age:    age,
 		Number: number,
 		Date:   date,
+		Roles:  Roles{},
 	}
 
-	if len(name) < 5 {
-		return nil, Error{Code: http.StatusBadRequest, Message: "Name should be longer than 5 characters"}
+	var err error
+	if model.Attributes, err = profileSchema.Parse(attributes); err != nil {
+		return nil, err
 	}
 
-	if age < 5 {
-		return nil, Error{Code: http.StatusBadRequest, Message: "Age should be greater than 5"}
+	if err := h.validateModel(&model); err != nil {
+		return nil, err
 	}
 
-	model.ProtectionScheme = "lizard.v1"
-	protectedForm, err := h.ProtectedFormFromPassword(password)
-	if err != nil {
-		panic(err)
+	// Users created without a password only log in with identity providers,
+	// directories or magic links
+	if password != "" {
+		model.ProtectionScheme = defaultProtectionScheme
+		protectedForm, err := h.ProtectedFormFromPassword(password)
+		if err != nil {
+			panic(err)
+		}
+		model.Password = protectedForm
 	}
-	model.Password = protectedForm
 	model.Compromised = false
 
 	inUse, err := h.isEmailInUse(model.Email)
 	if err != nil {
 		panic(err)
 	}
-	if inUse == false {
-		return nil, Error{Code: http.StatusConflict, Message: "Email is already in use"}
-	}
-
-	//TODO remove later
-	if err := h.persistenceHandler.Migrate(&model); err != nil {
-		panic(err)
+	if inUse {
+		return nil, errEmailInUse
 	}
 
 	if err := h.persistenceHandler.Create(&model); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
 		panic(err)
 	}
 
 	return &model, nil
 }
 
+// validateModel applies the rules every new user must follow, whether it signs
+// up, is created by an admin or is imported, normalizing its fields.
+func (h *UsecaseHandler) validateModel(model *Model) error {
+
+	var err error
+
+	if model.Email, err = ValidateString("email", model.Email); err != nil {
+		return err
+	}
+	if model.Name, err = ValidateString("name", model.Name); err != nil {
+		return err
+	}
+	if err := ValidateNumber("age", float64(model.Age)); err != nil {
+		return err
+	}
+	if err := ValidateNumber("number", float64(model.Number)); err != nil {
+		return err
+	}
+
+	return profileSchema.CheckRequired(model.Attributes)
+}
+
 func (h *UsecaseHandler) isEmailInUse(email string) (bool, error) {
 	const other = false
 	_, err := h.FindByEmail(email)
@@ -128,40 +169,55 @@ func (h *UsecaseHandler) generateHash(password []byte, salt []byte) ([]byte, err
 
 func (h *UsecaseHandler) ComparePasswordAndProtectedForm(password, protectedForm string) (bool, error) {
 
-	salt := protectedForm[:32]
-	oldHash := protectedForm[32:]
+	raw, err := hex.DecodeString(protectedForm)
+	if err != nil || len(raw) <= 32 {
+		return false, errMalformedProtectedForm
+	}
+	salt := raw[:32]
+	oldHash := raw[32:]
 
-	newHash, err := h.generateHash([]byte(password), []byte(salt))
+	newHash, err := h.generateHash([]byte(password), salt)
 	if err != nil {
 		return false, err
 	}
 
-	if fmt.Sprintf("%x", newHash) != oldHash {
+	if subtle.ConstantTimeCompare(newHash, oldHash) != 1 {
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// Login checks the credentials with each verifier in turn, until one knows
+// the email, then asks for the second factor of the user, if any.
 func (h *UsecaseHandler) Login(email string, password string) (string, *Model, error) {
 
-	user, err := h.FindByEmail(email)
-	if err != nil {
-		if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
-			return "", nil, Error{Code: http.StatusUnauthorized, Message: "Email or password incorrect"}
-		}
-		return "", nil, err
+	verifiers := h.verifiers
+	if verifiers == nil {
+		verifiers = []CredentialVerifier{LocalVerifier{}}
 	}
 
-	ok, err := h.ComparePasswordAndProtectedForm(password, user.Password)
-	if err != nil {
-		return "", nil, err
+	var user *Model
+	for _, verifier := range verifiers {
+		var err error
+		if user, err = verifier.Verify(h, email, password); err == nil {
+			break
+		}
+		if err != errCredentialsUnknown {
+			return "", nil, err
+		}
+	}
+	if user == nil {
+		return "", nil, errCredentialsIncorrect
 	}
-	if ok == false {
-		return "", nil, Error{Code: http.StatusUnauthorized, Message: "Email or password incorrect"}
+	if h.secondFactor != nil {
+		if err := h.secondFactor.Challenge(user); err != nil {
+			return "", nil, err
+		}
 	}
 
-	token, err := h.CreateToken(h.config, user.ID, user.Email)
+	issuer := TokenIssuer{h.groupPersistence, h.config, nil}
+	token, err := issuer.LoginToken(user)
 	if err != nil {
 		return "", nil, err
 	}
@@ -169,11 +225,44 @@ func (h *UsecaseHandler) Login(email string, password string) (string, *Model, e
 	return token, user, nil
 }
 
+// upgradeProtectedForm rehashes an imported password with the default scheme
+// once its plain text is known. Failing to do so doesn't fail the login.
+func (h *UsecaseHandler) upgradeProtectedForm(user *Model, password string) {
+	protectedForm, err := h.ProtectedFormFromPassword(password)
+	if err != nil {
+		log.Printf("upgrading the password of user %d: %v", user.ID, err)
+		return
+	}
+
+	updates := map[string]interface{}{"Password": protectedForm, "ProtectionScheme": defaultProtectionScheme}
+	if err := h.persistenceHandler.UpdateFields(user, updates); err != nil {
+		log.Printf("upgrading the password of user %d: %v", user.ID, err)
+		return
+	}
+	user.Password = protectedForm
+	user.ProtectionScheme = defaultProtectionScheme
+}
+
 type JWTCustomClaims struct {
-	Email string
+	Email  string
+	Tenant uint     `json:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Scope and ClientID are set on the access tokens of OAuth clients only
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
 	jwt.StandardClaims
 }
 
+// TenantID is the tenant of the token. Tokens issued before tenants existed
+// belong to the default one.
+func (c *JWTCustomClaims) TenantID() uint {
+	if c.Tenant == 0 {
+		return defaultTenantID
+	}
+	return c.Tenant
+}
+
 type JWTToken struct {
 	Id    uint
 	Name  string
@@ -181,42 +270,67 @@ type JWTToken struct {
 	Admin bool
 }
 
-func (h *UsecaseHandler) CreateToken(config *Config, id uint, email string) (string, error) {
-	claims := JWTCustomClaims{
-		email,
-		jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Hour * 24 * 30).Unix(),
-			Issuer:    config.AppName,
-			Subject:   strconv.FormatUint(uint64(id), 10),
-			Audience:  config.AppName,
-		},
-	}
+// Find loads only fields, plus what the cursors need, or every field when empty.
+func (h *UsecaseHandler) Find(filter FilterExpr, order Ordering, page Page, withTotal bool, fields []string) (*ResultPage, error) {
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// One extra row tells whether there's a page beyond this one
+	limit := page.Limit
+	page.Limit = limit + 1
 
-	tokenString, err := token.SignedString([]byte(config.JwtSecret))
+	models, err := h.persistenceHandler.Find(filter, order, page, selectColumns(fields, order))
 	if err != nil {
-		return "", err
+		panic(err)
 	}
 
-	return tokenString, nil
-}
+	backward := page.Cursor != nil && page.Cursor.Before
+	hasMore := len(models) > limit
+	if hasMore {
+		if backward {
+			models = models[1:]
+		} else {
+			models = models[:limit]
+		}
+	}
 
-func (h *UsecaseHandler) Find(filter []map[string]string, order map[string]string, offset, limit int) ([]Model, error) {
+	result := ResultPage{Models: models}
 
-	models, err := h.persistenceHandler.Find(filter, order, offset, limit)
+	if len(models) > 0 {
+		if !backward && hasMore || backward {
+			result.Next = h.encodeCursor(&models[len(models)-1], filter, order, false)
+		}
+		if backward && hasMore || !backward && page.Cursor != nil {
+			result.Prev = h.encodeCursor(&models[0], filter, order, true)
+		}
+	}
+
+	if withTotal {
+		total, err := h.persistenceHandler.Count(filter)
+		if err != nil {
+			panic(err)
+		}
+		result.Total = &total
+	}
+
+	return &result, nil
+}
+
+func (h *UsecaseHandler) encodeCursor(m *Model, filter FilterExpr, order Ordering, before bool) string {
+	cursor, err := CursorFromModel(m, order, before)
 	if err != nil {
 		panic(err)
 	}
-
-	//TODO change these responses to return something usable to other usecases. The transformation to a body type will happen in the endpoints!
-	return models, nil
+	cursor.Query = CursorQuery(filter, order)
+	encoded, err := EncodeCursor(cursor, h.config.JwtSecret)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
 }
 
 func (h *UsecaseHandler) FindByEmail(email string) (*Model, error) {
 
-	models, err := h.Find([]map[string]string{{"email = ?": email}}, nil, 0, 1)
+	filter := FilterComparison{Column: "email", Op: "=", Value: email}
+	models, err := h.persistenceHandler.Find(filter, Ordering{Column: "id"}, Page{Limit: 1}, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -228,27 +342,102 @@ func (h *UsecaseHandler) FindByEmail(email string) (*Model, error) {
 	return &models[0], nil
 }
 
-func (h *UsecaseHandler) Update(updates map[string]interface{}, filter []map[string]string) error {
+// BulkOptions controls a bulk update or delete. Confirm must repeat the number
+// of matched users when it's over the configured maximum.
+type BulkOptions struct {
+	DryRun  bool
+	Confirm int
+}
+
+type BulkResult struct {
+	Matched  int
+	Affected int64
+	Sample   []Model
+}
+
+func (h *UsecaseHandler) Update(updates map[string]interface{}, filter FilterExpr, options BulkOptions) (*BulkResult, error) {
+
+	if len(updates) == 0 {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Nothing to update"}
+	}
+	if err := validateUpdates(updates); err != nil {
+		return nil, err
+	}
+
+	result, err := h.prepareBulk(filter, options)
+	if err != nil || options.DryRun {
+		return result, err
+	}
+
+	affected, err := h.persistenceHandler.UpdateMany(updates, filter)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	result.Affected = affected
+
+	return result, nil
+}
+
+func (h *UsecaseHandler) Delete(filter FilterExpr, options BulkOptions) (*BulkResult, error) {
 
-	if err := h.persistenceHandler.UpdateMany(updates, filter); err != nil {
+	result, err := h.prepareBulk(filter, options)
+	if err != nil || options.DryRun {
+		return result, err
+	}
+
+	affected, err := h.persistenceHandler.DeleteMany(filter)
+	if err != nil {
 		panic(err)
 	}
+	result.Affected = affected
 
-	return nil
+	return result, nil
 }
 
-func (h *UsecaseHandler) Delete(filter []map[string]string) error {
+// prepareBulk applies the safety rules shared by bulk updates and deletes, and
+// fills the sample of matched users for dry runs.
+func (h *UsecaseHandler) prepareBulk(filter FilterExpr, options BulkOptions) (*BulkResult, error) {
+
+	if filter == nil {
+		return nil, Error{Code: http.StatusBadRequest, Message: "A filter is required for bulk operations"}
+	}
 
-	if err := h.persistenceHandler.DeleteMany(filter); err != nil {
+	matched, err := h.persistenceHandler.Count(filter)
+	if err != nil {
 		panic(err)
 	}
+	result := BulkResult{Matched: matched}
 
-	return nil
+	if options.DryRun {
+		sample, err := h.persistenceHandler.Find(filter, Ordering{Column: "id"}, Page{Limit: h.config.Bulk.SampleSize}, nil)
+		if err != nil {
+			panic(err)
+		}
+		result.Sample = sample
+		return &result, nil
+	}
+
+	if matched > h.config.Bulk.MaxAffected && options.Confirm != matched {
+		msg := fmt.Sprintf("This would affect %d users, more than the %d allowed without confirmation. Repeat the request with confirm=%d", matched, h.config.Bulk.MaxAffected, matched)
+		return nil, Error{Code: http.StatusBadRequest, Message: msg}
+	}
+
+	return &result, nil
 }
 
 func (h *UsecaseHandler) UpdateOne(model *Model, updates map[string]interface{}) (*Model, error) {
 
+	if err := validateUpdates(updates); err != nil {
+		return nil, err
+	}
+
 	if err := h.persistenceHandler.UpdateFields(model, updates); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
 		panic(err)
 	}
 
@@ -258,6 +447,9 @@ func (h *UsecaseHandler) UpdateOne(model *Model, updates map[string]interface{})
 func (h *UsecaseHandler) DeleteOne(model *Model) error {
 
 	if err := h.persistenceHandler.Delete(model); err != nil {
+		if _, ok := err.(Error); ok {
+			return err
+		}
 		panic(err)
 	}
 
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/gin-gonic/gin"
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
 
 func PanicIf(c *gin.Context, err error) {
 	if err != nil {
@@ -19,8 +23,17 @@ func ErrorReply(c *gin.Context, status int, msg string) {
 type Error struct {
 	Code    int
 	Message string
+	// Localized, when set, renders Message in the language of the request
+	Localized *LocalizedMessage
 }
 
 func (e Error) Error() string {
 	return e.Message
+}
+
+// logFailure logs what failed in source and why, returning reply, the error
+// users are told instead.
+func logFailure(source string, what string, err error, reply error) error {
+	log.Printf("%s: %s: %v", source, what, err)
+	return reply
 }
\ No newline at end of file
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ValidationRule constrains the values of a field. Strings are normalized
+// first, and their length is counted in runes. Unset limits don't apply.
+type ValidationRule struct {
+	MinLength *int
+	MaxLength *int
+	Min       *float64
+	Max       *float64
+	Pattern   string
+	Normalize string // NFC, NFD, NFKC or NFKD, kept in the stored value
+}
+
+type fieldValidator struct {
+	rule    ValidationRule
+	pattern *regexp.Regexp
+	form    *norm.Form
+}
+
+var normalizationForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+func newFieldValidator(field string, rule ValidationRule) (*fieldValidator, error) {
+	v := fieldValidator{rule: rule}
+
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("validation of %s: %v", field, err)
+		}
+		v.pattern = pattern
+	}
+	if rule.Normalize != "" {
+		form, ok := normalizationForms[strings.ToUpper(rule.Normalize)]
+		if !ok {
+			return nil, fmt.Errorf("validation of %s: unknown normalization %q, use NFC, NFD, NFKC or NFKD", field, rule.Normalize)
+		}
+		v.form = &form
+	}
+
+	return &v, nil
+}
+
+// String normalizes value and checks it, returning the normalized value.
+func (v *fieldValidator) String(field, value string) (string, error) {
+	if v.form != nil {
+		value = v.form.String(value)
+	}
+
+	length := utf8.RuneCountInString(value)
+	if v.rule.MinLength != nil && length < *v.rule.MinLength {
+		return "", validationError("min_length", field, *v.rule.MinLength)
+	}
+	if v.rule.MaxLength != nil && length > *v.rule.MaxLength {
+		return "", validationError("max_length", field, *v.rule.MaxLength)
+	}
+	if v.pattern != nil && !v.pattern.MatchString(value) {
+		return "", validationError("invalid", field)
+	}
+
+	return value, nil
+}
+
+func (v *fieldValidator) Number(field string, value float64) error {
+	if v.rule.Min != nil && value < *v.rule.Min {
+		return validationError("min", field, *v.rule.Min)
+	}
+	if v.rule.Max != nil && value > *v.rule.Max {
+		return validationError("max", field, *v.rule.Max)
+	}
+	return nil
+}
+
+// userValidators holds the rules of the built-in fields of a user, set up by
+// InitValidation from config.
+var userValidators = map[string]*fieldValidator{}
+
+func InitValidation(config *Config) error {
+	if _, ok := messages[config.Validation.Language]; !ok {
+		return fmt.Errorf("validation: unknown language %q", config.Validation.Language)
+	}
+	defaultLanguage = config.Validation.Language
+
+	rules := map[string]ValidationRule{
+		"email":  config.Validation.Email,
+		"name":   config.Validation.Name,
+		"age":    config.Validation.Age,
+		"number": config.Validation.Number,
+	}
+	for field, rule := range rules {
+		v, err := newFieldValidator(field, rule)
+		if err != nil {
+			return err
+		}
+		userValidators[field] = v
+	}
+	return nil
+}
+
+// ValidateString applies the rules of a built-in field to value, returning it
+// normalized.
+func ValidateString(field, value string) (string, error) {
+	if v, ok := userValidators[field]; ok {
+		return v.String(field, value)
+	}
+	return value, nil
+}
+
+// NormalizeString only normalizes value like the rules of field do, to look
+// up what was stored validated.
+func NormalizeString(field, value string) string {
+	if v, ok := userValidators[field]; ok && v.form != nil {
+		return v.form.String(value)
+	}
+	return value
+}
+
+func ValidateNumber(field string, value float64) error {
+	if v, ok := userValidators[field]; ok {
+		return v.Number(field, value)
+	}
+	return nil
+}
+
+// validateUpdates applies the rules of the built-in fields to updates, keyed
+// like UpdateFields expects them, normalizing them in place.
+func validateUpdates(updates map[string]interface{}) error {
+	var err error
+	for key, value := range updates {
+		switch key {
+		case "Name":
+			if updates[key], err = ValidateString("name", value.(string)); err != nil {
+				return err
+			}
+		case "Age":
+			if err := ValidateNumber("age", float64(value.(uint))); err != nil {
+				return err
+			}
+		case "Number":
+			if err := ValidateNumber("number", float64(value.(int))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// messages are the localized texts of validation errors, by language and key.
+// Every message takes the field first.
+var messages = map[string]map[string]string{
+	"en": {
+		"required":   "Parameter %s missing",
+		"invalid":    "Invalid value for %s",
+		"min_length": "%s should be at least %v characters long",
+		"max_length": "%s should be at most %v characters long",
+		"min":        "%s should be at least %v",
+		"max":        "%s should be at most %v",
+	},
+	"es": {
+		"required":   "Falta el parámetro %s",
+		"invalid":    "Valor inválido para %s",
+		"min_length": "El campo %s debe tener al menos %v caracteres",
+		"max_length": "El campo %s debe tener como máximo %v caracteres",
+		"min":        "El campo %s debe ser como mínimo %v",
+		"max":        "El campo %s debe ser como máximo %v",
+	},
+}
+
+// fieldNames are the names of the built-in fields in each language but
+// English. Attributes of the profile schema keep their own.
+var fieldNames = map[string]map[string]string{
+	"es": {
+		"email":    "correo electrónico",
+		"password": "contraseña",
+		"name":     "nombre",
+		"age":      "edad",
+		"number":   "número",
+		"date":     "fecha",
+	},
+}
+
+// defaultLanguage is the language of the messages when the request doesn't
+// accept any of the others.
+var defaultLanguage = "en"
+
+// LocalizedMessage is a message of the catalogue, renderable in any language.
+type LocalizedMessage struct {
+	Key  string
+	Args []interface{}
+}
+
+func (m *LocalizedMessage) In(language string) string {
+	format, ok := messages[language][m.Key]
+	if !ok {
+		format, language = messages[defaultLanguage][m.Key], defaultLanguage
+	}
+	args := m.Args
+	if field, ok := args[0].(string); ok && fieldNames[language][field] != "" {
+		args = append([]interface{}{fieldNames[language][field]}, args[1:]...)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func validationError(key string, args ...interface{}) error {
+	message := LocalizedMessage{Key: key, Args: args}
+	return Error{Code: http.StatusBadRequest, Message: message.In(defaultLanguage), Localized: &message}
+}
+
+// RequestMessage is the message of e in the language the request prefers,
+// going by its Accept-Language header.
+func RequestMessage(c *gin.Context, e Error) string {
+	if e.Localized == nil {
+		return e.Message
+	}
+	if language := acceptedLanguage(c.GetHeader("Accept-Language")); language != "" {
+		return e.Localized.In(language)
+	}
+	return e.Message
+}
+
+// acceptedLanguage picks the language of the catalogue with the highest
+// quality in an Accept-Language header, or "" for none.
+func acceptedLanguage(header string) string {
+	type accepted struct {
+		language string
+		quality  float64
+	}
+
+	var languages []accepted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		language := strings.SplitN(tag, "-", 2)[0]
+		if _, ok := messages[language]; !ok {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, accepted{language, quality})
+		}
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+	return languages[0].language
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func length(n int) *int {
+	return &n
+}
+
+func TestFieldValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ValidationRule
+		value   string
+		want    string
+		wantKey string
+	}{
+		{"runes, not bytes", ValidationRule{MaxLength: length(5)}, "ñandú", "ñandú", ""},
+		{"too many runes", ValidationRule{MaxLength: length(4)}, "ñandú", "", "max_length"},
+		{"too few runes", ValidationRule{MinLength: length(6)}, "ñandú", "", "min_length"},
+		{"decomposed", ValidationRule{MaxLength: length(1)}, "e\u0301", "", "max_length"},
+		{"composed by NFC", ValidationRule{MaxLength: length(1), Normalize: "NFC"}, "e\u0301", "\u00e9", ""},
+		{"decomposed by NFD", ValidationRule{Normalize: "nfd"}, "\u00e9", "e\u0301", ""},
+		{"folded by NFKC", ValidationRule{Normalize: "NFKC"}, "ｆｕｌｌ", "full", ""},
+		{"matching", ValidationRule{Pattern: `^[^@\s]+@[^@\s]+$`}, "a@example.com", "a@example.com", ""},
+		{"not matching", ValidationRule{Pattern: `^[^@\s]+@[^@\s]+$`}, "a example.com", "", "invalid"},
+		{"matching once normalized", ValidationRule{Pattern: "^\u00e9$", Normalize: "NFC"}, "e\u0301", "\u00e9", ""},
+	}
+	for _, tt := range tests {
+		v, err := newFieldValidator("name", tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := v.String("name", tt.value)
+		if tt.wantKey != "" {
+			if e, ok := err.(Error); !ok || e.Localized == nil || e.Localized.Key != tt.wantKey {
+				t.Errorf("%s: got %q, %v, want %s", tt.name, got, err, tt.wantKey)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	for _, rule := range []ValidationRule{{Pattern: "("}, {Normalize: "NFX"}} {
+		if _, err := newFieldValidator("name", rule); err == nil {
+			t.Errorf("created a validator of %+v", rule)
+		}
+	}
+}
+
+func TestFieldValidatorNumber(t *testing.T) {
+	v, err := newFieldValidator("age", ValidationRule{Min: float(18), Max: float(120)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value   float64
+		wantKey string
+	}{
+		{18, ""},
+		{120, ""},
+		{17.5, "min"},
+		{121, "max"},
+	}
+	for _, tt := range tests {
+		err := v.Number("age", tt.value)
+		if e, ok := err.(Error); tt.wantKey == "" && err != nil || tt.wantKey != "" && (!ok || e.Localized.Key != tt.wantKey) {
+			t.Errorf("%v: got %v, want %q", tt.value, err, tt.wantKey)
+		}
+	}
+}
+
+func TestAcceptedLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"es", "es"},
+		{"ES-ar", "es"},
+		{"es-AR,es;q=0.9,en;q=0.8", "es"},
+		{"en;q=0.5, es;q=0.9", "es"},
+		{"en, es", "en"},
+		{"fr, de;q=0.9", ""},
+		{"fr, en;q=0.1", "en"},
+		{"es;q=0, en;q=0.2", "en"},
+		{"es;q=0", ""},
+		{"es;q=high", "es"},
+		{"*", ""},
+	}
+	for _, tt := range tests {
+		if got := acceptedLanguage(tt.header); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	tests := []struct {
+		err      error
+		language string
+		want     string
+	}{
+		{validationError("min_length", "name", 2), "en", "name should be at least 2 characters long"},
+		{validationError("min_length", "name", 2), "es", "El campo nombre debe tener al menos 2 caracteres"},
+		{validationError("max", "age", 120.0), "es", "El campo edad debe ser como máximo 120"},
+		{validationError("invalid", "email"), "es", "Valor inválido para correo electrónico"},
+		{validationError("required", "password"), "es", "Falta el parámetro contraseña"},
+		{validationError("required", "nickname"), "es", "Falta el parámetro nickname"},
+		{validationError("invalid", "email"), "fr", "Invalid value for email"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.(Error).Localized.In(tt.language); got != tt.want {
+			t.Errorf("in %s: got %q, want %q", tt.language, got, tt.want)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	err := validationError("invalid", "name").(Error)
+	for header, want := range map[string]string{
+		"":                "Invalid value for name",
+		"fr":              "Invalid value for name",
+		"es-AR, en;q=0.5": "Valor inválido para nombre",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.Header.Set("Accept-Language", header)
+		if got := RequestMessage(c, err); got != want {
+			t.Errorf("Accept-Language %q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestInitValidation(t *testing.T) {
+	previous, previousLanguage := userValidators, defaultLanguage
+	t.Cleanup(func() { userValidators, defaultLanguage = previous, previousLanguage })
+	userValidators = map[string]*fieldValidator{}
+
+	config := &Config{}
+	config.Validation.Language = "fr"
+	if err := InitValidation(config); err == nil {
+		t.Error("initialized an unknown language")
+	}
+
+	config.Validation.Language = "es"
+	config.Validation.Name = ValidationRule{MinLength: length(2), Normalize: "NFC"}
+	if err := InitValidation(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateString("name", "a"); err == nil || err.(Error).Message != "El campo nombre debe tener al menos 2 caracteres" {
+		t.Errorf("got %v", err)
+	}
+	if got, err := ValidateString("name", "Jose\u0301"); err != nil || got != "Jos\u00e9" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if got := NormalizeString("name", "Jose\u0301"); got != "Jos\u00e9" {
+		t.Errorf("normalized to %q", got)
+	}
+}
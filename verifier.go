@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// CredentialVerifier checks the email and password of a user logging in to
+// the tenant of users, returning its user, which verifiers checking another
+// store create or update from it. Verifiers that don't know the email fail
+// with errCredentialsUnknown, so Login tries the next one.
+type CredentialVerifier interface {
+	Verify(users *UsecaseHandler, email string, password string) (*Model, error)
+}
+
+var errCredentialsUnknown = errors.New("credentials unknown")
+
+var errCredentialsIncorrect = Error{Code: http.StatusUnauthorized, Message: "Email or password incorrect"}
+
+// NewCredentialVerifiers returns the verifiers of config.Login.Verifiers, in
+// the order Login tries them.
+func NewCredentialVerifiers(config *Config) ([]CredentialVerifier, error) {
+	names := config.Login.Verifiers
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+
+	var verifiers []CredentialVerifier
+	for _, name := range names {
+		switch name {
+		case "local":
+			verifiers = append(verifiers, LocalVerifier{})
+		case "ldap":
+			verifier, err := NewLDAPVerifier(config)
+			if err != nil {
+				return nil, err
+			}
+			verifiers = append(verifiers, verifier)
+		default:
+			return nil, fmt.Errorf("login: unsupported verifier %q, use local or ldap", name)
+		}
+	}
+	return verifiers, nil
+}
+
+// LocalVerifier checks the passwords stored with the users. It doesn't know
+// the users without one, created by identity providers or directories.
+type LocalVerifier struct{}
+
+func (LocalVerifier) Verify(users *UsecaseHandler, email string, password string) (*Model, error) {
+
+	user, err := users.FindByEmail(NormalizeString("email", email))
+	if err != nil {
+		if v, ok := err.(Error); ok && v.Code == http.StatusNotFound {
+			return nil, errCredentialsUnknown
+		}
+		return nil, err
+	}
+	if user.Password == "" {
+		return nil, errCredentialsUnknown
+	}
+
+	ok, err := users.ComparePasswordWithScheme(password, user.ProtectionScheme, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	if ok == false {
+		return nil, errCredentialsIncorrect
+	}
+
+	if user.ProtectionScheme != defaultProtectionScheme {
+		users.upgradeProtectedForm(user, password)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RelyingParty runs the WebAuthn ceremonies registering passkeys and logging
+// in with them (https://www.w3.org/TR/webauthn-2/), for the pages of Origins.
+// Attestations are verified in the none and packed formats, but their
+// certificates aren't chained to the roots of the makers of authenticators,
+// as there's no metadata service to trust.
+type RelyingParty struct {
+	ID               string
+	Name             string
+	Origins          []string
+	UserVerification string // required, preferred or discouraged
+	Attestation      string // none or direct
+	Timeout          time.Duration
+}
+
+// COSE algorithms of the credentials accepted, by preference.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Flags of authenticator data.
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttested       = 0x40
+	flagExtensions     = 0x80
+)
+
+var errWebAuthnInvalid = Error{Code: http.StatusBadRequest, Message: "Invalid passkey response, start over"}
+
+// NewRelyingParty returns the relying party of config.WebAuthn, or nil when
+// neither its ID nor the issuer of the service are configured.
+func NewRelyingParty(config *Config) (*RelyingParty, error) {
+	c := config.WebAuthn
+
+	var issuer *url.URL
+	if config.Issuer != "" {
+		var err error
+		if issuer, err = url.Parse(config.Issuer); err != nil {
+			return nil, fmt.Errorf("webauthn: invalid issuer: %v", err)
+		}
+	}
+
+	rp := RelyingParty{
+		ID:               c.RPID,
+		Name:             c.RPName,
+		Origins:          c.Origins,
+		UserVerification: c.UserVerification,
+		Attestation:      c.Attestation,
+		Timeout:          time.Duration(c.TimeoutInSeconds) * time.Second,
+	}
+	if rp.ID == "" {
+		if issuer == nil {
+			return nil, nil
+		}
+		rp.ID = issuer.Hostname()
+	}
+	if rp.Name == "" {
+		rp.Name = config.AppName
+	}
+	if len(rp.Origins) == 0 {
+		if issuer == nil {
+			return nil, errors.New("webauthn: the origins of the pages running the ceremonies are missing")
+		}
+		rp.Origins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+
+	for _, origin := range rp.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("webauthn: invalid origin %q, like https://example.com", origin)
+		}
+		// The ID must be the domain of the origins, or one of its parents
+		if host := u.Hostname(); host != rp.ID && !strings.HasSuffix(host, "."+rp.ID) {
+			return nil, fmt.Errorf("webauthn: origin %s isn't in the domain %s", origin, rp.ID)
+		}
+	}
+	switch rp.UserVerification {
+	case "required", "preferred", "discouraged":
+	default:
+		return nil, fmt.Errorf("webauthn: invalid user verification %q, use required, preferred or discouraged", rp.UserVerification)
+	}
+	if rp.Attestation != "none" && rp.Attestation != "direct" {
+		return nil, fmt.Errorf("webauthn: invalid attestation %q, use none or direct", rp.Attestation)
+	}
+	return &rp, nil
+}
+
+// credentialDescriptor identifies a credential of a user to its
+// authenticator.
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// CredentialCreationOptions are the publicKey options of
+// navigator.credentials.create, encoded the way
+// PublicKeyCredential.parseCreationOptionsFromJSON takes them.
+type CredentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// CredentialRequestOptions are the publicKey options of
+// navigator.credentials.get, encoded the way
+// PublicKeyCredential.parseRequestOptionsFromJSON takes them.
+type CredentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions asks for a passkey of user, other than its credentials.
+func (rp *RelyingParty) CreationOptions(challenge string, user *Model, credentials []WebAuthnCredential) *CredentialCreationOptions {
+	options := CredentialCreationOptions{
+		Challenge:   challenge,
+		Timeout:     rp.Timeout.Milliseconds(),
+		Attestation: rp.Attestation,
+	}
+	options.RP.ID = rp.ID
+	options.RP.Name = rp.Name
+	options.User.ID = base64.RawURLEncoding.EncodeToString(webAuthnUserHandle(user.ID))
+	options.User.Name = user.Email
+	options.User.DisplayName = user.Name
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{"public-key", alg})
+	}
+	options.ExcludeCredentials = descriptors(credentials)
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = rp.UserVerification
+	return &options
+}
+
+// RequestOptions asks for an assertion of one of credentials, or of any
+// passkey of the service when there's none, which must verify its user when
+// userVerification is required.
+func (rp *RelyingParty) RequestOptions(challenge string, credentials []WebAuthnCredential, userVerification string) *CredentialRequestOptions {
+	return &CredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(credentials),
+		UserVerification: userVerification,
+	}
+}
+
+func descriptors(credentials []WebAuthnCredential) []credentialDescriptor {
+	descriptors := []credentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, credentialDescriptor{Type: "public-key", ID: credential.CredentialID})
+	}
+	return descriptors
+}
+
+// webAuthnUserHandle is the ID of a user its passkeys carry, which must not
+// tell anything about it but what its service knows.
+func webAuthnUserHandle(userID uint) []byte {
+	return []byte(fmt.Sprint(userID))
+}
+
+// publicKeyCredential is a PublicKeyCredential as its toJSON method encodes
+// it, the response of a registration or an assertion.
+type publicKeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key
+}
+
+// Registration is a credential a registration ceremony created, verified
+// but for its challenge.
+type Registration struct {
+	Challenge       string
+	CredentialID    string
+	PublicKey       []byte
+	Algorithm       int
+	SignCount       uint32
+	AAGUID          string
+	AttestationType string // none, self or basic
+	Flags           byte
+}
+
+// Assertion is the response of an authentication ceremony, whose signature
+// Verify checks with the key of its credential.
+type Assertion struct {
+	Challenge    string
+	CredentialID string
+	UserHandle   []byte // of discoverable credentials
+	Flags        byte
+	SignCount    uint32
+	signed       []byte
+	signature    []byte
+}
+
+// ParseRegistration checks a registration response, of the JSON of its
+// PublicKeyCredential, and its attestation.
+func (rp *RelyingParty) ParseRegistration(data string) (*Registration, error) {
+
+	credential, client, clientDataHash, err := rp.parseCredential(data, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := decodeWebAuthnBase64(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, rp.failed("attestation object", err)
+	}
+	decoded, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) > 0 {
+		return nil, rp.failed("attestation object", fmt.Errorf("malformed CBOR: %v", err))
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, rp.failed("attestation object", errors.New("not a map"))
+	}
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := object["authData"].([]byte)
+	if statement == nil || rawAuthData == nil {
+		return nil, rp.failed("attestation object", errors.New("attStmt or authData missing"))
+	}
+
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.Flags&flagAttested == 0 {
+		return nil, rp.failed("authenticator data", errors.New("the attested credential is missing"))
+	}
+	if credential.RawID != "" && credential.RawID != base64.RawURLEncoding.EncodeToString(authData.CredentialID) {
+		return nil, rp.failed("credential", errors.New("its ID isn't the one attested"))
+	}
+	key, alg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, rp.failed("credential public key", err)
+	}
+	if rp.UserVerification == "required" && authData.Flags&flagUserVerified == 0 {
+		return nil, rp.failed("authenticator data", errors.New("the user wasn't verified"))
+	}
+
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash...)
+	attestationType, err := verifyAttestation(format, statement, signed, authData, key, alg)
+	if err != nil {
+		return nil, rp.failed(format+" attestation", err)
+	}
+
+	return &Registration{
+		Challenge:       client.Challenge,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:       authData.PublicKey,
+		Algorithm:       int(alg),
+		SignCount:       authData.SignCount,
+		AAGUID:          formatAAGUID(authData.AAGUID),
+		AttestationType: attestationType,
+		Flags:           authData.Flags,
+	}, nil
+}
+
+// ParseAssertion checks an authentication response, of the JSON of its
+// PublicKeyCredential, but for its signature.
+func (rp *RelyingParty) ParseAssertion(data string) (*Assertion, error) {
+
+	credential, client, clientDataHash, err := rp.parseCredential(data, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+
+	rawAuthData, err := decodeWebAuthnBase64(credential.Response.AuthenticatorData)
+	if err != nil {
+		return nil, rp.failed("authenticator data", err)
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeWebAuthnBase64(credential.Response.Signature)
+	if err != nil {
+		return nil, rp.failed("signature", err)
+	}
+	userHandle, err := decodeWebAuthnBase64(credential.Response.UserHandle)
+	if err != nil {
+		return nil, rp.failed("user handle", err)
+	}
+	id, err := decodeWebAuthnBase64(credential.RawID)
+	if err != nil || len(id) == 0 {
+		return nil, rp.failed("credential", errors.New("its ID is missing"))
+	}
+
+	return &Assertion{
+		Challenge:    client.Challenge,
+		CredentialID: base64.RawURLEncoding.EncodeToString(id),
+		UserHandle:   userHandle,
+		Flags:        authData.Flags,
+		SignCount:    authData.SignCount,
+		signed:       append(append([]byte(nil), rawAuthData...), clientDataHash...),
+		signature:    signature,
+	}, nil
+}
+
+// Verify checks the signature of the assertion with publicKey, the COSE_Key
+// of its credential.
+func (a *Assertion) Verify(publicKey []byte) error {
+	key, alg, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return err
+	}
+	return verifyCOSESignature(alg, key, a.signed, a.signature)
+}
+
+// parseCredential checks the client data of the credential, of a ceremony
+// of ceremonyType, returning its hash, which its authenticator signed.
+func (rp *RelyingParty) parseCredential(data string, ceremonyType string) (*publicKeyCredential, *clientData, []byte, error) {
+
+	var credential publicKeyCredential
+	if err := json.Unmarshal([]byte(data), &credential); err != nil {
+		return nil, nil, nil, rp.failed("credential", err)
+	}
+	if credential.Type != "public-key" {
+		return nil, nil, nil, rp.failed("credential", fmt.Errorf("type %q", credential.Type))
+	}
+
+	rawClientData, err := decodeWebAuthnBase64(credential.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, nil, rp.failed("client data", err)
+	}
+	var client clientData
+	if err := json.Unmarshal(rawClientData, &client); err != nil {
+		return nil, nil, nil, rp.failed("client data", err)
+	}
+	if client.Type != ceremonyType {
+		return nil, nil, nil, rp.failed("client data", fmt.Errorf("type %q, not %s", client.Type, ceremonyType))
+	}
+	if client.Challenge == "" {
+		return nil, nil, nil, rp.failed("client data", errors.New("the challenge is missing"))
+	}
+	if client.CrossOrigin {
+		return nil, nil, nil, rp.failed("client data", errors.New("the ceremony ran in a cross-origin frame"))
+	}
+	allowed := false
+	for _, origin := range rp.Origins {
+		allowed = allowed || client.Origin == origin
+	}
+	if !allowed {
+		return nil, nil, nil, rp.failed("client data", fmt.Errorf("origin %q isn't allowed", client.Origin))
+	}
+
+	hash := sha256.Sum256(rawClientData)
+	return &credential, &client, hash[:], nil
+}
+
+// parseAuthenticatorData parses the authenticator data of a ceremony of
+// the relying party, where the user was present.
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, rp.failed("authenticator data", errors.New("truncated"))
+	}
+	authData := authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if hash := sha256.Sum256([]byte(rp.ID)); !bytes.Equal(authData.RPIDHash, hash[:]) {
+		return nil, rp.failed("authenticator data", errors.New("the hash of the relying party ID doesn't match"))
+	}
+	if authData.Flags&flagUserPresent == 0 {
+		return nil, rp.failed("authenticator data", errors.New("the user wasn't present"))
+	}
+
+	if authData.Flags&flagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, rp.failed("authenticator data", errors.New("truncated attested credential"))
+		}
+		authData.AAGUID = rest[:16]
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || length > 1023 || len(rest) < length {
+			return nil, rp.failed("authenticator data", fmt.Errorf("credential ID of %d bytes", length))
+		}
+		authData.CredentialID = rest[:length]
+		rest = rest[length:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, rp.failed("credential public key", err)
+		}
+		authData.PublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if authData.Flags&flagExtensions != 0 {
+		extensions, after, err := decodeCBOR(rest)
+		if _, ok := extensions.(map[interface{}]interface{}); err != nil || !ok {
+			return nil, rp.failed("authenticator data", errors.New("malformed extensions"))
+		}
+		rest = after
+	}
+	if len(rest) > 0 {
+		return nil, rp.failed("authenticator data", fmt.Errorf("%d bytes left over", len(rest)))
+	}
+	return &authData, nil
+}
+
+func (rp *RelyingParty) failed(what string, err error) error {
+	return logFailure("webauthn", what, err, errWebAuthnInvalid)
+}
+
+// idFIDOGenCeAAGUID is the extension of attestation certificates with the
+// AAGUID of the model of their authenticators.
+var idFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyAttestation checks the attestation statement in format, of the
+// credential of authData, returning its type.
+func verifyAttestation(format string, statement map[interface{}]interface{}, signed []byte, authData *authenticatorData, key crypto.PublicKey, alg int64) (string, error) {
+	switch format {
+	case "none":
+		if len(statement) > 0 {
+			return "", errors.New("the statement isn't empty")
+		}
+		return "none", nil
+	case "packed":
+	default:
+		return "", errors.New("unsupported format")
+	}
+
+	statementAlg, _ := statement["alg"].(int64)
+	signature, _ := statement["sig"].([]byte)
+	if signature == nil {
+		return "", errors.New("the signature is missing")
+	}
+
+	chain, ok := statement["x5c"].([]interface{})
+	if !ok {
+		// Self attestation, signed by the credential itself
+		if statementAlg != alg {
+			return "", fmt.Errorf("algorithm %d isn't the one of the credential", statementAlg)
+		}
+		return "self", verifyCOSESignature(alg, key, signed, signature)
+	}
+
+	if len(chain) == 0 {
+		return "", errors.New("x5c is empty")
+	}
+	der, _ := chain[0].([]byte)
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyCOSESignature(statementAlg, certificate.PublicKey, signed, signature); err != nil {
+		return "", err
+	}
+	if certificate.Version != 3 || !certificate.BasicConstraintsValid || certificate.IsCA {
+		return "", errors.New("the certificate must be a version 3 one, not of a CA")
+	}
+	organizationalUnit := certificate.Subject.OrganizationalUnit
+	if len(organizationalUnit) != 1 || organizationalUnit[0] != "Authenticator Attestation" {
+		return "", errors.New("the organizational unit of the certificate isn't Authenticator Attestation")
+	}
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(idFIDOGenCeAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(extension.Value, &aaguid); err != nil || extension.Critical || !bytes.Equal(aaguid, authData.AAGUID) {
+			return "", errors.New("the AAGUID of the certificate doesn't match")
+		}
+	}
+	return "basic", nil
+}
+
+// parseCOSEKey parses a public key of a credential, in one of the
+// algorithms of CreationOptions.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	decoded, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok || len(rest) > 0 {
+		return nil, 0, errors.New("the key isn't a map")
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, 0, errors.New("the point isn't on the P-256 curve")
+		}
+		return public, alg, nil
+	case kty == 1 && alg == coseEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key, of 2048 bits at least")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key type %d and algorithm %d", kty, alg)
+}
+
+// verifyCOSESignature checks the signature of signed by key, in the COSE
+// algorithm alg.
+func verifyCOSESignature(alg int64, key crypto.PublicKey, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case coseES256:
+		if public, ok := key.(*ecdsa.PublicKey); ok && public.Curve == elliptic.P256() {
+			if ecdsa.VerifyASN1(public, digest[:], signature) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	case coseEdDSA:
+		if public, ok := key.(ed25519.PublicKey); ok {
+			if ed25519.Verify(public, signed, signature) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	case coseRS256:
+		if public, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature)
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+	return fmt.Errorf("the key doesn't fit algorithm %d", alg)
+}
+
+// decodeWebAuthnBase64 decodes the base64url of the JSON of credentials,
+// padded or not.
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", aaguid[:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:])
+}
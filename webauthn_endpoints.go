@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebAuthnEndpointHandler struct {
+	webAuthnUsecaseHandler WebAuthnUsecase
+}
+
+func (h *WebAuthnEndpointHandler) BeginRegistration() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultBeginRegistration(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) FinishRegistration() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultFinishRegistration(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) BeginLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultBeginLogin(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) FinishLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultFinishLogin(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) Get() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultGet(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) PutOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultPutOne(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) DeleteOne() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h.defaultDeleteOne(c)
+	}
+}
+
+func (h *WebAuthnEndpointHandler) usecases(c *gin.Context) WebAuthnUsecase {
+	return h.webAuthnUsecaseHandler.ForTenant(c.MustGet("tenantID").(uint))
+}
+
+// defaultBeginRegistration replies the options of navigator.credentials.create
+// creating a passkey of the authenticated user.
+func (h *WebAuthnEndpointHandler) defaultBeginRegistration(c *gin.Context) {
+
+	options, err := h.usecases(c).StartRegistration(c.MustGet("authenticatedID").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": options})
+}
+
+// defaultFinishRegistration takes the credential navigator.credentials.create
+// created, as the JSON of its toJSON method.
+func (h *WebAuthnEndpointHandler) defaultFinishRegistration(c *gin.Context) {
+
+	response, ok := c.GetPostForm("credential")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter credential missing")
+		return
+	}
+
+	credential, err := h.usecases(c).FinishRegistration(c.MustGet("authenticatedID").(uint), c.PostForm("name"), response)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, credential)
+}
+
+// defaultBeginLogin replies the options of navigator.credentials.get logging
+// in to the tenant of the request with a passkey.
+func (h *WebAuthnEndpointHandler) defaultBeginLogin(c *gin.Context) {
+
+	options, err := h.usecases(c).StartLogin()
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": options})
+}
+
+// defaultFinishLogin takes the credential navigator.credentials.get asserted,
+// for the options of /webauthn/login/begin or of a password login asking for
+// a second factor, and replies like /login.
+func (h *WebAuthnEndpointHandler) defaultFinishLogin(c *gin.Context) {
+
+	response, ok := c.GetPostForm("credential")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter credential missing")
+		return
+	}
+
+	// The challenge tells the tenant
+	token, user, err := h.webAuthnUsecaseHandler.FinishLogin(response)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "user": user})
+}
+
+// defaultGet lists the passkeys of the authenticated user.
+func (h *WebAuthnEndpointHandler) defaultGet(c *gin.Context) {
+
+	credentials, err := h.usecases(c).ListCredentials(c.MustGet("authenticatedID").(uint))
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+func (h *WebAuthnEndpointHandler) defaultPutOne(c *gin.Context) {
+
+	name, ok := c.GetPostForm("name")
+	if !ok {
+		ErrorReply(c, http.StatusBadRequest, "Parameter name missing")
+		return
+	}
+
+	credential, err := h.usecases(c).RenameCredential(c.MustGet("authenticatedID").(uint), c.MustGet("id").(uint), name)
+	if err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, credential)
+}
+
+func (h *WebAuthnEndpointHandler) defaultDeleteOne(c *gin.Context) {
+
+	if err := h.usecases(c).DeleteCredential(c.MustGet("authenticatedID").(uint), c.MustGet("id").(uint)); err != nil {
+		if v, ok := err.(Error); ok {
+			c.JSON(v.Code, gin.H{"msg": RequestMessage(c, v)})
+		} else {
+			panic(err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+// WebAuthnCredential is a passkey of a user, the public key of a credential
+// its authenticator keeps, which logs it in alone or confirms its password.
+type WebAuthnCredential struct {
+	ID              uint `gorm:"primary_key"`
+	CreatedAt       time.Time
+	TenantID        uint   `gorm:"not null" json:"-"`
+	UserID          uint   `gorm:"not null;index"`
+	CredentialID    string `gorm:"type:varchar(255);unique_index"` // base64url
+	Name            string `gorm:"type:varchar(64)"`
+	PublicKey       []byte `json:"-"` // COSE_Key
+	Algorithm       int    // COSE
+	SignCount       uint32 // of the last assertion, which must grow unless the authenticator doesn't count
+	AAGUID          string `gorm:"column:aaguid;type:varchar(36)"` // the model of the authenticator, as attested
+	AttestationType string `gorm:"type:varchar(16)"`               // none, self or basic
+	UserVerified    bool   // at registration
+	BackupEligible  bool
+	BackedUp        bool // synced to other devices, as of the last assertion
+	LastUsedAt      *time.Time
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// WebAuthnChallenge is a ceremony in progress, used once: the registration
+// of a passkey by a user, a login with a passkey, or the confirmation of the
+// password of a user with one. Only the hash of its challenge is stored.
+type WebAuthnChallenge struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	ChallengeHash string `gorm:"type:varchar(64);unique_index"`
+	Ceremony      string `gorm:"type:varchar(16)"` // registration, login or mfa
+	TenantID      uint
+	UserID        uint // none for logins, where the passkey tells the user
+	ExpiresAt     time.Time
+}
+
+func (WebAuthnChallenge) TableName() string {
+	return "webauthn_challenges"
+}
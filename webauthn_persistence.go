@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type WebAuthnPersistence interface {
+	// CreateWebAuthnChallenge forgets the expired challenges first
+	CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error
+	// UseWebAuthnChallenge deletes the challenge with challengeHash and
+	// returns it, failing with errWebAuthnChallengeNotFound if it was used
+	// already.
+	UseWebAuthnChallenge(challengeHash string) (*WebAuthnChallenge, error)
+
+	// CreateWebAuthnCredential fails with errWebAuthnCredentialInUse when
+	// the credential was registered already
+	CreateWebAuthnCredential(credential *WebAuthnCredential) error
+	FindWebAuthnCredential(credentialID string) (*WebAuthnCredential, error)
+	ListWebAuthnCredentials(userID uint) ([]WebAuthnCredential, error)
+	// SaveWebAuthnCredential saves the name of the credential, and what its
+	// last assertion changed
+	SaveWebAuthnCredential(credential *WebAuthnCredential) error
+	DeleteWebAuthnCredential(credential *WebAuthnCredential) error
+}
+
+var errWebAuthnChallengeNotFound = Error{Code: http.StatusBadRequest, Message: "Invalid, expired or used challenge, start over"}
+
+var errWebAuthnCredentialNotFound = Error{Code: http.StatusNotFound, Message: "Passkey not found"}
+
+var errWebAuthnCredentialInUse = Error{Code: http.StatusConflict, Message: "The passkey is registered already"}
+
+func (h *PersistenceHandler) CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error {
+	if err := h.DB.Where("expires_at < ?", time.Now()).Delete(WebAuthnChallenge{}).Error; err != nil {
+		return err
+	}
+	return h.DB.Create(challenge).Error
+}
+
+func (h *PersistenceHandler) UseWebAuthnChallenge(challengeHash string) (*WebAuthnChallenge, error) {
+	var challenge WebAuthnChallenge
+
+	r := h.DB.Where("challenge_hash = ?", challengeHash).First(&challenge)
+	if r.RecordNotFound() {
+		return nil, errWebAuthnChallengeNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	// Of concurrent uses, only the one deleting it gets it
+	r = h.DB.Where("id = ?", challenge.ID).Delete(WebAuthnChallenge{})
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	if r.RowsAffected == 0 {
+		return nil, errWebAuthnChallengeNotFound
+	}
+
+	return &challenge, nil
+}
+
+func (h *PersistenceHandler) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	if err := h.DB.Create(credential).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errWebAuthnCredentialInUse
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *PersistenceHandler) FindWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+
+	r := h.DB.Where("credential_id = ?", credentialID).First(&credential)
+	if r.RecordNotFound() {
+		return nil, errWebAuthnCredentialNotFound
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	return &credential, nil
+}
+
+func (h *PersistenceHandler) ListWebAuthnCredentials(userID uint) ([]WebAuthnCredential, error) {
+	var credentials []WebAuthnCredential
+
+	if err := h.DB.Where("user_id = ?", userID).Order("id").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (h *PersistenceHandler) SaveWebAuthnCredential(credential *WebAuthnCredential) error {
+	updates := map[string]interface{}{
+		"name":         credential.Name,
+		"sign_count":   credential.SignCount,
+		"backed_up":    credential.BackedUp,
+		"last_used_at": credential.LastUsedAt,
+	}
+	return h.DB.Model(&WebAuthnCredential{}).Where("id = ?", credential.ID).Updates(updates).Error
+}
+
+func (h *PersistenceHandler) DeleteWebAuthnCredential(credential *WebAuthnCredential) error {
+	return h.DB.Delete(credential).Error
+}
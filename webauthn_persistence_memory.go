@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+func (h *MemoryPersistence) CreateWebAuthnChallenge(challenge *WebAuthnChallenge) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for hash, stored := range h.webAuthnChallenges {
+		if stored.ExpiresAt.Before(now) {
+			delete(h.webAuthnChallenges, hash)
+		}
+	}
+
+	h.nextWebAuthnChallengeID++
+	challenge.ID = h.nextWebAuthnChallengeID
+	challenge.CreatedAt = now
+
+	stored := *challenge
+	h.webAuthnChallenges[challenge.ChallengeHash] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) UseWebAuthnChallenge(challengeHash string) (*WebAuthnChallenge, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.webAuthnChallenges[challengeHash]
+	if !ok {
+		return nil, errWebAuthnChallengeNotFound
+	}
+	delete(h.webAuthnChallenges, challengeHash)
+
+	challenge := *stored
+	return &challenge, nil
+}
+
+func (h *MemoryPersistence) CreateWebAuthnCredential(credential *WebAuthnCredential) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, stored := range h.webAuthnCredentials {
+		if stored.CredentialID == credential.CredentialID {
+			return errWebAuthnCredentialInUse
+		}
+	}
+
+	h.nextWebAuthnCredentialID++
+	credential.ID = h.nextWebAuthnCredentialID
+	credential.CreatedAt = time.Now()
+
+	stored := *credential
+	h.webAuthnCredentials[credential.ID] = &stored
+	return nil
+}
+
+func (h *MemoryPersistence) FindWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, stored := range h.webAuthnCredentials {
+		if stored.CredentialID == credentialID {
+			credential := *stored
+			return &credential, nil
+		}
+	}
+	return nil, errWebAuthnCredentialNotFound
+}
+
+func (h *MemoryPersistence) ListWebAuthnCredentials(userID uint) ([]WebAuthnCredential, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var credentials []WebAuthnCredential
+	for _, stored := range h.webAuthnCredentials {
+		if stored.UserID == userID {
+			credentials = append(credentials, *stored)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].ID < credentials[j].ID })
+	return credentials, nil
+}
+
+func (h *MemoryPersistence) SaveWebAuthnCredential(credential *WebAuthnCredential) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored, ok := h.webAuthnCredentials[credential.ID]
+	if !ok {
+		return nil
+	}
+	stored.Name = credential.Name
+	stored.SignCount = credential.SignCount
+	stored.BackedUp = credential.BackedUp
+	stored.LastUsedAt = credential.LastUsedAt
+	return nil
+}
+
+func (h *MemoryPersistence) DeleteWebAuthnCredential(credential *WebAuthnCredential) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.webAuthnCredentials, credential.ID)
+	return nil
+}
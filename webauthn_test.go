@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testAuthenticator is a software authenticator of an ECDSA P-256 passkey,
+// answering the ceremonies of the relying party of example.com.
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	aaguid       []byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 32)
+	rand.Read(credentialID)
+	return &testAuthenticator{t, key, credentialID, []byte("0123456789abcdef")}
+}
+
+// testCeremony is what the browser and the authenticator put in a
+// response, which tests change.
+type testCeremony struct {
+	Type      string
+	Challenge string
+	Origin    string
+	RPID      string
+	Flags     byte
+	SignCount uint32
+	Format    string // of the attestation of registrations, none, self or x5c
+	AAGUID    []byte // of the attestation certificate
+}
+
+func (a *testAuthenticator) ceremony(ceremonyType string, challenge string) *testCeremony {
+	return &testCeremony{
+		Type:      ceremonyType,
+		Challenge: challenge,
+		Origin:    "https://example.com",
+		RPID:      "example.com",
+		Flags:     flagUserPresent | flagUserVerified,
+		Format:    "none",
+		AAGUID:    a.aaguid,
+	}
+}
+
+func (a *testAuthenticator) sign(key *ecdsa.PrivateKey, signed []byte) []byte {
+	digest := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return signature
+}
+
+// response returns the client data of c and the authenticator data up to
+// its counter.
+func (c *testCeremony) response() ([]byte, []byte) {
+	clientData, _ := json.Marshal(clientData{Type: c.Type, Challenge: c.Challenge, Origin: c.Origin})
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	authData := append(rpIDHash[:], c.Flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], c.SignCount)
+	return clientData, authData
+}
+
+func (a *testAuthenticator) register(c *testCeremony) string {
+	clientData, authData := c.response()
+	authData[32] |= flagAttested
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	authData = append(authData, a.aaguid...)
+	authData = append(authData, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, encodeCBOR(cborMap{{1, 2}, {3, coseES256}, {-1, 1}, {-2, x}, {-3, y}})...)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	format, statement := "packed", cborMap{}
+	switch c.Format {
+	case "none":
+		format = "none"
+	case "self":
+		statement = cborMap{{"alg", coseES256}, {"sig", a.sign(a.key, signed)}}
+	case "x5c":
+		key, certificate := a.attestationCertificate(c.AAGUID)
+		statement = cborMap{{"alg", coseES256}, {"sig", a.sign(key, signed)}, {"x5c", []interface{}{certificate}}}
+	}
+	object := encodeCBOR(cborMap{{"fmt", format}, {"attStmt", statement}, {"authData", authData}})
+
+	var credential publicKeyCredential
+	credential.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	credential.RawID = credential.ID
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	credential.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(object)
+	encoded, _ := json.Marshal(credential)
+	return string(encoded)
+}
+
+// attestationCertificate is a certificate of the model of the authenticator,
+// of aaguid, with its key.
+func (a *testAuthenticator) attestationCertificate(aaguid []byte) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	extension, _ := asn1.Marshal(aaguid)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Test"}, OrganizationalUnit: []string{"Authenticator Attestation"}, CommonName: "Test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: idFIDOGenCeAAGUID, Value: extension}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return key, der
+}
+
+func (a *testAuthenticator) assert(c *testCeremony, userHandle []byte) string {
+	clientData, authData := c.response()
+	clientDataHash := sha256.Sum256(clientData)
+
+	var credential publicKeyCredential
+	credential.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	credential.RawID = credential.ID
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	credential.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	credential.Response.Signature = base64.RawURLEncoding.EncodeToString(a.sign(a.key, append(authData, clientDataHash[:]...)))
+	credential.Response.UserHandle = base64.RawURLEncoding.EncodeToString(userHandle)
+	encoded, _ := json.Marshal(credential)
+	return string(encoded)
+}
+
+func newTestWebAuthn(t *testing.T, userVerification string) (*WebAuthnUsecaseHandler, *Model) {
+	config := &Config{JwtSecret: "secret", AppName: "test", Issuer: "https://example.com"}
+	config.WebAuthn.UserVerification = userVerification
+	config.WebAuthn.Attestation = "direct"
+	config.WebAuthn.TimeoutInSeconds = 300
+	rp, err := NewRelyingParty(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryPersistence()
+	user := createTestModels(t, store, "alice")[0]
+	return &WebAuthnUsecaseHandler{store, store, &TokenIssuer{store, config, nil}, rp, config, defaultTenantID}, user
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	tests := []struct {
+		name             string
+		userVerification string
+		change           func(c *testCeremony)
+		wantType         string // of attestation, an error when empty
+	}{
+		{"none attestation", "preferred", func(c *testCeremony) {}, "none"},
+		{"self attestation", "preferred", func(c *testCeremony) { c.Format = "self" }, "self"},
+		{"x5c attestation", "preferred", func(c *testCeremony) { c.Format = "x5c" }, "basic"},
+		{"x5c of another model", "preferred", func(c *testCeremony) { c.Format, c.AAGUID = "x5c", []byte("fedcba9876543210") }, ""},
+		{"another relying party", "preferred", func(c *testCeremony) { c.RPID = "evil.com" }, ""},
+		{"another origin", "preferred", func(c *testCeremony) { c.Origin = "https://evil.com" }, ""},
+		{"login type", "preferred", func(c *testCeremony) { c.Type = "webauthn.get" }, ""},
+		{"user not present", "preferred", func(c *testCeremony) { c.Flags = flagUserVerified }, ""},
+		{"user not verified", "preferred", func(c *testCeremony) { c.Flags = flagUserPresent }, "none"},
+		{"user not verified when required", "required", func(c *testCeremony) { c.Flags = flagUserPresent }, ""},
+		{"another challenge", "preferred", func(c *testCeremony) { c.Challenge = "other" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, user := newTestWebAuthn(t, tt.userVerification)
+			authenticator := newTestAuthenticator(t)
+			options, err := h.StartRegistration(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := authenticator.ceremony("webauthn.create", options.Challenge)
+			tt.change(c)
+			credential, err := h.FinishRegistration(user.ID, "", authenticator.register(c))
+			if tt.wantType == "" {
+				if err == nil {
+					t.Fatalf("registered %+v", credential)
+				}
+				if credentials, _ := h.ListCredentials(user.ID); len(credentials) != 0 {
+					t.Errorf("registered %d credentials", len(credentials))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credential.AttestationType != tt.wantType || credential.Algorithm != coseES256 ||
+				credential.AAGUID != "30313233-3435-3637-3839-616263646566" || credential.Name != "Passkey" {
+				t.Errorf("registered %+v", credential)
+			}
+		})
+	}
+}
+
+func TestWebAuthnRegistrationChallenge(t *testing.T) {
+	h, user := newTestWebAuthn(t, "preferred")
+	other := createTestModels(t, h.persistenceHandler, "bob")[0]
+	authenticator := newTestAuthenticator(t)
+
+	options, err := h.StartRegistration(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))
+	if _, err := h.FinishRegistration(other.ID, "", response); err != errWebAuthnInvalid {
+		t.Errorf("challenge of another user: got %v, want %v", err, errWebAuthnInvalid)
+	}
+
+	options, err = h.StartRegistration(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))
+	if _, err := h.FinishRegistration(user.ID, "", response); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.FinishRegistration(user.ID, "", response); err != errWebAuthnChallengeNotFound {
+		t.Errorf("reused challenge: got %v, want %v", err, errWebAuthnChallengeNotFound)
+	}
+}
+
+func TestWebAuthnRegistrationMalformed(t *testing.T) {
+	h, user := newTestWebAuthn(t, "preferred")
+	authenticator := newTestAuthenticator(t)
+
+	options, err := h.StartRegistration(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var credential publicKeyCredential
+	json.Unmarshal([]byte(authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))), &credential)
+	object, _ := decodeWebAuthnBase64(credential.Response.AttestationObject)
+
+	for _, malformed := range [][]byte{
+		object[:len(object)-1],
+		append(object, 0x00),
+		object[:len(object)/2],
+		encodeCBOR([]interface{}{object}),
+		{0xbf, 0xff},
+	} {
+		credential.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(malformed)
+		response, _ := json.Marshal(credential)
+		if _, err := h.rp.ParseRegistration(string(response)); err != errWebAuthnInvalid {
+			t.Errorf("%x: got %v, want %v", malformed, err, errWebAuthnInvalid)
+		}
+	}
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	h, user := newTestWebAuthn(t, "preferred")
+	authenticator := newTestAuthenticator(t)
+	options, err := h.StartRegistration(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.FinishRegistration(user.ID, "", authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))); err != nil {
+		t.Fatal(err)
+	}
+
+	signCount := uint32(0)
+	tests := []struct {
+		name    string
+		change  func(c *testCeremony)
+		handle  []byte
+		wantErr bool
+	}{
+		{"valid", func(c *testCeremony) {}, webAuthnUserHandle(user.ID), false},
+		{"another relying party", func(c *testCeremony) { c.RPID = "evil.com" }, webAuthnUserHandle(user.ID), true},
+		{"another origin", func(c *testCeremony) { c.Origin = "https://evil.com" }, webAuthnUserHandle(user.ID), true},
+		{"registration type", func(c *testCeremony) { c.Type = "webauthn.create" }, webAuthnUserHandle(user.ID), true},
+		{"user not verified", func(c *testCeremony) { c.Flags = flagUserPresent }, webAuthnUserHandle(user.ID), true},
+		{"no user handle", func(c *testCeremony) {}, nil, true},
+		{"user handle of another user", func(c *testCeremony) {}, webAuthnUserHandle(user.ID + 1), true},
+		{"counter rolled back", func(c *testCeremony) { c.SignCount -= 2 }, webAuthnUserHandle(user.ID), true},
+		{"counter not moved", func(c *testCeremony) { c.SignCount-- }, webAuthnUserHandle(user.ID), true},
+		{"valid again", func(c *testCeremony) {}, webAuthnUserHandle(user.ID), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := h.StartLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.UserVerification != "required" {
+				t.Errorf("got user verification %q, want required", options.UserVerification)
+			}
+
+			c := authenticator.ceremony("webauthn.get", options.Challenge)
+			c.SignCount = signCount + 1
+			tt.change(c)
+			response := authenticator.assert(c, tt.handle)
+			token, logged, err := h.FinishLogin(response)
+			if tt.wantErr {
+				if err != errWebAuthnInvalid {
+					t.Errorf("got %v, want %v", err, errWebAuthnInvalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token == "" || logged.ID != user.ID {
+				t.Errorf("logged in %+v with token %q", logged, token)
+			}
+			signCount = c.SignCount
+
+			if _, _, err := h.FinishLogin(response); err != errWebAuthnChallengeNotFound {
+				t.Errorf("reused challenge: got %v, want %v", err, errWebAuthnChallengeNotFound)
+			}
+		})
+	}
+}
+
+// TestWebAuthnSecondFactor checks the assertions confirming password logins
+// verify the user as the relying party requires.
+func TestWebAuthnSecondFactor(t *testing.T) {
+	tests := []struct {
+		userVerification string
+		flags            byte
+		wantErr          bool
+	}{
+		{"preferred", flagUserPresent | flagUserVerified, false},
+		{"preferred", flagUserPresent, false},
+		{"required", flagUserPresent | flagUserVerified, false},
+		{"required", flagUserPresent, true},
+	}
+	for _, tt := range tests {
+		h, user := newTestWebAuthn(t, tt.userVerification)
+		authenticator := newTestAuthenticator(t)
+		options, err := h.StartRegistration(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.FinishRegistration(user.ID, "", authenticator.register(authenticator.ceremony("webauthn.create", options.Challenge))); err != nil {
+			t.Fatal(err)
+		}
+
+		required, ok := h.Challenge(user).(SecondFactorRequired)
+		if !ok || required.Options.UserVerification != tt.userVerification || len(required.Options.AllowCredentials) != 1 {
+			t.Fatalf("%s: got %+v", tt.userVerification, required)
+		}
+		c := authenticator.ceremony("webauthn.get", required.Options.Challenge)
+		c.Flags, c.SignCount = tt.flags, 1
+		_, _, err = h.FinishLogin(authenticator.assert(c, nil))
+		if tt.wantErr && err != errWebAuthnInvalid || !tt.wantErr && err != nil {
+			t.Errorf("%s with flags %x: got %v", tt.userVerification, tt.flags, err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type WebAuthnUsecase interface {
+	// ForTenant returns the usecases confined to the users of a tenant
+	ForTenant(tenantID uint) WebAuthnUsecase
+	// StartRegistration returns the options creating a passkey of the user
+	StartRegistration(userID uint) (*CredentialCreationOptions, error)
+	// FinishRegistration stores the passkey of the registration response of
+	// the user, named name
+	FinishRegistration(userID uint, name string, response string) (*WebAuthnCredential, error)
+	// StartLogin returns the options asserting any passkey, which tells its
+	// user
+	StartLogin() (*CredentialRequestOptions, error)
+	// FinishLogin logs in the user of the passkey of the assertion response,
+	// alone or confirming the password it logged in with
+	FinishLogin(response string) (string, *Model, error)
+	ListCredentials(userID uint) ([]WebAuthnCredential, error)
+	RenameCredential(userID uint, id uint, name string) (*WebAuthnCredential, error)
+	DeleteCredential(userID uint, id uint) error
+}
+
+type WebAuthnUsecaseHandler struct {
+	webAuthnPersistence WebAuthnPersistence
+	persistenceHandler  Persistence
+	issuer              *TokenIssuer
+	rp                  *RelyingParty // passkeys are disabled when nil
+	config              *Config
+	tenantID            uint
+}
+
+func (h *WebAuthnUsecaseHandler) ForTenant(tenantID uint) WebAuthnUsecase {
+	return &WebAuthnUsecaseHandler{h.webAuthnPersistence, h.persistenceHandler, h.issuer, h.rp, h.config, tenantID}
+}
+
+// Ceremonies of challenges
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+	ceremonyMFA          = "mfa"
+)
+
+var errWebAuthnDisabled = Error{Code: http.StatusNotFound, Message: "Passkeys aren't enabled"}
+
+var errSecondFactorRequired = Error{Code: http.StatusUnauthorized, Message: "Confirm the login with a passkey"}
+
+// SecondFactor confirms the password logins of the users that set one up,
+// failing them with what the second step needs.
+type SecondFactor interface {
+	Challenge(user *Model) error
+}
+
+// SecondFactorRequired fails the password logins of users with passkeys,
+// which finish with the assertion of one of Options.
+type SecondFactorRequired struct {
+	Options *CredentialRequestOptions
+}
+
+func (e SecondFactorRequired) Error() string {
+	return errSecondFactorRequired.Message
+}
+
+func (h *WebAuthnUsecaseHandler) StartRegistration(userID uint) (*CredentialCreationOptions, error) {
+
+	if h.rp == nil {
+		return nil, errWebAuthnDisabled
+	}
+
+	user, err := ScopeToTenant(h.persistenceHandler, h.tenantID).FindOne(userID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	credentials, err := h.webAuthnPersistence.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	challenge := h.newChallenge(ceremonyRegistration, user.TenantID, user.ID)
+	return h.rp.CreationOptions(challenge, user, credentials), nil
+}
+
+// FinishRegistration takes the passkeys of the users their challenges were
+// for only.
+func (h *WebAuthnUsecaseHandler) FinishRegistration(userID uint, name string, response string) (*WebAuthnCredential, error) {
+
+	if h.rp == nil {
+		return nil, errWebAuthnDisabled
+	}
+	name, ok := validCredentialName(name)
+	if !ok {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for name, use up to 64 characters"}
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+
+	registration, err := h.rp.ParseRegistration(response)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := h.useChallenge(registration.Challenge, ceremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.UserID != userID || challenge.TenantID != h.tenantID {
+		return nil, h.rp.failed("registration", errors.New("the challenge was for another user"))
+	}
+	if len(registration.CredentialID) > 255 {
+		return nil, h.rp.failed("registration", errors.New("the credential ID is too long"))
+	}
+
+	credential := WebAuthnCredential{
+		TenantID:        h.tenantID,
+		UserID:          userID,
+		CredentialID:    registration.CredentialID,
+		Name:            name,
+		PublicKey:       registration.PublicKey,
+		Algorithm:       registration.Algorithm,
+		SignCount:       registration.SignCount,
+		AAGUID:          registration.AAGUID,
+		AttestationType: registration.AttestationType,
+		UserVerified:    registration.Flags&flagUserVerified != 0,
+		BackupEligible:  registration.Flags&flagBackupEligible != 0,
+		BackedUp:        registration.Flags&flagBackedUp != 0,
+	}
+	if err := h.webAuthnPersistence.CreateWebAuthnCredential(&credential); err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+
+	return &credential, nil
+}
+
+// StartLogin allows every passkey, so it tells nothing about the users of
+// the tenant.
+func (h *WebAuthnUsecaseHandler) StartLogin() (*CredentialRequestOptions, error) {
+
+	if h.rp == nil {
+		return nil, errWebAuthnDisabled
+	}
+
+	challenge := h.newChallenge(ceremonyLogin, h.tenantID, 0)
+	return h.rp.RequestOptions(challenge, nil, "required"), nil
+}
+
+// Challenge asks the users with passkeys for the assertion of one of them.
+func (h *WebAuthnUsecaseHandler) Challenge(user *Model) error {
+
+	if h.rp == nil {
+		return nil
+	}
+
+	credentials, err := h.webAuthnPersistence.ListWebAuthnCredentials(user.ID)
+	if err != nil {
+		panic(err)
+	}
+	if len(credentials) == 0 {
+		return nil
+	}
+
+	challenge := h.newChallenge(ceremonyMFA, user.TenantID, user.ID)
+	return SecondFactorRequired{h.rp.RequestOptions(challenge, credentials, h.rp.UserVerification)}
+}
+
+// FinishLogin requires the user verification of logins with a passkey
+// alone, which stands for both factors then, and rejects the assertions of
+// credentials whose counter went back, which were likely cloned.
+func (h *WebAuthnUsecaseHandler) FinishLogin(response string) (string, *Model, error) {
+
+	if h.rp == nil {
+		return "", nil, errWebAuthnDisabled
+	}
+
+	assertion, err := h.rp.ParseAssertion(response)
+	if err != nil {
+		return "", nil, err
+	}
+	challenge, err := h.useChallenge(assertion.Challenge, ceremonyLogin, ceremonyMFA)
+	if err != nil {
+		return "", nil, err
+	}
+
+	credential, err := h.webAuthnPersistence.FindWebAuthnCredential(assertion.CredentialID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, h.rp.failed("login", errors.New("unknown credential "+assertion.CredentialID))
+		}
+		panic(err)
+	}
+	if credential.TenantID != challenge.TenantID {
+		return "", nil, h.rp.failed("login", errors.New("the credential is of another tenant"))
+	}
+	if challenge.Ceremony == ceremonyMFA && credential.UserID != challenge.UserID {
+		return "", nil, h.rp.failed("login", errors.New("the credential is of another user"))
+	}
+	if challenge.Ceremony == ceremonyLogin && len(assertion.UserHandle) == 0 {
+		return "", nil, h.rp.failed("login", errors.New("the user handle is missing"))
+	}
+	if len(assertion.UserHandle) > 0 && !bytes.Equal(assertion.UserHandle, webAuthnUserHandle(credential.UserID)) {
+		return "", nil, h.rp.failed("login", errors.New("the user handle isn't the one of the credential"))
+	}
+	if (challenge.Ceremony == ceremonyLogin || h.rp.UserVerification == "required") && assertion.Flags&flagUserVerified == 0 {
+		return "", nil, h.rp.failed("login", errors.New("the user wasn't verified"))
+	}
+	if err := assertion.Verify(credential.PublicKey); err != nil {
+		return "", nil, h.rp.failed("login", err)
+	}
+	if (assertion.SignCount != 0 || credential.SignCount != 0) && assertion.SignCount <= credential.SignCount {
+		log.Printf("webauthn: the counter of credential %d went back from %d to %d, it may be cloned", credential.ID, credential.SignCount, assertion.SignCount)
+		return "", nil, errWebAuthnInvalid
+	}
+
+	now := time.Now()
+	credential.SignCount = assertion.SignCount
+	credential.BackedUp = assertion.Flags&flagBackedUp != 0
+	credential.LastUsedAt = &now
+	if err := h.webAuthnPersistence.SaveWebAuthnCredential(credential); err != nil {
+		panic(err)
+	}
+
+	user, err := ScopeToTenant(h.persistenceHandler, credential.TenantID).FindOne(credential.UserID)
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return "", nil, errWebAuthnInvalid
+		}
+		panic(err)
+	}
+
+	issued, err := h.issuer.LoginToken(user)
+	if err != nil {
+		panic(err)
+	}
+
+	return issued, user, nil
+}
+
+func (h *WebAuthnUsecaseHandler) ListCredentials(userID uint) ([]WebAuthnCredential, error) {
+
+	credentials, err := h.webAuthnPersistence.ListWebAuthnCredentials(userID)
+	if err != nil {
+		panic(err)
+	}
+	if credentials == nil {
+		credentials = []WebAuthnCredential{}
+	}
+
+	return credentials, nil
+}
+
+func (h *WebAuthnUsecaseHandler) RenameCredential(userID uint, id uint, name string) (*WebAuthnCredential, error) {
+
+	name, ok := validCredentialName(name)
+	if !ok || name == "" {
+		return nil, Error{Code: http.StatusBadRequest, Message: "Invalid value for name, use up to 64 characters"}
+	}
+
+	credential, err := h.findCredential(userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	credential.Name = name
+	if err := h.webAuthnPersistence.SaveWebAuthnCredential(credential); err != nil {
+		panic(err)
+	}
+
+	return credential, nil
+}
+
+func (h *WebAuthnUsecaseHandler) DeleteCredential(userID uint, id uint) error {
+
+	credential, err := h.findCredential(userID, id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.webAuthnPersistence.DeleteWebAuthnCredential(credential); err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+func (h *WebAuthnUsecaseHandler) findCredential(userID uint, id uint) (*WebAuthnCredential, error) {
+
+	credentials, err := h.webAuthnPersistence.ListWebAuthnCredentials(userID)
+	if err != nil {
+		panic(err)
+	}
+	for i := range credentials {
+		if credentials[i].ID == id {
+			return &credentials[i], nil
+		}
+	}
+
+	return nil, errWebAuthnCredentialNotFound
+}
+
+func (h *WebAuthnUsecaseHandler) newChallenge(ceremony string, tenantID uint, userID uint) string {
+
+	token, hash := newOpaqueToken()
+	challenge := WebAuthnChallenge{
+		ChallengeHash: hash,
+		Ceremony:      ceremony,
+		TenantID:      tenantID,
+		UserID:        userID,
+		ExpiresAt:     time.Now().Add(h.rp.Timeout),
+	}
+	if err := h.webAuthnPersistence.CreateWebAuthnChallenge(&challenge); err != nil {
+		panic(err)
+	}
+
+	return token
+}
+
+// useChallenge uses the challenge up, failing unless it's of one of
+// ceremonies and unexpired.
+func (h *WebAuthnUsecaseHandler) useChallenge(token string, ceremonies ...string) (*WebAuthnChallenge, error) {
+
+	challenge, err := h.webAuthnPersistence.UseWebAuthnChallenge(hashOpaqueToken(token))
+	if err != nil {
+		if _, ok := err.(Error); ok {
+			return nil, err
+		}
+		panic(err)
+	}
+	if !time.Now().Before(challenge.ExpiresAt) {
+		return nil, errWebAuthnChallengeNotFound
+	}
+	for _, ceremony := range ceremonies {
+		if challenge.Ceremony == ceremony {
+			return challenge, nil
+		}
+	}
+
+	return nil, errWebAuthnChallengeNotFound
+}
+
+// validCredentialName trims name, which may be empty.
+func validCredentialName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, utf8.RuneCountInString(name) <= 64
+}
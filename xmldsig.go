@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// XML signatures, as SAML identity providers sign their messages: enveloped,
+// canonicalized with exclusive XML canonicalization and signed with RSA.
+// encoding/xml can't write documents back as they were, which checking their
+// digests needs, so they're parsed into trees of xmlElement.
+const (
+	xmlNamespace              = "http://www.w3.org/XML/1998/namespace"
+	xmldsigNamespace          = "http://www.w3.org/2000/09/xmldsig#"
+	xmldsigEnveloped          = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	exclusiveCanonicalization = "http://www.w3.org/2001/10/xml-exc-c14n#"
+)
+
+var xmldsigSignatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#rsa-sha1":        crypto.SHA1,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+var xmldsigDigestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2000/09/xmldsig#sha1":  crypto.SHA1,
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+// xmlElement is an element as it was written, with the prefixes of its name
+// and attributes and the namespaces it declares, by prefix, "" being the
+// default one. Its methods take nil for a missing element.
+type xmlElement struct {
+	Prefix     string
+	Local      string
+	Namespaces map[string]string
+	Attrs      []xmlAttr
+	Children   []xmlNode
+	parent     *xmlElement
+}
+
+type xmlAttr struct {
+	Prefix string
+	Local  string
+	Value  string
+}
+
+// xmlNode is either an element or text. Comments and processing
+// instructions are dropped.
+type xmlNode struct {
+	Element *xmlElement
+	Text    string
+}
+
+// parseXML reads the root element of data, refusing DTDs, so no entity is
+// defined by the document.
+func parseXML(data []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var root, current *xmlElement
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if current == nil && root != nil {
+				return nil, errors.New("xml: more than one root element")
+			}
+			e := &xmlElement{Prefix: t.Name.Space, Local: t.Name.Local, Namespaces: map[string]string{}, parent: current}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					e.Namespaces[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.Namespaces[""] = a.Value
+				default:
+					e.Attrs = append(e.Attrs, xmlAttr{a.Name.Space, a.Name.Local, a.Value})
+				}
+			}
+			if current == nil {
+				root = e
+			} else {
+				current.Children = append(current.Children, xmlNode{Element: e})
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.Prefix || t.Name.Local != current.Local {
+				return nil, errors.New("xml: unexpected end element " + t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, xmlNode{Text: string(t)})
+			}
+		case xml.Directive:
+			return nil, errors.New("xml: DTDs aren't allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("xml: incomplete document")
+	}
+
+	return root, nil
+}
+
+// lookup is the namespace prefix is bound to in the scope of e.
+func (e *xmlElement) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for el := e; el != nil; el = el.parent {
+		if space, ok := el.Namespaces[prefix]; ok {
+			return space, true
+		}
+	}
+	return "", false
+}
+
+func (e *xmlElement) is(space string, local string) bool {
+	if e == nil || e.Local != local {
+		return false
+	}
+	s, _ := e.lookup(e.Prefix)
+	return s == space
+}
+
+// attr is the value of the attribute of e named local, without a prefix.
+func (e *xmlElement) attr(local string) string {
+	if e == nil {
+		return ""
+	}
+	for _, a := range e.Attrs {
+		if a.Prefix == "" && a.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e *xmlElement) children(space string, local string) []*xmlElement {
+	if e == nil {
+		return nil
+	}
+	var children []*xmlElement
+	for _, n := range e.Children {
+		if n.Element.is(space, local) {
+			children = append(children, n.Element)
+		}
+	}
+	return children
+}
+
+func (e *xmlElement) child(space string, local string) *xmlElement {
+	if children := e.children(space, local); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
+
+// text is the text directly in e, trimmed.
+func (e *xmlElement) text() string {
+	if e == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, n := range e.Children {
+		if n.Element == nil {
+			b.WriteString(n.Text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func qualifiedName(prefix string, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+// uniqueIDs tells whether no two elements under e have the same ID, so a
+// reference to one can't be pointed at another one.
+func uniqueIDs(e *xmlElement) bool {
+	seen := map[string]bool{}
+	var walk func(e *xmlElement) bool
+	walk = func(e *xmlElement) bool {
+		if id := e.attr("ID"); id != "" {
+			if seen[id] {
+				return false
+			}
+			seen[id] = true
+		}
+		for _, n := range e.Children {
+			if n.Element != nil && !walk(n.Element) {
+				return false
+			}
+		}
+		return true
+	}
+	return walk(e)
+}
+
+// verifySignature checks the enveloped signature of e, which must reference
+// e by its ID, against certificates. Only what it signs can be trusted, so
+// callers read e once it passes, never the rest of its document.
+func verifySignature(e *xmlElement, certificates []*x509.Certificate) error {
+
+	signatures := e.children(xmldsigNamespace, "Signature")
+	if len(signatures) != 1 {
+		return errors.New("xmldsig: not signed once")
+	}
+	signature := signatures[0]
+	signedInfo := signature.child(xmldsigNamespace, "SignedInfo")
+
+	canonicalization := signedInfo.child(xmldsigNamespace, "CanonicalizationMethod")
+	if canonicalization.attr("Algorithm") != exclusiveCanonicalization {
+		return errors.New("xmldsig: unsupported canonicalization " + canonicalization.attr("Algorithm"))
+	}
+	hash, ok := xmldsigSignatureMethods[signedInfo.child(xmldsigNamespace, "SignatureMethod").attr("Algorithm")]
+	if !ok {
+		return errors.New("xmldsig: unsupported signature method")
+	}
+
+	references := signedInfo.children(xmldsigNamespace, "Reference")
+	if len(references) != 1 {
+		return errors.New("xmldsig: not one reference")
+	}
+	reference := references[0]
+	if id := e.attr("ID"); id == "" || reference.attr("URI") != "#"+id {
+		return errors.New("xmldsig: the reference isn't to the signed element")
+	}
+
+	var prefixes []string
+	canonicalized := false
+	for _, transform := range reference.child(xmldsigNamespace, "Transforms").children(xmldsigNamespace, "Transform") {
+		switch transform.attr("Algorithm") {
+		case xmldsigEnveloped:
+		case exclusiveCanonicalization:
+			canonicalized = true
+			prefixes = inclusivePrefixes(transform)
+		default:
+			return errors.New("xmldsig: unsupported transform " + transform.attr("Algorithm"))
+		}
+	}
+	if !canonicalized {
+		return errors.New("xmldsig: unsupported canonicalization of the reference")
+	}
+
+	digestHash, ok := xmldsigDigestMethods[reference.child(xmldsigNamespace, "DigestMethod").attr("Algorithm")]
+	if !ok {
+		return errors.New("xmldsig: unsupported digest method")
+	}
+	digest, err := decodeXMLBase64(reference.child(xmldsigNamespace, "DigestValue").text())
+	if err != nil {
+		return err
+	}
+	h := digestHash.New()
+	h.Write(canonicalXML(e, prefixes, signature))
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return errors.New("xmldsig: the digest doesn't match")
+	}
+
+	value, err := decodeXMLBase64(signature.child(xmldsigNamespace, "SignatureValue").text())
+	if err != nil {
+		return err
+	}
+	h = hash.New()
+	h.Write(canonicalXML(signedInfo, inclusivePrefixes(canonicalization), nil))
+	sum := h.Sum(nil)
+	for _, certificate := range certificates {
+		if key, ok := certificate.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, hash, sum, value) == nil {
+			return nil
+		}
+	}
+	return errors.New("xmldsig: the signature isn't one of the certificates")
+}
+
+// inclusivePrefixes are the prefixes the InclusiveNamespaces of a
+// canonicalization list, "" for #default.
+func inclusivePrefixes(method *xmlElement) []string {
+	var prefixes []string
+	for _, prefix := range strings.Fields(method.child(exclusiveCanonicalization, "InclusiveNamespaces").attr("PrefixList")) {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func decodeXMLBase64(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
+
+// canonicalXML writes e with exclusive XML canonicalization, without
+// comments and leaving skip out, as the enveloped signature transform does.
+// The namespaces of prefixes are rendered as inclusive canonicalization does.
+func canonicalXML(e *xmlElement, prefixes []string, skip *xmlElement) []byte {
+	var b bytes.Buffer
+	writeCanonicalXML(&b, e, map[string]string{}, prefixes, skip)
+	return b.Bytes()
+}
+
+// writeCanonicalXML writes e, declaring the namespaces it visibly uses that
+// rendered, the ones declared by the elements written around it, lacks.
+func writeCanonicalXML(b *bytes.Buffer, e *xmlElement, rendered map[string]string, prefixes []string, skip *xmlElement) {
+
+	used := map[string]bool{e.Prefix: true}
+	for _, a := range e.Attrs {
+		if a.Prefix != "" {
+			used[a.Prefix] = true
+		}
+	}
+	for _, prefix := range prefixes {
+		if _, ok := e.lookup(prefix); ok {
+			used[prefix] = true
+		}
+	}
+
+	var declared []string
+	for prefix := range used {
+		space, ok := e.lookup(prefix)
+		if prefix == "xml" || (!ok && prefix != "") || rendered[prefix] == space {
+			continue
+		}
+		declared = append(declared, prefix)
+	}
+	// The default namespace, "", sorts first
+	sort.Strings(declared)
+	if len(declared) > 0 {
+		scope := make(map[string]string, len(rendered)+len(declared))
+		for prefix, space := range rendered {
+			scope[prefix] = space
+		}
+		for _, prefix := range declared {
+			scope[prefix], _ = e.lookup(prefix)
+		}
+		rendered = scope
+	}
+
+	name := qualifiedName(e.Prefix, e.Local)
+	b.WriteString("<" + name)
+	for _, prefix := range declared {
+		if prefix == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + prefix + `="`)
+		}
+		escapeCanonicalXML(b, rendered[prefix], true)
+		b.WriteByte('"')
+	}
+
+	// Attributes sort by namespace, the ones without one first, then name
+	attrs := make([]xmlAttr, len(e.Attrs))
+	spaces := make(map[string]string, len(e.Attrs))
+	copy(attrs, e.Attrs)
+	for _, a := range attrs {
+		if a.Prefix != "" {
+			spaces[a.Prefix], _ = e.lookup(a.Prefix)
+		}
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if si, sj := spaces[attrs[i].Prefix], spaces[attrs[j].Prefix]; si != sj {
+			return si < sj
+		}
+		return attrs[i].Local < attrs[j].Local
+	})
+	for _, a := range attrs {
+		b.WriteString(" " + qualifiedName(a.Prefix, a.Local) + `="`)
+		escapeCanonicalXML(b, a.Value, true)
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, n := range e.Children {
+		switch {
+		case n.Element == nil:
+			escapeCanonicalXML(b, n.Text, false)
+		case n.Element != skip:
+			writeCanonicalXML(b, n.Element, rendered, prefixes, skip)
+		}
+	}
+	b.WriteString("</" + name + ">")
+}
+
+func escapeCanonicalXML(b *bytes.Buffer, s string, attr bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '>' && !attr:
+			b.WriteString("&gt;")
+		case r == '"' && attr:
+			b.WriteString("&quot;")
+		case r == '\t' && attr:
+			b.WriteString("&#x9;")
+		case r == '\n' && attr:
+			b.WriteString("&#xA;")
+		case r == '\r':
+			b.WriteString("&#xD;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+}